@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"bt-go/internal/agent"
 	"bt-go/internal/app"
 	"bt-go/internal/bt"
 	"bt-go/internal/config"
@@ -19,6 +25,9 @@ import (
 var version string
 
 func main() {
+	if version != "" {
+		app.Version = version
+	}
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
@@ -26,7 +35,28 @@ func main() {
 
 // newApp reads the config and creates a BTApp. The caller must defer app.Close().
 // operation identifies the CLI command being run (e.g. "AddDirectory", "BackupAll").
-func newApp(operation string) (*app.BTApp, error) {
+// configure functions adjust the loaded config before the app is built,
+// for command-line flags that override config settings.
+func newApp(operation string, configure ...func(*config.Config)) (*app.BTApp, error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+
+	a, err := app.NewBTApp(cfg, operation)
+	if err != nil {
+		return nil, fmt.Errorf("initializing app: %w", err)
+	}
+
+	return a, nil
+}
+
+// readConfig reads the config from its default path, for commands that do
+// not need a full BTApp.
+func readConfig() (*config.Config, error) {
 	defaults, err := app.GetDefaults()
 	if err != nil {
 		return nil, fmt.Errorf("getting defaults: %w", err)
@@ -36,19 +66,165 @@ func newApp(operation string) (*app.BTApp, error) {
 	if err != nil {
 		return nil, fmt.Errorf("reading config: %w", err)
 	}
+	return cfg, nil
+}
 
-	a, err := app.NewBTApp(cfg, operation)
+// oneFileSystemFlag applies a command's --one-file-system flag, which turns
+// on filesystem.one_file_system for every tracked directory.
+func oneFileSystemFlag(cmd *cobra.Command) func(*config.Config) {
+	return func(cfg *config.Config) {
+		if on, _ := cmd.Flags().GetBool("one-file-system"); on {
+			cfg.Filesystem.OneFileSystem = true
+			for i := range cfg.Filesystem.Directories {
+				cfg.Filesystem.Directories[i].OneFileSystem = nil
+			}
+		}
+	}
+}
+
+// passphraseFlags are the global flags selecting a non-interactive passphrase
+// source, by source kind.
+var passphraseFlags = map[string]string{
+	encryption.PassphraseEnv:     "passphrase-env",
+	encryption.PassphraseFD:      "passphrase-fd",
+	encryption.PassphraseFile:    "passphrase-file",
+	encryption.PassphraseCommand: "passphrase-command",
+}
+
+// passphraseSource returns the passphrase source selected by the
+// --passphrase-* flags or, failing that, by configured, which returns the
+// source set in the config and may be nil before a config exists. It returns
+// nil if the passphrase should be prompted for.
+func passphraseSource(cmd *cobra.Command, configured func() (*encryption.PassphraseSource, error)) (*encryption.PassphraseSource, error) {
+	var source *encryption.PassphraseSource
+	for kind, name := range passphraseFlags {
+		if !cmd.Flags().Changed(name) {
+			continue
+		}
+		if source != nil {
+			return nil, fmt.Errorf("only one --passphrase-* flag may be given")
+		}
+		value, _ := cmd.Flags().GetString(name)
+		source = &encryption.PassphraseSource{Kind: kind, Value: value}
+	}
+	if source != nil || configured == nil {
+		return source, nil
+	}
+	return configured()
+}
+
+// readPassphrase reads the passphrase from the source selected by
+// passphraseSource, or prompts for it on the terminal if there is none.
+// prompted reports which happened.
+func readPassphrase(cmd *cobra.Command, configured func() (*encryption.PassphraseSource, error), prompt string) (passphrase string, prompted bool, err error) {
+	source, err := passphraseSource(cmd, configured)
 	if err != nil {
-		return nil, fmt.Errorf("initializing app: %w", err)
+		return "", false, err
+	}
+	if source != nil {
+		passphrase, err := source.Read()
+		return passphrase, false, err
 	}
+	passphrase, err = promptPassphrase(prompt)
+	return passphrase, true, err
+}
 
-	return a, nil
+// unlockEncryption returns a DecryptionContext for the private key: through a
+// running bt agent if there is one, or else by reading the passphrase.
+func unlockEncryption(cmd *cobra.Command, a *app.BTApp) (bt.DecryptionContext, error) {
+	if ctx := a.AgentDecryptionContext(); ctx != nil {
+		return ctx, nil
+	}
+	passphrase, _, err := readPassphrase(cmd, a.PassphraseSource, "Enter passphrase for decryption: ")
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := a.UnlockEncryption(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("unlocking encryption: %w", err)
+	}
+	return ctx, nil
+}
+
+// decryptionContext returns the DecryptionContext for restoring content: the
+// identity file given by the command's --identity flag, or else the private
+// key through unlockEncryption. It is nil if neither is configured. The
+// passphrase of an identity file is always prompted for: the configured
+// passphrase sources hold the private key's.
+func decryptionContext(cmd *cobra.Command, a *app.BTApp) (bt.DecryptionContext, error) {
+	if identity, _ := cmd.Flags().GetString("identity"); identity != "" {
+		ctx, err := a.UnlockIdentityFile(identity, func() (string, error) {
+			return promptPassphrase(fmt.Sprintf("Enter passphrase for %s: ", identity))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unlocking identity: %w", err)
+		}
+		return ctx, nil
+	}
+	if a.EncryptionConfigured() {
+		return unlockEncryption(cmd, a)
+	}
+	return nil, nil
+}
+
+// openApp creates a BTApp for a command that reads backups: this host's, or
+// with --host, another host's. Another host's metadata is decrypted with
+// decryptionContext, which is returned for reuse; it is nil for this host.
+// With --trust-vault, another host's metadata is read even if it is unsigned.
+// The caller must defer app.Close().
+func openApp(cmd *cobra.Command, operation string) (*app.BTApp, bt.DecryptionContext, error) {
+	hostID, _ := cmd.Flags().GetString("host")
+	if hostID == "" {
+		a, err := newApp(operation)
+		return a, nil, err
+	}
+	trustVault, _ := cmd.Flags().GetBool("trust-vault")
+	cfg, err := readConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	a, decryptCtx, err := app.OpenHost(cfg, hostID, trustVault, operation, func(a *app.BTApp) (bt.DecryptionContext, error) {
+		return decryptionContext(cmd, a)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening host %s: %w", hostID, err)
+	}
+	return a, decryptCtx, nil
+}
+
+// promptPassphrase prints prompt and reads a passphrase from the terminal
+// without echoing it.
+func promptPassphrase(prompt string) (string, error) {
+	fmt.Print(prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("reading passphrase: %w", err)
+	}
+	return string(passphrase), nil
 }
 
 var rootCmd = &cobra.Command{
 	Use:     "bt",
 	Short:   "Personal backup tool",
 	Version: version,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("host") && !hostCommands[cmd] {
+			return fmt.Errorf("--host only applies to log, ls and restore")
+		}
+		if hostCommands[cmd] && cmd.Flags().Changed("trust-vault") && !cmd.Flags().Changed("host") {
+			return fmt.Errorf("--trust-vault only applies with --host")
+		}
+		return nil
+	},
+}
+
+// hostCommands are the commands that can read another host's backups with
+// --host.
+var hostCommands = map[*cobra.Command]bool{
+	logCmd:     true,
+	lsCmd:      true,
+	restoreCmd: true,
 }
 
 // config command
@@ -60,6 +236,35 @@ var configCmd = &cobra.Command{
 var configInitCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Initialize configuration and generate encryption keys",
+	Long: `Initialize configuration and generate encryption keys.
+
+With --convergent, file content is encrypted deterministically: each file's key
+is derived from a convergence secret and the file's checksum, so hosts sharing
+a vault and the secret store identical files once. A secret is generated unless
+one was already copied into place from another host. This trades privacy for
+space:
+
+  - Anyone holding the secret can check whether the vault holds a file they can
+    guess, such as a known document or a common binary, by encrypting it.
+  - Identical files are visibly identical in the vault, to anyone.
+  - Convergent content is protected by the secret, which is stored unencrypted
+    on each host, rather than by the passphrase.
+  - Convergent content can only be decrypted with the secret. Additional
+    recipients, such as recovery keys and SSH keys, cannot decrypt it on their
+    own: restore --identity needs the secret on the restoring host too.
+
+The vault copy of the secret is encrypted to the key pair.
+
+With --import-identity, an existing identity is used instead of generating a
+key pair, e.g. to share one key between hosts so each can restore the others'
+backups. The file may hold an age identity, be encrypted with an age
+passphrase, or be an ed25519 or RSA SSH private key. It is stored like a
+generated key, protected by the passphrase entered here; its own passphrase,
+if any, is asked for separately. A later 'bt keys rotate' replaces it with a
+generated key pair.
+
+--recipient adds a public key that content and the metadata database are also
+encrypted to, such as an offline recovery key; it may be repeated.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		defaults, err := app.GetDefaults()
 		if err != nil {
@@ -68,6 +273,28 @@ var configInitCmd = &cobra.Command{
 
 		hostID := uuid.New().String()
 		cfg := config.NewConfig(hostID, defaults["base_dir"])
+		cfg.Encryption.PostQuantum, _ = cmd.Flags().GetBool("pq")
+		cfg.Encryption.Convergent, _ = cmd.Flags().GetBool("convergent")
+		cfg.Encryption.Recipients, _ = cmd.Flags().GetStringArray("recipient")
+		identityPath, _ := cmd.Flags().GetString("import-identity")
+
+		if identityPath != "" {
+			if cfg.Encryption.PostQuantum {
+				return fmt.Errorf("--pq cannot be combined with --import-identity; the identity's key type is kept")
+			}
+			if _, err := os.Stat(identityPath); err != nil {
+				return fmt.Errorf("reading identity file: %w", err)
+			}
+			// Whether recipients must be post-quantum depends on the
+			// identity, which ImportIdentity checks.
+			for _, r := range cfg.Encryption.Recipients {
+				if _, err := encryption.ParseRecipient(r); err != nil {
+					return err
+				}
+			}
+		} else if _, err := encryption.ParseRecipients(cfg.Encryption.Recipients, cfg.Encryption.PostQuantum); err != nil {
+			return err
+		}
 
 		// Write config file first; errors if it already exists.
 		if err := config.Init(defaults["config_path"], cfg); err != nil {
@@ -84,29 +311,39 @@ var configInitCmd = &cobra.Command{
 			return fmt.Errorf("encryption keys already exist at %s", cfg.Encryption.PublicKeyPath)
 		}
 
-		fmt.Print("Enter passphrase for encryption key: ")
-		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
-		fmt.Println()
+		passphrase, prompted, err := readPassphrase(cmd, nil, "Enter passphrase for encryption key: ")
 		if err != nil {
-			return fmt.Errorf("reading passphrase: %w", err)
+			return err
 		}
 
 		if len(passphrase) == 0 {
 			return fmt.Errorf("passphrase must not be empty")
 		}
 
-		fmt.Print("Confirm passphrase: ")
-		confirm, err := term.ReadPassword(int(os.Stdin.Fd()))
-		fmt.Println()
-		if err != nil {
-			return fmt.Errorf("reading passphrase confirmation: %w", err)
-		}
-
-		if string(passphrase) != string(confirm) {
-			return fmt.Errorf("passphrases do not match")
+		if prompted {
+			confirm, err := promptPassphrase("Confirm passphrase: ")
+			if err != nil {
+				return fmt.Errorf("reading passphrase confirmation: %w", err)
+			}
+			if passphrase != confirm {
+				return fmt.Errorf("passphrases do not match")
+			}
 		}
 
-		if err := enc.Setup(string(passphrase)); err != nil {
+		if identityPath != "" {
+			ageEnc, ok := enc.(*encryption.AgeEncryptor)
+			if !ok {
+				return fmt.Errorf("--import-identity requires age encryption")
+			}
+			identityPassphrase := func() (string, error) {
+				return promptPassphrase("Enter passphrase for identity file: ")
+			}
+			if err := ageEnc.ImportIdentity(identityPath, identityPassphrase, passphrase); err != nil {
+				// Nothing else was written, so let the command be retried.
+				os.Remove(defaults["config_path"])
+				return fmt.Errorf("importing identity: %w", err)
+			}
+		} else if err := enc.Setup(passphrase); err != nil {
 			return fmt.Errorf("generating encryption keys: %w", err)
 		}
 
@@ -115,6 +352,9 @@ var configInitCmd = &cobra.Command{
 		fmt.Printf("Base Dir:    %s\n", defaults["base_dir"])
 		fmt.Printf("Public key:  %s\n", cfg.Encryption.PublicKeyPath)
 		fmt.Printf("Private key: %s\n", cfg.Encryption.PrivateKeyPath)
+		if cfg.Encryption.Convergent {
+			fmt.Printf("Convergence secret: %s\n", encryption.ConvergenceSecretPath(cfg.Encryption))
+		}
 		return nil
 	},
 }
@@ -189,13 +429,176 @@ var dirInitCmd = &cobra.Command{
 	},
 }
 
+var dirListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List tracked directories",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+
+		a, err := newApp("ListDirectories")
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		dirs, err := a.ListDirectories(all)
+		if err != nil {
+			return err
+		}
+
+		if len(dirs) == 0 {
+			fmt.Println("No directories tracked.")
+			return nil
+		}
+
+		for _, d := range dirs {
+			lastBackup := "never"
+			if !d.LastBackupAt.IsZero() {
+				lastBackup = d.LastBackupAt.Format("2006-01-02 15:04:05")
+			}
+			var flags []string
+			if d.Encrypted {
+				flags = append(flags, "encrypted")
+			}
+			if d.Removed {
+				flags = append(flags, "removed")
+			}
+			if d.Missing {
+				flags = append(flags, "missing")
+			}
+			fmt.Printf("%s  %d file(s)  %d bytes  last backup: %s  %s\n",
+				d.Path,
+				d.FileCount,
+				d.TotalSize,
+				lastBackup,
+				strings.Join(flags, ","),
+			)
+		}
+		return nil
+	},
+}
+
+var dirRemoveCmd = &cobra.Command{
+	Use:   "remove [PATH]",
+	Short: "Stop tracking a directory",
+	Long: `Stop tracking a directory (default: the current directory).
+
+Staged files for the directory are dropped. Its backup history is kept and
+comes back if the directory is tracked again with 'bt dir init'. With --purge,
+the history is deleted from the database instead. Content already in the
+vault is not deleted.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		purge, _ := cmd.Flags().GetBool("purge")
+
+		a, err := newApp("RemoveDirectory")
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		path := "."
+		if len(args) > 0 {
+			path = args[0]
+		}
+		path, err = filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("resolving path: %w", err)
+		}
+
+		unstaged, err := a.RemoveDirectory(path, purge)
+		if err != nil {
+			return fmt.Errorf("removing directory: %w", err)
+		}
+
+		if unstaged > 0 {
+			fmt.Printf("Dropped %d staged file(s)\n", unstaged)
+		}
+		if purge {
+			fmt.Printf("Stopped tracking %s and deleted its history\n", path)
+		} else {
+			fmt.Printf("Stopped tracking %s (history kept)\n", path)
+		}
+		return nil
+	},
+}
+
+var dirMoveCmd = &cobra.Command{
+	Use:   "move OLD NEW",
+	Short: "Record that a tracked directory has moved",
+	Long: `Record that the tracked directory OLD now lives at NEW, keeping its history.
+
+OLD need not exist anymore. If NEW is inside another tracked directory, the
+history joins that directory; tracked directories inside NEW are merged into
+the moved one, as with 'bt dir init'. Staged files of merged directories are
+dropped and must be added again.
+
+Settings for OLD in the config ([[filesystem.directories]]) are not changed;
+edit their path to keep them applying.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := newApp("MoveDirectory")
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		override, err := a.DirectoryOverride(args[0])
+		if err != nil {
+			return err
+		}
+		trackedAs, unstaged, err := a.MoveDirectory(args[0], args[1])
+		if err != nil {
+			return fmt.Errorf("moving directory: %w", err)
+		}
+
+		if unstaged > 0 {
+			fmt.Printf("Dropped %d staged file(s); run 'bt add' again\n", unstaged)
+		}
+		fmt.Printf("Tracking directory: %s\n", trackedAs)
+		if override != nil && filepath.Clean(override.Path) != trackedAs {
+			fmt.Fprintf(os.Stderr, "The [[filesystem.directories]] settings for %s in the config no longer apply; the directory is now tracked as %s\n", override.Path, trackedAs)
+		}
+		return nil
+	},
+}
+
+// suggestMove explains err and, if it is because dir is untracked but looks
+// like a tracked directory that was moved, suggests 'bt dir move'.
+func suggestMove(a *app.BTApp, dir string, err error) error {
+	if !errors.Is(err, bt.ErrDirectoryNotTracked) {
+		return err
+	}
+	moved, detectErr := a.DetectMovedDirectory(dir)
+	if detectErr != nil || moved == nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s is missing, and %d of %d files checked match it here.\n", moved.OldPath, moved.Matched, moved.Sampled)
+	fmt.Fprintf(os.Stderr, "If it was moved, run: bt dir move %s %s\n", moved.OldPath, moved.NewPath)
+	return err
+}
+
+// suggestMovesInto suggests 'bt dir move' for each tracked directory that is
+// missing but looks like it was moved into dir, whose files would otherwise
+// just look new.
+func suggestMovesInto(a *app.BTApp, dir string) {
+	moved, err := a.DetectMovedDirectoriesIn(dir)
+	if err != nil {
+		return
+	}
+	for _, m := range moved {
+		fmt.Fprintf(os.Stderr, "%s is missing, and %d of %d files checked match %s.\n", m.OldPath, m.Matched, m.Sampled, m.NewPath)
+		fmt.Fprintf(os.Stderr, "If it was moved, run: bt dir move %s %s\n", m.OldPath, m.NewPath)
+	}
+}
+
 var dirStatusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "View directory status",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		recursive, _ := cmd.Flags().GetBool("recursive")
 
-		a, err := newApp("GetStatus")
+		a, err := newApp("GetStatus", oneFileSystemFlag(cmd))
 		if err != nil {
 			return err
 		}
@@ -208,8 +611,9 @@ var dirStatusCmd = &cobra.Command{
 
 		statuses, err := a.GetStatus(cwd, recursive)
 		if err != nil {
-			return err
+			return suggestMove(a, cwd, err)
 		}
+		suggestMovesInto(a, cwd)
 
 		if len(statuses) == 0 {
 			fmt.Println("No files found.")
@@ -217,6 +621,11 @@ var dirStatusCmd = &cobra.Command{
 		}
 
 		for _, s := range statuses {
+			if s.ExclusionReason != "" {
+				fmt.Printf("X   %s (%s)\n", s.RelativePath, s.ExclusionReason)
+				continue
+			}
+
 			var indicator string
 			switch {
 			case s.IsBackedUp && s.IsModifiedSince && s.IsStaged:
@@ -243,10 +652,23 @@ var dirStatusCmd = &cobra.Command{
 var addCmd = &cobra.Command{
 	Use:   "add [PATH]",
 	Short: "Stage files for backup",
+	Long: `Stage files for backup.
+
+Files whose size, mtime, ctime, mode, uid and gid all match their last
+backed-up snapshot are skipped without being read. Use --force (or its
+alias --checksum) to re-read and hash every file regardless.
+
+With --auto-flush, a full staging area is backed up to the vault and
+staging continues, and files larger than the staging area itself are
+streamed directly to the vault.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		recursive, _ := cmd.Flags().GetBool("recursive")
+		force, _ := cmd.Flags().GetBool("force")
+		checksum, _ := cmd.Flags().GetBool("checksum")
+		autoFlush, _ := cmd.Flags().GetBool("auto-flush")
+		jobs, _ := cmd.Flags().GetInt("jobs")
 
-		a, err := newApp("StageFiles")
+		a, err := newApp("StageFiles", oneFileSystemFlag(cmd))
 		if err != nil {
 			return err
 		}
@@ -262,12 +684,33 @@ var addCmd = &cobra.Command{
 			return fmt.Errorf("resolving path: %w", err)
 		}
 
-		count, err := a.StageFiles(absTarget, recursive)
+		result, err := a.StageFiles(absTarget, bt.StageOptions{
+			Recursive: recursive,
+			Force:     force || checksum,
+			AutoFlush: autoFlush,
+			Workers:   jobs,
+		})
 		if err != nil {
-			return fmt.Errorf("staging: %w", err)
+			// A file may be under a moved directory too; check the
+			// directory holding it.
+			dir := absTarget
+			if info, statErr := os.Stat(absTarget); statErr == nil && !info.IsDir() {
+				dir = filepath.Dir(absTarget)
+			}
+			return suggestMove(a, dir, fmt.Errorf("staging: %w", err))
+		}
+		if info, err := os.Stat(absTarget); err == nil && info.IsDir() {
+			suggestMovesInto(a, absTarget)
 		}
 
-		fmt.Printf("Staged %d file(s)\n", count)
+		if result.Unchanged > 0 {
+			fmt.Printf("Staged %d file(s), %d unchanged\n", result.Staged, result.Unchanged)
+		} else {
+			fmt.Printf("Staged %d file(s)\n", result.Staged)
+		}
+		if result.BackedUp > 0 || result.Streamed > 0 {
+			fmt.Printf("Backed up %d file(s) while staging, %d streamed directly\n", result.BackedUp+result.Streamed, result.Streamed)
+		}
 		return nil
 	},
 }
@@ -299,7 +742,7 @@ var logCmd = &cobra.Command{
 	Short: "View file history",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		a, err := newApp("GetFileHistory")
+		a, _, err := openApp(cmd, "GetFileHistory")
 		if err != nil {
 			return err
 		}
@@ -378,13 +821,725 @@ var historyCmd = &cobra.Command{
 	},
 }
 
+var historyVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the backup operation history has not been tampered with",
+	Long: `Verify the hash chain of backup operations.
+
+Each finished operation is sealed with a hash over its record, the snapshots it
+created and the operation before it, so changing or deleting one breaks the
+chain. The chain of the local database is checked, then that of the latest
+metadata in the vault, which must end at the head recorded when it was
+uploaded and agree with the local database. Snapshots purged since they were
+created are counted as missing; that alone is not a problem.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := newApp("VerifyHistory")
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		decryptCtx, err := decryptionContext(cmd, a)
+		if err != nil {
+			return err
+		}
+		result, err := a.VerifyHistory(decryptCtx)
+		if err != nil {
+			return err
+		}
+
+		printChain := func(name string, chain *bt.OperationChain) {
+			head := "none"
+			if chain.Head != nil {
+				head = fmt.Sprintf("#%d %s", chain.Head.ID, chain.Head.Hash.String[:16])
+			}
+			fmt.Printf("%s: %d operations sealed, %d unsealed, head %s\n", name, chain.Sealed, chain.Unsealed, head)
+			fmt.Printf("  %d snapshots verified, %d purged\n", chain.Snapshots, chain.Missing)
+			for _, p := range chain.Problems {
+				fmt.Printf("  problem: %s\n", p)
+			}
+		}
+		printChain("local", result.Local)
+		if result.Vault == nil {
+			fmt.Println("vault: no metadata uploaded yet")
+		} else {
+			printChain(fmt.Sprintf("vault (version %d)", result.VaultVersion), result.Vault)
+		}
+		for _, p := range result.Problems {
+			fmt.Printf("problem: %s\n", p)
+		}
+
+		if !result.OK() {
+			return fmt.Errorf("the backup operation history failed verification")
+		}
+		fmt.Println("History verified.")
+		return nil
+	},
+}
+
+var dirEncryptCmd = &cobra.Command{
+	Use:   "encrypt [PATH]",
+	Short: "Encrypt a tracked directory and its history",
+	Long: `Encrypt a tracked directory (default: the current directory).
+
+New backups of the directory are encrypted, and content already backed up
+from it is encrypted and uploaded again. The plaintext copies left in the
+vault are no longer referenced. Content is shared by checksum, so snapshots of
+the same content in other directories become encrypted too. If interrupted,
+run the command again to resume.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSetDirectoryEncryption(cmd, args, true)
+	},
+}
+
+var dirDecryptCmd = &cobra.Command{
+	Use:   "decrypt [PATH]",
+	Short: "Stop encrypting a tracked directory and decrypt its history",
+	Long: `Stop encrypting a tracked directory (default: the current directory).
+
+New backups of the directory are stored unencrypted, and content already
+backed up from it is decrypted and uploaded again in plaintext. Content that
+an encrypted directory also references stays encrypted. The encrypted copies
+left in the vault are no longer referenced. If interrupted, run the command
+again to resume.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSetDirectoryEncryption(cmd, args, false)
+	},
+}
+
+// runSetDirectoryEncryption implements dir encrypt and dir decrypt. Decrypting
+// prompts for the passphrase if encryption keys are present.
+func runSetDirectoryEncryption(cmd *cobra.Command, args []string, encrypted bool) error {
+	op := "DecryptDirectory"
+	if encrypted {
+		op = "EncryptDirectory"
+	}
+	a, err := newApp(op)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	path := "."
+	if len(args) > 0 {
+		path = args[0]
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("resolving path: %w", err)
+	}
+
+	var decryptCtx bt.DecryptionContext
+	if encrypted {
+		if !a.EncryptionConfigured() {
+			return fmt.Errorf("encryption keys not found; run 'bt config init' first")
+		}
+	} else if a.EncryptionConfigured() {
+		decryptCtx, err = unlockEncryption(cmd, a)
+		if err != nil {
+			return err
+		}
+	}
+
+	change, err := a.SetDirectoryEncryption(path, encrypted, decryptCtx)
+	if err != nil {
+		if change != nil && change.Migrated > 0 {
+			fmt.Fprintf(os.Stderr, "Migrated %d content(s) before failing; run the command again to resume\n", change.Migrated)
+		}
+		return fmt.Errorf("changing directory encryption: %w", err)
+	}
+
+	if encrypted {
+		fmt.Printf("Encrypted %s (%d content(s) migrated)\n", path, change.Migrated)
+	} else {
+		fmt.Printf("Decrypted %s (%d content(s) migrated)\n", path, change.Migrated)
+		if change.Kept > 0 {
+			fmt.Printf("Kept %d content(s) encrypted; encrypted directories also reference them\n", change.Kept)
+		}
+	}
+	return nil
+}
+
+// keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage encryption keys",
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replace the encryption key pair and re-encrypt all content",
+	Long: `Generate a new encryption key pair and re-encrypt all encrypted content to it.
+
+The new private key is protected by the current passphrase. Each content is
+downloaded, decrypted with the previous key, encrypted to the new one, and
+uploaded again; the old ciphertext is left in the vault, unreferenced. The
+database and the new keys are uploaded once the rotation finishes.
+
+In convergent mode, content encrypted with the convergence secret is not
+re-encrypted, and the secret itself is not changed: the rotation does not
+protect convergent content if the secret has leaked. The vault's copies of
+the secret encrypted to the previous key are deleted.
+
+If interrupted, run the command again to resume. Until then, the previous key
+pair is kept and uploaded alongside the new one.
+
+With --pq, the new key pair is a hybrid ML-KEM-768+X25519 one, which migrates
+existing content to post-quantum encryption. Once the key pair is post-quantum,
+later rotations keep it that way.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pq, _ := cmd.Flags().GetBool("pq")
+		a, err := newApp("RotateKeys", func(cfg *config.Config) {
+			cfg.Encryption.PostQuantum = cfg.Encryption.PostQuantum || pq
+		})
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		if !a.EncryptionConfigured() && !a.KeyRotationInProgress() {
+			return fmt.Errorf("encryption keys not found; run 'bt config init' first")
+		}
+		if a.KeyRotationInProgress() {
+			fmt.Println("Resuming interrupted key rotation")
+		}
+
+		passphrase, _, err := readPassphrase(cmd, a.PassphraseSource, "Enter passphrase: ")
+		if err != nil {
+			return err
+		}
+
+		count, err := a.RotateKeys(passphrase)
+		if err != nil {
+			if count > 0 {
+				fmt.Fprintf(os.Stderr, "Re-encrypted %d content(s) before failing; run the command again to resume\n", count)
+			}
+			return fmt.Errorf("rotating keys: %w", err)
+		}
+
+		fmt.Printf("Rotated encryption keys (%d content(s) re-encrypted)\n", count)
+		return nil
+	},
+}
+
+var keysPasswdCmd = &cobra.Command{
+	Use:   "passwd",
+	Short: "Change the passphrase protecting the private key",
+	Long: `Change the passphrase protecting the private key.
+
+The key itself is unchanged, so existing backups stay readable. The private key
+file is replaced atomically and uploaded to every configured vault, superseding
+the copies protected by the old passphrase.
+
+A --passphrase-* flag or configured passphrase source supplies the current
+passphrase; the new one is always prompted for.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := newApp("ChangePassphrase")
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		if !a.EncryptionConfigured() {
+			return fmt.Errorf("encryption keys not found; run 'bt config init' first")
+		}
+
+		oldPassphrase, _, err := readPassphrase(cmd, a.PassphraseSource, "Enter current passphrase: ")
+		if err != nil {
+			return err
+		}
+
+		newPassphrase, err := promptPassphrase("Enter new passphrase: ")
+		if err != nil {
+			return err
+		}
+		if len(newPassphrase) == 0 {
+			return fmt.Errorf("passphrase must not be empty")
+		}
+
+		confirm, err := promptPassphrase("Confirm new passphrase: ")
+		if err != nil {
+			return fmt.Errorf("reading passphrase confirmation: %w", err)
+		}
+		if newPassphrase != confirm {
+			return fmt.Errorf("passphrases do not match")
+		}
+
+		if err := a.ChangePassphrase(oldPassphrase, newPassphrase); err != nil {
+			return fmt.Errorf("changing passphrase: %w", err)
+		}
+
+		fmt.Println("Passphrase changed")
+		return nil
+	},
+}
+
+var keysSecretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Generate the convergence secret for convergent encryption",
+	Long: `Generate the convergence secret used when encryption.convergent is set in the
+configuration. Content backed up afterwards is encrypted deterministically, with
+a key derived from the secret and the file's checksum, so hosts sharing a vault
+and the secret store identical files once. To share deduplication with another
+host, copy the secret file to it instead of generating a new one.
+
+This trades privacy for space: anyone holding the secret can check whether the
+vault holds a file they can guess, identical files are visibly identical in the
+vault, and convergent content is protected by the secret, stored unencrypted on
+each host, rather than by the passphrase. Only the secret decrypts convergent
+content: additional recipients, such as recovery keys and SSH keys, cannot on
+their own, so restore --identity needs the secret on the restoring host too.
+
+An existing secret is never replaced, since content encrypted with it could no
+longer be decrypted.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+
+		path := encryption.ConvergenceSecretPath(cfg.Encryption)
+		if err := encryption.NewConvergenceSecret(path); err != nil {
+			return err
+		}
+
+		fmt.Printf("Convergence secret: %s\n", path)
+		if !cfg.Encryption.Convergent {
+			fmt.Println("Set convergent = true under [encryption] in the configuration to use it")
+		}
+		return nil
+	},
+}
+
+var keysExportKitCmd = &cobra.Command{
+	Use:   "export-kit",
+	Short: "Write a printable disaster-recovery kit",
+	Long: `Write a disaster-recovery kit: a single printable text file holding the host
+ID, the configuration, the key pair, the metadata signing key and, in
+convergent mode, the convergence secret, with instructions for restoring them
+with 'bt keys import-kit'. The signing key lets a new machine check that the
+metadata in the vault is the host's own.
+
+The private key stays protected by the passphrase, and the other secrets are
+encrypted to the key pair, so the kit is useless without the passphrase. A host
+that does not encrypt gets a kit with its configuration and signing key only,
+which must be kept safe: it lets anyone sign metadata as the host.
+Vault credentials are left out unless --include-secrets is given, in which case
+the kit must be protected like a password.
+
+Binary data is encoded as base32 lines, each with a checksum, so a printed kit
+can be typed back in and a typo is reported with its line.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+		includeSecrets, _ := cmd.Flags().GetBool("include-secrets")
+		output, _ := cmd.Flags().GetString("output")
+
+		if output == "" {
+			return app.ExportKit(cfg, includeSecrets, os.Stdout)
+		}
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("creating kit: %w", err)
+		}
+		if err := app.ExportKit(cfg, includeSecrets, f); err != nil {
+			f.Close()
+			os.Remove(output)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("writing kit: %w", err)
+		}
+		fmt.Printf("Wrote disaster-recovery kit to %s\n", output)
+		return nil
+	},
+}
+
+var keysImportKitCmd = &cobra.Command{
+	Use:   "import-kit FILE",
+	Short: "Restore the configuration and keys from a disaster-recovery kit",
+	Long: `Restore the configuration and keys from a kit written by 'bt keys export-kit',
+on a machine without a configuration. FILE may be "-" for standard input.
+
+The passphrase is checked against the kit's private key, if it has one, before
+anything is written. Paths under the kit's base directory are moved under this
+machine's.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defaults, err := app.GetDefaults()
+		if err != nil {
+			return fmt.Errorf("failed to get defaults: %w", err)
+		}
+
+		in := os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return fmt.Errorf("opening kit: %w", err)
+			}
+			defer f.Close()
+			in = f
+		}
+
+		cfg, err := app.ImportKit(in, defaults["config_path"], defaults["base_dir"], func() (string, error) {
+			passphrase, _, err := readPassphrase(cmd, nil, "Enter passphrase for the kit's private key: ")
+			return passphrase, err
+		})
+		if err != nil {
+			return fmt.Errorf("importing kit: %w", err)
+		}
+
+		fmt.Printf("Configuration restored at %s\n", defaults["config_path"])
+		fmt.Printf("Host ID:     %s\n", cfg.HostID)
+		if _, err := os.Stat(cfg.Encryption.PrivateKeyPath); err == nil {
+			fmt.Printf("Public key:  %s\n", cfg.Encryption.PublicKeyPath)
+			fmt.Printf("Private key: %s\n", cfg.Encryption.PrivateKeyPath)
+		}
+		if _, err := os.Stat(encryption.SigningKeyPath(cfg.Encryption)); err == nil {
+			fmt.Printf("Signing key: %s\n", encryption.SigningKeyPath(cfg.Encryption))
+		}
+		return nil
+	},
+}
+
+// metadata command
+var metadataCmd = &cobra.Command{
+	Use:   "metadata",
+	Short: "Manage the copy of the metadata database in the vault",
+}
+
+var metadataListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the metadata versions kept in the vault",
+	Long: `List the versions of the metadata database kept in the vault, newest first.
+Each version is named by the ID of the operation that uploaded it, and is
+either a full checkpoint or a journal segment following one.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+
+		versions, err := app.ListMetadataVersions(cfg)
+		if err != nil {
+			return fmt.Errorf("listing metadata versions: %w", err)
+		}
+
+		if len(versions) == 0 {
+			fmt.Println("No metadata in the vault.")
+			return nil
+		}
+
+		for _, v := range versions {
+			kind := "journal"
+			if v.Checkpoint {
+				kind = "checkpoint"
+			}
+			fmt.Printf("#%d  %s  %-10s  %d bytes\n",
+				v.Version,
+				v.Uploaded.Local().Format("2006-01-02 15:04:05"),
+				kind,
+				v.Size,
+			)
+		}
+		return nil
+	},
+}
+
+var metadataRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Replace the local database with the copy in the vault",
+	Long: `Rebuild the local metadata database from the vault: download the latest full
+checkpoint and replay the journal segments uploaded by every command since.
+Use it when the local database is lost, or behind the vault.
+
+With --version, rebuild an older version listed by 'bt metadata list'
+instead, to roll back a database that was corrupted or pruned by mistake.
+The rollback is recorded as a new operation and uploaded as the latest
+version, so the versions after it stay listed until they expire.
+
+The metadata must be signed with this host's signing key. On a new machine,
+import the recovery kit first, which holds it. Without the kit, --trust-vault
+accepts the metadata as the vault holds it; if the signing key cannot be
+restored from the vault, the host starts a new one, and other hosts that read
+its metadata must remove it from their pins.json.
+
+The database it replaces is kept next to it with a .bak suffix.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		version, _ := cmd.Flags().GetInt64("version")
+		trustVault, _ := cmd.Flags().GetBool("trust-vault")
+
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+
+		version, err = app.RestoreMetadata(cfg, version, trustVault, func() (string, error) {
+			passphrase, _, err := readPassphrase(cmd, func() (*encryption.PassphraseSource, error) {
+				return encryption.PassphraseSourceFromConfig(cfg.Encryption)
+			}, "Enter passphrase for decryption: ")
+			return passphrase, err
+		})
+		if err != nil {
+			return fmt.Errorf("restoring metadata: %w", err)
+		}
+
+		fmt.Printf("Restored metadata database at version %d\n", version)
+		return nil
+	},
+}
+
+// recover command
+var recoverCmd = &cobra.Command{
+	Use:   "recover --from-manifests",
+	Short: "Rebuild the metadata database when every copy of it is lost",
+	Long: `Rebuild the local metadata database from the manifests in the vault, for when
+the database, its checkpoints and its journal are all lost or corrupt; use
+'bt metadata restore' whenever it can still be restored. Every backup uploads a
+manifest of the files it backed up, encrypted like the metadata. Replaying them
+records every file version with the content that holds it, so the files can
+be restored again; removed directories, exclusions and the operation history
+are lost, and directories are recreated at the paths they had when each file
+was backed up. The database it replaces is kept with a .bak suffix. The
+manifests are checked and --trust-vault works as for 'bt metadata restore'.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if fromManifests, _ := cmd.Flags().GetBool("from-manifests"); !fromManifests {
+			return fmt.Errorf("recover requires --from-manifests")
+		}
+		trustVault, _ := cmd.Flags().GetBool("trust-vault")
+
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+
+		recovery, err := app.RecoverFromManifests(cfg, trustVault, func() (string, error) {
+			passphrase, _, err := readPassphrase(cmd, func() (*encryption.PassphraseSource, error) {
+				return encryption.PassphraseSourceFromConfig(cfg.Encryption)
+			}, "Enter passphrase for decryption: ")
+			return passphrase, err
+		})
+		if err != nil {
+			return fmt.Errorf("recovering metadata: %w", err)
+		}
+
+		fmt.Printf("Recovered %d file version(s) from %d manifest(s)\n", recovery.Files, recovery.Manifests)
+		return nil
+	},
+}
+
+// hosts command
+var hostsCmd = &cobra.Command{
+	Use:   "hosts",
+	Short: "Inspect the hosts backing up to the vault",
+}
+
+var hostsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the hosts backing up to the vault",
+	Long: `List every host with metadata in the vault, and when it last uploaded it.
+Each host describes itself in the vault after every command that changes its
+metadata: its hostname, OS, bt version, tracked directories and last backup.
+The descriptions are encrypted like the metadata, so only hosts sharing this
+host's key pair, or with it as an additional recipient, show theirs.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+
+		hosts, err := app.ListHosts(cfg, func() (string, error) {
+			passphrase, _, err := readPassphrase(cmd, func() (*encryption.PassphraseSource, error) {
+				return encryption.PassphraseSourceFromConfig(cfg.Encryption)
+			}, "Enter passphrase for decryption: ")
+			return passphrase, err
+		})
+		if err != nil {
+			return fmt.Errorf("listing hosts: %w", err)
+		}
+
+		if len(hosts) == 0 {
+			fmt.Println("No hosts in the vault.")
+			return nil
+		}
+
+		for _, h := range hosts {
+			marker := " "
+			if h.HostID == cfg.HostID {
+				marker = "*"
+			}
+			updated := "never"
+			if !h.Updated.IsZero() {
+				updated = fmt.Sprintf("%s (%s ago)",
+					h.Updated.Local().Format("2006-01-02 15:04:05"),
+					time.Since(h.Updated).Truncate(time.Minute))
+			}
+			d := h.Descriptor
+			if d == nil {
+				fmt.Printf("%s %s  updated %s  %s\n", marker, h.HostID, updated, h.Problem)
+				continue
+			}
+			lastBackup := "never"
+			if !d.LastBackupAt.IsZero() {
+				lastBackup = d.LastBackupAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%s %s  %s  %s  bt %s  #%d  last backup: %s  updated %s\n",
+				marker,
+				h.HostID,
+				d.Hostname,
+				d.OS,
+				d.BTVersion,
+				d.MetadataVersion,
+				lastBackup,
+				updated,
+			)
+			for _, dir := range d.Directories {
+				fmt.Printf("    %s\n", dir)
+			}
+		}
+		return nil
+	},
+}
+
+// agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Hold the unlocked private key for other commands",
+	Long: `Unlock the private key once and hold it in memory, so that restores and other
+decrypting commands do not prompt for the passphrase while the agent runs.
+
+The agent listens on a Unix socket only the current user can reach, checks
+the credentials of every connection, and never hands out the key: commands
+send it the wrapped file key from each encrypted file's header and get the
+file key back. It runs in the foreground until interrupted, stopped with
+'bt agent stop', or the --ttl elapses. Restart it after 'bt keys rotate':
+until then, commands prompt for the passphrase instead.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+
+		passphrase, _, err := readPassphrase(cmd, func() (*encryption.PassphraseSource, error) {
+			return encryption.PassphraseSourceFromConfig(cfg.Encryption)
+		}, "Enter passphrase: ")
+		if err != nil {
+			return err
+		}
+
+		ag, err := app.NewAgent(cfg, passphrase, ttl)
+		if err != nil {
+			return err
+		}
+		defer ag.Close()
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			ag.Close()
+		}()
+
+		if expires := ag.Expires(); !expires.IsZero() {
+			fmt.Printf("Agent running at %s until %s\n", agent.SocketPath(cfg), expires.Format(time.RFC3339))
+		} else {
+			fmt.Printf("Agent running at %s\n", agent.SocketPath(cfg))
+		}
+		return ag.Serve()
+	},
+}
+
+var agentStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether an agent is running",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+		client, err := agent.Dial(agent.SocketPath(cfg))
+		if err != nil {
+			return fmt.Errorf("no agent running: %w", err)
+		}
+		defer client.Close()
+
+		expires, err := client.Status()
+		if err != nil {
+			return err
+		}
+		if expires.IsZero() {
+			fmt.Printf("Agent running at %s\n", agent.SocketPath(cfg))
+		} else {
+			fmt.Printf("Agent running at %s until %s\n", agent.SocketPath(cfg), expires.Format(time.RFC3339))
+		}
+		return nil
+	},
+}
+
+var agentStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Make the running agent forget the key and exit",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+		client, err := agent.Dial(agent.SocketPath(cfg))
+		if err != nil {
+			return fmt.Errorf("no agent running: %w", err)
+		}
+		defer client.Close()
+
+		if err := client.Stop(); err != nil {
+			return fmt.Errorf("stopping agent: %w", err)
+		}
+		fmt.Println("Agent stopped")
+		return nil
+	},
+}
+
 // restore command
 var restoreCmd = &cobra.Command{
 	Use:   "restore FILENAME [CHECKSUM]",
 	Short: "Restore a file or directory from backup",
-	Args:  cobra.RangeArgs(1, 2),
+	Long: `Restore a file or directory from backup.
+
+Encrypted files are decrypted with the private key, through bt agent if one is
+running, or else after prompting for its passphrase. With --identity, they are
+decrypted with another identity instead: an age identity file such as an
+offline recovery key, or an SSH private key whose public key is listed in the
+encryption recipients.
+
+Restored files are written next to the originals as NAME.CHECKSUM.btrestored.
+With --target, they are written under the target directory instead, at their
+paths relative to their tracked directory and under their own names.
+
+With --host, the file or directory is one of another host's, named by its path
+on that host, and --target is required. That host's metadata is downloaded
+into a local cache and decrypted like its files, so its files can only be
+restored if it shares this host's key pair or --identity can decrypt them.
+The metadata must be signed; --trust-vault reads it even if it is not, as for
+a host last run by a bt version that did not sign its metadata.`,
+	Args: cobra.RangeArgs(1, 2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		a, err := newApp("Restore")
+		a, decryptCtx, err := openApp(cmd, "Restore")
 		if err != nil {
 			return err
 		}
@@ -394,30 +1549,78 @@ var restoreCmd = &cobra.Command{
 		if len(args) > 1 {
 			checksum = args[1]
 		}
+		target, _ := cmd.Flags().GetString("target")
+
+		// Unlock once if encryption keys are present, through bt agent or by
+		// prompting for the passphrase. The decryption context is reused for
+		// all files in this restore.
+		if decryptCtx == nil {
+			if decryptCtx, err = decryptionContext(cmd, a); err != nil {
+				return err
+			}
+		}
 
-		// Prompt for passphrase once if encryption keys are present.
-		// The decryption context is reused for all files in this restore.
-		var decryptCtx bt.DecryptionContext
-		if a.EncryptionConfigured() {
-			fmt.Print("Enter passphrase for decryption: ")
-			passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
-			fmt.Println()
+		paths, err := a.RestoreFiles(args[0], checksum, target, decryptCtx)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range paths {
+			fmt.Printf("Restored: %s\n", p)
+		}
+		return nil
+	},
+}
+
+// ls command
+var lsCmd = &cobra.Command{
+	Use:   "ls [PATH]",
+	Short: "List backed-up files",
+	Long: `List the backed-up files in a tracked directory, or at or under a path within
+one, with the current version of each. Without a path, list the tracked
+directories.
+
+With --host, list another host's files, named by their paths on that host.
+Its metadata must be signed unless --trust-vault is given.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, _, err := openApp(cmd, "ListFiles")
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		if len(args) == 0 {
+			dirs, err := a.ListDirectories(false)
 			if err != nil {
-				return fmt.Errorf("reading passphrase: %w", err)
+				return err
 			}
-			decryptCtx, err = a.UnlockEncryption(string(passphrase))
-			if err != nil {
-				return fmt.Errorf("unlocking encryption: %w", err)
+			if len(dirs) == 0 {
+				fmt.Println("No directories tracked.")
 			}
+			for _, d := range dirs {
+				fmt.Printf("%s/\n", d.Path)
+			}
+			return nil
 		}
 
-		paths, err := a.RestoreFiles(args[0], checksum, decryptCtx)
+		entries, err := a.ListFiles(args[0])
 		if err != nil {
 			return err
 		}
 
-		for _, p := range paths {
-			fmt.Printf("Restored: %s\n", p)
+		if len(entries) == 0 {
+			fmt.Println("No backed-up files.")
+			return nil
+		}
+
+		for _, e := range entries {
+			fmt.Printf("%s  %s  %d  %s\n",
+				e.ContentChecksum[:12],
+				e.BackedUpAt.Format("2006-01-02 15:04:05"),
+				e.Size,
+				e.Path,
+			)
 		}
 		return nil
 	},
@@ -426,6 +1629,10 @@ var restoreCmd = &cobra.Command{
 func init() {
 	// config subcommands
 	configCmd.AddCommand(configInitCmd)
+	configInitCmd.Flags().Bool("pq", false, "Generate a post-quantum hybrid (ML-KEM-768+X25519) key pair")
+	configInitCmd.Flags().Bool("convergent", false, "Encrypt identical files identically so they are stored once (see help)")
+	configInitCmd.Flags().String("import-identity", "", "Use the age or SSH identity in this file instead of generating a key pair")
+	configInitCmd.Flags().StringArray("recipient", nil, "Also encrypt to this age or SSH public key (repeatable)")
 	configCmd.AddCommand(configListCmd)
 	configCmd.AddCommand(configVaultCmd)
 	configVaultCmd.AddCommand(configVaultInitCmd)
@@ -433,17 +1640,74 @@ func init() {
 	// dir subcommands
 	dirCmd.AddCommand(dirInitCmd)
 	dirInitCmd.Flags().Bool("encrypted", false, "Encrypt files in this directory on backup")
+	dirCmd.AddCommand(dirListCmd)
+	dirListCmd.Flags().BoolP("all", "a", false, "Include removed directories whose history was kept")
+	dirCmd.AddCommand(dirRemoveCmd)
+	dirCmd.AddCommand(dirMoveCmd)
+	dirCmd.AddCommand(dirEncryptCmd)
+	dirCmd.AddCommand(dirDecryptCmd)
+	dirRemoveCmd.Flags().Bool("purge", false, "Delete the directory's backup history too")
 	dirCmd.AddCommand(dirStatusCmd)
 	dirStatusCmd.Flags().BoolP("recursive", "r", false, "Recurse into subdirectories")
+	dirStatusCmd.Flags().Bool("one-file-system", false, "Skip directories on other filesystems")
+
+	// keys subcommands
+	keysCmd.AddCommand(keysRotateCmd)
+	keysRotateCmd.Flags().Bool("pq", false, "Generate a post-quantum hybrid key pair")
+	keysCmd.AddCommand(keysPasswdCmd)
+	keysCmd.AddCommand(keysSecretCmd)
+	keysCmd.AddCommand(keysExportKitCmd)
+	keysExportKitCmd.Flags().StringP("output", "o", "", "Write the kit to this file, readable only by its owner, instead of standard output")
+	keysExportKitCmd.Flags().Bool("include-secrets", false, "Include vault credentials in the kit")
+	keysCmd.AddCommand(keysImportKitCmd)
+
+	// metadata subcommands
+	metadataCmd.AddCommand(metadataListCmd)
+	metadataCmd.AddCommand(metadataRestoreCmd)
+	metadataRestoreCmd.Flags().Int64("version", 0, "Restore this version instead of the latest")
+	metadataRestoreCmd.Flags().Bool("trust-vault", false, "Trust the metadata in the vault without the signing key to check it")
+
+	// hosts subcommands
+	hostsCmd.AddCommand(hostsListCmd)
+
+	// agent subcommands
+	agentCmd.AddCommand(agentStatusCmd)
+	agentCmd.AddCommand(agentStopCmd)
+	agentCmd.Flags().Duration("ttl", 15*time.Minute, "Forget the key after this long; 0 keeps it until stopped")
 
 	// root commands
+	rootCmd.PersistentFlags().String("passphrase-env", "", "Read the passphrase from this environment variable")
+	rootCmd.PersistentFlags().String("passphrase-fd", "", "Read the passphrase from this file descriptor")
+	rootCmd.PersistentFlags().String("passphrase-file", "", "Read the passphrase from this file, which must be yours and only accessible by you")
+	rootCmd.PersistentFlags().String("passphrase-command", "", "Read the passphrase from the output of this shell command")
+	rootCmd.PersistentFlags().String("host", "", "Read the backups of this other host sharing the vault (log, ls and restore)")
 	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(keysCmd)
 	rootCmd.AddCommand(dirCmd)
 	rootCmd.AddCommand(addCmd)
 	addCmd.Flags().BoolP("recursive", "r", false, "Recurse into subdirectories")
+	addCmd.Flags().BoolP("force", "f", false, "Stage files even if unchanged since the last backup")
+	addCmd.Flags().Bool("checksum", false, "Alias for --force: re-read and hash every file")
+	addCmd.Flags().Bool("auto-flush", false, "Back up the staging queue when it fills up, then keep staging")
+	addCmd.Flags().IntP("jobs", "j", 0, "Number of files to hash concurrently (default: one per CPU)")
+	addCmd.Flags().Bool("one-file-system", false, "Skip directories on other filesystems")
 	rootCmd.AddCommand(backupCmd)
 	rootCmd.AddCommand(logCmd)
 	rootCmd.AddCommand(historyCmd)
 	historyCmd.Flags().IntP("limit", "n", 50, "Maximum number of operations to show")
+	historyCmd.AddCommand(historyVerifyCmd)
+	historyVerifyCmd.Flags().String("identity", "", "Decrypt the vault's metadata with this identity file instead of the private key")
 	rootCmd.AddCommand(restoreCmd)
+	for cmd := range hostCommands {
+		cmd.Flags().Bool("trust-vault", false, "With --host, read the host's metadata even if it is not signed")
+	}
+	rootCmd.AddCommand(lsCmd)
+	rootCmd.AddCommand(metadataCmd)
+	rootCmd.AddCommand(recoverCmd)
+	recoverCmd.Flags().Bool("from-manifests", false, "Rebuild the database from the backup manifests")
+	recoverCmd.Flags().Bool("trust-vault", false, "Trust the manifests in the vault without the signing key to check them")
+	rootCmd.AddCommand(hostsCmd)
+	rootCmd.AddCommand(agentCmd)
+	restoreCmd.Flags().String("identity", "", "Decrypt with this identity file or SSH private key instead of the private key")
+	restoreCmd.Flags().StringP("target", "t", "", "Write the restored files under this directory")
 }
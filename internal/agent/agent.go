@@ -0,0 +1,225 @@
+// Package agent implements bt agent, which holds unlocked age identities in
+// memory behind a Unix socket so that repeated restores do not prompt for the
+// passphrase and re-run scrypt each time.
+//
+// The agent never hands out its identities. Clients send the recipient
+// stanzas from an age header and get the unwrapped file key back, so content
+// is still decrypted, and streamed, by the client.
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/config"
+)
+
+// connTimeout bounds how long a single request may take.
+const connTimeout = 10 * time.Second
+
+// Request ops.
+const (
+	opUnwrap = "unwrap"
+	opStatus = "status"
+	opStop   = "stop"
+)
+
+// request is sent by the client as a single JSON object per connection.
+type request struct {
+	Op      string        `json:"op"`
+	Stanzas []*age.Stanza `json:"stanzas,omitempty"`
+}
+
+// response answers a request.
+type response struct {
+	FileKey []byte `json:"file_key,omitempty"`
+
+	// Incorrect reports that no held identity matches the stanzas, which the
+	// client turns back into age.ErrIncorrectIdentity.
+	Incorrect bool `json:"incorrect,omitempty"`
+
+	// Expires is when the agent forgets its identities; zero if never.
+	Expires time.Time `json:"expires,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// SocketPath returns the path of the agent socket for cfg.
+func SocketPath(cfg *config.Config) string {
+	if cfg.Encryption.AgentSocket != "" {
+		return cfg.Encryption.AgentSocket
+	}
+	return filepath.Join(cfg.BaseDir, "agent", "agent.sock")
+}
+
+// Server holds unlocked identities and serves unwrap requests from processes
+// running as the same user.
+type Server struct {
+	path     string
+	listener net.Listener
+	logger   bt.Logger
+	expires  time.Time
+	timer    *time.Timer
+
+	mu         sync.Mutex
+	identities []age.Identity
+	closed     bool
+	done       chan struct{}
+}
+
+// Listen creates the agent socket at path and returns a Server holding
+// identities. The socket's directory is created with mode 0700 and the socket
+// itself with mode 0600; a stale socket left by an agent that exited
+// uncleanly is replaced, but a live one is an error. If ttl is positive, the
+// server closes itself, forgetting the identities, once it elapses.
+func Listen(path string, identities []age.Identity, ttl time.Duration, logger bt.Logger) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating agent socket directory: %w", err)
+	}
+	if _, err := os.Lstat(path); err == nil {
+		if c, err := Dial(path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("an agent is already running at %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale agent socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listening on agent socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting agent socket permissions: %w", err)
+	}
+
+	s := &Server{
+		path:       path,
+		listener:   listener,
+		logger:     logger,
+		identities: identities,
+		done:       make(chan struct{}),
+	}
+	if ttl > 0 {
+		s.expires = time.Now().Add(ttl)
+		s.mu.Lock()
+		s.timer = time.AfterFunc(ttl, func() {
+			s.logger.Info("agent expired")
+			s.Close()
+		})
+		s.mu.Unlock()
+	}
+	return s, nil
+}
+
+// Expires returns when the server closes itself; zero if never.
+func (s *Server) Expires() time.Time {
+	return s.expires
+}
+
+// Serve accepts connections until the server is closed, by Close, a stop
+// request or the TTL elapsing. It returns nil once closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+			}
+			return fmt.Errorf("accepting agent connection: %w", err)
+		}
+		go s.handle(conn.(*net.UnixConn))
+	}
+}
+
+// Close forgets the identities, stops listening and removes the socket.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.identities = nil
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	close(s.done)
+
+	err := s.listener.Close()
+	if rmErr := os.Remove(s.path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// handle serves a single request on conn.
+func (s *Server) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(connTimeout))
+
+	uid, err := peerUID(conn)
+	if err != nil {
+		s.logger.Warn("rejected agent connection", "error", err)
+		return
+	}
+	if uid != os.Getuid() {
+		s.logger.Warn("rejected agent connection from another user", "uid", uid)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		s.logger.Warn("reading agent request", "error", err)
+		return
+	}
+
+	resp := s.respond(&req)
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		s.logger.Warn("writing agent response", "error", err)
+	}
+	if req.Op == opStop {
+		s.logger.Info("agent stopped by request")
+		s.Close()
+	}
+}
+
+// respond computes the response to req.
+func (s *Server) respond(req *request) *response {
+	switch req.Op {
+	case opStatus, opStop:
+		return &response{Expires: s.expires}
+	case opUnwrap:
+		s.mu.Lock()
+		identities := s.identities
+		s.mu.Unlock()
+
+		for _, identity := range identities {
+			fileKey, err := identity.Unwrap(req.Stanzas)
+			if errors.Is(err, age.ErrIncorrectIdentity) {
+				continue
+			}
+			if err != nil {
+				return &response{Error: err.Error()}
+			}
+			s.logger.Debug("unwrapped file key")
+			return &response{FileKey: fileKey}
+		}
+		return &response{Incorrect: true}
+	default:
+		return &response{Error: fmt.Sprintf("unknown op %q", req.Op)}
+	}
+}
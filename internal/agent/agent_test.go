@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"bt-go/internal/bt"
+)
+
+// startAgent starts a server holding identity and returns its socket path.
+// Socket paths are limited to ~100 bytes, so the socket goes in a short
+// temporary directory rather than t.TempDir.
+func startAgent(t *testing.T, identity age.Identity, ttl time.Duration) (*Server, string, chan error) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "bt-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "s", "agent.sock")
+	s, err := Listen(path, []age.Identity{identity}, ttl, bt.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	return s, path, served
+}
+
+func encryptTo(t *testing.T, r age.Recipient, plaintext string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, plaintext)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAgent_Unwrap(t *testing.T) {
+	t.Parallel()
+	identity, _ := age.GenerateX25519Identity()
+	_, path, _ := startAgent(t, identity, 0)
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	ciphertext := encryptTo(t, identity.Recipient(), "secret")
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), client.Identity())
+	if err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "secret" {
+		t.Errorf("Decrypt() = %q, want %q", got, "secret")
+	}
+
+	other, _ := age.GenerateX25519Identity()
+	ciphertext = encryptTo(t, other.Recipient(), "secret")
+	if _, err := age.Decrypt(bytes.NewReader(ciphertext), client.Identity()); err == nil {
+		t.Error("expected error decrypting content for another identity")
+	}
+}
+
+func TestAgent_Socket(t *testing.T) {
+	t.Parallel()
+	identity, _ := age.GenerateX25519Identity()
+	_, path, _ := startAgent(t, identity, 0)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket mode = %04o, want 0600", perm)
+	}
+	if info, _ := os.Stat(filepath.Dir(path)); info.Mode().Perm() != 0700 {
+		t.Errorf("socket directory mode = %04o, want 0700", info.Mode().Perm())
+	}
+
+	if _, err := Listen(path, nil, 0, bt.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("second Listen() error = %v, want already running", err)
+	}
+}
+
+func TestAgent_Stop(t *testing.T) {
+	t.Parallel()
+	identity, _ := age.GenerateX25519Identity()
+	_, path, served := startAgent(t, identity, 0)
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if err := client.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("socket should be removed")
+	}
+	if _, err := Dial(path); err == nil {
+		t.Error("Dial() should fail once stopped")
+	}
+}
+
+func TestAgent_TTL(t *testing.T) {
+	t.Parallel()
+	identity, _ := age.GenerateX25519Identity()
+	s, path, served := startAgent(t, identity, 50*time.Millisecond)
+
+	if s.Expires().IsZero() {
+		t.Error("Expires() should be set with a TTL")
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not expire")
+	}
+	if _, err := Dial(path); err == nil {
+		t.Error("Dial() should fail once expired")
+	}
+}
+
+func TestAgent_ReplacesStaleSocket(t *testing.T) {
+	t.Parallel()
+	dir, err := os.MkdirTemp("", "bt-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.sock")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Listen(path, nil, 0, bt.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Listen() over a stale socket error = %v", err)
+	}
+	s.Close()
+}
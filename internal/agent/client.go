@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"filippo.io/age"
+)
+
+// Client talks to a running agent. Each request uses its own connection.
+type Client struct {
+	path string
+}
+
+// Dial returns a Client for the agent at path, or an error if no agent is
+// running there or it runs as another user.
+func Dial(path string) (*Client, error) {
+	c := &Client{path: path}
+	if _, err := c.Status(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close releases the client. Connections are per request, so there is
+// nothing to release yet.
+func (c *Client) Close() error {
+	return nil
+}
+
+// Status returns when the agent forgets its identities; zero if never.
+func (c *Client) Status() (time.Time, error) {
+	resp, err := c.do(&request{Op: opStatus})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return resp.Expires, nil
+}
+
+// Stop makes the agent forget its identities and exit.
+func (c *Client) Stop() error {
+	_, err := c.do(&request{Op: opStop})
+	return err
+}
+
+// Identity returns an age.Identity that unwraps file keys through the agent.
+func (c *Client) Identity() age.Identity {
+	return &identity{client: c}
+}
+
+// do sends req and returns the agent's response. The agent's uid is checked
+// like the agent checks ours, so a socket planted by another user is refused.
+func (c *Client) do(req *request) (*response, error) {
+	conn, err := net.DialTimeout("unix", c.path, connTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to agent: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(connTimeout))
+
+	uid, err := peerUID(conn.(*net.UnixConn))
+	if err != nil {
+		return nil, fmt.Errorf("checking agent credentials: %w", err)
+	}
+	if uid != os.Getuid() {
+		return nil, fmt.Errorf("agent at %s runs as uid %d", c.path, uid)
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("sending agent request: %w", err)
+	}
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("reading agent response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("agent: %s", resp.Error)
+	}
+	return &resp, nil
+}
+
+// identity is an age.Identity backed by the agent.
+type identity struct {
+	client *Client
+}
+
+var _ age.Identity = (*identity)(nil)
+
+// Unwrap asks the agent to unwrap the file key from stanzas.
+func (i *identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	resp, err := i.client.do(&request{Op: opUnwrap, Stanzas: stanzas})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Incorrect {
+		return nil, age.ErrIncorrectIdentity
+	}
+	if len(resp.FileKey) == 0 {
+		return nil, errors.New("agent returned no file key")
+	}
+	return resp.FileKey, nil
+}
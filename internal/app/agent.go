@@ -0,0 +1,110 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"bt-go/internal/agent"
+	"bt-go/internal/bt"
+	"bt-go/internal/config"
+	"bt-go/internal/encryption"
+)
+
+// Agent runs bt agent: it holds the unlocked private key and unwraps file
+// keys for other bt commands over a Unix socket.
+type Agent struct {
+	server  *agent.Server
+	logFile *os.File
+}
+
+// NewAgent unlocks the private key with passphrase and starts listening on
+// the agent socket. If ttl is positive, the agent forgets the key and stops
+// once it elapses. The caller must call Serve, then Close.
+func NewAgent(cfg *config.Config, passphrase string, ttl time.Duration) (*Agent, error) {
+	enc, err := encryption.NewEncryptorFromConfig(cfg.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("creating encryptor: %w", err)
+	}
+	if !enc.IsConfigured() {
+		return nil, fmt.Errorf("encryption keys not found; run 'bt config init' first")
+	}
+	ctx, err := enc.Unlock(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("unlocking encryption: %w", err)
+	}
+	ageCtx, ok := ctx.(*encryption.AgeDecryptionContext)
+	if !ok {
+		return nil, fmt.Errorf("bt agent requires age encryption")
+	}
+
+	opID := time.Now().UTC().Format("20060102T150405Z")
+	logger, logFile, err := newLogger(cfg.LogDir, opID)
+	if err != nil {
+		return nil, fmt.Errorf("creating logger: %w", err)
+	}
+
+	server, err := agent.Listen(agent.SocketPath(cfg), ageCtx.Identities(), ttl, &slogAdapter{l: logger})
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	logger.Info("agent started", "socket", agent.SocketPath(cfg), "ttl", ttl)
+	return &Agent{server: server, logFile: logFile}, nil
+}
+
+// Expires returns when the agent forgets the key; zero if never.
+func (a *Agent) Expires() time.Time {
+	return a.server.Expires()
+}
+
+// Serve answers requests until the agent is closed, stopped, or expires.
+func (a *Agent) Serve() error {
+	return a.server.Serve()
+}
+
+// Close forgets the key and removes the socket.
+func (a *Agent) Close() error {
+	err := a.server.Close()
+	a.logFile.Close()
+	return err
+}
+
+// AgentDecryptionContext returns a DecryptionContext that unwraps file keys
+// through a running bt agent, or nil if none is running or it holds a key
+// other than the configured one, as after 'bt keys rotate'.
+func (a *BTApp) AgentDecryptionContext() bt.DecryptionContext {
+	return agentDecryptionContext(a.cfg, a.encryptor)
+}
+
+// agentDecryptionContext returns a DecryptionContext for enc through the bt
+// agent of cfg, or nil if none is running or it cannot decrypt what enc
+// encrypts.
+func agentDecryptionContext(cfg *config.Config, e bt.Encryptor) bt.DecryptionContext {
+	enc, ok := e.(*encryption.AgeEncryptor)
+	if !ok {
+		return nil
+	}
+	client, err := agent.Dial(agent.SocketPath(cfg))
+	if err != nil {
+		return nil
+	}
+	ctx, err := enc.DecryptionContext(client.Identity())
+	if err != nil {
+		return nil
+	}
+
+	// Try a file key wrapped to the configured key before relying on the
+	// agent, so that callers can prompt for the passphrase instead.
+	var ciphertext bytes.Buffer
+	if err := enc.Encrypt(strings.NewReader("bt agent probe"), &ciphertext); err != nil {
+		return nil
+	}
+	if err := ctx.Decrypt(&ciphertext, io.Discard); err != nil {
+		return nil
+	}
+	return ctx
+}
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAgentDecryptionContext(t *testing.T) {
+	cfg := newTestConfig(t, "host-1", t.TempDir())
+	// Socket paths are limited to ~100 bytes, too few for t.TempDir.
+	dir, err := os.MkdirTemp("", "bt-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	cfg.Encryption.AgentSocket = filepath.Join(dir, "agent.sock")
+
+	ag, err := NewAgent(cfg, "correct", 0)
+	if err != nil {
+		t.Fatalf("NewAgent() error = %v", err)
+	}
+	defer ag.Close()
+	go ag.Serve()
+
+	a, err := NewBTApp(cfg, "RotateKeys")
+	if err != nil {
+		t.Fatalf("NewBTApp() error = %v", err)
+	}
+	defer a.Close()
+	if a.AgentDecryptionContext() == nil {
+		t.Fatal("AgentDecryptionContext() = nil with the agent holding the key")
+	}
+	if _, err := a.RotateKeys("correct"); err != nil {
+		t.Fatalf("RotateKeys() error = %v", err)
+	}
+	if a.AgentDecryptionContext() != nil {
+		t.Error("AgentDecryptionContext() should be nil once the agent holds a rotated-away key")
+	}
+}
@@ -1,9 +1,10 @@
 package app
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"time"
@@ -31,13 +32,25 @@ type BTApp struct {
 	service   *bt.BTService
 	op        *BackupOperation
 	logFile   *os.File
+
+	// host is the ID of the other host whose metadata the app reads, if it
+	// was opened by OpenHost.
+	host string
+
+	// signer is the key the app signs metadata with, loaded on first use.
+	signer ed25519.PrivateKey
+
+	// checkpoint makes the next sync upload the whole database, as after a
+	// key rotation, once the checkpoint and segments already in the vault
+	// are encrypted to a deleted key.
+	checkpoint bool
 }
 
 // NewBTApp creates a fully wired BTApp from the given config.
 // operation identifies the CLI command being run (e.g. "AddDirectory", "BackupAll").
 // The caller must call Close when done.
 func NewBTApp(cfg *config.Config, operation string) (*BTApp, error) {
-	fsmgr := fs.NewOSFilesystemManager(cfg.Filesystem.Ignore)
+	fsmgr := fs.NewOSFilesystemManager(cfg.Filesystem)
 
 	if len(cfg.Vaults) == 0 {
 		return nil, fmt.Errorf("no vaults configured")
@@ -63,7 +76,7 @@ func NewBTApp(cfg *config.Config, operation string) (*BTApp, error) {
 	}
 
 	// Check local DB version against remote vault version.
-	remoteVersion, err := v.GetMetadataVersion(cfg.HostID, "db")
+	remoteVersion, err := remoteMetadataVersion(v, cfg.HostID)
 	if err != nil {
 		db.Close()
 		return nil, fmt.Errorf("checking remote metadata version: %w", err)
@@ -75,6 +88,11 @@ func NewBTApp(cfg *config.Config, operation string) (*BTApp, error) {
 		return nil, fmt.Errorf("checking local metadata version: %w", err)
 	}
 
+	if err := checkRollback(cfg, cfg.HostID, remoteVersion); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	if remoteVersion > localMax {
 		db.Close()
 		return nil, fmt.Errorf("local database is behind remote (local=%d, remote=%d): restore from vault or re-initialize", localMax, remoteVersion)
@@ -115,6 +133,9 @@ func (a *BTApp) persistOperation() error {
 	if a.op.Persisted() {
 		return nil // already persisted
 	}
+	if a.host != "" {
+		return fmt.Errorf("the metadata of host %s is read-only", a.host)
+	}
 	dbOp, err := a.db.CreateBackupOperation(a.op.Operation, a.op.Parameters)
 	if err != nil {
 		return fmt.Errorf("persisting backup operation: %w", err)
@@ -136,16 +157,112 @@ func (a *BTApp) AddDirectory(rawPath string, encrypted bool) error {
 	return a.service.AddDirectory(p, encrypted)
 }
 
+// ListDirectories returns the directories tracked on this host.
+// If includeRemoved is true, removed directories whose history was kept are included.
+func (a *BTApp) ListDirectories(includeRemoved bool) ([]*bt.DirectoryInfo, error) {
+	return a.service.ListDirectories(includeRemoved)
+}
+
+// RemoveDirectory stops tracking the directory at the given path and drops its
+// staged files. The path may no longer exist on disk — resolution uses
+// filepath.Abs only. If purge is true, the directory's history is deleted too.
+// Returns the number of staged files dropped.
+func (a *BTApp) RemoveDirectory(rawPath string, purge bool) (int, error) {
+	if err := a.persistOperation(); err != nil {
+		return 0, err
+	}
+	absPath, err := filepath.Abs(rawPath)
+	if err != nil {
+		return 0, fmt.Errorf("resolving path: %w", err)
+	}
+	return a.service.RemoveDirectory(absPath, purge)
+}
+
+// MoveDirectory records that the tracked directory at oldPath now lives at
+// newPath. oldPath may no longer exist on disk — resolution uses filepath.Abs
+// only. Returns the path of the directory now holding the history and the
+// number of staged files dropped.
+func (a *BTApp) MoveDirectory(oldPath, newPath string) (string, int, error) {
+	if err := a.persistOperation(); err != nil {
+		return "", 0, err
+	}
+	absOld, err := filepath.Abs(oldPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("resolving path: %w", err)
+	}
+	p, err := a.fsmgr.Resolve(newPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("resolving path: %w", err)
+	}
+	return a.service.MoveDirectory(absOld, p)
+}
+
+// SetDirectoryEncryption converts the tracked directory at the given path to
+// encrypted or unencrypted storage, migrating its existing history. The path
+// may no longer exist on disk — resolution uses filepath.Abs only.
+// decryptCtx must be non-nil when decrypting encrypted content.
+func (a *BTApp) SetDirectoryEncryption(rawPath string, encrypted bool, decryptCtx bt.DecryptionContext) (*bt.EncryptionChange, error) {
+	if err := a.persistOperation(); err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("resolving path: %w", err)
+	}
+	return a.service.SetDirectoryEncryption(absPath, encrypted, decryptCtx)
+}
+
+// DetectMovedDirectory reports whether the untracked directory at the given
+// path looks like a tracked directory that is missing from disk, or nil.
+func (a *BTApp) DetectMovedDirectory(rawPath string) (*bt.MovedDirectory, error) {
+	p, err := a.fsmgr.Resolve(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("resolving path: %w", err)
+	}
+	return a.service.DetectMovedDirectory(p)
+}
+
+// DetectMovedDirectoriesIn reports the tracked directories missing from disk
+// that look like they were moved into the directory at the given path.
+func (a *BTApp) DetectMovedDirectoriesIn(rawPath string) ([]*bt.MovedDirectory, error) {
+	p, err := a.fsmgr.Resolve(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("resolving path: %w", err)
+	}
+	return a.service.DetectMovedDirectoriesIn(p)
+}
+
+// DirectoryOverride returns the per-directory settings of the config
+// ([[filesystem.directories]]) for the directory at the given path, or nil.
+// They are keyed by path, so they stop applying when the directory moves.
+func (a *BTApp) DirectoryOverride(rawPath string) (*config.DirectoryFilesystemConfig, error) {
+	absPath, err := filepath.Abs(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("resolving path: %w", err)
+	}
+	for i, d := range a.cfg.Filesystem.Directories {
+		if filepath.Clean(d.Path) == absPath {
+			return &a.cfg.Filesystem.Directories[i], nil
+		}
+	}
+	return nil, nil
+}
+
 // StageFiles resolves the given path and stages file(s) for backup.
 // If the path is a directory, all discovered files are staged.
-// When recursive is true, files in subdirectories are included.
-// Returns the number of files staged.
-func (a *BTApp) StageFiles(rawPath string, recursive bool) (int, error) {
+// Files unchanged since their last backup are skipped unless opts.Force is set.
+// With opts.AutoFlush, staging may back files up, so the operation is persisted.
+func (a *BTApp) StageFiles(rawPath string, opts bt.StageOptions) (*bt.StageResult, error) {
+	if opts.AutoFlush {
+		if err := a.persistOperation(); err != nil {
+			return nil, err
+		}
+	}
 	p, err := a.fsmgr.Resolve(rawPath)
 	if err != nil {
-		return 0, fmt.Errorf("resolving path: %w", err)
+		return nil, fmt.Errorf("resolving path: %w", err)
 	}
-	return a.service.StageFiles(p, recursive)
+	return a.service.StageFiles(p, opts)
 }
 
 // GetStatus returns the backup status of files under the given path.
@@ -158,7 +275,15 @@ func (a *BTApp) GetStatus(rawPath string, recursive bool) ([]*bt.FileStatus, err
 }
 
 // GetFileHistory resolves the given path and returns its backup history.
+// Another host's paths are taken as files without looking for them on disk.
 func (a *BTApp) GetFileHistory(rawPath string) ([]*bt.FileHistoryEntry, error) {
+	if a.host != "" {
+		absPath, err := filepath.Abs(rawPath)
+		if err != nil {
+			return nil, fmt.Errorf("resolving path: %w", err)
+		}
+		return a.service.GetFileHistory(bt.NewPath(absPath, false, nil))
+	}
 	p, err := a.fsmgr.Resolve(rawPath)
 	if err != nil {
 		return nil, fmt.Errorf("resolving path: %w", err)
@@ -166,6 +291,16 @@ func (a *BTApp) GetFileHistory(rawPath string) ([]*bt.FileHistoryEntry, error) {
 	return a.service.GetFileHistory(p)
 }
 
+// ListFiles returns the backed-up files at or under the given path, which
+// may not exist on disk.
+func (a *BTApp) ListFiles(rawPath string) ([]*bt.FileEntry, error) {
+	absPath, err := filepath.Abs(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("resolving path: %w", err)
+	}
+	return a.service.ListFiles(absPath)
+}
+
 // GetHistory returns the most recent backup operations.
 func (a *BTApp) GetHistory(limit int) ([]*sqlc.BackupOperation, error) {
 	return a.service.GetHistory(limit)
@@ -176,23 +311,123 @@ func (a *BTApp) EncryptionConfigured() bool {
 	return a.encryptor.IsConfigured()
 }
 
+// PassphraseSource returns the configured non-interactive passphrase source,
+// or nil if the passphrase should be prompted for.
+func (a *BTApp) PassphraseSource() (*encryption.PassphraseSource, error) {
+	return encryption.PassphraseSourceFromConfig(a.cfg.Encryption)
+}
+
 // UnlockEncryption decrypts the private key using the given passphrase and returns
 // a DecryptionContext for use during the restore session.
 func (a *BTApp) UnlockEncryption(passphrase string) (bt.DecryptionContext, error) {
 	return a.encryptor.Unlock(passphrase)
 }
 
+// UnlockIdentityFile returns a DecryptionContext for the identity file at path
+// instead of the configured private key. passphrase is only called if the file
+// is protected by one.
+func (a *BTApp) UnlockIdentityFile(path string, passphrase func() (string, error)) (bt.DecryptionContext, error) {
+	return a.encryptor.UnlockIdentityFile(path, passphrase)
+}
+
+// KeyRotationInProgress returns true if a key rotation was interrupted and
+// must be resumed with RotateKeys.
+func (a *BTApp) KeyRotationInProgress() bool {
+	return a.encryptor.RotationInProgress()
+}
+
+// RotateKeys replaces the encryption key pair, protecting the new private key
+// with the same passphrase, and re-encrypts all encrypted content to it.
+// The new keys and the database, encrypted to the new key, are uploaded when
+// the app is closed, the database as a new checkpoint since the older ones
+// are encrypted to the previous key; the manifests already in the vault are
+// re-encrypted to the new key before the previous one is deleted, and so is
+// the convergence secret. Convergent content is left as it is: the rotation
+// does not change the convergence secret. Returns the number of contents
+// re-encrypted.
+func (a *BTApp) RotateKeys(passphrase string) (int, error) {
+	if err := a.persistOperation(); err != nil {
+		return 0, err
+	}
+	a.checkpoint = true
+	return a.service.RotateKeys(passphrase, func(previous bt.DecryptionContext) error {
+		if err := a.reencryptManifests(previous, passphrase); err != nil {
+			return err
+		}
+		return a.replaceConvergenceSecret()
+	})
+}
+
+// replaceConvergenceSecret deletes the copies of the convergence secret
+// encrypted to the previous key pair from every configured vault, kept
+// versions included, so the retired private key cannot read it. The primary
+// vault gets a copy encrypted to the new key when the app is closed, the
+// others right away.
+func (a *BTApp) replaceConvergenceSecret() error {
+	if err := a.vault.DeleteMetadata(a.cfg.HostID, convergenceSecretName); err != nil {
+		return fmt.Errorf("deleting %s: %w", convergenceSecretName, err)
+	}
+	for _, vc := range a.cfg.Vaults[1:] {
+		v, err := vault.NewVaultFromConfig(vc)
+		if err != nil {
+			return fmt.Errorf("creating vault %s: %w", vc.Name, err)
+		}
+		if err := v.DeleteMetadata(a.cfg.HostID, convergenceSecretName); err != nil {
+			return fmt.Errorf("vault %s: deleting %s: %w", vc.Name, convergenceSecretName, err)
+		}
+		if err := a.uploadConvergenceSecret(v, a.op.ID); err != nil {
+			return fmt.Errorf("vault %s: %w", vc.Name, err)
+		}
+	}
+	return nil
+}
+
+// ChangePassphrase re-encrypts the private key with a new passphrase. The key
+// files are uploaded to every configured vault with this operation's ID as
+// their version, superseding the copies protected by the old passphrase; the
+// primary vault gets them when the app is closed, along with the DB.
+func (a *BTApp) ChangePassphrase(oldPassphrase string, newPassphrase string) error {
+	if err := a.persistOperation(); err != nil {
+		return err
+	}
+	if err := a.encryptor.ChangePassphrase(oldPassphrase, newPassphrase); err != nil {
+		return err
+	}
+
+	for _, vc := range a.cfg.Vaults[1:] {
+		v, err := vault.NewVaultFromConfig(vc)
+		if err != nil {
+			return fmt.Errorf("creating vault %s: %w", vc.Name, err)
+		}
+		if err := a.uploadKeyFiles(v, a.op.ID); err != nil {
+			return fmt.Errorf("vault %s: %w", vc.Name, err)
+		}
+	}
+	return nil
+}
+
 // RestoreFiles resolves the given path and restores file(s) from the vault.
 // The path may not exist on disk — resolution uses filepath.Abs only.
 // If checksum is non-empty, restores a specific version (file only, not directory).
+// If targetDir is non-empty, the files are written under it instead of next to
+// the originals; restoring another host's files requires one.
 // decryptCtx must be non-nil when restoring encrypted files; pass nil for unencrypted restores.
 // Returns the list of restored file paths.
-func (a *BTApp) RestoreFiles(rawPath string, checksum string, decryptCtx bt.DecryptionContext) ([]string, error) {
+func (a *BTApp) RestoreFiles(rawPath string, checksum string, targetDir string, decryptCtx bt.DecryptionContext) ([]string, error) {
 	absPath, err := filepath.Abs(rawPath)
 	if err != nil {
 		return nil, fmt.Errorf("resolving path: %w", err)
 	}
-	return a.service.Restore(absPath, checksum, decryptCtx)
+	if targetDir == "" {
+		if a.host != "" {
+			return nil, fmt.Errorf("restoring files of host %s requires a target directory", a.host)
+		}
+		return a.service.Restore(absPath, checksum, decryptCtx)
+	}
+	if targetDir, err = filepath.Abs(targetDir); err != nil {
+		return nil, fmt.Errorf("resolving target directory: %w", err)
+	}
+	return a.service.RestoreTo(absPath, checksum, targetDir, decryptCtx)
 }
 
 // BackupAll processes all staged files and backs them up to the vault.
@@ -205,7 +440,7 @@ func (a *BTApp) BackupAll() (int, error) {
 }
 
 // Close finalizes the operation and closes all resources.
-// For persisted operations: finishes the operation record, backs up the DB, and uploads to vault.
+// For persisted operations: finishes the operation record and syncs the DB changes to the vault.
 // For non-persisted operations: just closes the database.
 func (a *BTApp) Close() error {
 	var errs []error
@@ -216,21 +451,20 @@ func (a *BTApp) Close() error {
 			errs = append(errs, fmt.Errorf("finishing backup operation: %w", err))
 		}
 
-		// Snapshot the DB to a temp file
-		tmpFile, err := os.CreateTemp("", "bt-db-backup-*.db")
-		if err != nil {
-			errs = append(errs, fmt.Errorf("creating temp file for db backup: %w", err))
+		// Upload the changes to the vault with version = operation ID
+		if err := a.syncMetadata(a.op.ID); err != nil {
+			errs = append(errs, fmt.Errorf("syncing metadata to vault: %w", err))
 		}
 
-		var tmpPath string
-		if tmpFile != nil {
-			tmpPath = tmpFile.Name()
-			tmpFile.Close()
+		// List the files backed up apart from the database, for recovery
+		// without it
+		if err := a.uploadManifest(a.op.ID); err != nil {
+			errs = append(errs, fmt.Errorf("uploading manifest: %w", err))
+		}
 
-			if err := a.db.BackupTo(tmpPath); err != nil {
-				errs = append(errs, fmt.Errorf("backing up database: %w", err))
-				tmpPath = "" // skip vault upload
-			}
+		// Describe this host to the others sharing the vault
+		if err := a.publishHost(a.op.ID); err != nil {
+			errs = append(errs, fmt.Errorf("publishing host descriptor: %w", err))
 		}
 
 		// Close the database
@@ -238,21 +472,10 @@ func (a *BTApp) Close() error {
 			errs = append(errs, fmt.Errorf("closing database: %w", err))
 		}
 
-		// Upload DB snapshot to vault with version = operation ID
-		if tmpPath != "" {
-			if err := a.uploadMetadata(tmpPath, a.op.ID); err != nil {
-				errs = append(errs, err)
-			}
-		}
-
-		// Clean up temp file
-		if tmpPath != "" {
-			os.Remove(tmpPath)
-		}
-
-		// Upload encryption key files to vault (idempotent; version is always 1).
+		// Upload encryption key files to vault with the same version as the
+		// DB, so the latest keys always match the DB they encrypted.
 		if a.encryptor.IsConfigured() {
-			if err := a.uploadKeyMetadata(); err != nil {
+			if err := a.uploadKeyMetadata(a.op.ID); err != nil {
 				errs = append(errs, err)
 			}
 		}
@@ -270,63 +493,26 @@ func (a *BTApp) Close() error {
 	return errors.Join(errs...)
 }
 
-// uploadMetadata opens the temp DB file, encrypts it if encryption is configured,
-// and uploads it to the vault as metadata.
-func (a *BTApp) uploadMetadata(path string, version int64) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("opening db backup for upload: %w", err)
-	}
-	defer f.Close()
-
-	if a.encryptor.IsConfigured() {
-		encTmp, err := os.CreateTemp("", "bt-meta-enc-*.tmp")
-		if err != nil {
-			return fmt.Errorf("creating encrypted temp file: %w", err)
-		}
-		encTmpPath := encTmp.Name()
-		defer os.Remove(encTmpPath)
-
-		if err := a.encryptor.Encrypt(f, encTmp); err != nil {
-			encTmp.Close()
-			return fmt.Errorf("encrypting db backup: %w", err)
-		}
-		info, err := encTmp.Stat()
-		if err != nil {
-			encTmp.Close()
-			return fmt.Errorf("stat encrypted db temp file: %w", err)
-		}
-		if _, err := encTmp.Seek(0, io.SeekStart); err != nil {
-			encTmp.Close()
-			return fmt.Errorf("seeking encrypted db temp file: %w", err)
-		}
-		if err := a.vault.PutMetadata(a.cfg.HostID, "db", encTmp, info.Size(), version); err != nil {
-			encTmp.Close()
-			return fmt.Errorf("uploading metadata to vault: %w", err)
-		}
-		encTmp.Close()
-		return nil
-	}
-
-	info, err := f.Stat()
-	if err != nil {
-		return fmt.Errorf("stat db backup: %w", err)
-	}
-
-	if err := a.vault.PutMetadata(a.cfg.HostID, "db", f, info.Size(), version); err != nil {
-		return fmt.Errorf("uploading metadata to vault: %w", err)
-	}
-
-	return nil
+// uploadKeyMetadata uploads the public and private key files to the vault as metadata.
+// Keys change on rotation, so they are versioned like the DB. While a rotation
+// is in progress, the previous key pair is uploaded too, since content not yet
+// re-encrypted can only be decrypted with it.
+func (a *BTApp) uploadKeyMetadata(version int64) error {
+	return a.uploadKeyFiles(a.vault, version)
 }
 
-// uploadKeyMetadata uploads the public and private key files to the vault as metadata.
-// Keys use a fixed version (1) since they are immutable after initial setup.
-func (a *BTApp) uploadKeyMetadata() error {
+// uploadKeyFiles uploads the key files to v as described by uploadKeyMetadata.
+func (a *BTApp) uploadKeyFiles(v bt.Vault, version int64) error {
 	keys := []struct{ name, path string }{
 		{"public_key", a.cfg.Encryption.PublicKeyPath},
 		{"private_key", a.cfg.Encryption.PrivateKeyPath},
 	}
+	if a.encryptor.RotationInProgress() {
+		keys = append(keys,
+			struct{ name, path string }{"previous_public_key", encryption.PreviousKeyPath(a.cfg.Encryption.PublicKeyPath)},
+			struct{ name, path string }{"previous_private_key", encryption.PreviousKeyPath(a.cfg.Encryption.PrivateKeyPath)},
+		)
+	}
 	for _, k := range keys {
 		f, err := os.Open(k.path)
 		if err != nil {
@@ -337,11 +523,69 @@ func (a *BTApp) uploadKeyMetadata() error {
 			f.Close()
 			return fmt.Errorf("stat %s: %w", k.name, err)
 		}
-		if err := a.vault.PutMetadata(a.cfg.HostID, k.name, f, info.Size(), 1); err != nil {
+		if err := v.PutMetadata(a.cfg.HostID, k.name, f, info.Size(), version); err != nil {
 			f.Close()
 			return fmt.Errorf("uploading %s to vault: %w", k.name, err)
 		}
 		f.Close()
 	}
-	return nil
+	if err := a.uploadConvergenceSecret(v, version); err != nil {
+		return err
+	}
+	return a.uploadSigningKey(v, version)
+}
+
+// convergenceSecretName is the metadata item holding the convergence secret.
+const convergenceSecretName = "convergence_secret"
+
+// uploadConvergenceSecret uploads the convergence secret to v, if there is
+// one, encrypted to the key pair and signed like the metadata database.
+func (a *BTApp) uploadConvergenceSecret(v bt.Vault, version int64) error {
+	secret, err := os.Open(encryption.ConvergenceSecretPath(a.cfg.Encryption))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening %s for upload: %w", convergenceSecretName, err)
+	}
+	defer secret.Close()
+	return a.putMetadataTo(v, convergenceSecretName, secret, version)
+}
+
+// restoreConvergenceSecret installs the convergence secret from the copy in
+// the vault of the host r reads if there is none locally, as on a new machine
+// or when reading the backups of a host that shares its secret. The copy is
+// checked and decrypted like the host's other metadata. Returns true if the
+// secret was installed.
+func restoreConvergenceSecret(r *metadataReader) (bool, error) {
+	path := encryption.ConvergenceSecretPath(r.cfg.Encryption)
+	if _, err := os.Stat(path); !os.IsNotExist(err) || r.decryptCtx == nil {
+		return false, nil
+	}
+	version, err := r.v.GetMetadataVersion(r.hostID, convergenceSecretName)
+	if err != nil || version == 0 {
+		return false, err
+	}
+	var secret bytes.Buffer
+	if err := r.get(convergenceSecretName, version, &secret); err != nil {
+		return false, err
+	}
+	if err := encryption.InstallConvergenceSecret(path, secret.Bytes()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// withConvergenceSecret returns decryptCtx again with the convergence secret
+// installed since it was created, so it can decrypt convergent content.
+func withConvergenceSecret(enc bt.Encryptor, decryptCtx bt.DecryptionContext) (bt.DecryptionContext, error) {
+	ageEnc, ok := enc.(*encryption.AgeEncryptor)
+	if !ok {
+		return decryptCtx, nil
+	}
+	ageCtx, ok := decryptCtx.(*encryption.AgeDecryptionContext)
+	if !ok {
+		return decryptCtx, nil
+	}
+	return ageEnc.DecryptionContext(ageCtx.Identities()...)
 }
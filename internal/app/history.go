@@ -0,0 +1,105 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"bt-go/internal/bt"
+)
+
+// HistoryVerification is the result of VerifyHistory.
+type HistoryVerification struct {
+	// Local is the operation chain of the local database.
+	Local *bt.OperationChain
+
+	// Vault is the operation chain of the latest metadata in the vault, or
+	// nil if the vault holds none.
+	Vault *bt.OperationChain
+
+	// VaultVersion is the version of the metadata Vault was checked in.
+	VaultVersion int64
+
+	// Problems lists where the vault's metadata disagrees with the chain head
+	// its journal index records or with the local database.
+	Problems []string
+}
+
+// OK returns true if no problem was found in either chain.
+func (h *HistoryVerification) OK() bool {
+	if len(h.Problems) > 0 || len(h.Local.Problems) > 0 {
+		return false
+	}
+	return h.Vault == nil || len(h.Vault.Problems) == 0
+}
+
+// VerifyHistory verifies the operation chain of the local database and of
+// the latest metadata in the vault, which is rebuilt in a temporary file and
+// decrypted with decryptCtx unless that is nil. The vault's chain must end at
+// the head its journal index records, and that operation must be the same
+// locally: the local database may be ahead of the vault, never apart from it.
+func (a *BTApp) VerifyHistory(decryptCtx bt.DecryptionContext) (*HistoryVerification, error) {
+	if a.host != "" {
+		return nil, fmt.Errorf("verifying the history of host %s is not supported", a.host)
+	}
+	local, err := a.db.VerifyOperationChain()
+	if err != nil {
+		return nil, err
+	}
+	result := &HistoryVerification{Local: local}
+
+	latest, err := remoteMetadataVersion(a.vault, a.cfg.HostID)
+	if err != nil {
+		return nil, fmt.Errorf("checking remote metadata version: %w", err)
+	}
+	if latest == 0 {
+		return result, nil
+	}
+	result.VaultVersion = latest
+
+	r := &metadataReader{cfg: a.cfg, v: a.vault, hostID: a.cfg.HostID, decryptCtx: decryptCtx}
+	index, err := journalIndexAt(r, latest)
+	if err != nil {
+		return nil, err
+	}
+	tmpDir, err := os.MkdirTemp("", "bt-history-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPath := filepath.Join(tmpDir, "metadata.db")
+	if err := downloadMetadata(r, latest, tmpPath); err != nil {
+		return nil, err
+	}
+	if err := r.savePin(); err != nil {
+		return nil, err
+	}
+	db, err := openReadOnly(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if result.Vault, err = db.VerifyOperationChain(); err != nil {
+		return nil, err
+	}
+
+	head := index.ChainHead
+	if head == nil {
+		return result, nil
+	}
+	if h := result.Vault.Head; h == nil || h.ID != head.OperationID || h.Hash.String != head.Hash {
+		result.Problems = append(result.Problems, fmt.Sprintf(
+			"version %d of the metadata does not end at operation %d its journal index records", latest, head.OperationID))
+	}
+	op, err := a.db.FindBackupOperation(head.OperationID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case op == nil:
+		result.Problems = append(result.Problems, fmt.Sprintf("operation %d in the vault is missing locally", head.OperationID))
+	case op.Hash.String != head.Hash:
+		result.Problems = append(result.Problems, fmt.Sprintf("operation %d differs between the vault and the local database", head.OperationID))
+	}
+	return result, nil
+}
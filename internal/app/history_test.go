@@ -0,0 +1,83 @@
+package app
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bt-go/internal/config"
+	"bt-go/internal/database"
+)
+
+func TestVerifyHistory(t *testing.T) {
+	// setup runs two commands on host-1 and returns its config.
+	setup := func(t *testing.T) *config.Config {
+		t.Helper()
+		cfg := newTestConfig(t, "host-1", t.TempDir())
+		addDirectory(t, cfg, t.TempDir())
+		addDirectory(t, cfg, t.TempDir())
+		return cfg
+	}
+
+	verify := func(t *testing.T, cfg *config.Config) *HistoryVerification {
+		t.Helper()
+		a, err := NewBTApp(cfg, "VerifyHistory")
+		if err != nil {
+			t.Fatalf("NewBTApp() error = %v", err)
+		}
+		defer a.Close()
+		decryptCtx, err := a.UnlockEncryption("correct")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := a.VerifyHistory(decryptCtx)
+		if err != nil {
+			t.Fatalf("VerifyHistory() error = %v", err)
+		}
+		return result
+	}
+
+	// tamper runs query against the local database of cfg.
+	tamper := func(t *testing.T, cfg *config.Config, query string) {
+		t.Helper()
+		db, err := database.OpenConnection(filepath.Join(cfg.Database.DataDir, cfg.HostID+".db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("an untouched history verifies", func(t *testing.T) {
+		result := verify(t, setup(t))
+		if !result.OK() {
+			t.Errorf("result = %+v, want no problems", result)
+		}
+		if result.Local.Sealed != 2 || result.Vault == nil || result.Vault.Sealed != 2 || result.VaultVersion != 2 {
+			t.Errorf("result = %+v, want 2 operations sealed locally and in version 2", result)
+		}
+	})
+
+	t.Run("a changed local operation fails", func(t *testing.T) {
+		cfg := setup(t)
+		tamper(t, cfg, "UPDATE backup_operations SET parameters = '/elsewhere' WHERE id = 1")
+
+		result := verify(t, cfg)
+		if result.OK() || len(result.Local.Problems) != 1 || len(result.Vault.Problems) != 0 {
+			t.Errorf("result = %+v, want only the local chain broken", result)
+		}
+	})
+
+	t.Run("a local history apart from the vault's fails", func(t *testing.T) {
+		cfg := setup(t)
+		// Resealing an operation after changing it moves the chain head.
+		tamper(t, cfg, "UPDATE backup_operations SET status = 'failed', hash = 'resealed' WHERE id = 2")
+
+		result := verify(t, cfg)
+		if result.OK() || len(result.Problems) != 1 || !strings.Contains(result.Problems[0], "operation 2 differs") {
+			t.Errorf("Problems = %q, want operation 2 differing", result.Problems)
+		}
+	})
+}
@@ -0,0 +1,354 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/config"
+	"bt-go/internal/database"
+	"bt-go/internal/encryption"
+	"bt-go/internal/fs"
+	"bt-go/internal/vault"
+
+	"github.com/google/uuid"
+)
+
+// Version is the bt version recorded in the host descriptor. The CLI sets it
+// to its build version.
+var Version = "dev"
+
+// hostDescriptorName is the metadata item holding a host's descriptor.
+const hostDescriptorName = "host"
+
+// HostDescriptor describes a host backing up to a vault. Each mutating command
+// uploads it along with the metadata, encrypted like the metadata, so that
+// 'bt hosts list' on any host sharing the vault can show it.
+type HostDescriptor struct {
+	HostID          string    `json:"host_id"`
+	Hostname        string    `json:"hostname"`
+	OS              string    `json:"os"`
+	BTVersion       string    `json:"bt_version"`
+	Directories     []string  `json:"directories"`
+	LastBackupAt    time.Time `json:"last_backup_at"` // zero if nothing has been backed up
+	MetadataVersion int64     `json:"metadata_version"`
+}
+
+// HostInfo describes a host found in the vault by ListHosts.
+type HostInfo struct {
+	HostID string
+
+	// Updated is when the host last uploaded its descriptor, or its metadata
+	// if it has no descriptor.
+	Updated time.Time
+
+	// Descriptor is nil if the host has no descriptor, or it could not be
+	// read; Problem then says why.
+	Descriptor *HostDescriptor
+	Problem    string
+}
+
+// publishHost uploads this host's descriptor with the given version.
+func (a *BTApp) publishHost(version int64) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("getting hostname: %w", err)
+	}
+	desc := &HostDescriptor{
+		HostID:          a.cfg.HostID,
+		Hostname:        hostname,
+		OS:              runtime.GOOS + "/" + runtime.GOARCH,
+		BTVersion:       Version,
+		Directories:     []string{},
+		MetadataVersion: version,
+	}
+
+	dirs, err := a.db.ListDirectories(false)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		desc.Directories = append(desc.Directories, dir.Path)
+		stats, err := a.db.FindDirectoryStats(dir)
+		if err != nil {
+			return err
+		}
+		if stats.LastBackupAt.After(desc.LastBackupAt) {
+			desc.LastBackupAt = stats.LastBackupAt
+		}
+	}
+
+	data, err := json.Marshal(desc)
+	if err != nil {
+		return fmt.Errorf("encoding host descriptor: %w", err)
+	}
+	return a.putMetadata(hostDescriptorName, bytes.NewReader(data), version)
+}
+
+// ListHosts returns the hosts that back up to the vault, with their
+// descriptors. Descriptors are decrypted with this host's key pair, through
+// the bt agent if one is running or else by calling passphrase, which is
+// only called if a descriptor is encrypted. The descriptors of hosts with
+// key pairs of their own cannot be read, but the hosts are still listed.
+func ListHosts(cfg *config.Config, passphrase func() (string, error)) ([]*HostInfo, error) {
+	if len(cfg.Vaults) == 0 {
+		return nil, fmt.Errorf("no vaults configured")
+	}
+	v, err := vault.NewVaultFromConfig(cfg.Vaults[0])
+	if err != nil {
+		return nil, fmt.Errorf("creating vault: %w", err)
+	}
+	enc, err := encryption.NewEncryptorFromConfig(cfg.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("creating encryptor: %w", err)
+	}
+	hostIDs, err := v.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	var decryptCtx bt.DecryptionContext
+	var hosts []*HostInfo
+	for _, hostID := range hostIDs {
+		host := &HostInfo{HostID: hostID}
+		hosts = append(hosts, host)
+
+		versions, err := v.ListMetadataVersions(hostID, hostDescriptorName)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			host.Problem = "no host descriptor"
+			for _, name := range []string{"db", "journal"} {
+				versions, err := v.ListMetadataVersions(hostID, name)
+				if err != nil {
+					return nil, err
+				}
+				if len(versions) > 0 && versions[len(versions)-1].Uploaded.After(host.Updated) {
+					host.Updated = versions[len(versions)-1].Uploaded
+				}
+			}
+			continue
+		}
+		latest := versions[len(versions)-1]
+		host.Updated = latest.Uploaded
+
+		metadataVersion, err := remoteMetadataVersion(v, hostID)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRollback(cfg, hostID, metadataVersion); err != nil {
+			host.Problem = err.Error()
+			continue
+		}
+		r := &metadataReader{cfg: cfg, v: v, hostID: hostID}
+		data, err := r.download(hostDescriptorName, latest.Version)
+		if errors.Is(err, ErrUnsignedMetadata) || errors.Is(err, ErrBadSignature) || errors.Is(err, ErrUntrustedMetadata) {
+			host.Problem = err.Error()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := r.savePin(); err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(data, []byte("{")) {
+			if !enc.IsConfigured() {
+				host.Problem = "host descriptor is encrypted"
+				continue
+			}
+			if decryptCtx == nil {
+				if decryptCtx, err = unlockMetadata(cfg, enc, passphrase); err != nil {
+					return nil, err
+				}
+			}
+			var plain bytes.Buffer
+			if err := decryptCtx.Decrypt(bytes.NewReader(data), &plain); err != nil {
+				host.Problem = "host descriptor is encrypted to another key"
+				continue
+			}
+			data = plain.Bytes()
+		}
+		var desc HostDescriptor
+		if err := json.Unmarshal(data, &desc); err != nil {
+			host.Problem = fmt.Sprintf("decoding host descriptor: %v", err)
+			continue
+		}
+		host.Descriptor = &desc
+	}
+	return hosts, nil
+}
+
+// unlockMetadata returns a DecryptionContext for the metadata encrypted to
+// the key pair: through the bt agent if one is running, or else by unlocking
+// the private key with the passphrase.
+func unlockMetadata(cfg *config.Config, enc bt.Encryptor, passphrase func() (string, error)) (bt.DecryptionContext, error) {
+	if ctx := agentDecryptionContext(cfg, enc); ctx != nil {
+		return ctx, nil
+	}
+	p, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := enc.Unlock(p)
+	if err != nil {
+		return nil, fmt.Errorf("unlocking encryption: %w", err)
+	}
+	return ctx, nil
+}
+
+// OpenHost returns a BTApp over the metadata of another host sharing the
+// vault, to browse and restore its backups from this one. The host's latest
+// metadata is downloaded into a cache under the data directory, and
+// downloaded again only once the host has uploaded a newer version. The
+// database is opened read-only: the app cannot run commands that change
+// metadata, and paths given to it are the other host's, which are not
+// resolved on this filesystem.
+//
+// The host's metadata must be signed, with the key pinned for it once one
+// is, unless trustVault is set: then unsigned metadata of a host with no key
+// pinned is accepted too, as for a host last run by a bt version that did not
+// sign its metadata.
+//
+// unlock is called with the app before the metadata is downloaded, and
+// returns the DecryptionContext for the host's metadata and content, or nil
+// if they are not encrypted. It is also returned, for restoring content.
+// The caller must call Close when done.
+func OpenHost(cfg *config.Config, hostID string, trustVault bool, operation string, unlock func(*BTApp) (bt.DecryptionContext, error)) (*BTApp, bt.DecryptionContext, error) {
+	// The ID names the cache file and the host's items in the vault, so it
+	// must not be able to point outside them.
+	id, err := uuid.Parse(hostID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid host ID %q: %w", hostID, err)
+	}
+	hostID = id.String()
+	if hostID == cfg.HostID {
+		return nil, nil, fmt.Errorf("host %s is this host", hostID)
+	}
+	if cfg.Database.Type != "sqlite" {
+		return nil, nil, fmt.Errorf("cannot cache metadata in a %s database", cfg.Database.Type)
+	}
+	if len(cfg.Vaults) == 0 {
+		return nil, nil, fmt.Errorf("no vaults configured")
+	}
+	v, err := vault.NewVaultFromConfig(cfg.Vaults[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating vault: %w", err)
+	}
+	enc, err := encryption.NewEncryptorFromConfig(cfg.Encryption)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating encryptor: %w", err)
+	}
+
+	latest, err := remoteMetadataVersion(v, hostID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("checking remote metadata version: %w", err)
+	}
+	if latest == 0 {
+		return nil, nil, fmt.Errorf("the vault holds no metadata for host %s", hostID)
+	}
+	if err := checkRollback(cfg, hostID, latest); err != nil {
+		return nil, nil, err
+	}
+
+	a := &BTApp{
+		cfg:       cfg,
+		vault:     v,
+		fsmgr:     fs.NewOSFilesystemManager(cfg.Filesystem),
+		encryptor: enc,
+		op:        NewBackupOperation(operation, hostID),
+		host:      hostID,
+	}
+	decryptCtx, err := unlock(a)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cacheDir := filepath.Join(cfg.Database.DataDir, "hosts")
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("creating host cache directory: %w", err)
+	}
+	cachePath := filepath.Join(cacheDir, hostID+".db")
+	r := &metadataReader{cfg: cfg, v: v, hostID: hostID, decryptCtx: decryptCtx, trustVault: trustVault}
+	if cachedMetadataVersion(cachePath) != latest {
+		tmpPath := cachePath + ".download"
+		os.Remove(tmpPath)
+		defer os.Remove(tmpPath)
+		if err := downloadMetadata(r, latest, tmpPath); err != nil {
+			return nil, nil, fmt.Errorf("downloading metadata of host %s: %w", hostID, err)
+		}
+		if err := os.Rename(tmpPath, cachePath); err != nil {
+			return nil, nil, fmt.Errorf("caching metadata of host %s: %w", hostID, err)
+		}
+	}
+	installed, err := restoreConvergenceSecret(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := r.savePin(); err != nil {
+		return nil, nil, err
+	}
+	if installed {
+		// Content decrypted with the context needs the secret too.
+		if decryptCtx, err = withConvergenceSecret(enc, decryptCtx); err != nil {
+			return nil, nil, err
+		}
+	}
+	if a.db, err = openReadOnly(cachePath); err != nil {
+		return nil, nil, err
+	}
+
+	opID := time.Now().UTC().Format("20060102T150405Z")
+	logger, logFile, err := newLogger(cfg.LogDir, opID)
+	if err != nil {
+		a.db.Close()
+		return nil, nil, fmt.Errorf("creating logger: %w", err)
+	}
+	a.logFile = logFile
+	a.service = bt.NewBTService(a.db, nil, v, a.fsmgr, enc, &slogAdapter{l: logger}, bt.RealClock{}, bt.UUIDGenerator{})
+	return a, decryptCtx, nil
+}
+
+// cachedMetadataVersion returns the version of the host metadata cached at
+// path, the ID of its latest operation, or 0 if there is no usable cache.
+func cachedMetadataVersion(path string) int64 {
+	if _, err := os.Stat(path); err != nil {
+		return 0
+	}
+	db, err := openReadOnly(path)
+	if err != nil {
+		return 0
+	}
+	defer db.Close()
+	version, err := db.MaxBackupOperationID()
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// openReadOnly opens the cached metadata of another host at path so that
+// nothing can write to it.
+func openReadOnly(path string) (*database.SQLiteDatabase, error) {
+	conn, err := database.OpenConnection(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec("PRAGMA query_only = ON"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("opening %s read-only: %w", path, err)
+	}
+	db := database.NewSQLiteDatabaseFromDB(conn, nil, nil)
+	if err := db.CheckMigrations(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cached metadata schema out of date: %w", err)
+	}
+	return db, nil
+}
@@ -0,0 +1,303 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/encryption"
+	"bt-go/internal/vault"
+)
+
+// Host IDs for the OpenHost tests, which only accepts UUIDs like the ones
+// 'bt config init' generates.
+const (
+	host1ID = "6f1c2a3e-5b7d-4c8e-9a0f-1b2c3d4e5f60"
+	host2ID = "0a9b8c7d-6e5f-4a3b-8c2d-1e0f9a8b7c6d"
+	host3ID = "3c4d5e6f-7a8b-4c9d-8e0f-a1b2c3d4e5f6"
+)
+
+func TestListHosts(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg1 := newTestConfig(t, "host-1", vaultRoot)
+	cfg2 := newTestConfig(t, "host-2", vaultRoot)
+	dir := t.TempDir()
+	addDirectory(t, cfg1, dir)
+	addDirectory(t, cfg2, t.TempDir())
+
+	prompts := 0
+	hosts, err := ListHosts(cfg1, func() (string, error) {
+		prompts++
+		return "correct", nil
+	})
+	if err != nil {
+		t.Fatalf("ListHosts() error = %v", err)
+	}
+	if prompts != 1 {
+		t.Errorf("passphrase read %d times, want once", prompts)
+	}
+	if len(hosts) != 2 || hosts[0].HostID != "host-1" || hosts[1].HostID != "host-2" {
+		t.Fatalf("ListHosts() = %+v, want host-1 and host-2", hosts)
+	}
+
+	own := hosts[0]
+	if own.Descriptor == nil {
+		t.Fatalf("own descriptor not read: %s", own.Problem)
+	}
+	if own.Updated.IsZero() {
+		t.Error("Updated should be set")
+	}
+	d := own.Descriptor
+	if d.HostID != "host-1" || d.Hostname == "" || d.OS == "" || d.BTVersion != Version || d.MetadataVersion != 1 {
+		t.Errorf("descriptor = %+v", d)
+	}
+	if len(d.Directories) != 1 || d.Directories[0] != dir {
+		t.Errorf("descriptor directories = %v, want [%s]", d.Directories, dir)
+	}
+
+	// host-2 has a key pair of its own.
+	other := hosts[1]
+	if other.Descriptor != nil || !strings.Contains(other.Problem, "another key") || other.Updated.IsZero() {
+		t.Errorf("other host = %+v, want an unreadable descriptor", other)
+	}
+}
+
+func TestOpenHost(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg1 := newTestConfig(t, host1ID, vaultRoot)
+	cfg2 := newTestConfig(t, host2ID, vaultRoot)
+	cfg2.Encryption = cfg1.Encryption // host-2 shares host-1's key pair
+
+	// host-1 backs up an encrypted file.
+	dir := t.TempDir()
+	backup := func(content string) {
+		t.Helper()
+		os.WriteFile(filepath.Join(dir, "notes.txt"), []byte(content), 0644)
+		a, err := NewBTApp(cfg1, "BackupAll")
+		if err != nil {
+			t.Fatalf("NewBTApp() error = %v", err)
+		}
+		if err := a.AddDirectory(dir, true); err != nil {
+			t.Fatalf("AddDirectory() error = %v", err)
+		}
+		if _, err := a.StageFiles(dir, bt.StageOptions{Recursive: true}); err != nil {
+			t.Fatalf("StageFiles() error = %v", err)
+		}
+		if _, err := a.BackupAll(); err != nil {
+			t.Fatalf("BackupAll() error = %v", err)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	}
+	backup("v1")
+
+	unlocks := 0
+	openHost := func() (*BTApp, bt.DecryptionContext) {
+		t.Helper()
+		a, decryptCtx, err := OpenHost(cfg2, host1ID, false, "Restore", func(a *BTApp) (bt.DecryptionContext, error) {
+			unlocks++
+			return a.UnlockEncryption("correct")
+		})
+		if err != nil {
+			t.Fatalf("OpenHost() error = %v", err)
+		}
+		return a, decryptCtx
+	}
+
+	a, decryptCtx := openHost()
+	notes := filepath.Join(dir, "notes.txt")
+	entries, err := a.ListFiles(dir)
+	if err != nil || len(entries) != 1 || entries[0].Path != notes {
+		t.Fatalf("ListFiles() = %v, %v, want %s", entries, err, notes)
+	}
+	history, err := a.GetFileHistory(notes)
+	if err != nil || len(history) != 1 {
+		t.Fatalf("GetFileHistory() = %v, %v", history, err)
+	}
+	if _, err := a.RestoreFiles(notes, "", "", decryptCtx); err == nil {
+		t.Error("RestoreFiles() of another host's file without a target should fail")
+	}
+	target := t.TempDir()
+	paths, err := a.RestoreFiles(dir, "", target, decryptCtx)
+	if err != nil {
+		t.Fatalf("RestoreFiles() error = %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(target, "notes.txt")); err != nil || string(got) != "v1" || len(paths) != 1 {
+		t.Errorf("restored %v: %q, %v, want v1", paths, got, err)
+	}
+	if err := a.AddDirectory(t.TempDir(), false); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("AddDirectory() error = %v, want read-only", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// The cache is refreshed once host-1 uploads newer metadata.
+	cachePath := filepath.Join(cfg2.Database.DataDir, "hosts", host1ID+".db")
+	cached := cachedMetadataVersion(cachePath)
+	if cached == 0 {
+		t.Fatal("metadata of host-1 should be cached")
+	}
+	backup("v2")
+	a, _ = openHost()
+	history, err = a.GetFileHistory(notes)
+	a.Close()
+	if err != nil || len(history) != 2 {
+		t.Errorf("GetFileHistory() after a new backup = %v, %v, want 2 versions", history, err)
+	}
+	if v := cachedMetadataVersion(cachePath); v <= cached {
+		t.Errorf("cached version = %d, want newer than %d", v, cached)
+	}
+	if unlocks != 2 {
+		t.Errorf("unlocked %d times, want 2", unlocks)
+	}
+
+	if _, _, err := OpenHost(cfg2, host2ID, false, "Restore", nil); err == nil {
+		t.Error("OpenHost() of this host should fail")
+	}
+	if _, _, err := OpenHost(cfg2, host3ID, false, "Restore", nil); err == nil {
+		t.Error("OpenHost() of a host without metadata should fail")
+	}
+	for _, hostID := range []string{"../" + host1ID, "host-1", ""} {
+		if _, _, err := OpenHost(cfg2, hostID, false, "Restore", nil); err == nil || !strings.Contains(err.Error(), "invalid host ID") {
+			t.Errorf("OpenHost(%q) error = %v, want an invalid host ID", hostID, err)
+		}
+	}
+}
+
+func TestOpenHost_Unsigned(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg1 := newTestConfig(t, host1ID, vaultRoot)
+	cfg2 := newTestConfig(t, host2ID, vaultRoot)
+	cfg2.Encryption = cfg1.Encryption
+	addDirectory(t, cfg1, t.TempDir())
+
+	// host-1's metadata as a bt version that did not sign it uploaded it.
+	for _, name := range []string{"db", "journal"} {
+		path := filepath.Join(vaultRoot, "metadata", host1ID, name+".versions", "1")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data[signedHeaderLen:], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unlock := func(a *BTApp) (bt.DecryptionContext, error) {
+		return a.UnlockEncryption("correct")
+	}
+	if _, _, err := OpenHost(cfg2, host1ID, false, "ListFiles", unlock); !errors.Is(err, ErrUnsignedMetadata) {
+		t.Fatalf("OpenHost() error = %v, want ErrUnsignedMetadata", err)
+	}
+	a, _, err := OpenHost(cfg2, host1ID, true, "ListFiles", unlock)
+	if err != nil {
+		t.Fatalf("OpenHost() trusting the vault error = %v", err)
+	}
+	defer a.Close()
+	if dirs, err := a.ListDirectories(false); err != nil || len(dirs) != 1 {
+		t.Errorf("ListDirectories() = %v, %v, want 1 directory", dirs, err)
+	}
+}
+
+func TestOpenHost_ConvergenceSecret(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg1 := newTestConfig(t, host1ID, vaultRoot)
+	cfg1.Encryption.Convergent = true
+	if err := encryption.NewConvergenceSecret(encryption.ConvergenceSecretPath(cfg1.Encryption)); err != nil {
+		t.Fatal(err)
+	}
+	cfg2 := newTestConfig(t, host2ID, vaultRoot)
+	cfg2.Encryption = cfg1.Encryption
+	cfg2.Encryption.ConvergenceSecretPath = filepath.Join(t.TempDir(), "bt.secret") // not copied over
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("convergent"), 0644)
+	a, err := NewBTApp(cfg1, "BackupAll")
+	if err != nil {
+		t.Fatalf("NewBTApp() error = %v", err)
+	}
+	if err := a.AddDirectory(dir, true); err != nil {
+		t.Fatalf("AddDirectory() error = %v", err)
+	}
+	if _, err := a.StageFiles(dir, bt.StageOptions{Recursive: true}); err != nil {
+		t.Fatalf("StageFiles() error = %v", err)
+	}
+	if _, err := a.BackupAll(); err != nil {
+		t.Fatalf("BackupAll() error = %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	a, decryptCtx, err := OpenHost(cfg2, host1ID, false, "Restore", func(a *BTApp) (bt.DecryptionContext, error) {
+		return a.UnlockEncryption("correct")
+	})
+	if err != nil {
+		t.Fatalf("OpenHost() error = %v", err)
+	}
+	defer a.Close()
+	if _, err := os.Stat(cfg2.Encryption.ConvergenceSecretPath); err != nil {
+		t.Errorf("the convergence secret should be installed from the vault: %v", err)
+	}
+	target := t.TempDir()
+	if _, err := a.RestoreFiles(dir, "", target, decryptCtx); err != nil {
+		t.Fatalf("RestoreFiles() error = %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(target, "notes.txt")); err != nil || string(got) != "convergent" {
+		t.Errorf("restored notes.txt = %q, %v, want %q", got, err, "convergent")
+	}
+}
+
+func TestRotateKeys_ConvergenceSecret(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg := newTestConfig(t, host1ID, vaultRoot)
+	cfg.Encryption.Convergent = true
+	if err := encryption.NewConvergenceSecret(encryption.ConvergenceSecretPath(cfg.Encryption)); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("convergent"), 0644)
+	a, err := NewBTApp(cfg, "BackupAll")
+	if err != nil {
+		t.Fatalf("NewBTApp() error = %v", err)
+	}
+	if err := a.AddDirectory(dir, true); err != nil {
+		t.Fatalf("AddDirectory() error = %v", err)
+	}
+	if _, err := a.StageFiles(dir, bt.StageOptions{Recursive: true}); err != nil {
+		t.Fatalf("StageFiles() error = %v", err)
+	}
+	if _, err := a.BackupAll(); err != nil {
+		t.Fatalf("BackupAll() error = %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	a, err = NewBTApp(cfg, "RotateKeys")
+	if err != nil {
+		t.Fatalf("NewBTApp() error = %v", err)
+	}
+	if n, err := a.RotateKeys("correct"); err != nil || n != 0 {
+		t.Fatalf("RotateKeys() = %d, %v, want no convergent content re-encrypted", n, err)
+	}
+	rotation := a.op.ID
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Only the copy encrypted to the new key is left.
+	v, err := vault.NewVaultFromConfig(cfg.Vaults[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := v.ListMetadataVersions(host1ID, convergenceSecretName)
+	if err != nil || len(versions) != 1 || versions[0].Version != rotation {
+		t.Errorf("%s versions = %+v, %v, want only version %d", convergenceSecretName, versions, err, rotation)
+	}
+}
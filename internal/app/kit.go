@@ -0,0 +1,241 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bt-go/internal/config"
+	"bt-go/internal/encryption"
+	"bt-go/internal/kit"
+)
+
+// ExportKit writes a disaster-recovery kit for cfg to w: the configuration,
+// the key pair with the private key still protected by the passphrase, the
+// convergence secret if there is one, and the metadata signing key, generated
+// now if the host has none yet. The secrets are encrypted to the key pair; a
+// host that does not encrypt gets a kit with its configuration and signing
+// key only. Vault credentials are left out unless includeSecrets is set.
+func ExportKit(cfg *config.Config, includeSecrets bool, w io.Writer) error {
+	enc, err := encryption.NewEncryptorFromConfig(cfg.Encryption)
+	if err != nil {
+		return fmt.Errorf("creating encryptor: %w", err)
+	}
+	if enc.RotationInProgress() {
+		return fmt.Errorf("a key rotation is in progress; run 'bt keys rotate' to finish it first")
+	}
+
+	k := &kit.Kit{
+		Created:         time.Now(),
+		HostID:          cfg.HostID,
+		SecretsIncluded: includeSecrets,
+	}
+
+	exported := *cfg
+	exported.Vaults = make([]config.VaultConfig, len(cfg.Vaults))
+	for i, vc := range cfg.Vaults {
+		if !includeSecrets {
+			vc.S3AccessKeyID = ""
+			vc.S3SecretAccessKey = ""
+		}
+		exported.Vaults[i] = vc
+		k.Vaults = append(k.Vaults, fmt.Sprintf("%s (%s)", vc.Name, vc.Type))
+	}
+	var buf bytes.Buffer
+	if err := (&config.Manager{}).Write(&buf, &exported); err != nil {
+		return err
+	}
+	k.Config = buf.Bytes()
+
+	signingKeyPath := encryption.SigningKeyPath(cfg.Encryption)
+	key, err := encryption.LoadSigningKey(signingKeyPath)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		if _, err := encryption.NewSigningKey(signingKeyPath); err != nil {
+			return err
+		}
+	}
+	signingKey, err := os.ReadFile(signingKeyPath)
+	if err != nil {
+		return fmt.Errorf("reading signing key: %w", err)
+	}
+	if !enc.IsConfigured() {
+		k.SigningKey = signingKey
+		return kit.Write(w, k)
+	}
+	var encrypted bytes.Buffer
+	if err := enc.Encrypt(bytes.NewReader(signingKey), &encrypted); err != nil {
+		return fmt.Errorf("encrypting signing key: %w", err)
+	}
+	k.SigningKey = encrypted.Bytes()
+
+	if k.PublicKey, err = os.ReadFile(cfg.Encryption.PublicKeyPath); err != nil {
+		return fmt.Errorf("reading public key: %w", err)
+	}
+	if k.PrivateKey, err = os.ReadFile(cfg.Encryption.PrivateKeyPath); err != nil {
+		return fmt.Errorf("reading private key: %w", err)
+	}
+
+	secret, err := os.Open(encryption.ConvergenceSecretPath(cfg.Encryption))
+	if err == nil {
+		defer secret.Close()
+		var encrypted bytes.Buffer
+		if err := enc.Encrypt(secret, &encrypted); err != nil {
+			return fmt.Errorf("encrypting convergence secret: %w", err)
+		}
+		k.ConvergenceSecret = encrypted.Bytes()
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("opening convergence secret: %w", err)
+	}
+
+	return kit.Write(w, k)
+}
+
+// ImportKit reconstitutes the configuration and keys from a kit written by
+// ExportKit. Paths under the kit's base directory are moved under baseDir,
+// and the configuration is written to configPath, which must not exist yet.
+// The private key, if the kit has one, is unlocked with passphrase before
+// anything is written, so a kit whose passphrase is lost is refused.
+func ImportKit(r io.Reader, configPath, baseDir string, passphrase func() (string, error)) (*config.Config, error) {
+	k, err := kit.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := (&config.Manager{}).Read(bytes.NewReader(k.Config))
+	if err != nil {
+		return nil, err
+	}
+	rebaseConfig(cfg, baseDir)
+
+	if _, err := os.Stat(configPath); err == nil {
+		return nil, fmt.Errorf("config file already exists at %s", configPath)
+	}
+	secretPath := encryption.ConvergenceSecretPath(cfg.Encryption)
+	signingKeyPath := encryption.SigningKeyPath(cfg.Encryption)
+	for _, path := range []string{cfg.Encryption.PublicKeyPath, cfg.Encryption.PrivateKeyPath, secretPath, signingKeyPath} {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("%s already exists", path)
+		}
+	}
+
+	if k.PrivateKey == nil {
+		if _, err := encryption.InstallSigningKey(signingKeyPath, k.SigningKey); err != nil {
+			return nil, err
+		}
+		if err := config.Init(configPath, cfg); err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+
+	p, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlock a copy of the private key before installing anything.
+	tmpDir, err := os.MkdirTemp("", "bt-kit-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpCfg := cfg.Encryption
+	tmpCfg.PublicKeyPath = filepath.Join(tmpDir, "bt.pub")
+	tmpCfg.PrivateKeyPath = filepath.Join(tmpDir, "bt.key")
+	tmpCfg.ConvergenceSecretPath = filepath.Join(tmpDir, "bt.secret")
+	if err := writeKitFile(tmpCfg.PublicKeyPath, k.PublicKey, 0644); err != nil {
+		return nil, err
+	}
+	if err := writeKitFile(tmpCfg.PrivateKeyPath, k.PrivateKey, 0600); err != nil {
+		return nil, err
+	}
+	enc, err := encryption.NewEncryptorFromConfig(tmpCfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating encryptor: %w", err)
+	}
+	ctx, err := enc.Unlock(p)
+	if err != nil {
+		return nil, fmt.Errorf("unlocking private key from kit: %w", err)
+	}
+	var secret bytes.Buffer
+	if k.ConvergenceSecret != nil {
+		if err := ctx.Decrypt(bytes.NewReader(k.ConvergenceSecret), &secret); err != nil {
+			return nil, fmt.Errorf("decrypting convergence secret: %w", err)
+		}
+	}
+	var signingKey bytes.Buffer
+	if k.SigningKey != nil {
+		if err := ctx.Decrypt(bytes.NewReader(k.SigningKey), &signingKey); err != nil {
+			return nil, fmt.Errorf("decrypting signing key: %w", err)
+		}
+	}
+
+	if err := writeKitFile(cfg.Encryption.PublicKeyPath, k.PublicKey, 0644); err != nil {
+		return nil, err
+	}
+	if err := writeKitFile(cfg.Encryption.PrivateKeyPath, k.PrivateKey, 0600); err != nil {
+		return nil, err
+	}
+	if secret.Len() > 0 {
+		if err := writeKitFile(secretPath, secret.Bytes(), 0600); err != nil {
+			return nil, err
+		}
+	}
+	if signingKey.Len() > 0 {
+		if _, err := encryption.InstallSigningKey(signingKeyPath, signingKey.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.Init(configPath, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// rebaseConfig moves the paths in cfg that lie under its base directory under
+// baseDir instead, since the kit may come from a machine with a different
+// home directory.
+func rebaseConfig(cfg *config.Config, baseDir string) {
+	oldBase := cfg.BaseDir
+	rebase := func(path *string) {
+		if rel, err := filepath.Rel(oldBase, *path); err == nil && *path != "" && !strings.HasPrefix(rel, "..") {
+			*path = filepath.Join(baseDir, rel)
+		}
+	}
+	for _, path := range []*string{
+		&cfg.BaseDir,
+		&cfg.LogDir,
+		&cfg.Encryption.PublicKeyPath,
+		&cfg.Encryption.PrivateKeyPath,
+		&cfg.Encryption.ConvergenceSecretPath,
+		&cfg.Encryption.SigningKeyPath,
+		&cfg.Encryption.PassphraseFile,
+		&cfg.Encryption.AgentSocket,
+		&cfg.Database.DataDir,
+		&cfg.Staging.StagingDir,
+	} {
+		rebase(path)
+	}
+}
+
+// writeKitFile writes a file restored from a kit, refusing to replace one.
+func writeKitFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating directory for %s: %w", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return f.Close()
+}
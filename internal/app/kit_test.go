@@ -0,0 +1,100 @@
+package app
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bt-go/internal/config"
+	"bt-go/internal/encryption"
+)
+
+func passphrase(p string) func() (string, error) {
+	return func() (string, error) { return p, nil }
+}
+
+func TestExportImportKit(t *testing.T) {
+	oldBase := filepath.Join(t.TempDir(), "old")
+	cfg := config.NewConfig("host-1", oldBase)
+	cfg.Encryption.Convergent = true
+	cfg.Vaults = []config.VaultConfig{{
+		Type:              "s3",
+		Name:              "remote",
+		S3Bucket:          "bucket",
+		S3AccessKeyID:     "AKIA",
+		S3SecretAccessKey: "hunter2",
+	}}
+	if err := encryption.NewAgeEncryptor(cfg.Encryption).Setup("correct"); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	var kit bytes.Buffer
+	if err := ExportKit(cfg, false, &kit); err != nil {
+		t.Fatalf("ExportKit() error = %v", err)
+	}
+
+	newBase := filepath.Join(t.TempDir(), "new")
+	configPath := filepath.Join(newBase, "bt.toml")
+	if _, err := ImportKit(bytes.NewReader(kit.Bytes()), configPath, newBase, passphrase("wrong")); err == nil {
+		t.Fatal("ImportKit() with the wrong passphrase should fail")
+	}
+	if _, err := os.Stat(newBase); !os.IsNotExist(err) {
+		t.Error("ImportKit() with the wrong passphrase should write nothing")
+	}
+
+	imported, err := ImportKit(bytes.NewReader(kit.Bytes()), configPath, newBase, passphrase("correct"))
+	if err != nil {
+		t.Fatalf("ImportKit() error = %v", err)
+	}
+	if imported.HostID != "host-1" || imported.BaseDir != newBase {
+		t.Errorf("imported HostID, BaseDir = %q, %q", imported.HostID, imported.BaseDir)
+	}
+	if want := filepath.Join(newBase, "keys", "bt.key"); imported.Encryption.PrivateKeyPath != want {
+		t.Errorf("PrivateKeyPath = %q, want %q", imported.Encryption.PrivateKeyPath, want)
+	}
+	if v := imported.Vaults[0]; v.S3Bucket != "bucket" || v.S3AccessKeyID != "" || v.S3SecretAccessKey != "" {
+		t.Errorf("imported vault = %+v, want credentials left out", v)
+	}
+
+	for _, name := range []string{"bt.pub", "bt.key", "bt.secret"} {
+		want, _ := os.ReadFile(filepath.Join(oldBase, "keys", name))
+		got, err := os.ReadFile(filepath.Join(newBase, "keys", name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("imported %s differs from the original (%v)", name, err)
+		}
+	}
+	if _, err := config.ReadFromFile(configPath); err != nil {
+		t.Errorf("reading imported config: %v", err)
+	}
+
+	if _, err := ImportKit(bytes.NewReader(kit.Bytes()), configPath, newBase, passphrase("correct")); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("second ImportKit() error = %v, want already exists", err)
+	}
+}
+
+func TestExportKit_IncludeSecrets(t *testing.T) {
+	cfg := config.NewConfig("host-1", t.TempDir())
+	cfg.Vaults = []config.VaultConfig{{Type: "s3", Name: "remote", S3SecretAccessKey: "hunter2"}}
+	if err := encryption.NewAgeEncryptor(cfg.Encryption).Setup("correct"); err != nil {
+		t.Fatal(err)
+	}
+
+	var kit bytes.Buffer
+	if err := ExportKit(cfg, true, &kit); err != nil {
+		t.Fatalf("ExportKit() error = %v", err)
+	}
+	if !strings.Contains(kit.String(), "vault credentials INCLUDED") {
+		t.Error("kit should warn that credentials are included")
+	}
+
+	base := t.TempDir()
+	imported, err := ImportKit(&kit, filepath.Join(base, "bt.toml"), base, passphrase("correct"))
+	if err != nil {
+		t.Fatalf("ImportKit() error = %v", err)
+	}
+	if imported.Vaults[0].S3SecretAccessKey != "hunter2" {
+		t.Errorf("S3SecretAccessKey = %q, want it included", imported.Vaults[0].S3SecretAccessKey)
+	}
+}
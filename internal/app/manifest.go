@@ -0,0 +1,272 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/config"
+	"bt-go/internal/database"
+	"bt-go/internal/database/migrations"
+	"bt-go/internal/encryption"
+	"bt-go/internal/vault"
+
+	"github.com/google/uuid"
+)
+
+// Every operation that backs up files or stores content again, as key rotation
+// and directory encryption changes do, also uploads a manifest of them, named
+// "manifest.<operation ID>" and encrypted like the rest of the metadata. The
+// manifests are never pruned, and only replaced when key rotation encrypts
+// them to the new key; nothing but RecoverFromManifests reads them: they are
+// the last resort when the database and every copy of it in the vault are
+// lost, since the content objects alone do not say which files they hold.
+const manifestPrefix = "manifest."
+
+// manifestName returns the metadata item name of the manifest uploaded by an
+// operation.
+func manifestName(operationID int64) string {
+	return manifestPrefix + strconv.FormatInt(operationID, 10)
+}
+
+// uploadManifest uploads the files backed up and the content rewritten by
+// this command as the manifest with the given version, if there are any.
+func (a *BTApp) uploadManifest(version int64) error {
+	entries := a.service.TakeManifest()
+	if len(entries) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
+	}
+	return a.putMetadata(manifestName(version), bytes.NewReader(data), version)
+}
+
+// reencryptManifests uploads again, encrypted to the current key, each of
+// this host's manifests that is encrypted to the previous one, so that
+// RecoverFromManifests can still read them once the previous key is deleted.
+// They are uploaded with this operation's version. Manifests already
+// re-encrypted by an interrupted rotation are left as they are.
+func (a *BTApp) reencryptManifests(previous bt.DecryptionContext, passphrase string) error {
+	current, err := a.encryptor.Unlock(passphrase)
+	if err != nil {
+		return err
+	}
+	names, err := a.vault.ListMetadata(a.cfg.HostID)
+	if err != nil {
+		return err
+	}
+	r := &metadataReader{cfg: a.cfg, v: a.vault, hostID: a.cfg.HostID}
+	for _, name := range names {
+		if !strings.HasPrefix(name, manifestPrefix) {
+			continue
+		}
+		version, err := a.vault.GetMetadataVersion(a.cfg.HostID, name)
+		if err != nil {
+			return err
+		}
+		data, err := r.download(name, version)
+		if err != nil {
+			return err
+		}
+		if current.Decrypt(bytes.NewReader(data), io.Discard) == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := previous.Decrypt(bytes.NewReader(data), &buf); err != nil {
+			return fmt.Errorf("decrypting %s: %w", name, err)
+		}
+		if err := a.putMetadata(name, &buf, a.op.ID); err != nil {
+			return err
+		}
+	}
+	return r.savePin()
+}
+
+// Recovery summarizes a database rebuilt by RecoverFromManifests.
+type Recovery struct {
+	Manifests int // manifests replayed
+	Files     int // file versions recorded
+}
+
+// RecoverFromManifests replaces the local database with one rebuilt from the
+// manifests in the vault, for when the database and its checkpoints and
+// journal are all lost or corrupt. The manifests are replayed in order,
+// recording every file version they list with the content that holds it,
+// and pointing content stored again since at its new vault object, so the
+// files can be restored again with the current keys; what they do not
+// record, such as removed directories, exclusions and the operation history,
+// is lost.
+// Directories are recreated at the paths they had when each file was backed
+// up. The database it replaces, if any, is kept with a ".bak" suffix.
+// passphrase is only called if the metadata is encrypted and no bt agent is
+// running.
+//
+// The recovery is recorded as a new operation numbered after the latest
+// manifest and metadata version, and uploaded as a new checkpoint. The
+// manifests must be signed like the rest of the metadata and are trusted as
+// by RestoreMetadata, with trustVault, but the version pinned is not checked,
+// since the metadata it pins is what was lost.
+func RecoverFromManifests(cfg *config.Config, trustVault bool, passphrase func() (string, error)) (*Recovery, error) {
+	if cfg.Database.Type != "sqlite" {
+		return nil, fmt.Errorf("cannot recover a %s database", cfg.Database.Type)
+	}
+	if len(cfg.Vaults) == 0 {
+		return nil, fmt.Errorf("no vaults configured")
+	}
+	v, err := vault.NewVaultFromConfig(cfg.Vaults[0])
+	if err != nil {
+		return nil, fmt.Errorf("creating vault: %w", err)
+	}
+	enc, err := encryption.NewEncryptorFromConfig(cfg.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("creating encryptor: %w", err)
+	}
+
+	names, err := v.ListMetadata(cfg.HostID)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []int64
+	for _, name := range names {
+		if id, ok := strings.CutPrefix(name, manifestPrefix); ok {
+			if op, err := strconv.ParseInt(id, 10, 64); err == nil {
+				manifests = append(manifests, op)
+			}
+		}
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("the vault holds no manifests for host %s", cfg.HostID)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i] < manifests[j] })
+
+	latest, err := remoteMetadataVersion(v, cfg.HostID)
+	if err != nil {
+		return nil, fmt.Errorf("checking remote metadata version: %w", err)
+	}
+	latest = max(latest, manifests[len(manifests)-1])
+
+	var decryptCtx bt.DecryptionContext
+	if enc.IsConfigured() {
+		if decryptCtx, err = unlockMetadata(cfg, enc, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(cfg.Database.DataDir, 0700); err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+	dbPath := filepath.Join(cfg.Database.DataDir, cfg.HostID+".db")
+	tmpPath := dbPath + ".recover"
+	os.Remove(tmpPath)
+	defer os.Remove(tmpPath)
+
+	if trustVault {
+		if err := restoreSigningKey(cfg, v, decryptCtx); err != nil {
+			return nil, err
+		}
+	}
+	r := &metadataReader{cfg: cfg, v: v, hostID: cfg.HostID, decryptCtx: decryptCtx, trustVault: trustVault}
+	recovery, err := replayManifests(r, manifests, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := restoreConvergenceSecret(r); err != nil {
+		return nil, err
+	}
+	if err := r.savePin(); err != nil {
+		return nil, err
+	}
+	if _, err := keepSigningKey(cfg, v, decryptCtx); err != nil {
+		return nil, err
+	}
+	last := strconv.FormatInt(manifests[len(manifests)-1], 10)
+	if err := recordRebuild(cfg, v, enc, tmpPath, "RecoverFromManifests", last, latest); err != nil {
+		return nil, err
+	}
+	if err := installDatabase(tmpPath, dbPath); err != nil {
+		return nil, err
+	}
+	return recovery, nil
+}
+
+// replayManifests creates a database at path and records in it the files
+// listed by the manifests with the given versions, in order, as downloaded by
+// r.
+func replayManifests(r *metadataReader, manifests []int64, path string) (*Recovery, error) {
+	conn, err := database.OpenConnection(path)
+	if err != nil {
+		return nil, err
+	}
+	err = migrations.MigrateUp(conn)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating database: %w", err)
+	}
+
+	db, err := database.NewSQLiteDatabase(path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	recovery := &Recovery{}
+	for _, op := range manifests {
+		// Re-encrypted manifests are newer than the operation they list.
+		version, err := r.v.GetMetadataVersion(r.hostID, manifestName(op))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := r.get(manifestName(op), version, &buf); err != nil {
+			return nil, err
+		}
+		var entries []*bt.ManifestEntry
+		if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+			return nil, fmt.Errorf("decoding manifest %d: %w", op, err)
+		}
+		for _, entry := range entries {
+			if entry.Rewrite {
+				if err := db.UpdateContentEncryption(entry.ContentID, entry.EncryptedContentID); err != nil {
+					return nil, fmt.Errorf("manifest %d: content %s: %w", op, entry.ContentID, err)
+				}
+				continue
+			}
+			if err := replayManifestEntry(db, entry); err != nil {
+				return nil, fmt.Errorf("manifest %d: %s: %w", op, filepath.Join(entry.Directory, entry.Path), err)
+			}
+			recovery.Files++
+		}
+		recovery.Manifests++
+	}
+	return recovery, nil
+}
+
+// replayManifestEntry records a file version from a manifest in db, in the
+// tracked directory that holds it, which is created if there is none.
+func replayManifestEntry(db *database.SQLiteDatabase, entry *bt.ManifestEntry) error {
+	dir, err := db.SearchDirectoryForPath(entry.Directory)
+	if err != nil {
+		return err
+	}
+	if dir == nil {
+		if dir, err = db.CreateDirectory(entry.Directory, entry.Encrypted); err != nil {
+			return err
+		}
+	}
+	relativePath, err := filepath.Rel(dir.Path, filepath.Join(entry.Directory, entry.Path))
+	if err != nil {
+		return fmt.Errorf("calculating relative path: %w", err)
+	}
+	return db.CreateFileSnapshotAndContent(dir.ID, relativePath, entry.Snapshot(uuid.New().String()), entry.EncryptedContentID)
+}
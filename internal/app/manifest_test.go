@@ -0,0 +1,172 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bt-go/internal/bt"
+)
+
+func TestRecoverFromManifests(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg := newTestConfig(t, "host-1", vaultRoot)
+	metadataDir := filepath.Join(vaultRoot, "metadata", "host-1")
+
+	if _, err := RecoverFromManifests(cfg, false, passphrase("correct")); err == nil {
+		t.Fatal("RecoverFromManifests() without manifests should fail")
+	}
+
+	dir := t.TempDir()
+	backup := func(files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+			os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		}
+		a, err := NewBTApp(cfg, "BackupAll")
+		if err != nil {
+			t.Fatalf("NewBTApp() error = %v", err)
+		}
+		if err := a.AddDirectory(dir, true); err != nil {
+			t.Fatalf("AddDirectory() error = %v", err)
+		}
+		if _, err := a.StageFiles(dir, bt.StageOptions{Recursive: true}); err != nil {
+			t.Fatalf("StageFiles() error = %v", err)
+		}
+		if _, err := a.BackupAll(); err != nil {
+			t.Fatalf("BackupAll() error = %v", err)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	}
+	backup(map[string]string{"a.txt": "a1", "sub/b.txt": "b1"})
+	backup(map[string]string{"a.txt": "a2 changed"})
+	for _, name := range []string{"manifest.1.versions/1", "manifest.2.versions/2"} {
+		if _, err := os.Stat(filepath.Join(metadataDir, name)); err != nil {
+			t.Errorf("expected manifest %s: %v", name, err)
+		}
+	}
+
+	// Lose the database and every copy of it in the vault.
+	entries, _ := os.ReadDir(metadataDir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "db") || strings.HasPrefix(e.Name(), "journal") {
+			os.RemoveAll(filepath.Join(metadataDir, e.Name()))
+		}
+	}
+	os.Remove(filepath.Join(cfg.Database.DataDir, "host-1.db"))
+
+	recovery, err := RecoverFromManifests(cfg, false, passphrase("correct"))
+	if err != nil {
+		t.Fatalf("RecoverFromManifests() error = %v", err)
+	}
+	if recovery.Manifests != 2 || recovery.Files != 3 {
+		t.Errorf("RecoverFromManifests() = %+v, want 3 files from 2 manifests", recovery)
+	}
+	if version, _ := os.ReadFile(filepath.Join(metadataDir, "db.version")); string(version) != "3" {
+		t.Errorf("recovered database uploaded as version %q, want 3", version)
+	}
+
+	a, err := NewBTApp(cfg, "Restore")
+	if err != nil {
+		t.Fatalf("NewBTApp() after recovery error = %v", err)
+	}
+	defer a.Close()
+	history, err := a.GetFileHistory(filepath.Join(dir, "a.txt"))
+	if err != nil || len(history) != 2 {
+		t.Fatalf("GetFileHistory() = %v, %v, want 2 versions", history, err)
+	}
+	decryptCtx, err := a.UnlockEncryption("correct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	if _, err := a.RestoreFiles(dir, "", target, decryptCtx); err != nil {
+		t.Fatalf("RestoreFiles() error = %v", err)
+	}
+	for name, want := range map[string]string{"a.txt": "a2 changed", "sub/b.txt": "b1"} {
+		if got, err := os.ReadFile(filepath.Join(target, name)); err != nil || string(got) != want {
+			t.Errorf("restored %s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	ops, _ := a.GetHistory(10)
+	if len(ops) != 1 || ops[0].Operation != "RecoverFromManifests" || ops[0].ID != 3 {
+		t.Errorf("history after recovery = %+v", ops)
+	}
+}
+
+func TestRecoverFromManifestsAfterRotation(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg := newTestConfig(t, "host-1", vaultRoot)
+	metadataDir := filepath.Join(vaultRoot, "metadata", "host-1")
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("secret"), 0644)
+	a, err := NewBTApp(cfg, "BackupAll")
+	if err != nil {
+		t.Fatalf("NewBTApp() error = %v", err)
+	}
+	if err := a.AddDirectory(dir, true); err != nil {
+		t.Fatalf("AddDirectory() error = %v", err)
+	}
+	if _, err := a.StageFiles(dir, bt.StageOptions{Recursive: true}); err != nil {
+		t.Fatalf("StageFiles() error = %v", err)
+	}
+	if _, err := a.BackupAll(); err != nil {
+		t.Fatalf("BackupAll() error = %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Rotation deletes the key the first manifest's content is encrypted to.
+	a, err = NewBTApp(cfg, "RotateKeys")
+	if err != nil {
+		t.Fatalf("NewBTApp() error = %v", err)
+	}
+	if n, err := a.RotateKeys("correct"); err != nil || n != 1 {
+		t.Fatalf("RotateKeys() = %d, %v, want 1 content re-encrypted", n, err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, "manifest.2.versions/2")); err != nil {
+		t.Errorf("expected a manifest of the rotation: %v", err)
+	}
+
+	entries, _ := os.ReadDir(metadataDir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "db") || strings.HasPrefix(e.Name(), "journal") {
+			os.RemoveAll(filepath.Join(metadataDir, e.Name()))
+		}
+	}
+	os.Remove(filepath.Join(cfg.Database.DataDir, "host-1.db"))
+
+	recovery, err := RecoverFromManifests(cfg, false, passphrase("correct"))
+	if err != nil {
+		t.Fatalf("RecoverFromManifests() error = %v", err)
+	}
+	if recovery.Manifests != 2 || recovery.Files != 1 {
+		t.Errorf("RecoverFromManifests() = %+v, want 1 file from 2 manifests", recovery)
+	}
+
+	a, err = NewBTApp(cfg, "Restore")
+	if err != nil {
+		t.Fatalf("NewBTApp() after recovery error = %v", err)
+	}
+	defer a.Close()
+	decryptCtx, err := a.UnlockEncryption("correct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	if _, err := a.RestoreFiles(dir, "", target, decryptCtx); err != nil {
+		t.Fatalf("RestoreFiles() error = %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(target, "a.txt")); err != nil || string(got) != "secret" {
+		t.Errorf("restored a.txt = %q, %v, want %q", got, err, "secret")
+	}
+}
@@ -0,0 +1,572 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/config"
+	"bt-go/internal/database"
+	"bt-go/internal/database/sqlc"
+	"bt-go/internal/encryption"
+	"bt-go/internal/vault"
+)
+
+// The metadata database is synced to the vault incrementally. Each mutating
+// command uploads the row changes it made as a journal segment, named
+// "journal.<operation ID>", and the whole database is uploaded as the "db"
+// checkpoint only every so often. The "journal" item indexes the segments
+// uploaded since the checkpoint, so a restore downloads the checkpoint and
+// replays them in order. Segments older than every kept checkpoint are
+// pruned once a new checkpoint is uploaded.
+const (
+	// checkpointSegments is how many segments may follow a checkpoint before
+	// the next command uploads a new one.
+	checkpointSegments = 32
+
+	// checkpointSegmentBytes caps the combined size of the segments that
+	// follow a checkpoint, so a restore never replays much more than it
+	// downloads.
+	checkpointSegmentBytes = 16 << 20
+)
+
+// journalIndex is the content of the "journal" metadata item.
+type journalIndex struct {
+	// Checkpoint is the version of the "db" checkpoint the segments follow.
+	Checkpoint int64 `json:"checkpoint"`
+
+	// Segments lists the segments uploaded since the checkpoint, in order.
+	Segments []*sqlc.MetadataSegment `json:"segments"`
+
+	// ChainHead is the last sealed operation of the metadata as uploaded, so
+	// that a copy altered in the vault can be told apart; nil if there is
+	// none or the index predates the operation chain.
+	ChainHead *chainHead `json:"chain_head,omitempty"`
+}
+
+// chainHead identifies the last sealed operation of the operation chain.
+type chainHead struct {
+	OperationID int64  `json:"operation_id"`
+	Hash        string `json:"hash"`
+}
+
+// segmentName returns the metadata item name of the journal segment
+// uploaded by an operation.
+func segmentName(operationID int64) string {
+	return "journal." + strconv.FormatInt(operationID, 10)
+}
+
+// remoteMetadataVersion returns the version of the newest metadata the vault
+// holds for a host: the last journal segment, or the checkpoint if none
+// follows it.
+func remoteMetadataVersion(v bt.Vault, hostID string) (int64, error) {
+	checkpoint, err := v.GetMetadataVersion(hostID, "db")
+	if err != nil {
+		return 0, err
+	}
+	journal, err := v.GetMetadataVersion(hostID, "journal")
+	if err != nil {
+		return 0, err
+	}
+	return max(checkpoint, journal), nil
+}
+
+// syncMetadata uploads the row changes made since the last sync as a journal
+// segment with the given version, or the whole database as a checkpoint if
+// there is none yet, the app asks for one, or the segments since the last
+// one have grown too many or too large. Changes whose upload fails stay in the journal and go with
+// the next sync.
+func (a *BTApp) syncMetadata(version int64) error {
+	entries, err := a.db.FindJournalEntries()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	throughSeq := entries[len(entries)-1].Seq
+
+	checkpoint, err := a.vault.GetMetadataVersion(a.cfg.HostID, "db")
+	if err != nil {
+		return fmt.Errorf("checking remote metadata version: %w", err)
+	}
+	segments, err := a.db.FindJournalSegments()
+	if err != nil {
+		return err
+	}
+	if checkpoint == 0 || a.checkpoint || len(segments) >= checkpointSegments {
+		return a.uploadCheckpoint(version, throughSeq)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("encoding journal segment: %w", err)
+	}
+	size := int64(len(data))
+	for _, s := range segments {
+		size += s.Size
+	}
+	if size > checkpointSegmentBytes {
+		return a.uploadCheckpoint(version, throughSeq)
+	}
+
+	segment := &sqlc.MetadataSegment{OperationID: version, Entries: int64(len(entries)), Size: int64(len(data))}
+	if err := a.putMetadata(segmentName(version), bytes.NewReader(data), version); err != nil {
+		return err
+	}
+	if err := a.putJournalIndex(&journalIndex{Checkpoint: checkpoint, Segments: append(segments, segment)}, version); err != nil {
+		return err
+	}
+	return a.db.RecordJournalSegment(segment, throughSeq)
+}
+
+// uploadCheckpoint uploads a copy of the whole database as the "db"
+// checkpoint with the given version, with the journal entries up to
+// throughSeq dropped since the checkpoint includes them, and starts a new
+// empty journal index after it.
+func (a *BTApp) uploadCheckpoint(version int64, throughSeq int64) error {
+	tmpFile, err := os.CreateTemp("", "bt-db-backup-*.db")
+	if err != nil {
+		return fmt.Errorf("creating temp file for db backup: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+
+	if err := a.db.BackupTo(tmpPath); err != nil {
+		return err
+	}
+	snapshot, err := database.NewSQLiteDatabase(tmpPath, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := snapshot.RecordCheckpoint(throughSeq); err != nil {
+		snapshot.Close()
+		return err
+	}
+	if err := snapshot.Close(); err != nil {
+		return fmt.Errorf("closing db backup: %w", err)
+	}
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return fmt.Errorf("opening db backup for upload: %w", err)
+	}
+	defer f.Close()
+	if err := a.putMetadata("db", f, version); err != nil {
+		return err
+	}
+	if err := a.putJournalIndex(&journalIndex{Checkpoint: version}, version); err != nil {
+		return err
+	}
+	if err := a.db.RecordCheckpoint(throughSeq); err != nil {
+		return err
+	}
+	return a.pruneSegments()
+}
+
+// pruneSegments deletes the journal segments uploaded before the oldest
+// checkpoint the vault keeps. Every version they belong to follows a
+// checkpoint that is gone, so no restore can replay them.
+func (a *BTApp) pruneSegments() error {
+	checkpoints, err := a.vault.ListMetadataVersions(a.cfg.HostID, "db")
+	if err != nil {
+		return fmt.Errorf("listing checkpoint versions: %w", err)
+	}
+	if len(checkpoints) == 0 {
+		return nil
+	}
+	oldest := checkpoints[0].Version
+
+	names, err := a.vault.ListMetadata(a.cfg.HostID)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		id, ok := strings.CutPrefix(name, "journal.")
+		if !ok {
+			continue
+		}
+		operationID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || operationID >= oldest {
+			continue
+		}
+		if err := a.vault.DeleteMetadata(a.cfg.HostID, name); err != nil {
+			return fmt.Errorf("pruning journal segment %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// putJournalIndex uploads the journal index with the given version, with
+// the head of the database's operation chain.
+func (a *BTApp) putJournalIndex(index *journalIndex, version int64) error {
+	head, err := a.db.FindOperationChainHead()
+	if err != nil {
+		return err
+	}
+	if head != nil {
+		index.ChainHead = &chainHead{OperationID: head.ID, Hash: head.Hash.String}
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("encoding journal index: %w", err)
+	}
+	return a.putMetadata("journal", bytes.NewReader(data), version)
+}
+
+// putMetadata encrypts r if encryption is configured, signs it and uploads it
+// to the vault as the named metadata item. Uploading the "db" or "journal"
+// item pins its version.
+func (a *BTApp) putMetadata(name string, r io.Reader, version int64) error {
+	if err := a.putMetadataTo(a.vault, name, r, version); err != nil {
+		return err
+	}
+	if name == "db" || name == "journal" {
+		return pinVersion(a.cfg, a.cfg.HostID, version)
+	}
+	return nil
+}
+
+// putMetadataTo uploads r to v as putMetadata does, without pinning it.
+func (a *BTApp) putMetadataTo(v bt.Vault, name string, r io.Reader, version int64) error {
+	key, err := a.signingKey(version)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp("", "bt-meta-enc-*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temp file for %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(tmp, h)
+	if a.encryptor.IsConfigured() {
+		if err := a.encryptor.Encrypt(r, w); err != nil {
+			return fmt.Errorf("encrypting %s: %w", name, err)
+		}
+	} else if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	header := signedHeader(key, a.cfg.HostID, name, version, h.Sum(nil))
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s temp file: %w", name, err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking %s temp file: %w", name, err)
+	}
+	signed := io.MultiReader(bytes.NewReader(header), tmp)
+	if err := v.PutMetadata(a.cfg.HostID, name, signed, int64(len(header))+info.Size(), version); err != nil {
+		return fmt.Errorf("uploading %s to vault: %w", name, err)
+	}
+	return nil
+}
+
+// MetadataVersion describes a version of a host's metadata kept in the
+// vault, as listed by 'bt metadata list'.
+type MetadataVersion struct {
+	// Version is the ID of the operation that uploaded it.
+	Version int64
+
+	// Uploaded is when it was uploaded.
+	Uploaded time.Time
+
+	// Size is the size of the upload: the whole database for a checkpoint,
+	// or the journal segment otherwise.
+	Size int64
+
+	// Checkpoint reports whether the version uploaded the whole database.
+	Checkpoint bool
+}
+
+// ListMetadataVersions returns the versions of the host's metadata that the
+// vault keeps, newest first. Each can be restored with RestoreMetadata as
+// long as the checkpoint it follows is kept too.
+func ListMetadataVersions(cfg *config.Config) ([]MetadataVersion, error) {
+	if len(cfg.Vaults) == 0 {
+		return nil, fmt.Errorf("no vaults configured")
+	}
+	v, err := vault.NewVaultFromConfig(cfg.Vaults[0])
+	if err != nil {
+		return nil, fmt.Errorf("creating vault: %w", err)
+	}
+	checkpoints, err := v.ListMetadataVersions(cfg.HostID, "db")
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := v.ListMetadataVersions(cfg.HostID, "journal")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*MetadataVersion)
+	for _, c := range checkpoints {
+		byVersion[c.Version] = &MetadataVersion{Version: c.Version, Uploaded: c.Uploaded, Size: c.Size, Checkpoint: true}
+	}
+	for _, idx := range indexes {
+		if _, ok := byVersion[idx.Version]; ok {
+			continue
+		}
+		mv := &MetadataVersion{Version: idx.Version, Uploaded: idx.Uploaded, Size: idx.Size}
+		segments, err := v.ListMetadataVersions(cfg.HostID, segmentName(idx.Version))
+		if err != nil {
+			return nil, err
+		}
+		if len(segments) > 0 {
+			mv.Size = segments[len(segments)-1].Size
+		}
+		byVersion[idx.Version] = mv
+	}
+
+	versions := make([]MetadataVersion, 0, len(byVersion))
+	for _, mv := range byVersion {
+		versions = append(versions, *mv)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+// RestoreMetadata replaces the local database with one rebuilt from the
+// vault: the checkpoint a version follows, with the journal segments
+// uploaded up to that version replayed on top. version 0 restores the
+// latest. The database it replaces, if any, is kept with a ".bak" suffix.
+// passphrase is only called if the metadata is encrypted and no bt agent is
+// running. Returns the version restored.
+//
+// The metadata must be signed with the key pinned for this host or, on a new
+// machine, with the local signing key installed from the recovery kit, unless
+// trustVault is set: then the signing key kept in the vault is installed
+// first, if the metadata is encrypted, and otherwise whatever key signed the
+// metadata is accepted. The signing key is restored too if it is missing; if
+// it cannot be, the host starts a new one.
+//
+// Restoring an older version rolls the metadata back: the restore is recorded
+// as a new operation numbered after the latest version and uploaded as a new
+// checkpoint, so the vault's latest metadata matches the local database
+// again. The versions rolled back stay kept until they expire. The same is
+// done when the host starts a new signing key.
+func RestoreMetadata(cfg *config.Config, version int64, trustVault bool, passphrase func() (string, error)) (int64, error) {
+	if cfg.Database.Type != "sqlite" {
+		return 0, fmt.Errorf("cannot restore a %s database", cfg.Database.Type)
+	}
+	if len(cfg.Vaults) == 0 {
+		return 0, fmt.Errorf("no vaults configured")
+	}
+	v, err := vault.NewVaultFromConfig(cfg.Vaults[0])
+	if err != nil {
+		return 0, fmt.Errorf("creating vault: %w", err)
+	}
+	enc, err := encryption.NewEncryptorFromConfig(cfg.Encryption)
+	if err != nil {
+		return 0, fmt.Errorf("creating encryptor: %w", err)
+	}
+
+	latest, err := remoteMetadataVersion(v, cfg.HostID)
+	if err != nil {
+		return 0, fmt.Errorf("checking remote metadata version: %w", err)
+	}
+	if latest == 0 {
+		return 0, fmt.Errorf("the vault holds no metadata for host %s", cfg.HostID)
+	}
+	if err := checkRollback(cfg, cfg.HostID, latest); err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		version = latest
+	} else if version > latest {
+		return 0, fmt.Errorf("version %d is newer than the latest, %d", version, latest)
+	}
+
+	var decryptCtx bt.DecryptionContext
+	if enc.IsConfigured() {
+		if decryptCtx, err = unlockMetadata(cfg, enc, passphrase); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := os.MkdirAll(cfg.Database.DataDir, 0700); err != nil {
+		return 0, fmt.Errorf("creating data directory: %w", err)
+	}
+	dbPath := filepath.Join(cfg.Database.DataDir, cfg.HostID+".db")
+	tmpPath := dbPath + ".restore"
+	defer os.Remove(tmpPath)
+
+	if trustVault {
+		if err := restoreSigningKey(cfg, v, decryptCtx); err != nil {
+			return 0, err
+		}
+	}
+	r := &metadataReader{cfg: cfg, v: v, hostID: cfg.HostID, decryptCtx: decryptCtx, trustVault: trustVault}
+	if err := downloadMetadata(r, version, tmpPath); err != nil {
+		return 0, err
+	}
+	if _, err := restoreConvergenceSecret(r); err != nil {
+		return 0, err
+	}
+	if err := r.savePin(); err != nil {
+		return 0, err
+	}
+	newKey, err := keepSigningKey(cfg, v, decryptCtx)
+	if err != nil {
+		return 0, err
+	}
+	if version < latest || newKey {
+		if err := recordRebuild(cfg, v, enc, tmpPath, "RestoreMetadata", strconv.FormatInt(version, 10), latest); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := installDatabase(tmpPath, dbPath); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// installDatabase replaces the database at dbPath with the one rebuilt at
+// tmpPath, keeping the one it replaces, if any, with a ".bak" suffix.
+func installDatabase(tmpPath string, dbPath string) error {
+	if _, err := os.Stat(dbPath); err == nil {
+		if err := os.Rename(dbPath, dbPath+".bak"); err != nil {
+			return fmt.Errorf("keeping the current database: %w", err)
+		}
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return fmt.Errorf("installing restored database: %w", err)
+	}
+	return nil
+}
+
+// recordRebuild records the operation that rebuilt the database at path,
+// numbered after latest, and uploads the database as a checkpoint with that
+// operation's ID as its version, so the vault's latest metadata matches it.
+func recordRebuild(cfg *config.Config, v bt.Vault, enc bt.Encryptor, path string, operation string, parameters string, latest int64) error {
+	db, err := database.NewSQLiteDatabase(path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.SkipBackupOperationIDs(latest); err != nil {
+		return err
+	}
+	op, err := db.CreateBackupOperation(operation, parameters)
+	if err != nil {
+		return err
+	}
+	if err := db.FinishBackupOperation(op.ID, "success"); err != nil {
+		return err
+	}
+	entries, err := db.FindJournalEntries()
+	if err != nil {
+		return err
+	}
+
+	a := &BTApp{cfg: cfg, db: db, vault: v, encryptor: enc}
+	if err := a.uploadCheckpoint(op.ID, entries[len(entries)-1].Seq); err != nil {
+		return fmt.Errorf("uploading rebuilt metadata: %w", err)
+	}
+	if enc.IsConfigured() {
+		return a.uploadKeyMetadata(op.ID)
+	}
+	return nil
+}
+
+// downloadMetadata rebuilds a version of a host's database from the vault at
+// destPath, which must not exist, with the items r downloads. A checkpoint
+// uploaded before a schema migration is migrated before the segments are
+// replayed: journal rows name their columns, so segments from either side of
+// the migration replay onto the current schema.
+func downloadMetadata(r *metadataReader, version int64, destPath string) error {
+	index, err := journalIndexAt(r, version)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", destPath, err)
+	}
+	err = r.get("db", index.Checkpoint, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("checkpoint %d of version %d: %w", index.Checkpoint, version, err)
+	}
+
+	db, err := database.NewSQLiteDatabase(destPath, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Migrate(); err != nil {
+		return fmt.Errorf("migrating checkpoint %d: %w", index.Checkpoint, err)
+	}
+
+	for _, segment := range index.Segments {
+		var buf bytes.Buffer
+		if err := r.get(segmentName(segment.OperationID), segment.OperationID, &buf); err != nil {
+			return err
+		}
+		var entries []*sqlc.MetadataJournal
+		if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+			return fmt.Errorf("decoding journal segment %d: %w", segment.OperationID, err)
+		}
+		if err := db.ApplyJournal(entries); err != nil {
+			return fmt.Errorf("replaying journal segment %d: %w", segment.OperationID, err)
+		}
+		if err := db.RecordJournalSegment(segment, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalIndexAt returns the journal index uploaded with a version of a
+// host's metadata. A version that uploaded a checkpoint but no index, because
+// the index upload failed or the vault predates the journal, has an empty
+// index following that checkpoint.
+func journalIndexAt(r *metadataReader, version int64) (*journalIndex, error) {
+	indexes, err := r.v.ListMetadataVersions(r.hostID, "journal")
+	if err != nil {
+		return nil, fmt.Errorf("listing journal versions: %w", err)
+	}
+	for _, idx := range indexes {
+		if idx.Version != version {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := r.get("journal", version, &buf); err != nil {
+			return nil, err
+		}
+		var index journalIndex
+		if err := json.Unmarshal(buf.Bytes(), &index); err != nil {
+			return nil, fmt.Errorf("decoding journal index: %w", err)
+		}
+		return &index, nil
+	}
+
+	checkpoints, err := r.v.ListMetadataVersions(r.hostID, "db")
+	if err != nil {
+		return nil, fmt.Errorf("listing checkpoint versions: %w", err)
+	}
+	for _, c := range checkpoints {
+		if c.Version == version {
+			return &journalIndex{Checkpoint: version}, nil
+		}
+	}
+	return nil, fmt.Errorf("version %d of the metadata is not kept in the vault", version)
+}
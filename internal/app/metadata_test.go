@@ -0,0 +1,383 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"bt-go/internal/config"
+	"bt-go/internal/database"
+	"bt-go/internal/database/migrations"
+	"bt-go/internal/database/sqlc"
+	"bt-go/internal/encryption"
+)
+
+// TestMain lowers the scrypt work factor, since every newTestConfig sets up
+// a key pair.
+func TestMain(m *testing.M) {
+	encryption.ScryptWorkFactor = 10
+	os.Exit(m.Run())
+}
+
+// newTestConfig returns a config for a host backing up to a filesystem vault
+// under a temp directory, with its database migrated and encryption set up
+// with the passphrase "correct".
+func newTestConfig(t *testing.T, hostID string, vaultRoot string) *config.Config {
+	t.Helper()
+	base := t.TempDir()
+	cfg := config.NewConfig(hostID, base)
+	cfg.Database.DataDir = filepath.Join(base, "db")
+	cfg.Staging.StagingDir = filepath.Join(base, "staging")
+	cfg.Vaults = []config.VaultConfig{{Type: "filesystem", Name: "local", FSVaultRoot: vaultRoot}}
+	if err := encryption.NewAgeEncryptor(cfg.Encryption).Setup("correct"); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	if err := os.MkdirAll(cfg.Database.DataDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.OpenConnection(filepath.Join(cfg.Database.DataDir, hostID+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrations.MigrateUp(db); err != nil {
+		t.Fatalf("MigrateUp() error = %v", err)
+	}
+	return cfg
+}
+
+// addDirectory tracks path in a command of its own, like 'bt dir init'.
+func addDirectory(t *testing.T, cfg *config.Config, path string) {
+	t.Helper()
+	a, err := NewBTApp(cfg, "AddDirectory")
+	if err != nil {
+		t.Fatalf("NewBTApp() error = %v", err)
+	}
+	if err := a.AddDirectory(path, false); err != nil {
+		t.Fatalf("AddDirectory() error = %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
+
+func TestSyncAndRestoreMetadata(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg := newTestConfig(t, "host-1", vaultRoot)
+	metadataDir := filepath.Join(vaultRoot, "metadata", "host-1")
+
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	addDirectory(t, cfg, dirs[0])
+	if _, err := os.Stat(filepath.Join(metadataDir, "db.versions", "1")); err != nil {
+		t.Fatalf("first command should upload a checkpoint: %v", err)
+	}
+
+	addDirectory(t, cfg, dirs[1])
+	addDirectory(t, cfg, dirs[2])
+	for _, name := range []string{"journal.2.versions/2", "journal.3.versions/3"} {
+		if _, err := os.Stat(filepath.Join(metadataDir, name)); err != nil {
+			t.Errorf("expected journal segment %s: %v", name, err)
+		}
+	}
+	if version, _ := os.ReadFile(filepath.Join(metadataDir, "db.version")); string(version) != "1" {
+		t.Error("later commands should not upload the whole database")
+	}
+
+	if _, err := RestoreMetadata(cfg, 0, false, passphrase("wrong")); err == nil {
+		t.Fatal("RestoreMetadata() with the wrong passphrase should fail")
+	}
+	version, err := RestoreMetadata(cfg, 0, false, passphrase("correct"))
+	if err != nil {
+		t.Fatalf("RestoreMetadata() error = %v", err)
+	}
+	if version != 3 {
+		t.Errorf("RestoreMetadata() version = %d, want 3", version)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Database.DataDir, "host-1.db.bak")); err != nil {
+		t.Errorf("the replaced database should be kept: %v", err)
+	}
+
+	a, err := NewBTApp(cfg, "ListDirectories")
+	if err != nil {
+		t.Fatalf("NewBTApp() after restore error = %v", err)
+	}
+	defer a.Close()
+	got, err := a.ListDirectories(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(dirs) {
+		t.Fatalf("restored %d directories, want %d", len(got), len(dirs))
+	}
+	ops, _ := a.GetHistory(10)
+	if len(ops) != 3 || ops[0].Status != "success" {
+		t.Errorf("restored history = %+v", ops)
+	}
+}
+
+func TestRestoreMetadataAfterRotation(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg := newTestConfig(t, "host-1", vaultRoot)
+	addDirectory(t, cfg, t.TempDir())
+	addDirectory(t, cfg, t.TempDir())
+
+	// The checkpoint and segment are encrypted to the key rotated away.
+	a, err := NewBTApp(cfg, "RotateKeys")
+	if err != nil {
+		t.Fatalf("NewBTApp() error = %v", err)
+	}
+	if _, err := a.RotateKeys("correct"); err != nil {
+		t.Fatalf("RotateKeys() error = %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if version, _ := os.ReadFile(filepath.Join(vaultRoot, "metadata", "host-1", "db.version")); string(version) != "3" {
+		t.Errorf("checkpoint version after rotation = %q, want 3", version)
+	}
+
+	if _, err := RestoreMetadata(cfg, 0, false, passphrase("correct")); err != nil {
+		t.Fatalf("RestoreMetadata() error = %v", err)
+	}
+	a, err = NewBTApp(cfg, "ListDirectories")
+	if err != nil {
+		t.Fatalf("NewBTApp() after restore error = %v", err)
+	}
+	defer a.Close()
+	if got, _ := a.ListDirectories(false); len(got) != 2 {
+		t.Errorf("restored %d directories, want 2", len(got))
+	}
+}
+
+func TestListAndRollBackMetadata(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg := newTestConfig(t, "host-1", vaultRoot)
+	for range 3 {
+		addDirectory(t, cfg, t.TempDir())
+	}
+
+	versions, err := ListMetadataVersions(cfg)
+	if err != nil {
+		t.Fatalf("ListMetadataVersions() error = %v", err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("ListMetadataVersions() = %+v, want 3 versions", versions)
+	}
+	for i, want := range []int64{3, 2, 1} {
+		if versions[i].Version != want || versions[i].Checkpoint != (want == 1) || versions[i].Size == 0 {
+			t.Errorf("versions[%d] = %+v, want version %d", i, versions[i], want)
+		}
+	}
+
+	if _, err := RestoreMetadata(cfg, 4, false, passphrase("correct")); err == nil {
+		t.Error("RestoreMetadata() of a version newer than the latest should fail")
+	}
+	version, err := RestoreMetadata(cfg, 2, false, passphrase("correct"))
+	if err != nil {
+		t.Fatalf("RestoreMetadata() error = %v", err)
+	}
+	if version != 2 {
+		t.Errorf("RestoreMetadata() version = %d, want 2", version)
+	}
+
+	a, err := NewBTApp(cfg, "ListDirectories")
+	if err != nil {
+		t.Fatalf("NewBTApp() after rollback error = %v", err)
+	}
+	got, err := a.ListDirectories(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("rolled back to %d directories, want 2", len(got))
+	}
+	ops, _ := a.GetHistory(1)
+	if len(ops) != 1 || ops[0].ID != 4 || ops[0].Operation != "RestoreMetadata" {
+		t.Errorf("rollback operation = %+v, want #4 RestoreMetadata", ops)
+	}
+	a.Close()
+
+	// Later commands carry on from the rollback, and the vault's latest
+	// metadata matches it.
+	addDirectory(t, cfg, t.TempDir())
+	if _, err := RestoreMetadata(cfg, 0, false, passphrase("correct")); err != nil {
+		t.Fatalf("RestoreMetadata() latest error = %v", err)
+	}
+	a, err = NewBTApp(cfg, "ListDirectories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if got, _ := a.ListDirectories(false); len(got) != 3 {
+		t.Errorf("restored %d directories after rollback, want 3", len(got))
+	}
+}
+
+func TestPruneJournalSegments(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg := newTestConfig(t, "host-1", vaultRoot)
+	cfg.Vaults[0].MetadataVersions = 2
+	metadataDir := filepath.Join(vaultRoot, "metadata", "host-1")
+	segmentKept := func(operationID int) bool {
+		t.Helper()
+		_, err := os.Stat(filepath.Join(metadataDir, fmt.Sprintf("journal.%d.version", operationID)))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+	for range 3 {
+		addDirectory(t, cfg, t.TempDir())
+	}
+
+	// Rolling back uploads checkpoint 4; checkpoint 1, which segments 2 and 3
+	// follow, is still kept.
+	if _, err := RestoreMetadata(cfg, 2, false, passphrase("correct")); err != nil {
+		t.Fatalf("RestoreMetadata() error = %v", err)
+	}
+	if !segmentKept(2) || !segmentKept(3) {
+		t.Error("segments following a kept checkpoint should stay")
+	}
+
+	// Checkpoint 6 replaces checkpoint 1.
+	addDirectory(t, cfg, t.TempDir())
+	if _, err := RestoreMetadata(cfg, 4, false, passphrase("correct")); err != nil {
+		t.Fatalf("RestoreMetadata() error = %v", err)
+	}
+	if segmentKept(2) || segmentKept(3) {
+		t.Error("segments following no kept checkpoint should be pruned")
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, "journal.2.versions")); !os.IsNotExist(err) {
+		t.Errorf("kept versions of a pruned segment should be removed: %v", err)
+	}
+	if !segmentKept(5) {
+		t.Error("segment 5 follows checkpoint 4 and should stay")
+	}
+
+	if _, err := RestoreMetadata(cfg, 5, false, passphrase("correct")); err != nil {
+		t.Fatalf("RestoreMetadata() of version 5 error = %v", err)
+	}
+	a, err := NewBTApp(cfg, "ListDirectories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if got, _ := a.ListDirectories(false); len(got) != 3 {
+		t.Errorf("restored %d directories, want 3", len(got))
+	}
+}
+
+func TestRestoreMetadataAfterUpgrade(t *testing.T) {
+	vaultRoot := t.TempDir()
+	cfg := newTestConfig(t, "host-1", vaultRoot)
+	for range 3 {
+		addDirectory(t, cfg, t.TempDir())
+	}
+
+	// Make the checkpoint and the first segment look as if a version of bt
+	// without the operation chain, at schema version 6, uploaded them before
+	// the upgrade.
+	enc := encryption.NewAgeEncryptor(cfg.Encryption)
+	decryptCtx, err := unlockMetadata(cfg, enc, passphrase("correct"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encryption.LoadSigningKey(encryption.SigningKeyPath(cfg.Encryption))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite := func(name string, version int64, downgrade func(path string)) {
+		t.Helper()
+		path := filepath.Join(vaultRoot, "metadata", "host-1", name+".versions", strconv.FormatInt(version, 10))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plain bytes.Buffer
+		if err := decryptCtx.Decrypt(bytes.NewReader(data[signedHeaderLen:]), &plain); err != nil {
+			t.Fatal(err)
+		}
+		tmp := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(tmp, plain.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		downgrade(tmp)
+		f, err := os.Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var encrypted bytes.Buffer
+		if err := enc.Encrypt(f, &encrypted); err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256(encrypted.Bytes())
+		signed := append(signedHeader(key, "host-1", name, version, digest[:]), encrypted.Bytes()...)
+		if err := os.WriteFile(path, signed, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rewrite("db", 1, func(path string) {
+		conn, err := database.OpenConnection(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := migrations.MigrateTo(conn, 6); err != nil {
+			t.Fatalf("MigrateTo() error = %v", err)
+		}
+	})
+	rewrite(segmentName(2), 2, func(path string) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []*sqlc.MetadataJournal
+		if err := json.Unmarshal(data, &entries); err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			var row map[string]any
+			if err := json.Unmarshal([]byte(entry.RowData), &row); err != nil {
+				t.Fatal(err)
+			}
+			delete(row, "hash")
+			rowData, err := json.Marshal(row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry.RowData = string(rowData)
+		}
+		if data, err = json.Marshal(entries); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	version, err := RestoreMetadata(cfg, 0, false, passphrase("correct"))
+	if err != nil {
+		t.Fatalf("RestoreMetadata() error = %v", err)
+	}
+	if version != 3 {
+		t.Errorf("RestoreMetadata() version = %d, want 3", version)
+	}
+	a, err := NewBTApp(cfg, "ListDirectories")
+	if err != nil {
+		t.Fatalf("NewBTApp() after restore error = %v", err)
+	}
+	defer a.Close()
+	if got, _ := a.ListDirectories(false); len(got) != 3 {
+		t.Errorf("restored %d directories, want 3", len(got))
+	}
+	ops, _ := a.GetHistory(10)
+	if len(ops) != 3 || !ops[0].Hash.Valid || ops[1].Hash.Valid || ops[2].Hash.Valid {
+		t.Errorf("restored history = %+v, want only operation 3 sealed", ops)
+	}
+}
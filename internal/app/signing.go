@@ -0,0 +1,463 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/config"
+	"bt-go/internal/encryption"
+)
+
+// Every metadata item uploaded through putMetadata is signed with the host's
+// signing key, an Ed25519 key kept beside its key pair, so that a vault
+// operator, or anyone else with access to the bucket, cannot swap in
+// metadata of their own or an older copy of the host's. The upload starts
+// with signedMagic, then the public key and the signature, and then the item
+// as it would otherwise be uploaded, encrypted or not. The signature covers
+// the host ID, the item name, the version and the SHA-256 of the rest, so a
+// signed item cannot be passed off as another item or version.
+//
+// Each host remembers in its pins file, for itself and every other host it
+// has read metadata of, the key the host signs with and the highest version
+// of its metadata seen. Metadata signed with another key is rejected, and so
+// is a vault whose latest metadata is older than the version pinned: a
+// rollback. The key of another host is pinned the first time its metadata is
+// read. Items from before a host started signing are still accepted unsigned,
+// but only at versions older than the first signed one seen; unsigned items of
+// a host with no key pinned yet are only read if the user trusts the vault.
+//
+// A host's own metadata is never trusted on first use, since anyone with
+// access to the bucket can sign metadata with a key of their own and encrypt
+// it to the public key. Without a pin, as on a new machine, the signing key
+// itself vouches for it; the recovery kit carries it for that. Failing that,
+// the metadata is only read if the user explicitly trusts the vault.
+//
+// The key files and the signing key itself are uploaded unsigned; the
+// signing key is encrypted to the key pair, so a machine that lost it can get
+// it back, but it is never trusted unless it matches the key pinned. The
+// convergence secret is signed like the metadata, since a machine that lost
+// it installs it from the vault.
+const (
+	signedMagic     = "bt-signed/v1\n"
+	signedHeaderLen = len(signedMagic) + ed25519.PublicKeySize + ed25519.SignatureSize
+
+	// pinsFile holds the pins, under the base directory.
+	pinsFile = "pins.json"
+
+	// signingKeyName is the metadata item holding the encrypted signing key.
+	signingKeyName = "signing_key"
+)
+
+var (
+	// ErrUnsignedMetadata is returned when a metadata item that must be
+	// signed is not.
+	ErrUnsignedMetadata = errors.New("metadata is not signed")
+
+	// ErrBadSignature is returned when a metadata item's signature does not
+	// verify, or it was signed with a key other than the one pinned for its
+	// host.
+	ErrBadSignature = errors.New("metadata signature is not valid")
+
+	// ErrUntrustedMetadata is returned when this host's metadata is read
+	// with neither a pinned nor a local signing key to check it against.
+	ErrUntrustedMetadata = errors.New("no trusted signing key to check the metadata against; import the recovery kit with 'bt keys import-kit', or pass --trust-vault to trust the vault as it is")
+
+	// ErrMetadataRollback is returned when the latest metadata of a host in
+	// the vault is older than the highest version seen before.
+	ErrMetadataRollback = errors.New("metadata was rolled back")
+)
+
+// hostPin is what this host remembers of a host's metadata.
+type hostPin struct {
+	// SigningKey is the public key the host signs its metadata with; nil
+	// until signed metadata of the host has been seen.
+	SigningKey []byte `json:"signing_key,omitempty"`
+
+	// SignedFrom is the lowest version seen signed with SigningKey. Unsigned
+	// items are only accepted at older versions.
+	SignedFrom int64 `json:"signed_from,omitempty"`
+
+	// Version is the highest version of the host's "db" or "journal" seen.
+	Version int64 `json:"version"`
+}
+
+// pinsPath returns the path of the pins file.
+func pinsPath(cfg *config.Config) string {
+	return filepath.Join(cfg.BaseDir, pinsFile)
+}
+
+// loadPins reads the pins file, keyed by host ID. A missing file has no pins.
+func loadPins(cfg *config.Config) (map[string]*hostPin, error) {
+	pins := make(map[string]*hostPin)
+	data, err := os.ReadFile(pinsPath(cfg))
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading pins: %w", err)
+	}
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("decoding pins %s: %w", pinsPath(cfg), err)
+	}
+	return pins, nil
+}
+
+// updatePin reads the pins file, calls update with the pin of a host, created
+// if there is none, and writes the file back atomically.
+func updatePin(cfg *config.Config, hostID string, update func(pin *hostPin) error) error {
+	pins, err := loadPins(cfg)
+	if err != nil {
+		return err
+	}
+	pin := pins[hostID]
+	if pin == nil {
+		pin = &hostPin{}
+		pins[hostID] = pin
+	}
+	if err := update(pin); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding pins: %w", err)
+	}
+	path := pinsPath(cfg)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating pins directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("writing pins: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing pins: %w", err)
+	}
+	return nil
+}
+
+// pinVersion records that version of the host's "db" or "journal" item was
+// seen.
+func pinVersion(cfg *config.Config, hostID string, version int64) error {
+	return updatePin(cfg, hostID, func(pin *hostPin) error {
+		pin.Version = max(pin.Version, version)
+		return nil
+	})
+}
+
+// checkRollback returns ErrMetadataRollback if latest, the version of a
+// host's newest metadata in the vault, is older than the version pinned.
+func checkRollback(cfg *config.Config, hostID string, latest int64) error {
+	pins, err := loadPins(cfg)
+	if err != nil {
+		return err
+	}
+	if pin := pins[hostID]; pin != nil && latest < pin.Version {
+		return fmt.Errorf("%w: the vault holds version %d of the metadata of host %s, but version %d was seen before; if the vault was restored on purpose, remove the host from %s",
+			ErrMetadataRollback, latest, hostID, pin.Version, pinsPath(cfg))
+	}
+	return nil
+}
+
+// signingKey returns the key this host signs its metadata with, generating
+// it and pinning it if the host has none yet. A host whose key is pinned but
+// missing must get it back, with RestoreMetadata or from a backup, rather
+// than sign with a new one.
+func (a *BTApp) signingKey(version int64) (ed25519.PrivateKey, error) {
+	if a.signer != nil {
+		return a.signer, nil
+	}
+	path := encryption.SigningKeyPath(a.cfg.Encryption)
+	key, err := encryption.LoadSigningKey(path)
+	if err != nil {
+		return nil, err
+	}
+	err = updatePin(a.cfg, a.cfg.HostID, func(pin *hostPin) error {
+		switch {
+		case key == nil && pin.SigningKey != nil:
+			return fmt.Errorf("the signing key %s is missing; run 'bt metadata restore' to get it back", path)
+		case key == nil:
+			if key, err = encryption.NewSigningKey(path); err != nil {
+				return err
+			}
+			pin.SigningKey = key.Public().(ed25519.PublicKey)
+			pin.SignedFrom = version
+		case pin.SigningKey == nil:
+			pin.SigningKey = key.Public().(ed25519.PublicKey)
+			pin.SignedFrom = version
+		case !bytes.Equal(pin.SigningKey, key.Public().(ed25519.PublicKey)):
+			return fmt.Errorf("the signing key %s is not the one pinned for this host", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.signer = key
+	return key, nil
+}
+
+// signedMessage returns the message signed for a metadata item: its host,
+// name and version, and the digest of the item as uploaded unsigned.
+func signedMessage(hostID string, name string, version int64, digest []byte) []byte {
+	msg := []byte(signedMagic)
+	msg = append(msg, hostID...)
+	msg = append(msg, 0)
+	msg = append(msg, name...)
+	msg = append(msg, 0)
+	msg = strconv.AppendInt(msg, version, 10)
+	msg = append(msg, 0)
+	return append(msg, digest...)
+}
+
+// signedHeader returns the header that signs a metadata item whose unsigned
+// upload has the given SHA-256 digest.
+func signedHeader(key ed25519.PrivateKey, hostID string, name string, version int64, digest []byte) []byte {
+	header := append([]byte(signedMagic), key.Public().(ed25519.PublicKey)...)
+	return append(header, ed25519.Sign(key, signedMessage(hostID, name, version, digest))...)
+}
+
+// metadataReader downloads the metadata items of a host, verifying them
+// against the host's pin and decrypting them with decryptCtx unless that is
+// nil. The pin is read once and kept in memory; savePin writes back what the
+// downloads taught it.
+type metadataReader struct {
+	cfg        *config.Config
+	v          bt.Vault
+	hostID     string
+	decryptCtx bt.DecryptionContext
+
+	// trustVault accepts this host's metadata when neither a pin nor the
+	// local signing key can vouch for it, as when recovering on a new machine
+	// without the recovery kit. The key it is signed with is then not pinned,
+	// since the host may not be able to sign with it again. For another host,
+	// it accepts unsigned metadata when no key is pinned for the host.
+	trustVault bool
+
+	hostPin  *hostPin
+	dirty    bool
+	unpinned bool
+}
+
+// ownHost returns true if the reader reads this host's metadata.
+func (r *metadataReader) ownHost() bool {
+	return r.hostID == r.cfg.HostID
+}
+
+// pin returns the host's pin, loading it on first use. This host's own
+// signing key, as installed from a recovery kit, anchors its metadata when
+// no key is pinned: every version must then be signed with it.
+func (r *metadataReader) pin() (*hostPin, error) {
+	if r.hostPin != nil {
+		return r.hostPin, nil
+	}
+	pins, err := loadPins(r.cfg)
+	if err != nil {
+		return nil, err
+	}
+	pin := pins[r.hostID]
+	if pin == nil {
+		pin = &hostPin{}
+	}
+	if pin.SigningKey == nil && r.ownHost() {
+		key, err := encryption.LoadSigningKey(encryption.SigningKeyPath(r.cfg.Encryption))
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			pin.SigningKey = key.Public().(ed25519.PublicKey)
+			r.dirty = true
+		}
+	}
+	r.hostPin = pin
+	return pin, nil
+}
+
+// savePin writes the host's pin back to the pins file if a download changed
+// it.
+func (r *metadataReader) savePin() error {
+	if !r.dirty {
+		return nil
+	}
+	saved := *r.hostPin
+	if r.unpinned {
+		saved.SigningKey, saved.SignedFrom = nil, 0
+	}
+	return updatePin(r.cfg, r.hostID, func(pin *hostPin) error {
+		*pin = saved
+		return nil
+	})
+}
+
+// get downloads a version of the named metadata item to w.
+func (r *metadataReader) get(name string, version int64, w io.Writer) error {
+	data, err := r.download(name, version)
+	if err != nil {
+		return err
+	}
+	if r.decryptCtx == nil {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("writing %s: %w", name, err)
+		}
+		return nil
+	}
+	if err := r.decryptCtx.Decrypt(bytes.NewReader(data), w); err != nil {
+		return fmt.Errorf("decrypting %s: %w", name, err)
+	}
+	return nil
+}
+
+// download returns a version of the named metadata item as uploaded,
+// encrypted or not, once its signature is verified. The signed metadata of
+// another host is trusted on first use, but not its unsigned metadata; this
+// host's must be vouched for by its pin or its signing key. trustVault lifts
+// both restrictions.
+func (r *metadataReader) download(name string, version int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := r.v.GetMetadataAt(r.hostID, name, version, &buf); err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", name, err)
+	}
+	data := buf.Bytes()
+
+	pin, err := r.pin()
+	if err != nil {
+		return nil, err
+	}
+	untrusted := pin.SigningKey == nil && r.ownHost() && !r.trustVault
+	if !bytes.HasPrefix(data, []byte(signedMagic)) {
+		if pin.SigningKey != nil && version >= pin.SignedFrom {
+			return nil, fmt.Errorf("%w: %s version %d of host %s", ErrUnsignedMetadata, name, version, r.hostID)
+		}
+		if untrusted {
+			return nil, fmt.Errorf("%w: %s version %d of host %s is not signed", ErrUntrustedMetadata, name, version, r.hostID)
+		}
+		if pin.SigningKey == nil && !r.trustVault {
+			return nil, fmt.Errorf("%w: %s version %d of host %s, and no key is pinned for the host; pass --trust-vault to read it anyway",
+				ErrUnsignedMetadata, name, version, r.hostID)
+		}
+		r.record(name, version, nil)
+		return data, nil
+	}
+	if len(data) < signedHeaderLen {
+		return nil, fmt.Errorf("%w: %s version %d of host %s is truncated", ErrBadSignature, name, version, r.hostID)
+	}
+	publicKey := ed25519.PublicKey(data[len(signedMagic) : len(signedMagic)+ed25519.PublicKeySize])
+	signature := data[len(signedMagic)+ed25519.PublicKeySize : signedHeaderLen]
+	payload := data[signedHeaderLen:]
+	digest := sha256.Sum256(payload)
+	if !ed25519.Verify(publicKey, signedMessage(r.hostID, name, version, digest[:]), signature) {
+		return nil, fmt.Errorf("%w: %s version %d of host %s", ErrBadSignature, name, version, r.hostID)
+	}
+	if pin.SigningKey != nil && !bytes.Equal(pin.SigningKey, publicKey) {
+		return nil, fmt.Errorf("%w: %s version %d of host %s is signed with a key other than the one pinned in %s",
+			ErrBadSignature, name, version, r.hostID, pinsPath(r.cfg))
+	}
+	if untrusted {
+		return nil, fmt.Errorf("%w: %s version %d of host %s", ErrUntrustedMetadata, name, version, r.hostID)
+	}
+	if pin.SigningKey == nil && r.ownHost() {
+		r.unpinned = true
+	}
+	r.record(name, version, publicKey)
+	return payload, nil
+}
+
+// record notes a verified item in the host's pin: the key it was signed
+// with, if any, and its version if it is the "db" or "journal" item.
+func (r *metadataReader) record(name string, version int64, publicKey ed25519.PublicKey) {
+	pin := r.hostPin
+	if publicKey != nil {
+		if pin.SigningKey == nil || version < pin.SignedFrom {
+			pin.SignedFrom = version
+		}
+		pin.SigningKey = publicKey
+		r.dirty = true
+	}
+	if name == "db" || name == "journal" {
+		pin.Version = max(pin.Version, version)
+		r.dirty = true
+	}
+}
+
+// uploadSigningKey uploads the signing key to v, if there is one, encrypted
+// to the key pair like the convergence secret.
+func (a *BTApp) uploadSigningKey(v bt.Vault, version int64) error {
+	key, err := os.Open(encryption.SigningKeyPath(a.cfg.Encryption))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening %s for upload: %w", signingKeyName, err)
+	}
+	defer key.Close()
+
+	var buf bytes.Buffer
+	if err := a.encryptor.Encrypt(key, &buf); err != nil {
+		return fmt.Errorf("encrypting %s: %w", signingKeyName, err)
+	}
+	if err := v.PutMetadata(a.cfg.HostID, signingKeyName, &buf, int64(buf.Len()), version); err != nil {
+		return fmt.Errorf("uploading %s to vault: %w", signingKeyName, err)
+	}
+	return nil
+}
+
+// restoreSigningKey installs the host's signing key from the vault if it is
+// missing locally and the vault has a copy, once the copy is checked against
+// the key pinned from the host's signed metadata.
+func restoreSigningKey(cfg *config.Config, v bt.Vault, decryptCtx bt.DecryptionContext) error {
+	path := encryption.SigningKeyPath(cfg.Encryption)
+	if key, err := encryption.LoadSigningKey(path); err != nil || key != nil {
+		return err
+	}
+	version, err := v.GetMetadataVersion(cfg.HostID, signingKeyName)
+	if err != nil || version == 0 || decryptCtx == nil {
+		return err
+	}
+	var encrypted, plain bytes.Buffer
+	if err := v.GetMetadataAt(cfg.HostID, signingKeyName, version, &encrypted); err != nil {
+		return fmt.Errorf("downloading %s: %w", signingKeyName, err)
+	}
+	if err := decryptCtx.Decrypt(&encrypted, &plain); err != nil {
+		return fmt.Errorf("decrypting %s: %w", signingKeyName, err)
+	}
+	return updatePin(cfg, cfg.HostID, func(pin *hostPin) error {
+		key, err := encryption.InstallSigningKey(path, plain.Bytes())
+		if err != nil {
+			return err
+		}
+		if pin.SigningKey != nil && !bytes.Equal(pin.SigningKey, key.Public().(ed25519.PublicKey)) {
+			os.Remove(path)
+			return fmt.Errorf("%w: the signing key in the vault is not the one the metadata is signed with", ErrBadSignature)
+		}
+		return nil
+	})
+}
+
+// keepSigningKey makes sure this host can go on signing once its metadata is
+// rebuilt: the signing key is restored from the vault if it is missing, and
+// if that cannot be done, the key pinned is dropped so that the next upload
+// starts a new one. Returns true in that case: the rebuilt metadata must be
+// uploaded again, signed with the new key, for the host to read it back.
+func keepSigningKey(cfg *config.Config, v bt.Vault, decryptCtx bt.DecryptionContext) (bool, error) {
+	if err := restoreSigningKey(cfg, v, decryptCtx); err != nil {
+		return false, err
+	}
+	key, err := encryption.LoadSigningKey(encryption.SigningKeyPath(cfg.Encryption))
+	if err != nil || key != nil {
+		return false, err
+	}
+	return true, updatePin(cfg, cfg.HostID, func(pin *hostPin) error {
+		pin.SigningKey, pin.SignedFrom = nil, 0
+		return nil
+	})
+}
@@ -0,0 +1,237 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bt-go/internal/config"
+	"bt-go/internal/encryption"
+)
+
+func TestSignedMetadata(t *testing.T) {
+	// setup runs two commands on host-1 and returns its config and the
+	// vault root; the latest version of its metadata is 2.
+	setup := func(t *testing.T) (*config.Config, string) {
+		t.Helper()
+		vaultRoot := t.TempDir()
+		cfg := newTestConfig(t, "host-1", vaultRoot)
+		addDirectory(t, cfg, t.TempDir())
+		addDirectory(t, cfg, t.TempDir())
+		return cfg, vaultRoot
+	}
+
+	t.Run("metadata is signed with the pinned key", func(t *testing.T) {
+		cfg, vaultRoot := setup(t)
+		metadataDir := filepath.Join(vaultRoot, "metadata", "host-1")
+		data, err := os.ReadFile(filepath.Join(metadataDir, "journal.versions", "2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), signedMagic) {
+			t.Error("the journal index should be signed")
+		}
+		key, err := encryption.LoadSigningKey(encryption.SigningKeyPath(cfg.Encryption))
+		if err != nil || key == nil {
+			t.Fatalf("LoadSigningKey() = %v, %v", key, err)
+		}
+		pins, err := loadPins(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pin := pins["host-1"]; pin == nil || pin.Version != 2 || pin.SignedFrom != 1 {
+			t.Errorf("pin = %+v, want version 2 signed from 1", pin)
+		}
+		if _, err := RestoreMetadata(cfg, 0, false, passphrase("correct")); err != nil {
+			t.Errorf("RestoreMetadata() error = %v", err)
+		}
+	})
+
+	t.Run("tampered metadata is rejected", func(t *testing.T) {
+		cfg, vaultRoot := setup(t)
+		metadataDir := filepath.Join(vaultRoot, "metadata", "host-1")
+		path := filepath.Join(metadataDir, "journal.versions", "2")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-1] ^= 0xff
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := RestoreMetadata(cfg, 0, false, passphrase("correct")); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("RestoreMetadata() error = %v, want ErrBadSignature", err)
+		}
+	})
+
+	t.Run("an older signed version passed off as a newer one is rejected", func(t *testing.T) {
+		cfg, vaultRoot := setup(t)
+		metadataDir := filepath.Join(vaultRoot, "metadata", "host-1")
+		older, err := os.ReadFile(filepath.Join(metadataDir, "journal.versions", "1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(metadataDir, "journal.versions", "2"), older, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := RestoreMetadata(cfg, 0, false, passphrase("correct")); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("RestoreMetadata() error = %v, want ErrBadSignature", err)
+		}
+	})
+
+	t.Run("unsigned metadata is rejected", func(t *testing.T) {
+		cfg, vaultRoot := setup(t)
+		metadataDir := filepath.Join(vaultRoot, "metadata", "host-1")
+		path := filepath.Join(metadataDir, "journal.versions", "2")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data[signedHeaderLen:], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := RestoreMetadata(cfg, 0, false, passphrase("correct")); !errors.Is(err, ErrUnsignedMetadata) {
+			t.Errorf("RestoreMetadata() error = %v, want ErrUnsignedMetadata", err)
+		}
+	})
+
+	t.Run("a rolled back vault is detected", func(t *testing.T) {
+		vaultRoot := t.TempDir()
+		cfg := newTestConfig(t, "host-1", vaultRoot)
+		addDirectory(t, cfg, t.TempDir())
+		saved := t.TempDir()
+		if err := os.CopyFS(saved, os.DirFS(vaultRoot)); err != nil {
+			t.Fatal(err)
+		}
+		addDirectory(t, cfg, t.TempDir())
+
+		// Put back the vault as it was after the first command.
+		if err := os.RemoveAll(filepath.Join(vaultRoot, "metadata")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.CopyFS(filepath.Join(vaultRoot, "metadata"), os.DirFS(filepath.Join(saved, "metadata"))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewBTApp(cfg, "ListDirectories"); !errors.Is(err, ErrMetadataRollback) {
+			t.Errorf("NewBTApp() error = %v, want ErrMetadataRollback", err)
+		}
+		if _, err := RestoreMetadata(cfg, 0, false, passphrase("correct")); !errors.Is(err, ErrMetadataRollback) {
+			t.Errorf("RestoreMetadata() error = %v, want ErrMetadataRollback", err)
+		}
+	})
+
+	t.Run("a lost signing key is restored from the vault", func(t *testing.T) {
+		cfg, _ := setup(t)
+		keyPath := encryption.SigningKeyPath(cfg.Encryption)
+		want, err := os.ReadFile(keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(keyPath); err != nil {
+			t.Fatal(err)
+		}
+
+		// A new key would not match the one pinned.
+		if _, err := (&BTApp{cfg: cfg}).signingKey(3); err == nil || !strings.Contains(err.Error(), "is missing") {
+			t.Errorf("signingKey() error = %v, want the key missing", err)
+		}
+
+		if _, err := RestoreMetadata(cfg, 0, false, passphrase("correct")); err != nil {
+			t.Fatalf("RestoreMetadata() error = %v", err)
+		}
+		if got, err := os.ReadFile(keyPath); err != nil || string(got) != string(want) {
+			t.Errorf("restored signing key = %q, %v; want the original", got, err)
+		}
+		addDirectory(t, cfg, t.TempDir())
+	})
+
+	t.Run("a new machine does not trust the vault on first use", func(t *testing.T) {
+		cfg, _ := setup(t)
+		keyPath := encryption.SigningKeyPath(cfg.Encryption)
+		want, err := os.ReadFile(keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(keyPath)
+		os.Remove(pinsPath(cfg))
+
+		if _, err := RestoreMetadata(cfg, 0, false, passphrase("correct")); !errors.Is(err, ErrUntrustedMetadata) {
+			t.Fatalf("RestoreMetadata() error = %v, want ErrUntrustedMetadata", err)
+		}
+
+		// Trusting the vault installs the signing key kept there first.
+		if _, err := RestoreMetadata(cfg, 0, true, passphrase("correct")); err != nil {
+			t.Fatalf("RestoreMetadata() trusting the vault error = %v", err)
+		}
+		if got, err := os.ReadFile(keyPath); err != nil || string(got) != string(want) {
+			t.Errorf("restored signing key = %q, %v; want the original", got, err)
+		}
+		addDirectory(t, cfg, t.TempDir())
+	})
+
+	t.Run("an unencrypted host recovers on a new machine", func(t *testing.T) {
+		vaultRoot := t.TempDir()
+		cfg := newTestConfig(t, "host-1", vaultRoot)
+		os.Remove(cfg.Encryption.PublicKeyPath)
+		os.Remove(cfg.Encryption.PrivateKeyPath)
+		addDirectory(t, cfg, t.TempDir())
+		addDirectory(t, cfg, t.TempDir())
+
+		var kit bytes.Buffer
+		if err := ExportKit(cfg, false, &kit); err != nil {
+			t.Fatalf("ExportKit() error = %v", err)
+		}
+		newBase := filepath.Join(t.TempDir(), "new")
+		cfg2, err := ImportKit(&kit, filepath.Join(newBase, "bt.toml"), newBase, nil)
+		if err != nil {
+			t.Fatalf("ImportKit() error = %v", err)
+		}
+		if _, err := RestoreMetadata(cfg2, 0, false, nil); err != nil {
+			t.Fatalf("RestoreMetadata() with the kit error = %v", err)
+		}
+		addDirectory(t, cfg2, t.TempDir())
+
+		// Without the kit, the vault must be trusted explicitly, and the host
+		// starts a new signing key it can go on with.
+		cfg3 := newTestConfig(t, "host-1", vaultRoot)
+		os.Remove(cfg3.Encryption.PublicKeyPath)
+		os.Remove(cfg3.Encryption.PrivateKeyPath)
+		if _, err := RestoreMetadata(cfg3, 0, false, nil); !errors.Is(err, ErrUntrustedMetadata) {
+			t.Fatalf("RestoreMetadata() without the kit error = %v, want ErrUntrustedMetadata", err)
+		}
+		if _, err := RestoreMetadata(cfg3, 0, true, nil); err != nil {
+			t.Fatalf("RestoreMetadata() trusting the vault error = %v", err)
+		}
+		addDirectory(t, cfg3, t.TempDir())
+		if _, err := RestoreMetadata(cfg3, 0, false, nil); err != nil {
+			t.Errorf("RestoreMetadata() with the new key error = %v", err)
+		}
+	})
+
+	t.Run("another host signing with a new key is flagged", func(t *testing.T) {
+		cfg, vaultRoot := setup(t)
+		cfg2 := newTestConfig(t, "host-2", vaultRoot)
+		addDirectory(t, cfg2, t.TempDir())
+		if _, err := ListHosts(cfg, passphrase("correct")); err != nil {
+			t.Fatalf("ListHosts() error = %v", err)
+		}
+
+		// host-2 starts over with a new signing key.
+		os.Remove(encryption.SigningKeyPath(cfg2.Encryption))
+		os.Remove(pinsPath(cfg2))
+		addDirectory(t, cfg2, t.TempDir())
+
+		hosts, err := ListHosts(cfg, passphrase("correct"))
+		if err != nil {
+			t.Fatalf("ListHosts() error = %v", err)
+		}
+		for _, host := range hosts {
+			if host.HostID == "host-2" && !strings.Contains(host.Problem, ErrBadSignature.Error()) {
+				t.Errorf("host-2 problem = %q, want a bad signature", host.Problem)
+			}
+		}
+	})
+}
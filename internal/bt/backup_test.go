@@ -46,7 +46,7 @@ func TestBTService_BackupAll(t *testing.T) {
 
 		// Stage file
 		filePath, _ := fsmgr.Resolve("/home/user/docs/file.txt")
-		if _, err := svc.StageFiles(filePath, false); err != nil {
+		if _, err := svc.StageFiles(filePath, bt.StageOptions{}); err != nil {
 			t.Fatalf("StageFiles() error = %v", err)
 		}
 
@@ -93,7 +93,7 @@ func TestBTService_BackupAll(t *testing.T) {
 		// Stage files
 		for _, name := range []string{"file1.txt", "file2.txt", "file3.txt"} {
 			filePath, _ := fsmgr.Resolve("/home/user/docs/" + name)
-			if _, err := svc.StageFiles(filePath, false); err != nil {
+			if _, err := svc.StageFiles(filePath, bt.StageOptions{}); err != nil {
 				t.Fatalf("StageFiles(%s) error = %v", name, err)
 			}
 		}
@@ -133,10 +133,10 @@ func TestBTService_BackupAll(t *testing.T) {
 		svc.AddDirectory(dirPath, false)
 
 		file1Path, _ := fsmgr.Resolve("/home/user/docs/file1.txt")
-		svc.StageFiles(file1Path, false)
+		svc.StageFiles(file1Path, bt.StageOptions{})
 
 		file2Path, _ := fsmgr.Resolve("/home/user/docs/file2.txt")
-		svc.StageFiles(file2Path, false)
+		svc.StageFiles(file2Path, bt.StageOptions{})
 
 		// Backup all
 		count, err := svc.BackupAll()
@@ -173,7 +173,7 @@ func TestBTService_BackupAll(t *testing.T) {
 
 		// First backup
 		filePath, _ := fsmgr.Resolve("/home/user/docs/file.txt")
-		svc.StageFiles(filePath, false)
+		svc.StageFiles(filePath, bt.StageOptions{})
 		count1, err := svc.BackupAll()
 		if err != nil {
 			t.Fatalf("first BackupAll() error = %v", err)
@@ -182,8 +182,9 @@ func TestBTService_BackupAll(t *testing.T) {
 			t.Errorf("first BackupAll() count = %d, want 1", count1)
 		}
 
-		// Stage same file again (content unchanged)
-		svc.StageFiles(filePath, false)
+		// Stage same file again (content unchanged); Force bypasses the
+		// unchanged-file skip so the backup path sees it.
+		svc.StageFiles(filePath, bt.StageOptions{Force: true})
 		count2, err := svc.BackupAll()
 		if err != nil {
 			t.Fatalf("second BackupAll() error = %v", err)
@@ -212,7 +213,7 @@ func TestBTService_BackupAll_Encrypted(t *testing.T) {
 		}
 
 		filePath, _ := fsmgr.Resolve("/home/user/secret/file.txt")
-		if _, err := svc.StageFiles(filePath, false); err != nil {
+		if _, err := svc.StageFiles(filePath, bt.StageOptions{}); err != nil {
 			t.Fatalf("StageFiles() error = %v", err)
 		}
 
@@ -282,7 +283,7 @@ func TestBTService_BackupAll_Encrypted(t *testing.T) {
 		svc.AddDirectory(dirPath, false) // encrypted=false
 
 		filePath, _ := fsmgr.Resolve("/home/user/docs/file.txt")
-		svc.StageFiles(filePath, false)
+		svc.StageFiles(filePath, bt.StageOptions{})
 		svc.BackupAll()
 
 		// The plaintext content record should have no encrypted_content_id.
@@ -316,7 +317,7 @@ func TestBTService_BackupAll_Encrypted(t *testing.T) {
 		filePath, _ := fsmgr.Resolve("/home/user/secret/file.txt")
 
 		// First backup
-		svc.StageFiles(filePath, false)
+		svc.StageFiles(filePath, bt.StageOptions{})
 		count1, err := svc.BackupAll()
 		if err != nil {
 			t.Fatalf("first BackupAll() error = %v", err)
@@ -326,7 +327,7 @@ func TestBTService_BackupAll_Encrypted(t *testing.T) {
 		}
 
 		// Second backup of same content — should deduplicate
-		svc.StageFiles(filePath, false)
+		svc.StageFiles(filePath, bt.StageOptions{Force: true})
 		count2, err := svc.BackupAll()
 		if err != nil {
 			t.Fatalf("second BackupAll() error = %v", err)
@@ -1,32 +1,99 @@
 package bt
 
-import "bt-go/internal/database/sqlc"
+import (
+	"time"
+
+	"bt-go/internal/database/sqlc"
+)
+
+// DirectoryStats summarizes what has been backed up from a directory.
+type DirectoryStats struct {
+	// FileCount is the number of files with a current snapshot.
+	FileCount int64
+
+	// TotalSize is the combined size in bytes of those current snapshots.
+	TotalSize int64
+
+	// LastBackupAt is when the most recent snapshot was created, or the zero
+	// time if nothing has been backed up.
+	LastBackupAt time.Time
+}
+
+// OperationChain is the result of checking the hash chain of the backup
+// operation log.
+type OperationChain struct {
+	// Sealed is the number of operations whose hash checked out.
+	Sealed int
+
+	// Unsealed is the number of operations without a hash: recorded before
+	// the log was chained, or still running or interrupted.
+	Unsealed int
+
+	// Head is the last sealed operation, or nil if there is none.
+	Head *sqlc.BackupOperation
+
+	// Snapshots is the number of snapshots recorded by the operations that
+	// matched the digest taken when they were created, and Missing the
+	// number since deleted, as purging a directory's history does.
+	Snapshots int
+	Missing   int
+
+	// Problems describes each mismatch found; the chain is intact if there
+	// are none.
+	Problems []string
+}
 
 // Database provides an interface for metadata storage operations.
 // All methods should be implemented with appropriate transaction handling.
 type Database interface {
 	// Directory operations
 
-	// FindDirectoryByPath returns a directory with an exact path match.
+	// FindDirectoryByPath returns a tracked directory with an exact path match.
+	// Removed directories are not returned.
 	FindDirectoryByPath(path string) (*sqlc.Directory, error)
 
-	// SearchDirectoryForPath finds the directory that contains the given path.
+	// SearchDirectoryForPath finds the tracked directory that contains the given path.
 	// For example, if "/home/user/docs" is tracked and path is "/home/user/docs/file.txt",
 	// this returns the "/home/user/docs" directory.
 	SearchDirectoryForPath(path string) (*sqlc.Directory, error)
 
 	// CreateDirectory creates a new tracked directory.
 	// If there are existing child directories, moves their files and deletes them.
+	// If a removed directory exists at path, it is tracked again with its history.
 	// encrypted marks whether files in this directory should be encrypted on backup.
 	CreateDirectory(path string, encrypted bool) (*sqlc.Directory, error)
 
+	// MoveDirectory changes the path of a tracked directory, keeping its files
+	// and snapshots. Directories are nested the way CreateDirectory nests them:
+	// if newPath is inside another tracked directory, the files join that
+	// directory and it is returned; otherwise tracked directories beneath
+	// newPath are merged into the moved one. Where both sides have history for
+	// the same file, the histories are combined.
+	MoveDirectory(directory *sqlc.Directory, newPath string) (*sqlc.Directory, error)
+
 	// FindDirectoryByID returns a directory by its ID, or nil if not found.
 	FindDirectoryByID(id string) (*sqlc.Directory, error)
 
-	// FindDirectoriesByPathPrefix returns all directories whose path starts with the given prefix.
+	// FindDirectoriesByPathPrefix returns all tracked directories whose path starts with the given prefix.
 	FindDirectoriesByPathPrefix(pathPrefix string) ([]*sqlc.Directory, error)
 
-	// DeleteDirectory deletes a directory from tracking.
+	// ListDirectories returns tracked directories ordered by path. If
+	// includeRemoved is true, directories removed with their history kept
+	// are included too.
+	ListDirectories(includeRemoved bool) ([]*sqlc.Directory, error)
+
+	// FindDirectoryStats summarizes the files backed up from a directory.
+	FindDirectoryStats(directory *sqlc.Directory) (*DirectoryStats, error)
+
+	// RemoveDirectory stops tracking a directory but keeps its files and
+	// snapshots, which return if the same path is tracked again.
+	RemoveDirectory(directory *sqlc.Directory) error
+
+	// SetDirectoryEncrypted changes whether new backups of a directory's files
+	// are encrypted. Existing content is left as it is.
+	SetDirectoryEncrypted(directory *sqlc.Directory, encrypted bool) error
+
+	// DeleteDirectory deletes a directory along with all of its files and snapshots.
 	DeleteDirectory(directory *sqlc.Directory) error
 
 	// File operations
@@ -45,6 +112,9 @@ type Database interface {
 	// FindFileSnapshotsForFile returns all snapshots for a given file, ordered by creation time.
 	FindFileSnapshotsForFile(file *sqlc.File) ([]*sqlc.FileSnapshot, error)
 
+	// FindFileSnapshotByID returns a snapshot by its ID, or nil if not found.
+	FindFileSnapshotByID(id string) (*sqlc.FileSnapshot, error)
+
 	// FindFileSnapshotByChecksum returns a snapshot for a file with a specific content checksum.
 	FindFileSnapshotByChecksum(file *sqlc.File, checksum string) (*sqlc.FileSnapshot, error)
 
@@ -73,12 +143,56 @@ type Database interface {
 	// FindContentByChecksum returns content metadata by checksum.
 	FindContentByChecksum(checksum string) (*sqlc.Content, error)
 
+	// FindPlaintextChecksum returns the checksum of the plaintext content whose
+	// record points at the encrypted content encryptedContentID, or "" if none
+	// does.
+	FindPlaintextChecksum(encryptedContentID string) (string, error)
+
+	// FindContentsByDirectory returns the content records referenced by any
+	// snapshot of a directory's files, ordered by checksum.
+	FindContentsByDirectory(directory *sqlc.Directory) ([]*sqlc.Content, error)
+
+	// UpdateContentEncryption changes where the content with the given
+	// plaintext checksum is stored in the vault. A non-empty
+	// encryptedContentID makes the record virtual, pointing at that encrypted
+	// object and creating its real record if needed; an empty one makes the
+	// record refer to its plaintext object again.
+	UpdateContentEncryption(checksum string, encryptedContentID string) error
+
+	// IsContentInEncryptedDirectory reports whether any snapshot of a file in
+	// an encrypted directory references the content.
+	IsContentInEncryptedDirectory(checksum string) (bool, error)
+
+	// Key rotation
+
+	// MarkContentConvergent records that the real encrypted content record
+	// encryptedContentID was encrypted with the convergence secret rather
+	// than to the key pair, so key rotations in convergent mode leave it out.
+	MarkContentConvergent(encryptedContentID string) error
+
+	// StartKeyRotation queues every real encrypted content record, i.e. every
+	// one a virtual record points at, for re-encryption, leaving convergent
+	// ones out if skipConvergent is true. Content already queued stays
+	// queued, so this is safe to call again.
+	StartKeyRotation(skipConvergent bool) error
+
+	// FindKeyRotationPending returns the IDs of real encrypted content records
+	// still queued for re-encryption.
+	FindKeyRotationPending() ([]string, error)
+
+	// ReplaceEncryptedContent atomically records that the encrypted content
+	// oldID was re-encrypted as newID: creates the real record for newID,
+	// points every virtual record at it, and dequeues oldID.
+	ReplaceEncryptedContent(oldID string, newID string) error
+
 	// Backup operation tracking
 
 	// CreateBackupOperation records a new backup operation with "running" status.
 	CreateBackupOperation(operation string, parameters string) (*sqlc.BackupOperation, error)
 
-	// FinishBackupOperation marks a backup operation as finished with the given status.
+	// FinishBackupOperation marks a backup operation as finished with the
+	// given status, and seals it into the operation log's hash chain along
+	// with the snapshots created since it was created.
 	FinishBackupOperation(id int64, status string) error
 
 	// ListBackupOperations returns the most recent backup operations, ordered by ID descending.
@@ -87,6 +201,42 @@ type Database interface {
 	// MaxBackupOperationID returns the highest backup operation ID, or 0 if none exist.
 	MaxBackupOperationID() (int64, error)
 
+	// FindBackupOperation returns the backup operation with the given ID, or
+	// nil if there is none.
+	FindBackupOperation(id int64) (*sqlc.BackupOperation, error)
+
+	// FindOperationChainHead returns the last operation sealed into the hash
+	// chain, or nil if none is.
+	FindOperationChainHead() (*sqlc.BackupOperation, error)
+
+	// VerifyOperationChain recomputes the hash chain of the operation log and
+	// the digests of the snapshots its operations created.
+	VerifyOperationChain() (*OperationChain, error)
+
+	// Metadata journal
+
+	// FindJournalEntries returns the row changes recorded since they were
+	// last uploaded, in the order they were made.
+	FindJournalEntries() ([]*sqlc.MetadataJournal, error)
+
+	// FindJournalSegments returns the journal segments uploaded since the
+	// last checkpoint, ordered by operation ID.
+	FindJournalSegments() ([]*sqlc.MetadataSegment, error)
+
+	// RecordJournalSegment records that the journal entries up to and
+	// including throughSeq were uploaded as segment, and drops them.
+	RecordJournalSegment(segment *sqlc.MetadataSegment, throughSeq int64) error
+
+	// RecordCheckpoint records that the whole database was uploaded with the
+	// journal entries up to and including throughSeq applied: drops them,
+	// along with the segments the checkpoint replaces.
+	RecordCheckpoint(throughSeq int64) error
+
+	// ApplyJournal replays row changes recorded by another copy of the
+	// database, in order and in a single transaction. The replay itself is
+	// not journaled.
+	ApplyJournal(entries []*sqlc.MetadataJournal) error
+
 	// Path returns the database file path (or ":memory:" for in-memory databases).
 	Path() string
 
@@ -0,0 +1,305 @@
+package bt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"bt-go/internal/database/sqlc"
+)
+
+// ErrDirectoryNotTracked is returned (wrapped) when a directory is neither
+// tracked nor inside a tracked directory.
+var ErrDirectoryNotTracked = errors.New("directory is not tracked")
+
+// maxMoveSamples bounds how many files DetectMovedDirectory hashes for each
+// missing directory it compares against.
+const maxMoveSamples = 16
+
+// DirectoryInfo describes a tracked directory and what has been backed up from it.
+type DirectoryInfo struct {
+	Path         string
+	Encrypted    bool
+	FileCount    int64
+	TotalSize    int64
+	LastBackupAt time.Time // zero if nothing has been backed up
+
+	// Removed is set for directories no longer tracked whose history was kept.
+	Removed bool
+
+	// Missing is set when the directory no longer exists on disk, for
+	// example because it was moved.
+	Missing bool
+}
+
+// MovedDirectory is a tracked directory missing from disk whose backed-up
+// files were found at another path.
+type MovedDirectory struct {
+	OldPath string
+	NewPath string
+
+	// Matched is how many of the Sampled backed-up files were found at the
+	// new path with the content of their current snapshot.
+	Matched int
+	Sampled int
+}
+
+// matches reports whether most of the sampled files were found.
+func (m *MovedDirectory) matches() bool {
+	return m.Matched > 0 && m.Matched*2 > m.Sampled
+}
+
+// ListDirectories returns the directories tracked on this host, ordered by
+// path. If includeRemoved is true, removed directories whose history was
+// kept are listed too.
+func (s *BTService) ListDirectories(includeRemoved bool) ([]*DirectoryInfo, error) {
+	s.logger.Debug("listing directories", "include_removed", includeRemoved)
+
+	dirs, err := s.database.ListDirectories(includeRemoved)
+	if err != nil {
+		return nil, fmt.Errorf("listing directories: %w", err)
+	}
+
+	infos := make([]*DirectoryInfo, len(dirs))
+	for i, dir := range dirs {
+		stats, err := s.database.FindDirectoryStats(dir)
+		if err != nil {
+			return nil, fmt.Errorf("summarizing %s: %w", dir.Path, err)
+		}
+		infos[i] = &DirectoryInfo{
+			Path:         dir.Path,
+			Encrypted:    dir.Encrypted != 0,
+			FileCount:    stats.FileCount,
+			TotalSize:    stats.TotalSize,
+			LastBackupAt: stats.LastBackupAt,
+			Removed:      dir.RemovedAt.Valid,
+			Missing:      s.isMissing(dir.Path),
+		}
+	}
+	return infos, nil
+}
+
+// RemoveDirectory stops tracking the directory at absPath, which must be a
+// tracked directory itself rather than a path inside one. It need not exist
+// on disk. Staged files for the directory are dropped from the queue.
+// If purge is false, the directory's history is kept and returns if the path
+// is tracked again; if true, its files and snapshots are deleted. Content
+// already in the vault is left in place either way.
+// Returns the number of staged files dropped.
+func (s *BTService) RemoveDirectory(absPath string, purge bool) (int, error) {
+	directory, err := s.database.FindDirectoryByPath(absPath)
+	if err != nil {
+		return 0, fmt.Errorf("finding directory: %w", err)
+	}
+	if directory == nil {
+		parent, err := s.database.SearchDirectoryForPath(absPath)
+		if err != nil {
+			return 0, fmt.Errorf("searching for directory: %w", err)
+		}
+		if parent != nil {
+			return 0, fmt.Errorf("directory is not tracked itself, only as part of %s: %s", parent.Path, absPath)
+		}
+		return 0, fmt.Errorf("directory is not tracked: %s", absPath)
+	}
+
+	unstaged, err := s.stagingArea.RemoveDirectory(directory.ID)
+	if err != nil {
+		return 0, fmt.Errorf("removing staged files: %w", err)
+	}
+
+	if purge {
+		if err := s.database.DeleteDirectory(directory); err != nil {
+			return unstaged, fmt.Errorf("deleting directory: %w", err)
+		}
+	} else {
+		if err := s.database.RemoveDirectory(directory); err != nil {
+			return unstaged, fmt.Errorf("removing directory: %w", err)
+		}
+	}
+
+	s.logger.Info("directory untracked", "path", absPath, "purged", purge, "unstaged", unstaged)
+	return unstaged, nil
+}
+
+// MoveDirectory records that the tracked directory at oldPath, which need not
+// exist anymore, now lives at newPath, keeping its history. If newPath is
+// inside another tracked directory, the history joins that directory, and
+// tracked directories beneath newPath are merged into the moved one, the same
+// way AddDirectory nests directories.
+// Staged files of directories merged away are dropped from the queue and must
+// be added again. Returns the path of the directory now holding the history
+// and the number of staged files dropped.
+func (s *BTService) MoveDirectory(oldPath string, newPath *Path) (string, int, error) {
+	if !newPath.IsDir() {
+		return "", 0, fmt.Errorf("path is not a directory: %s", newPath.String())
+	}
+
+	directory, err := s.database.FindDirectoryByPath(oldPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("finding directory: %w", err)
+	}
+	if directory == nil {
+		return "", 0, fmt.Errorf("%w: %s", ErrDirectoryNotTracked, oldPath)
+	}
+	if oldPath == newPath.String() {
+		return directory.Path, 0, nil
+	}
+
+	merged, err := s.database.FindDirectoriesByPathPrefix(newPath.String())
+	if err != nil {
+		return "", 0, fmt.Errorf("finding directories under new path: %w", err)
+	}
+
+	moved, err := s.database.MoveDirectory(directory, newPath.String())
+	if err != nil {
+		return "", 0, fmt.Errorf("moving directory: %w", err)
+	}
+
+	// Queued files refer to their directory by ID, so those of directories
+	// that no longer exist can't be backed up.
+	if moved.ID != directory.ID {
+		merged = append(merged, directory)
+	}
+	unstaged := 0
+	for _, dir := range merged {
+		if dir.ID == moved.ID {
+			continue
+		}
+		n, err := s.stagingArea.RemoveDirectory(dir.ID)
+		if err != nil {
+			return moved.Path, unstaged, fmt.Errorf("removing staged files: %w", err)
+		}
+		unstaged += n
+	}
+
+	s.logger.Info("directory moved", "from", oldPath, "to", newPath.String(), "tracked_as", moved.Path)
+	return moved.Path, unstaged, nil
+}
+
+// DetectMovedDirectory checks whether the untracked directory at path holds a
+// tracked directory that has gone missing from disk. For each missing
+// directory, a sample of its backed-up files is looked up under path and
+// hashed; a directory matches if most sampled files have the content of
+// their current snapshot. Returns the best match, or nil if there is none.
+func (s *BTService) DetectMovedDirectory(path *Path) (*MovedDirectory, error) {
+	dirs, err := s.database.ListDirectories(false)
+	if err != nil {
+		return nil, fmt.Errorf("listing directories: %w", err)
+	}
+
+	var best *MovedDirectory
+	for _, dir := range dirs {
+		if dir.Path == path.String() || !s.isMissing(dir.Path) {
+			continue
+		}
+		candidate, err := s.compareMovedDirectory(dir, path)
+		if err != nil {
+			return nil, fmt.Errorf("comparing with %s: %w", dir.Path, err)
+		}
+		if !candidate.matches() {
+			continue
+		}
+		if best == nil || candidate.Matched > best.Matched {
+			best = candidate
+		}
+	}
+	return best, nil
+}
+
+// DetectMovedDirectoriesIn checks whether the subdirectories of the directory
+// at path hold tracked directories that have gone missing from disk, as when
+// one is moved into a tracked directory and its files show up there as new.
+// Only the subdirectory named like the missing directory is compared, so a
+// directory renamed as it was moved is not found. Returns the matches.
+func (s *BTService) DetectMovedDirectoriesIn(path *Path) ([]*MovedDirectory, error) {
+	dirs, err := s.database.ListDirectories(false)
+	if err != nil {
+		return nil, fmt.Errorf("listing directories: %w", err)
+	}
+
+	var moved []*MovedDirectory
+	for _, dir := range dirs {
+		if !s.isMissing(dir.Path) {
+			continue
+		}
+		p, err := s.fsmgr.Resolve(filepath.Join(path.String(), filepath.Base(dir.Path)))
+		if err != nil || !p.IsDir() {
+			continue
+		}
+		candidate, err := s.compareMovedDirectory(dir, p)
+		if err != nil {
+			return nil, fmt.Errorf("comparing with %s: %w", dir.Path, err)
+		}
+		if candidate.matches() {
+			moved = append(moved, candidate)
+		}
+	}
+	return moved, nil
+}
+
+// compareMovedDirectory hashes up to maxMoveSamples of directory's backed-up
+// files as found under path and counts those matching their current snapshot.
+func (s *BTService) compareMovedDirectory(directory *sqlc.Directory, path *Path) (*MovedDirectory, error) {
+	result := &MovedDirectory{OldPath: directory.Path, NewPath: path.String()}
+
+	files, err := s.database.FindFilesByDirectory(directory)
+	if err != nil {
+		return nil, fmt.Errorf("finding files: %w", err)
+	}
+	files = slices.DeleteFunc(files, func(f *sqlc.File) bool {
+		return f.Deleted || !f.CurrentSnapshotID.Valid
+	})
+	slices.SortFunc(files, func(a, b *sqlc.File) int { return strings.Compare(a.Name, b.Name) })
+
+	for _, file := range files[:min(len(files), maxMoveSamples)] {
+		result.Sampled++
+
+		p, err := s.fsmgr.Resolve(filepath.Join(path.String(), file.Name))
+		if err != nil || p.IsDir() {
+			continue
+		}
+		snapshot, err := s.database.FindFileSnapshotByID(file.CurrentSnapshotID.String)
+		if err != nil {
+			return nil, fmt.Errorf("finding snapshot: %w", err)
+		}
+		if snapshot == nil || snapshot.Size != p.Info().Size() {
+			continue
+		}
+		checksum, err := s.checksumFile(p)
+		if err != nil {
+			continue
+		}
+		if checksum == snapshot.ContentID {
+			result.Matched++
+		}
+	}
+	return result, nil
+}
+
+// checksumFile returns the hex SHA-256 of the file's current content.
+func (s *BTService) checksumFile(path *Path) (string, error) {
+	r, err := s.fsmgr.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isMissing reports whether nothing exists at the directory path anymore.
+func (s *BTService) isMissing(path string) bool {
+	_, err := s.fsmgr.Resolve(path)
+	return errors.Is(err, fs.ErrNotExist)
+}
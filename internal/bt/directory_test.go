@@ -0,0 +1,252 @@
+package bt_test
+
+import (
+	"testing"
+	"time"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/testutil"
+)
+
+func TestBTService_ListDirectories(t *testing.T) {
+	t.Parallel()
+	db := testutil.NewTestDatabase(t)
+	fsmgr := testutil.NewMockFilesystemManager()
+	staging := testutil.NewTestStagingArea(fsmgr)
+	svc := bt.NewBTService(db, staging, testutil.NewTestVault(), fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+	fsmgr.AddDirectory("/home/user/docs")
+	fsmgr.AddFile("/home/user/docs/a.txt", []byte("hello"))
+	fsmgr.AddFile("/home/user/docs/b.txt", []byte("world!"))
+	fsmgr.AddDirectory("/home/user/secret")
+
+	docs, _ := fsmgr.Resolve("/home/user/docs")
+	secret, _ := fsmgr.Resolve("/home/user/secret")
+	svc.AddDirectory(docs, false)
+	svc.AddDirectory(secret, true)
+
+	if _, err := svc.StageFiles(docs, bt.StageOptions{}); err != nil {
+		t.Fatalf("StageFiles() error = %v", err)
+	}
+	if _, err := svc.BackupAll(); err != nil {
+		t.Fatalf("BackupAll() error = %v", err)
+	}
+
+	dirs, err := svc.ListDirectories(false)
+	if err != nil {
+		t.Fatalf("ListDirectories() error = %v", err)
+	}
+	if len(dirs) != 2 {
+		t.Fatalf("got %d directories, want 2", len(dirs))
+	}
+
+	d := dirs[0]
+	if d.Path != "/home/user/docs" || d.Encrypted {
+		t.Errorf("dirs[0] = %s (encrypted %v), want unencrypted /home/user/docs", d.Path, d.Encrypted)
+	}
+	if d.FileCount != 2 || d.TotalSize != 11 {
+		t.Errorf("docs has %d files, %d bytes; want 2 files, 11 bytes", d.FileCount, d.TotalSize)
+	}
+	if d.LastBackupAt.IsZero() {
+		t.Error("docs LastBackupAt should be set")
+	}
+
+	s := dirs[1]
+	if !s.Encrypted || s.FileCount != 0 || !s.LastBackupAt.IsZero() {
+		t.Errorf("secret = %+v, want encrypted with no backups", s)
+	}
+}
+
+func TestBTService_RemoveDirectory(t *testing.T) {
+	setup := func(t *testing.T) (*bt.BTService, *testutil.MockFilesystemManager, bt.Database, bt.StagingArea) {
+		t.Helper()
+		db := testutil.NewTestDatabase(t)
+		fsmgr := testutil.NewMockFilesystemManager()
+		staging := testutil.NewTestStagingArea(fsmgr)
+		svc := bt.NewBTService(db, staging, testutil.NewTestVault(), fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+		fsmgr.AddDirectory("/home/user/docs")
+		fsmgr.AddDirectory("/home/user/docs/sub")
+		fsmgr.AddFile("/home/user/docs/a.txt", []byte("backed up"))
+		fsmgr.AddFile("/home/user/docs/b.txt", []byte("staged"))
+
+		dirPath, _ := fsmgr.Resolve("/home/user/docs")
+		svc.AddDirectory(dirPath, false)
+		a, _ := fsmgr.Resolve("/home/user/docs/a.txt")
+		svc.StageFiles(a, bt.StageOptions{})
+		svc.BackupAll()
+		b, _ := fsmgr.Resolve("/home/user/docs/b.txt")
+		svc.StageFiles(b, bt.StageOptions{})
+		return svc, fsmgr, db, staging
+	}
+
+	t.Run("keeps history and drops staged files", func(t *testing.T) {
+		t.Parallel()
+		svc, _, db, staging := setup(t)
+
+		unstaged, err := svc.RemoveDirectory("/home/user/docs", false)
+		if err != nil {
+			t.Fatalf("RemoveDirectory() error = %v", err)
+		}
+		if unstaged != 1 {
+			t.Errorf("RemoveDirectory() unstaged = %d, want 1", unstaged)
+		}
+		if count, _ := staging.Count(); count != 0 {
+			t.Errorf("staging Count() = %d, want 0", count)
+		}
+
+		tracked, _ := db.ListDirectories(false)
+		if len(tracked) != 0 {
+			t.Errorf("got %d tracked directories, want 0", len(tracked))
+		}
+		all, _ := db.ListDirectories(true)
+		if len(all) != 1 {
+			t.Fatalf("got %d directories including removed, want 1", len(all))
+		}
+		if file, _ := db.FindFileByPath(all[0], "a.txt"); file == nil {
+			t.Error("history should be kept")
+		}
+	})
+
+	t.Run("purge deletes history", func(t *testing.T) {
+		t.Parallel()
+		svc, _, db, _ := setup(t)
+
+		if _, err := svc.RemoveDirectory("/home/user/docs", true); err != nil {
+			t.Fatalf("RemoveDirectory() error = %v", err)
+		}
+
+		all, _ := db.ListDirectories(true)
+		if len(all) != 0 {
+			t.Errorf("got %d directories including removed, want 0", len(all))
+		}
+	})
+
+	t.Run("rejects subdirectory of tracked directory", func(t *testing.T) {
+		t.Parallel()
+		svc, _, _, _ := setup(t)
+
+		if _, err := svc.RemoveDirectory("/home/user/docs/sub", false); err == nil {
+			t.Error("expected error for subdirectory of tracked directory")
+		}
+	})
+
+	t.Run("rejects untracked directory", func(t *testing.T) {
+		t.Parallel()
+		svc, _, _, _ := setup(t)
+
+		if _, err := svc.RemoveDirectory("/elsewhere", false); err == nil {
+			t.Error("expected error for untracked directory")
+		}
+	})
+}
+
+func TestBTService_MoveDirectory(t *testing.T) {
+	// setup backs up /home/user/projects, then moves it on disk to /data/projects.
+	setup := func(t *testing.T) (*bt.BTService, *testutil.MockFilesystemManager, bt.Database) {
+		t.Helper()
+		db := testutil.NewTestDatabase(t)
+		fsmgr := testutil.NewMockFilesystemManager()
+		staging := testutil.NewTestStagingArea(fsmgr)
+		svc := bt.NewBTService(db, staging, testutil.NewTestVault(), fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+		fsmgr.AddDirectory("/home/user/projects")
+		fsmgr.AddFile("/home/user/projects/a.txt", []byte("alpha"))
+		fsmgr.AddFile("/home/user/projects/b.txt", []byte("beta"))
+		dirPath, _ := fsmgr.Resolve("/home/user/projects")
+		svc.AddDirectory(dirPath, false)
+		svc.StageFiles(dirPath, bt.StageOptions{})
+		svc.BackupAll()
+
+		fsmgr.RemoveAll("/home/user/projects")
+		fsmgr.AddDirectory("/data/projects")
+		fsmgr.AddFile("/data/projects/a.txt", []byte("alpha"))
+		fsmgr.AddFile("/data/projects/b.txt", []byte("beta"))
+		return svc, fsmgr, db
+	}
+
+	t.Run("detects the moved directory", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, _ := setup(t)
+
+		newPath, _ := fsmgr.Resolve("/data/projects")
+		moved, err := svc.DetectMovedDirectory(newPath)
+		if err != nil {
+			t.Fatalf("DetectMovedDirectory() error = %v", err)
+		}
+		if moved == nil {
+			t.Fatal("DetectMovedDirectory() = nil, want a match")
+		}
+		if moved.OldPath != "/home/user/projects" || moved.Matched != 2 || moved.Sampled != 2 {
+			t.Errorf("DetectMovedDirectory() = %+v", moved)
+		}
+
+		dirs, _ := svc.ListDirectories(false)
+		if len(dirs) != 1 || !dirs[0].Missing {
+			t.Error("ListDirectories() should flag the old path as missing")
+		}
+	})
+
+	t.Run("detects the directory moved into a tracked one", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, _ := setup(t)
+		fsmgr.AddDirectory("/data")
+		dataPath, _ := fsmgr.Resolve("/data")
+		if err := svc.AddDirectory(dataPath, false); err != nil {
+			t.Fatalf("AddDirectory() error = %v", err)
+		}
+
+		moved, err := svc.DetectMovedDirectoriesIn(dataPath)
+		if err != nil {
+			t.Fatalf("DetectMovedDirectoriesIn() error = %v", err)
+		}
+		if len(moved) != 1 || moved[0].OldPath != "/home/user/projects" || moved[0].NewPath != "/data/projects" {
+			t.Errorf("DetectMovedDirectoriesIn() = %+v", moved)
+		}
+	})
+
+	t.Run("ignores directories with different content", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, _ := setup(t)
+		fsmgr.UpdateFile("/data/projects/a.txt", []byte("ALPHA"), time.Now())
+		fsmgr.UpdateFile("/data/projects/b.txt", []byte("BETA"), time.Now())
+
+		newPath, _ := fsmgr.Resolve("/data/projects")
+		moved, err := svc.DetectMovedDirectory(newPath)
+		if err != nil {
+			t.Fatalf("DetectMovedDirectory() error = %v", err)
+		}
+		if moved != nil {
+			t.Errorf("DetectMovedDirectory() = %+v, want nil", moved)
+		}
+	})
+
+	t.Run("moves history to the new path", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, _ := setup(t)
+
+		newPath, _ := fsmgr.Resolve("/data/projects")
+		trackedAs, _, err := svc.MoveDirectory("/home/user/projects", newPath)
+		if err != nil {
+			t.Fatalf("MoveDirectory() error = %v", err)
+		}
+		if trackedAs != "/data/projects" {
+			t.Errorf("MoveDirectory() tracked as %q, want /data/projects", trackedAs)
+		}
+
+		a, _ := fsmgr.Resolve("/data/projects/a.txt")
+		if history, err := svc.GetFileHistory(a); err != nil || len(history) != 1 {
+			t.Errorf("GetFileHistory() = %d entries, %v; want 1", len(history), err)
+		}
+	})
+
+	t.Run("rejects untracked old path", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, _ := setup(t)
+
+		newPath, _ := fsmgr.Resolve("/data/projects")
+		if _, _, err := svc.MoveDirectory("/nowhere", newPath); err == nil {
+			t.Error("expected error for untracked directory")
+		}
+	})
+}
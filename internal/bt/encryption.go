@@ -0,0 +1,185 @@
+package bt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"bt-go/internal/database/sqlc"
+)
+
+// EncryptionChange summarizes converting a directory between encrypted and
+// unencrypted storage.
+type EncryptionChange struct {
+	// Migrated is how many contents were stored again in the new form.
+	Migrated int
+
+	// Kept is how many contents stayed encrypted while decrypting because a
+	// snapshot in an encrypted directory references them too.
+	Kept int
+}
+
+// SetDirectoryEncryption converts the tracked directory at absPath to
+// encrypted or unencrypted storage. The flag is flipped first, so new backups
+// use the new form, then each content referenced by the directory's history is
+// stored again: encrypting re-uploads plaintext through the Encryptor and
+// turns its record into a virtual one pointing at the ciphertext, as
+// CreateFileSnapshotAndContent does; decrypting uploads the plaintext under
+// its own checksum and drops the pointer. Content is shared by checksum, so
+// encrypting also covers other directories' snapshots of the same content,
+// and decrypting leaves content alone while an encrypted directory still
+// references it.
+// The vault objects no longer referenced are left for garbage collection.
+// Each content is committed on its own, so running the conversion again after
+// an interruption resumes where it stopped.
+// decryptCtx is required when decrypting content; pass nil when encrypting.
+func (s *BTService) SetDirectoryEncryption(absPath string, encrypted bool, decryptCtx DecryptionContext) (*EncryptionChange, error) {
+	directory, err := s.database.FindDirectoryByPath(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("finding directory: %w", err)
+	}
+	if directory == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDirectoryNotTracked, absPath)
+	}
+	if encrypted && !s.encryptor.IsConfigured() {
+		return nil, fmt.Errorf("encryption keys are not configured")
+	}
+
+	if (directory.Encrypted != 0) != encrypted {
+		if err := s.database.SetDirectoryEncrypted(directory, encrypted); err != nil {
+			return nil, fmt.Errorf("updating directory: %w", err)
+		}
+	}
+
+	contents, err := s.database.FindContentsByDirectory(directory)
+	if err != nil {
+		return nil, fmt.Errorf("finding contents: %w", err)
+	}
+
+	change := &EncryptionChange{}
+	for _, content := range contents {
+		if content.EncryptedContentID.Valid == encrypted {
+			continue // already in the target form
+		}
+
+		if !encrypted {
+			shared, err := s.database.IsContentInEncryptedDirectory(content.ID)
+			if err != nil {
+				return change, fmt.Errorf("checking content %s: %w", content.ID, err)
+			}
+			if shared {
+				change.Kept++
+				continue
+			}
+		}
+
+		if encrypted {
+			err = s.encryptContent(content)
+		} else {
+			err = s.decryptContent(content, decryptCtx)
+		}
+		if err != nil {
+			return change, fmt.Errorf("migrating content %s: %w", content.ID, err)
+		}
+		change.Migrated++
+	}
+
+	s.logger.Info("directory encryption changed", "path", absPath, "encrypted", encrypted, "migrated", change.Migrated, "kept", change.Kept)
+	return change, nil
+}
+
+// encryptContent re-uploads plaintext content through the Encryptor and points
+// its record at the ciphertext.
+func (s *BTService) encryptContent(content *sqlc.Content) error {
+	h := sha256.New()
+	var encChecksum string
+	err := s.readContent(content.ID, func(r io.Reader) error {
+		var err error
+		encChecksum, err = s.uploadEncrypted(content.ID, io.TeeReader(r, h))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != content.ID {
+		return fmt.Errorf("vault content has checksum %s", checksum)
+	}
+
+	if err := s.database.UpdateContentEncryption(content.ID, encChecksum); err != nil {
+		return fmt.Errorf("recording encrypted content: %w", err)
+	}
+	if err := s.recordConvergent(encChecksum); err != nil {
+		return err
+	}
+	s.addRewriteToManifest(content.ID, encChecksum)
+	return nil
+}
+
+// decryptContent uploads the plaintext of encrypted content under its own
+// checksum and points its record back at it.
+func (s *BTService) decryptContent(content *sqlc.Content, decryptCtx DecryptionContext) error {
+	if decryptCtx == nil {
+		return fmt.Errorf("content is encrypted but no passphrase was provided")
+	}
+
+	tmp, err := os.CreateTemp("", "bt-dec-*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating decrypted temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	err = s.readContent(content.EncryptedContentID.String, func(r io.Reader) error {
+		return decryptCtx.Decrypt(r, io.MultiWriter(tmp, h))
+	})
+	if err != nil {
+		return fmt.Errorf("decrypting content: %w", err)
+	}
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != content.ID {
+		return fmt.Errorf("decrypted content has checksum %s", checksum)
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat decrypted temp file: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking decrypted temp file: %w", err)
+	}
+	if err := s.vault.PutContent(content.ID, tmp, info.Size()); err != nil {
+		return fmt.Errorf("uploading to vault: %w", err)
+	}
+
+	if err := s.database.UpdateContentEncryption(content.ID, ""); err != nil {
+		return fmt.Errorf("recording decrypted content: %w", err)
+	}
+	s.addRewriteToManifest(content.ID, "")
+	return nil
+}
+
+// readContent streams the vault object with the given checksum to consume
+// without an intermediate buffer.
+func (s *BTService) readContent(checksum string, consume func(r io.Reader) error) error {
+	pr, pw := io.Pipe()
+	vaultErrCh := make(chan error, 1)
+	go func() {
+		err := s.vault.GetContent(checksum, pw)
+		pw.CloseWithError(err)
+		vaultErrCh <- err
+	}()
+
+	consumeErr := consume(pr)
+	pr.CloseWithError(consumeErr) // unblock goroutine if consume failed early
+	vaultErr := <-vaultErrCh
+
+	if consumeErr != nil {
+		return consumeErr
+	}
+	if vaultErr != nil {
+		return fmt.Errorf("retrieving content from vault: %w", vaultErr)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package bt_test
+
+import (
+	"bytes"
+	"testing"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/encryption"
+	"bt-go/internal/testutil"
+)
+
+func TestBTService_SetDirectoryEncryption(t *testing.T) {
+	// setup backs up one file in each of /home/user/docs and /home/user/secret,
+	// with the given encryption flags.
+	setup := func(t *testing.T, docsEncrypted, secretEncrypted bool) (*bt.BTService, bt.Database, bt.Vault) {
+		t.Helper()
+		db := testutil.NewTestDatabase(t)
+		fsmgr := testutil.NewMockFilesystemManager()
+		staging := testutil.NewTestStagingArea(fsmgr)
+		vault := testutil.NewTestVault()
+		svc := bt.NewBTService(db, staging, vault, fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+		fsmgr.AddDirectory("/home/user/docs")
+		fsmgr.AddFile("/home/user/docs/a.txt", []byte("alpha"))
+		fsmgr.AddDirectory("/home/user/secret")
+		fsmgr.AddFile("/home/user/secret/s.txt", []byte("secret"))
+
+		docs, _ := fsmgr.Resolve("/home/user/docs")
+		secret, _ := fsmgr.Resolve("/home/user/secret")
+		svc.AddDirectory(docs, docsEncrypted)
+		svc.AddDirectory(secret, secretEncrypted)
+		svc.StageFiles(docs, bt.StageOptions{})
+		svc.StageFiles(secret, bt.StageOptions{})
+		if _, err := svc.BackupAll(); err != nil {
+			t.Fatalf("BackupAll() error = %v", err)
+		}
+		return svc, db, vault
+	}
+	// readContent returns the plaintext the vault holds for content, decrypting
+	// it if the record points at ciphertext.
+	readContent := func(t *testing.T, db bt.Database, vault bt.Vault, content []byte) (string, bool) {
+		t.Helper()
+		record, err := db.FindContentByChecksum(testutil.SHA256Hex(content))
+		if err != nil || record == nil {
+			t.Fatalf("FindContentByChecksum() = %v, %v", record, err)
+		}
+		var buf bytes.Buffer
+		if !record.EncryptedContentID.Valid {
+			if err := vault.GetContent(record.ID, &buf); err != nil {
+				t.Fatalf("GetContent() error = %v", err)
+			}
+			return buf.String(), false
+		}
+		var enc bytes.Buffer
+		if err := vault.GetContent(record.EncryptedContentID.String, &enc); err != nil {
+			t.Fatalf("GetContent(encrypted) error = %v", err)
+		}
+		if err := (&encryption.TestDecryptionContext{}).Decrypt(&enc, &buf); err != nil {
+			t.Fatalf("Decrypt() error = %v", err)
+		}
+		return buf.String(), true
+	}
+
+	t.Run("encrypt migrates existing history", func(t *testing.T) {
+		t.Parallel()
+		svc, db, vault := setup(t, false, false)
+
+		change, err := svc.SetDirectoryEncryption("/home/user/docs", true, nil)
+		if err != nil {
+			t.Fatalf("SetDirectoryEncryption() error = %v", err)
+		}
+		if change.Migrated != 1 {
+			t.Errorf("Migrated = %d, want 1", change.Migrated)
+		}
+
+		if dir, _ := db.FindDirectoryByPath("/home/user/docs"); dir.Encrypted == 0 {
+			t.Error("directory should be marked encrypted")
+		}
+		if got, encrypted := readContent(t, db, vault, []byte("alpha")); !encrypted || got != "alpha" {
+			t.Errorf("docs content = %q (encrypted %v), want encrypted alpha", got, encrypted)
+		}
+		if _, encrypted := readContent(t, db, vault, []byte("secret")); encrypted {
+			t.Error("other directories' content should be left alone")
+		}
+
+		// Running again resumes with nothing left to migrate.
+		change, err = svc.SetDirectoryEncryption("/home/user/docs", true, nil)
+		if err != nil || change.Migrated != 0 {
+			t.Errorf("second SetDirectoryEncryption() = %+v, %v; want nothing migrated", change, err)
+		}
+	})
+
+	t.Run("decrypt migrates existing history", func(t *testing.T) {
+		t.Parallel()
+		svc, db, vault := setup(t, true, false)
+
+		if _, err := svc.SetDirectoryEncryption("/home/user/docs", false, nil); err == nil {
+			t.Fatal("expected error decrypting without a passphrase")
+		}
+
+		change, err := svc.SetDirectoryEncryption("/home/user/docs", false, &encryption.TestDecryptionContext{})
+		if err != nil {
+			t.Fatalf("SetDirectoryEncryption() error = %v", err)
+		}
+		if change.Migrated != 1 || change.Kept != 0 {
+			t.Errorf("SetDirectoryEncryption() = %+v, want 1 migrated", change)
+		}
+		if got, encrypted := readContent(t, db, vault, []byte("alpha")); encrypted || got != "alpha" {
+			t.Errorf("docs content = %q (encrypted %v), want plaintext alpha", got, encrypted)
+		}
+	})
+
+	t.Run("decrypt keeps content shared with encrypted directories", func(t *testing.T) {
+		t.Parallel()
+		db := testutil.NewTestDatabase(t)
+		fsmgr := testutil.NewMockFilesystemManager()
+		staging := testutil.NewTestStagingArea(fsmgr)
+		vault := testutil.NewTestVault()
+		svc := bt.NewBTService(db, staging, vault, fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+		for _, dir := range []string{"/home/user/a", "/home/user/b"} {
+			fsmgr.AddDirectory(dir)
+			fsmgr.AddFile(dir+"/same.txt", []byte("shared"))
+			p, _ := fsmgr.Resolve(dir)
+			svc.AddDirectory(p, true)
+			svc.StageFiles(p, bt.StageOptions{})
+		}
+		svc.BackupAll()
+
+		change, err := svc.SetDirectoryEncryption("/home/user/a", false, &encryption.TestDecryptionContext{})
+		if err != nil {
+			t.Fatalf("SetDirectoryEncryption() error = %v", err)
+		}
+		if change.Migrated != 0 || change.Kept != 1 {
+			t.Errorf("SetDirectoryEncryption() = %+v, want 1 kept", change)
+		}
+		if _, encrypted := readContent(t, db, vault, []byte("shared")); !encrypted {
+			t.Error("shared content should stay encrypted")
+		}
+	})
+
+	t.Run("rejects untracked directory", func(t *testing.T) {
+		t.Parallel()
+		svc, _, _ := setup(t, false, false)
+
+		if _, err := svc.SetDirectoryEncryption("/elsewhere", true, nil); err == nil {
+			t.Error("expected error for untracked directory")
+		}
+	})
+}
@@ -16,13 +16,48 @@ type Encryptor interface {
 	// Uses the public key only — no passphrase required.
 	Encrypt(r io.Reader, w io.Writer) error
 
+	// EncryptContent encrypts file content read from r, whose plaintext
+	// checksum is checksum, and writes ciphertext to w. In convergent mode the
+	// ciphertext depends only on the plaintext and the convergence secret, so
+	// identical files encrypt identically; otherwise it is the same as Encrypt.
+	EncryptContent(checksum string, r io.Reader, w io.Writer) error
+
+	// Convergent returns true if EncryptContent encrypts with the convergence
+	// secret, so its output does not change when the key pair does.
+	Convergent() bool
+
 	// Unlock decrypts the private key using the passphrase and returns a
 	// DecryptionContext that can decrypt data for the duration of the session.
 	// Returns an error if the passphrase is incorrect.
 	Unlock(passphrase string) (DecryptionContext, error)
 
+	// UnlockIdentityFile returns a DecryptionContext for the identity file at
+	// path, such as a recovery key or an SSH private key whose public key is
+	// one of the configured recipients, instead of the configured private key.
+	// passphrase is only called if the file is protected by one.
+	UnlockIdentityFile(path string, passphrase func() (string, error)) (DecryptionContext, error)
+
 	// IsConfigured returns true if both key files exist at configured paths.
 	IsConfigured() bool
+
+	// ChangePassphrase unlocks the private key with oldPassphrase and stores
+	// the same key protected by newPassphrase instead, replacing the key file
+	// atomically. Returns an error if oldPassphrase is incorrect.
+	ChangePassphrase(oldPassphrase string, newPassphrase string) error
+
+	// BeginRotation starts replacing the key pair, or resumes a rotation that
+	// was interrupted. It unlocks the current private key with the passphrase,
+	// then generates a new key pair protected by the same passphrase and makes
+	// it current, so Encrypt uses it from then on. The previous pair is kept
+	// until FinishRotation. Returns a DecryptionContext for the previous key.
+	BeginRotation(passphrase string) (DecryptionContext, error)
+
+	// RotationInProgress returns true between BeginRotation and FinishRotation.
+	RotationInProgress() bool
+
+	// FinishRotation deletes the previous key pair once nothing is encrypted
+	// to it anymore.
+	FinishRotation() error
 }
 
 // DecryptionContext holds an unlocked private key in memory for the duration
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"io"
 	"io/fs"
+	"iter"
 	"time"
 )
 
@@ -17,6 +18,20 @@ type StatData struct {
 	BirthTime sql.NullTime
 }
 
+// Exclusion is a file or directory that discovery leaves out of backups.
+type Exclusion struct {
+	Path   string // absolute path
+	IsDir  bool
+	Reason string
+}
+
+// WalkEntry is something Walk finds: either a regular file to back up, File,
+// or a file or directory left out, Exclusion.
+type WalkEntry struct {
+	File      *Path
+	Exclusion *Exclusion
+}
+
 // FilesystemManager provides an interface for filesystem operations.
 // It abstracts file access to enable testing without touching the real filesystem.
 type FilesystemManager interface {
@@ -37,14 +52,29 @@ type FilesystemManager interface {
 	// This includes uid, gid, atime, ctime, and birthtime where available.
 	ExtractStatData(info fs.FileInfo) (*StatData, error)
 
-	// FindFiles discovers regular files under the given directory path.
-	// If recursive is false, only files directly in the directory are returned.
+	// WalkFiles discovers regular files under the given directory path,
+	// yielding them one at a time in lexical order as they are found rather
+	// than collecting the whole tree first. A discovery error is yielded with
+	// a nil Path and ends the sequence.
+	// dirRoot is the tracked directory containing path; ignore files and
+	// per-directory exclusion settings are resolved relative to it.
+	// If recursive is false, only files directly in the directory are yielded.
 	// If recursive is true, files in all subdirectories are included.
 	// Symlinks, devices, and other special files are skipped.
-	// Ignored files (from hard-coded patterns, config, and .btignore) are excluded.
-	FindFiles(path *Path, recursive bool) ([]*Path, error)
+	// Excluded files and directories (see ExclusionReason) are left out, and
+	// excluded directories are not walked.
+	WalkFiles(path *Path, dirRoot string, recursive bool) iter.Seq2[*Path, error]
+
+	// Walk walks like WalkFiles but also yields what WalkFiles leaves out,
+	// with the reason, in the same pass. An excluded directory is yielded
+	// once, without its contents.
+	Walk(path *Path, dirRoot string, recursive bool) iter.Seq2[*WalkEntry, error]
 
-	// IsIgnored checks whether a file path should be ignored based on
-	// ignore rules (hard-coded patterns, config patterns, and .btignore in dirRoot).
-	IsIgnored(path *Path, dirRoot string) (bool, error)
+	// ExclusionReason reports why a file within the tracked directory dirRoot
+	// is excluded from backups, or "" if it is not. Files are excluded by
+	// ignore patterns (hard-coded, config, .btignore and optionally
+	// .gitignore), by size, or by being inside an excluded directory: one
+	// that is ignored, tagged with CACHEDIR.TAG, holds an exclude-if-present
+	// marker file, or is on another filesystem.
+	ExclusionReason(path *Path, dirRoot string) (string, error)
 }
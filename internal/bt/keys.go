@@ -0,0 +1,100 @@
+package bt
+
+import (
+	"fmt"
+	"io"
+)
+
+// RotateKeys replaces the encryption key pair and re-encrypts every encrypted
+// content in the vault to the new one. Encrypted content is queued in the
+// database before the new key pair is made current, so everything queued is
+// encrypted to the previous key and everything backed up afterwards to the new
+// one. In convergent mode, convergent content is not queued: it is encrypted
+// with the convergence secret, which the rotation does not change; otherwise
+// it is re-encrypted to the new key pair like the rest. Each content is
+// re-encrypted, uploaded, and swapped in on its own, so running RotateKeys
+// again after an interruption resumes with the content still queued; the
+// previous key pair is only deleted once the queue is empty. The old ciphertext is left in the
+// vault, unreferenced. reencryptMetadata, if not nil, is called with the
+// previous key once the content is done and before the previous key pair is
+// deleted, to re-encrypt whatever else is encrypted to it.
+// Returns the number of contents re-encrypted.
+func (s *BTService) RotateKeys(passphrase string, reencryptMetadata func(previous DecryptionContext) error) (int, error) {
+	if !s.encryptor.RotationInProgress() {
+		if err := s.database.StartKeyRotation(s.encryptor.Convergent()); err != nil {
+			return 0, fmt.Errorf("starting key rotation: %w", err)
+		}
+	}
+
+	previous, err := s.encryptor.BeginRotation(passphrase)
+	if err != nil {
+		return 0, fmt.Errorf("replacing key pair: %w", err)
+	}
+
+	pending, err := s.database.FindKeyRotationPending()
+	if err != nil {
+		return 0, fmt.Errorf("finding content to re-encrypt: %w", err)
+	}
+	s.logger.Info("key rotation started", "pending", len(pending))
+
+	count := 0
+	for _, oldID := range pending {
+		checksum, newID, err := s.reencryptContent(oldID, previous)
+		if err != nil {
+			return count, fmt.Errorf("re-encrypting content %s: %w", oldID, err)
+		}
+		if err := s.database.ReplaceEncryptedContent(oldID, newID); err != nil {
+			return count, fmt.Errorf("recording re-encrypted content %s: %w", oldID, err)
+		}
+		if err := s.recordConvergent(newID); err != nil {
+			return count, err
+		}
+		s.addRewriteToManifest(checksum, newID)
+		count++
+	}
+
+	if reencryptMetadata != nil {
+		if err := reencryptMetadata(previous); err != nil {
+			return count, fmt.Errorf("re-encrypting metadata: %w", err)
+		}
+	}
+
+	if err := s.encryptor.FinishRotation(); err != nil {
+		return count, fmt.Errorf("removing previous key pair: %w", err)
+	}
+
+	s.logger.Info("key rotation complete", "count", count)
+	return count, nil
+}
+
+// reencryptContent decrypts the vault object oldID with previous, encrypts it
+// to the current key, and uploads it, returning the plaintext checksum and the
+// new checksum. Plaintext is streamed between the two without touching disk.
+// The plaintext checksum is looked up rather than computed, since convergent
+// encryption needs it before the first byte is encrypted.
+func (s *BTService) reencryptContent(oldID string, previous DecryptionContext) (string, string, error) {
+	checksum, err := s.database.FindPlaintextChecksum(oldID)
+	if err != nil {
+		return "", "", err
+	}
+	if checksum == "" {
+		return "", "", fmt.Errorf("no content record points at %s", oldID)
+	}
+
+	var newID string
+	err = s.readContent(oldID, func(r io.Reader) error {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(previous.Decrypt(r, pw))
+		}()
+
+		var err error
+		newID, err = s.uploadEncrypted(checksum, pr)
+		pr.CloseWithError(err) // unblock Decrypt if the upload failed early
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return checksum, newID, nil
+}
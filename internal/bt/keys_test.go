@@ -0,0 +1,188 @@
+package bt_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/encryption"
+	"bt-go/internal/testutil"
+)
+
+// failingVault fails PutContent once fail is set.
+type failingVault struct {
+	bt.Vault
+	fail bool
+}
+
+func (v *failingVault) PutContent(checksum string, r io.Reader, size int64) error {
+	if v.fail {
+		return errors.New("vault unavailable")
+	}
+	return v.Vault.PutContent(checksum, r, size)
+}
+
+func TestBTService_RotateKeys(t *testing.T) {
+	// setup backs up two files from an encrypted directory and one from an
+	// unencrypted one.
+	setup := func(t *testing.T) (*bt.BTService, bt.Database, *failingVault, *encryption.TestEncryptor) {
+		t.Helper()
+		db := testutil.NewTestDatabase(t)
+		fsmgr := testutil.NewMockFilesystemManager()
+		staging := testutil.NewTestStagingArea(fsmgr)
+		vault := &failingVault{Vault: testutil.NewTestVault()}
+		enc := encryption.NewTestEncryptor()
+		svc := bt.NewBTService(db, staging, vault, fsmgr, enc, bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+		fsmgr.AddDirectory("/home/user/secret")
+		fsmgr.AddFile("/home/user/secret/a.txt", []byte("alpha"))
+		fsmgr.AddFile("/home/user/secret/b.txt", []byte("beta"))
+		fsmgr.AddDirectory("/home/user/docs")
+		fsmgr.AddFile("/home/user/docs/c.txt", []byte("gamma"))
+
+		secret, _ := fsmgr.Resolve("/home/user/secret")
+		docs, _ := fsmgr.Resolve("/home/user/docs")
+		svc.AddDirectory(secret, true)
+		svc.AddDirectory(docs, false)
+		svc.StageFiles(secret, bt.StageOptions{})
+		svc.StageFiles(docs, bt.StageOptions{})
+		if _, err := svc.BackupAll(); err != nil {
+			t.Fatalf("BackupAll() error = %v", err)
+		}
+		return svc, db, vault, enc
+	}
+	// decrypt returns the plaintext of content via its encrypted record,
+	// using the encryptor's current key.
+	decrypt := func(t *testing.T, db bt.Database, vault bt.Vault, enc *encryption.TestEncryptor, content string) (string, error) {
+		t.Helper()
+		record, _ := db.FindContentByChecksum(testutil.SHA256Hex([]byte(content)))
+		if record == nil || !record.EncryptedContentID.Valid {
+			t.Fatalf("content %q should be encrypted, got %+v", content, record)
+		}
+		var ciphertext, plaintext bytes.Buffer
+		if err := vault.GetContent(record.EncryptedContentID.String, &ciphertext); err != nil {
+			t.Fatalf("GetContent() error = %v", err)
+		}
+		ctx, _ := enc.Unlock("")
+		err := ctx.Decrypt(&ciphertext, &plaintext)
+		return plaintext.String(), err
+	}
+
+	t.Run("re-encrypts all encrypted content to the new key", func(t *testing.T) {
+		t.Parallel()
+		svc, db, vault, enc := setup(t)
+		svc.TakeManifest()
+
+		var hooked bool
+		count, err := svc.RotateKeys("passphrase", func(previous bt.DecryptionContext) error {
+			hooked = enc.RotationInProgress()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("RotateKeys() error = %v", err)
+		}
+		if count != 2 {
+			t.Errorf("RotateKeys() = %d, want 2", count)
+		}
+		if !hooked {
+			t.Error("metadata should be re-encrypted before the previous key is deleted")
+		}
+		entries := svc.TakeManifest()
+		if len(entries) != 2 {
+			t.Errorf("TakeManifest() = %d entries, want 2 rewrites", len(entries))
+		}
+		for _, entry := range entries {
+			record, _ := db.FindContentByChecksum(entry.ContentID)
+			if !entry.Rewrite || entry.EncryptedContentID != record.EncryptedContentID.String {
+				t.Errorf("manifest entry = %+v, want a rewrite to %s", entry, record.EncryptedContentID.String)
+			}
+		}
+		if enc.RotationInProgress() {
+			t.Error("rotation should be finished")
+		}
+		for _, content := range []string{"alpha", "beta"} {
+			if got, err := decrypt(t, db, vault, enc, content); err != nil || got != content {
+				t.Errorf("decrypt(%q) = %q, %v", content, got, err)
+			}
+		}
+		if record, _ := db.FindContentByChecksum(testutil.SHA256Hex([]byte("gamma"))); record.EncryptedContentID.Valid {
+			t.Error("unencrypted content should be left alone")
+		}
+		if pending, _ := db.FindKeyRotationPending(); len(pending) != 0 {
+			t.Errorf("FindKeyRotationPending() = %v, want empty", pending)
+		}
+	})
+
+	t.Run("resumes an interrupted rotation", func(t *testing.T) {
+		t.Parallel()
+		svc, db, vault, enc := setup(t)
+
+		vault.fail = true
+		if _, err := svc.RotateKeys("passphrase", nil); err == nil {
+			t.Fatal("expected error while the vault is failing")
+		}
+		if !enc.RotationInProgress() {
+			t.Fatal("rotation should still be in progress")
+		}
+		if pending, _ := db.FindKeyRotationPending(); len(pending) != 2 {
+			t.Fatalf("FindKeyRotationPending() = %v, want 2 left", pending)
+		}
+
+		vault.fail = false
+		count, err := svc.RotateKeys("passphrase", nil)
+		if err != nil {
+			t.Fatalf("resumed RotateKeys() error = %v", err)
+		}
+		if count != 2 {
+			t.Errorf("resumed RotateKeys() = %d, want 2", count)
+		}
+		for _, content := range []string{"alpha", "beta"} {
+			if got, err := decrypt(t, db, vault, enc, content); err != nil || got != content {
+				t.Errorf("decrypt(%q) = %q, %v", content, got, err)
+			}
+		}
+	})
+	t.Run("leaves convergent content out", func(t *testing.T) {
+		t.Parallel()
+		db := testutil.NewTestDatabase(t)
+		fsmgr := testutil.NewMockFilesystemManager()
+		staging := testutil.NewTestStagingArea(fsmgr)
+		vault := testutil.NewTestVault()
+		enc := encryption.NewTestEncryptor()
+		svc := bt.NewBTService(db, staging, vault, fsmgr, enc, bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+		fsmgr.AddDirectory("/home/user/secret")
+		fsmgr.AddFile("/home/user/secret/a.txt", []byte("alpha"))
+		secret, _ := fsmgr.Resolve("/home/user/secret")
+		svc.AddDirectory(secret, true)
+		svc.StageFiles(secret, bt.StageOptions{})
+		if _, err := svc.BackupAll(); err != nil {
+			t.Fatalf("BackupAll() error = %v", err)
+		}
+		enc.SetConvergent(true)
+		fsmgr.AddFile("/home/user/secret/b.txt", []byte("beta"))
+		svc.StageFiles(secret, bt.StageOptions{})
+		if _, err := svc.BackupAll(); err != nil {
+			t.Fatalf("BackupAll() error = %v", err)
+		}
+		convergent, _ := db.FindContentByChecksum(testutil.SHA256Hex([]byte("beta")))
+
+		count, err := svc.RotateKeys("passphrase", nil)
+		if err != nil {
+			t.Fatalf("RotateKeys() error = %v", err)
+		}
+		if count != 1 {
+			t.Errorf("RotateKeys() = %d, want only the content encrypted to the key pair", count)
+		}
+		if record, _ := db.FindContentByChecksum(convergent.ID); record.EncryptedContentID != convergent.EncryptedContentID {
+			t.Errorf("convergent content moved to %s, want it left at %s", record.EncryptedContentID.String, convergent.EncryptedContentID.String)
+		}
+		for _, content := range []string{"alpha", "beta"} {
+			if got, err := decrypt(t, db, vault, enc, content); err != nil || got != content {
+				t.Errorf("decrypt(%q) = %q, %v", content, got, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package bt
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileEntry describes a backed-up file as of its current snapshot.
+type FileEntry struct {
+	Path            string // absolute, as on the host that backed it up
+	ContentChecksum string
+	Size            int64
+	ModifiedAt      time.Time
+	BackedUpAt      time.Time
+}
+
+// ListFiles returns the backed-up files at or under absPath, sorted by path.
+// absPath is a tracked directory, or a file or subdirectory within one; it
+// need not exist on disk. Deleted files are left out.
+func (s *BTService) ListFiles(absPath string) ([]*FileEntry, error) {
+	s.logger.Debug("listing files", "path", absPath)
+
+	directory, err := s.database.SearchDirectoryForPath(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("searching for directory: %w", err)
+	}
+	if directory == nil {
+		return nil, fmt.Errorf("path is not within a tracked directory: %s", absPath)
+	}
+
+	prefix, err := filepath.Rel(directory.Path, absPath)
+	if err != nil {
+		return nil, fmt.Errorf("calculating relative path: %w", err)
+	}
+
+	files, err := s.database.FindFilesByDirectory(directory)
+	if err != nil {
+		return nil, fmt.Errorf("finding files: %w", err)
+	}
+
+	var entries []*FileEntry
+	for _, file := range files {
+		if file.Deleted || !file.CurrentSnapshotID.Valid {
+			continue
+		}
+		if prefix != "." && file.Name != prefix && !strings.HasPrefix(file.Name, prefix+string(filepath.Separator)) {
+			continue
+		}
+
+		snapshot, err := s.resolveSnapshot(file, "")
+		if err != nil {
+			return nil, fmt.Errorf("resolving snapshot for %s: %w", file.Name, err)
+		}
+		entries = append(entries, &FileEntry{
+			Path:            filepath.Join(directory.Path, file.Name),
+			ContentChecksum: snapshot.ContentID,
+			Size:            snapshot.Size,
+			ModifiedAt:      snapshot.ModifiedAt,
+			BackedUpAt:      snapshot.CreatedAt,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
@@ -0,0 +1,65 @@
+package bt_test
+
+import (
+	"testing"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/testutil"
+)
+
+func TestBTService_ListFiles(t *testing.T) {
+	db := testutil.NewTestDatabase(t)
+	fsmgr := testutil.NewMockFilesystemManager()
+	staging := testutil.NewTestStagingArea(fsmgr)
+	vault := testutil.NewTestVault()
+	svc := bt.NewBTService(db, staging, vault, fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+	fsmgr.AddDirectory("/home/user/docs")
+	fsmgr.AddFile("/home/user/docs/b.txt", []byte("bb"))
+	fsmgr.AddFile("/home/user/docs/sub/a.txt", []byte("a"))
+	fsmgr.AddFile("/home/user/docs/subway.txt", []byte("sw"))
+	dirPath, _ := fsmgr.Resolve("/home/user/docs")
+	svc.AddDirectory(dirPath, false)
+	svc.StageFiles(dirPath, bt.StageOptions{Recursive: true})
+	if _, err := svc.BackupAll(); err != nil {
+		t.Fatalf("BackupAll() error = %v", err)
+	}
+
+	paths := func(entries []*bt.FileEntry) []string {
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Path)
+		}
+		return got
+	}
+
+	t.Run("directory lists all files sorted", func(t *testing.T) {
+		entries, err := svc.ListFiles("/home/user/docs")
+		if err != nil {
+			t.Fatalf("ListFiles() error = %v", err)
+		}
+		want := []string{"/home/user/docs/b.txt", "/home/user/docs/sub/a.txt", "/home/user/docs/subway.txt"}
+		if got := paths(entries); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Errorf("ListFiles() = %v, want %v", got, want)
+		}
+		if entries[0].Size != 2 || entries[0].ContentChecksum == "" || entries[0].BackedUpAt.IsZero() {
+			t.Errorf("entry = %+v", entries[0])
+		}
+	})
+
+	t.Run("subdirectory lists only the files under it", func(t *testing.T) {
+		entries, err := svc.ListFiles("/home/user/docs/sub")
+		if err != nil {
+			t.Fatalf("ListFiles() error = %v", err)
+		}
+		if got := paths(entries); len(got) != 1 || got[0] != "/home/user/docs/sub/a.txt" {
+			t.Errorf("ListFiles() = %v", got)
+		}
+	})
+
+	t.Run("untracked path returns error", func(t *testing.T) {
+		if _, err := svc.ListFiles("/home/user/other"); err == nil {
+			t.Fatal("expected error for untracked path")
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package bt
+
+import (
+	"fmt"
+	"time"
+
+	"bt-go/internal/database/sqlc"
+)
+
+// ManifestEntry records one file a backup operation backed up: where it
+// lives, the content that holds it and the snapshot of its metadata. The
+// entries of every operation are uploaded to the vault as a manifest, apart
+// from the metadata database, so that the content can be found by name
+// again if the database and its copies in the vault are all lost.
+//
+// Content stored again after it was backed up, by key rotation or by
+// converting a directory between encrypted and unencrypted storage, is
+// recorded by a rewrite entry instead: it names no file, only ContentID and
+// where that is now stored, EncryptedContentID or plaintext if that is empty.
+type ManifestEntry struct {
+	Rewrite            bool       `json:"rewrite,omitempty"`
+	Directory          string     `json:"directory"`
+	Encrypted          bool       `json:"encrypted"` // whether the directory is encrypted
+	Path               string     `json:"path"`      // relative to Directory
+	ContentID          string     `json:"content_id"`
+	EncryptedContentID string     `json:"encrypted_content_id,omitempty"`
+	Size               int64      `json:"size"`
+	Permissions        int64      `json:"permissions"`
+	Uid                int64      `json:"uid"`
+	Gid                int64      `json:"gid"`
+	BackedUpAt         time.Time  `json:"backed_up_at"`
+	AccessedAt         time.Time  `json:"accessed_at"`
+	ModifiedAt         time.Time  `json:"modified_at"`
+	ChangedAt          time.Time  `json:"changed_at"`
+	BornAt             *time.Time `json:"born_at,omitempty"`
+}
+
+// TakeManifest returns the files backed up and the content rewritten since it
+// was last called, in the order they happened, and starts a new list.
+func (s *BTService) TakeManifest() []*ManifestEntry {
+	entries := s.manifest
+	s.manifest = nil
+	return entries
+}
+
+// addToManifest records a backed-up file for TakeManifest.
+func (s *BTService) addToManifest(directoryID string, relativePath string, snapshot *sqlc.FileSnapshot, encryptedContentID string) error {
+	dir, err := s.database.FindDirectoryByID(directoryID)
+	if err != nil {
+		return fmt.Errorf("finding directory: %w", err)
+	}
+	if dir == nil {
+		return fmt.Errorf("directory not found: %s", directoryID)
+	}
+
+	entry := &ManifestEntry{
+		Directory:          dir.Path,
+		Encrypted:          dir.Encrypted != 0,
+		Path:               relativePath,
+		ContentID:          snapshot.ContentID,
+		EncryptedContentID: encryptedContentID,
+		Size:               snapshot.Size,
+		Permissions:        snapshot.Permissions,
+		Uid:                snapshot.Uid,
+		Gid:                snapshot.Gid,
+		BackedUpAt:         snapshot.CreatedAt,
+		AccessedAt:         snapshot.AccessedAt,
+		ModifiedAt:         snapshot.ModifiedAt,
+		ChangedAt:          snapshot.ChangedAt,
+	}
+	if snapshot.BornAt.Valid {
+		entry.BornAt = &snapshot.BornAt.Time
+	}
+	s.manifest = append(s.manifest, entry)
+	return nil
+}
+
+// addRewriteToManifest records for TakeManifest that the content with the
+// given plaintext checksum is now stored as encryptedContentID, or as
+// plaintext if that is empty.
+func (s *BTService) addRewriteToManifest(checksum string, encryptedContentID string) {
+	s.manifest = append(s.manifest, &ManifestEntry{
+		Rewrite:            true,
+		ContentID:          checksum,
+		EncryptedContentID: encryptedContentID,
+	})
+}
+
+// Snapshot returns the file snapshot the entry records, with a new ID.
+func (e *ManifestEntry) Snapshot(id string) *sqlc.FileSnapshot {
+	snapshot := &sqlc.FileSnapshot{
+		ID:          id,
+		ContentID:   e.ContentID,
+		CreatedAt:   e.BackedUpAt,
+		Size:        e.Size,
+		Permissions: e.Permissions,
+		Uid:         e.Uid,
+		Gid:         e.Gid,
+		AccessedAt:  e.AccessedAt,
+		ModifiedAt:  e.ModifiedAt,
+		ChangedAt:   e.ChangedAt,
+	}
+	if e.BornAt != nil {
+		snapshot.BornAt.Time = *e.BornAt
+		snapshot.BornAt.Valid = true
+	}
+	return snapshot
+}
@@ -0,0 +1,58 @@
+package bt_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/testutil"
+)
+
+func TestBTService_TakeManifest(t *testing.T) {
+	db := testutil.NewTestDatabase(t)
+	fsmgr := testutil.NewMockFilesystemManager()
+	staging := testutil.NewTestStagingArea(fsmgr)
+	vault := testutil.NewTestVault()
+	svc := bt.NewBTService(db, staging, vault, fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+	if entries := svc.TakeManifest(); len(entries) != 0 {
+		t.Fatalf("TakeManifest() before any backup = %v", entries)
+	}
+
+	fsmgr.AddDirectory("/home/user/docs")
+	fsmgr.AddFile("/home/user/docs/a.txt", []byte("same"))
+	fsmgr.AddFile("/home/user/docs/sub/b.txt", []byte("same")) // deduplicated
+	dirPath, _ := fsmgr.Resolve("/home/user/docs")
+	svc.AddDirectory(dirPath, true)
+	svc.StageFiles(dirPath, bt.StageOptions{Recursive: true})
+	if _, err := svc.BackupAll(); err != nil {
+		t.Fatalf("BackupAll() error = %v", err)
+	}
+
+	entries := svc.TakeManifest()
+	if len(entries) != 2 {
+		t.Fatalf("TakeManifest() = %d entries, want 2", len(entries))
+	}
+	paths := map[string]bool{}
+	for _, e := range entries {
+		paths[e.Path] = true
+		if e.Directory != "/home/user/docs" || !e.Encrypted || e.Size != 4 || e.BackedUpAt.IsZero() {
+			t.Errorf("entry = %+v", e)
+		}
+		if e.EncryptedContentID == "" || e.EncryptedContentID != entries[0].EncryptedContentID {
+			t.Errorf("entry %s encrypted content = %q, want the shared ciphertext", e.Path, e.EncryptedContentID)
+		}
+	}
+	if !paths["a.txt"] || !paths[filepath.Join("sub", "b.txt")] {
+		t.Errorf("manifest paths = %v", paths)
+	}
+
+	snapshot := entries[0].Snapshot("id-1")
+	if snapshot.ID != "id-1" || snapshot.ContentID != entries[0].ContentID || !snapshot.CreatedAt.Equal(entries[0].BackedUpAt) {
+		t.Errorf("Snapshot() = %+v", snapshot)
+	}
+
+	if entries := svc.TakeManifest(); len(entries) != 0 {
+		t.Errorf("TakeManifest() again = %v, want none", entries)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"bt-go/internal/database/sqlc"
 )
@@ -18,7 +19,16 @@ import (
 // unencrypted restores. If a file is encrypted and decryptCtx is nil, an error is returned.
 // Returns the list of output file paths written.
 func (s *BTService) Restore(absPath string, checksum string, decryptCtx DecryptionContext) ([]string, error) {
-	s.logger.Info("restore started", "path", absPath)
+	return s.RestoreTo(absPath, checksum, "", decryptCtx)
+}
+
+// RestoreTo is like Restore, but if targetDir is non-empty the files are
+// written under it, at their paths relative to their tracked directory and
+// under their own names, instead of next to the originals. This restores
+// files whose tracked directory is not on this host, such as another
+// host's.
+func (s *BTService) RestoreTo(absPath string, checksum string, targetDir string, decryptCtx DecryptionContext) ([]string, error) {
+	s.logger.Info("restore started", "path", absPath, "target", targetDir)
 
 	// Check if absPath matches a tracked directory exactly.
 	dir, err := s.database.FindDirectoryByPath(absPath)
@@ -30,11 +40,11 @@ func (s *BTService) Restore(absPath string, checksum string, decryptCtx Decrypti
 		if checksum != "" {
 			return nil, fmt.Errorf("cannot restore a directory with a specific checksum")
 		}
-		return s.restoreDirectory(dir, decryptCtx)
+		return s.restoreDirectory(dir, targetDir, decryptCtx)
 	}
 
 	// Treat as a file path.
-	outPath, err := s.restoreFile(absPath, checksum, decryptCtx)
+	outPath, err := s.restoreFile(absPath, checksum, targetDir, decryptCtx)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +52,7 @@ func (s *BTService) Restore(absPath string, checksum string, decryptCtx Decrypti
 }
 
 // restoreFile restores a single file from the vault.
-func (s *BTService) restoreFile(absPath string, checksum string, decryptCtx DecryptionContext) (string, error) {
+func (s *BTService) restoreFile(absPath string, checksum string, targetDir string, decryptCtx DecryptionContext) (string, error) {
 	directory, err := s.database.SearchDirectoryForPath(absPath)
 	if err != nil {
 		return "", fmt.Errorf("searching for directory: %w", err)
@@ -69,7 +79,7 @@ func (s *BTService) restoreFile(absPath string, checksum string, decryptCtx Decr
 		return "", err
 	}
 
-	return s.restoreOneFile(directory, relativePath, snapshot, decryptCtx)
+	return s.restoreOneFile(directory, relativePath, snapshot, targetDir, decryptCtx)
 }
 
 // resolveSnapshot finds the appropriate snapshot for restore.
@@ -106,7 +116,7 @@ func (s *BTService) resolveSnapshot(file *sqlc.File, checksum string) (*sqlc.Fil
 }
 
 // restoreDirectory restores all files in a tracked directory.
-func (s *BTService) restoreDirectory(dir *sqlc.Directory, decryptCtx DecryptionContext) ([]string, error) {
+func (s *BTService) restoreDirectory(dir *sqlc.Directory, targetDir string, decryptCtx DecryptionContext) ([]string, error) {
 	files, err := s.database.FindFilesByDirectory(dir)
 	if err != nil {
 		return nil, fmt.Errorf("finding files: %w", err)
@@ -123,7 +133,7 @@ func (s *BTService) restoreDirectory(dir *sqlc.Directory, decryptCtx DecryptionC
 			return restored, fmt.Errorf("resolving snapshot for %s: %w", file.Name, err)
 		}
 
-		outPath, err := s.restoreOneFile(dir, file.Name, snapshot, decryptCtx)
+		outPath, err := s.restoreOneFile(dir, file.Name, snapshot, targetDir, decryptCtx)
 		if err != nil {
 			return restored, fmt.Errorf("restoring %s: %w", file.Name, err)
 		}
@@ -134,12 +144,24 @@ func (s *BTService) restoreDirectory(dir *sqlc.Directory, decryptCtx DecryptionC
 }
 
 // restoreOneFile writes a single file from the vault to disk.
-// The output path is {dir}/{basename}.{checksum[:12]}.btrestored.
+// The output path is {dir}/{basename}.{checksum[:12]}.btrestored, or
+// {targetDir}/{relativePath} if targetDir is non-empty. relativePath comes
+// from the metadata, possibly another host's, so one that would lead out of
+// either directory is rejected.
 // If the content is encrypted and decryptCtx is non-nil, the ciphertext is
 // fetched by its encrypted checksum and decrypted before writing. If the
 // content is encrypted and decryptCtx is nil, an error is returned.
-func (s *BTService) restoreOneFile(dir *sqlc.Directory, relativePath string, snapshot *sqlc.FileSnapshot, decryptCtx DecryptionContext) (string, error) {
+func (s *BTService) restoreOneFile(dir *sqlc.Directory, relativePath string, snapshot *sqlc.FileSnapshot, targetDir string, decryptCtx DecryptionContext) (string, error) {
+	if _, err := joinContained(dir.Path, relativePath); err != nil {
+		return "", err
+	}
 	outPath := buildRestorePath(dir.Path, relativePath, snapshot.ContentID)
+	if targetDir != "" {
+		var err error
+		if outPath, err = joinContained(targetDir, relativePath); err != nil {
+			return "", err
+		}
+	}
 
 	// Ensure parent directory exists.
 	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
@@ -210,6 +232,17 @@ func (s *BTService) restoreOneFile(dir *sqlc.Directory, relativePath string, sna
 	return outPath, nil
 }
 
+// joinContained joins relativePath to root, failing unless the result is
+// below root.
+func joinContained(root string, relativePath string) (string, error) {
+	path := filepath.Join(root, relativePath)
+	rel, err := filepath.Rel(root, path)
+	if filepath.IsAbs(relativePath) || err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file path %q leads outside %s", relativePath, root)
+	}
+	return path, nil
+}
+
 // buildRestorePath constructs the output path for a restored file.
 // Format: {dir}/{basename}.{checksum[:12]}.btrestored
 func buildRestorePath(dirPath string, relativePath string, contentID string) string {
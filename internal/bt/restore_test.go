@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"bt-go/internal/bt"
+	"bt-go/internal/database"
 	"bt-go/internal/testutil"
 )
 
@@ -46,7 +47,7 @@ func backupOneFile(t *testing.T, svc *bt.BTService, fsmgr *testutil.MockFilesyst
 	if err != nil {
 		t.Fatalf("resolve file: %v", err)
 	}
-	if _, err := svc.StageFiles(fileP, false); err != nil {
+	if _, err := svc.StageFiles(fileP, bt.StageOptions{}); err != nil {
 		t.Fatalf("stage: %v", err)
 	}
 	if _, err := svc.BackupAll(); err != nil {
@@ -103,7 +104,7 @@ func TestBTService_Restore(t *testing.T) {
 		// Backup v2
 		fsmgr.UpdateFile(filepath.Join(dir, "file.txt"), []byte("version two"), time.Now().Add(time.Hour))
 		filePath, _ = fsmgr.Resolve(filepath.Join(dir, "file.txt"))
-		svc.StageFiles(filePath, false)
+		svc.StageFiles(filePath, bt.StageOptions{})
 		svc.BackupAll()
 
 		// Restore v1 by checksum
@@ -160,7 +161,7 @@ func TestBTService_Restore(t *testing.T) {
 		// Add and backup a second file
 		fsmgr.AddFile(filepath.Join(dir, "b.txt"), []byte("bbb"))
 		fileP, _ := fsmgr.Resolve(filepath.Join(dir, "b.txt"))
-		svc.StageFiles(fileP, false)
+		svc.StageFiles(fileP, bt.StageOptions{})
 		svc.BackupAll()
 
 		paths, err := svc.Restore(dir, "", nil)
@@ -232,6 +233,74 @@ func TestBTService_Restore(t *testing.T) {
 			t.Fatal("expected error for bad checksum")
 		}
 	})
+
+	t.Run("restore to a target directory keeps relative paths and names", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, dir := setupRestore(t)
+
+		backupOneFile(t, svc, fsmgr, dir, "sub/a.txt", []byte("aaa"))
+		fsmgr.AddFile(filepath.Join(dir, "b.txt"), []byte("bbb"))
+		fileP, _ := fsmgr.Resolve(filepath.Join(dir, "b.txt"))
+		svc.StageFiles(fileP, bt.StageOptions{})
+		svc.BackupAll()
+
+		target := t.TempDir()
+		paths, err := svc.RestoreTo(dir, "", target, nil)
+		if err != nil {
+			t.Fatalf("RestoreTo() error = %v", err)
+		}
+		if len(paths) != 2 {
+			t.Fatalf("got %d paths, want 2", len(paths))
+		}
+		for rel, want := range map[string]string{"sub/a.txt": "aaa", "b.txt": "bbb"} {
+			got, err := os.ReadFile(filepath.Join(target, rel))
+			if err != nil || string(got) != want {
+				t.Errorf("%s = %q, %v, want %q", rel, got, err, want)
+			}
+		}
+
+		// A single file lands at its path relative to its directory too.
+		target = t.TempDir()
+		paths, err = svc.RestoreTo(filepath.Join(dir, "sub", "a.txt"), "", target, nil)
+		if err != nil {
+			t.Fatalf("RestoreTo() of a file error = %v", err)
+		}
+		if want := filepath.Join(target, "sub", "a.txt"); len(paths) != 1 || paths[0] != want {
+			t.Errorf("RestoreTo() = %v, want [%s]", paths, want)
+		}
+	})
+
+	t.Run("paths leading out of the target directory are rejected", func(t *testing.T) {
+		t.Parallel()
+		conn, err := database.OpenConnection(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Exec(database.Schema); err != nil {
+			t.Fatal(err)
+		}
+		db := database.NewSQLiteDatabaseFromDB(conn, nil, nil)
+		t.Cleanup(func() { db.Close() })
+		fsmgr := testutil.NewMockFilesystemManager()
+		svc := bt.NewBTService(db, testutil.NewTestStagingArea(fsmgr), testutil.NewTestVault(), fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+		dir := t.TempDir()
+		backupOneFile(t, svc, fsmgr, dir, "a.txt", []byte("aaa"))
+
+		// Another host's metadata names the file whatever it likes.
+		root := t.TempDir()
+		target := filepath.Join(root, "target")
+		for _, name := range []string{"../escaped.txt", "sub/../../escaped.txt", "/escaped.txt"} {
+			if _, err := conn.Exec("UPDATE files SET name = ?", name); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.RestoreTo(dir, "", target, nil); err == nil {
+				t.Errorf("RestoreTo() of %q should fail", name)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(root, "escaped.txt")); !os.IsNotExist(err) {
+			t.Errorf("a file was written outside the target directory: %v", err)
+		}
+	})
 }
 
 func TestBTService_Restore_Encrypted(t *testing.T) {
@@ -253,7 +322,7 @@ func TestBTService_Restore_Encrypted(t *testing.T) {
 		if err != nil {
 			t.Fatalf("resolve file: %v", err)
 		}
-		if _, err := svc.StageFiles(fileP, false); err != nil {
+		if _, err := svc.StageFiles(fileP, bt.StageOptions{}); err != nil {
 			t.Fatalf("stage: %v", err)
 		}
 		if _, err := svc.BackupAll(); err != nil {
@@ -330,7 +399,7 @@ func TestBTService_Restore_Encrypted(t *testing.T) {
 		// Add a second file to the same encrypted directory.
 		fsmgr.AddFile(filepath.Join(dir, "b.txt"), []byte("beta"))
 		fileP, _ := fsmgr.Resolve(filepath.Join(dir, "b.txt"))
-		svc.StageFiles(fileP, false)
+		svc.StageFiles(fileP, bt.StageOptions{})
 		svc.BackupAll()
 
 		decryptCtx, _ := enc.Unlock("")
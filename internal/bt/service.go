@@ -3,10 +3,15 @@ package bt
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 
 	"bt-go/internal/database/sqlc"
 )
@@ -22,6 +27,9 @@ type BTService struct {
 	logger      Logger
 	clock       Clock
 	idgen       IDGenerator
+
+	// manifest collects the files backed up since TakeManifest last ran.
+	manifest []*ManifestEntry
 }
 
 // NewBTService creates a new BTService with the provided dependencies.
@@ -69,80 +77,362 @@ func (s *BTService) AddDirectory(path *Path, encrypted bool) error {
 	return nil
 }
 
+// StageOptions controls how StageFiles discovers and stages files.
+type StageOptions struct {
+	// Recursive includes files in subdirectories when staging a directory.
+	Recursive bool
+
+	// Force stages every file even when its size, mtime, ctime, mode, uid
+	// and gid match the current snapshot in the database. Without it,
+	// unchanged files are skipped without being read or hashed.
+	Force bool
+
+	// AutoFlush backs up the staging queue whenever the next file would
+	// exceed the staging area's size limit, then continues staging. Files
+	// too large to stage even into an empty staging area are streamed
+	// directly to the vault.
+	AutoFlush bool
+
+	// Workers is the number of files read and hashed concurrently when
+	// staging a directory. Zero or less means one per CPU.
+	Workers int
+}
+
+// StageResult reports what StageFiles did.
+type StageResult struct {
+	// Staged is the number of files added to the staging queue.
+	Staged int
+
+	// Unchanged is the number of files skipped because their metadata
+	// matches the current snapshot.
+	Unchanged int
+
+	// BackedUp is the number of queued files backed up to make room when
+	// AutoFlush is set.
+	BackedUp int
+
+	// Streamed is the number of files backed up directly, bypassing the
+	// staging area, because they were too large to stage.
+	Streamed int
+}
+
 // StageFiles stages one or more files for backup.
 // If path is a regular file, it stages that single file.
 // If path is a directory, it discovers files and stages them all.
-// When recursive is true, files in subdirectories are included.
-// Returns the number of files staged.
-func (s *BTService) StageFiles(path *Path, recursive bool) (int, error) {
+// Files whose metadata matches their current snapshot are skipped unless
+// opts.Force is set.
+func (s *BTService) StageFiles(path *Path, opts StageOptions) (*StageResult, error) {
+	result := &StageResult{}
+
 	if !path.IsDir() {
-		if err := s.stageOneFile(path); err != nil {
-			return 0, err
+		if err := s.stageOneFile(path, opts, result); err != nil {
+			return nil, err
 		}
-		return 1, nil
+		return result, nil
 	}
 
 	// Find the tracked directory for this path.
 	directory, err := s.database.FindDirectoryByPath(path.String())
 	if err != nil {
-		return 0, fmt.Errorf("finding directory: %w", err)
+		return nil, fmt.Errorf("finding directory: %w", err)
 	}
 	if directory == nil {
 		directory, err = s.database.SearchDirectoryForPath(path.String())
 		if err != nil {
-			return 0, fmt.Errorf("searching for directory: %w", err)
+			return nil, fmt.Errorf("searching for directory: %w", err)
 		}
 	}
 	if directory == nil {
-		return 0, fmt.Errorf("directory is not tracked: %s", path.String())
+		return nil, fmt.Errorf("%w: %s", ErrDirectoryNotTracked, path.String())
 	}
 
-	// Discover files on disk.
-	files, err := s.fsmgr.FindFiles(path, recursive)
-	if err != nil {
-		return 0, fmt.Errorf("finding files: %w", err)
+	if err := s.stageConcurrently(s.fsmgr.WalkFiles(path, directory.Path, opts.Recursive), opts, result); err != nil {
+		return nil, err
+	}
+
+	if result.Unchanged > 0 {
+		s.logger.Info("skipped unchanged files", "count", result.Unchanged)
+	}
+	return result, nil
+}
+
+// stageJob is one discovered file moving through stageConcurrently.
+type stageJob struct {
+	path    *Path
+	outcome chan stageOutcome // buffered, receives exactly one value
+}
+
+// stageOutcome is the result of preparing one file for staging.
+type stageOutcome struct {
+	path         *Path
+	directory    *sqlc.Directory
+	relativePath string
+	prepared     *PreparedFile // nil if unchanged or err is set
+	unchanged    bool
+	err          error
+}
+
+// stageConcurrently stages every file yielded by files. A pool of
+// opts.Workers goroutines does the reading and hashing (prepareOneFile),
+// while the calling goroutine commits results in discovery order, so the
+// staging queue comes out the same regardless of which worker finishes first.
+// At most a few files per worker are in flight, whatever the size of the tree.
+func (s *BTService) stageConcurrently(files iter.Seq2[*Path, error], opts StageOptions, result *StageResult) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	jobs := make(chan stageJob)
+	ordered := make(chan stageJob, workers)
+	done := make(chan struct{})
+	var walkErr error
+
+	// Discovery: every job a worker accepts is also sent to ordered, so the
+	// committing loop below always receives its outcome.
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+		for path, err := range files {
+			if err != nil {
+				walkErr = err
+				return
+			}
+			job := stageJob{path: path, outcome: make(chan stageOutcome, 1)}
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			}
+			ordered <- job
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for job := range jobs {
+				job.outcome <- s.prepareOneFile(job.path, opts, false)
+			}
+		})
+	}
+
+	var firstErr error
+	var deferred []stageOutcome
+	for job := range ordered {
+		outcome := <-job.outcome
+		if firstErr != nil {
+			if outcome.prepared != nil {
+				s.stagingArea.Discard(outcome.prepared)
+			}
+			continue
+		}
+		err := s.commitOutcome(outcome, opts, result)
+		if opts.AutoFlush && errors.Is(err, ErrStagingFull) {
+			// The room is held by files other workers have prepared but
+			// not committed yet; try again once none are in flight.
+			deferred = append(deferred, outcome)
+			continue
+		}
+		if err != nil {
+			firstErr = err
+			close(done)
+		}
 	}
+	wg.Wait()
 
-	for _, f := range files {
-		if err := s.stageOneFile(f); err != nil {
-			return 0, err
+	if firstErr != nil {
+		return firstErr
+	}
+	if walkErr != nil {
+		return fmt.Errorf("finding files: %w", walkErr)
+	}
+	for _, outcome := range deferred {
+		if err := s.commitOutcome(outcome, opts, result); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return len(files), nil
+// stageOneFile stages a single file for backup and records the outcome in result.
+// Unless opts.Force is set, a file whose metadata matches its current snapshot
+// is counted as unchanged and not staged.
+func (s *BTService) stageOneFile(path *Path, opts StageOptions, result *StageResult) error {
+	return s.commitOutcome(s.prepareOneFile(path, opts, true), opts, result)
 }
 
-// stageOneFile stages a single file for backup.
-func (s *BTService) stageOneFile(path *Path) error {
+// prepareOneFile resolves path to its tracked directory and, unless it is
+// unchanged, copies it into the staging area without queuing it.
+// checkExcluded refuses excluded files; it can be skipped for files that
+// came from WalkFiles, which has already applied the exclusion rules.
+// It is safe to call concurrently.
+func (s *BTService) prepareOneFile(path *Path, opts StageOptions, checkExcluded bool) stageOutcome {
+	outcome := stageOutcome{path: path}
+
 	directory, err := s.database.SearchDirectoryForPath(path.String())
 	if err != nil {
-		return fmt.Errorf("searching for directory: %w", err)
+		outcome.err = fmt.Errorf("searching for directory: %w", err)
+		return outcome
 	}
 	if directory == nil {
-		return fmt.Errorf("file is not within a tracked directory: %s", path.String())
+		outcome.err = fmt.Errorf("%w: no tracked directory contains %s", ErrDirectoryNotTracked, path.String())
+		return outcome
 	}
+	outcome.directory = directory
 
-	ignored, err := s.fsmgr.IsIgnored(path, directory.Path)
+	if checkExcluded {
+		reason, err := s.fsmgr.ExclusionReason(path, directory.Path)
+		if err != nil {
+			outcome.err = fmt.Errorf("checking exclusion rules: %w", err)
+			return outcome
+		}
+		if reason != "" {
+			outcome.err = fmt.Errorf("file is excluded (%s): %s", reason, path.String())
+			return outcome
+		}
+	}
+
+	relativePath, err := filepath.Rel(directory.Path, path.String())
 	if err != nil {
-		return fmt.Errorf("checking ignore rules: %w", err)
+		outcome.err = fmt.Errorf("calculating relative path: %w", err)
+		return outcome
 	}
-	if ignored {
-		return fmt.Errorf("file is ignored: %s", path.String())
+	outcome.relativePath = relativePath
+
+	if !opts.Force {
+		unchanged, err := s.isUnchanged(directory, relativePath, path)
+		if err != nil {
+			outcome.err = err
+			return outcome
+		}
+		if unchanged {
+			outcome.unchanged = true
+			return outcome
+		}
 	}
 
-	relativePath, err := filepath.Rel(directory.Path, path.String())
+	outcome.prepared, err = s.stagingArea.Prepare(directory, relativePath, path)
 	if err != nil {
-		return fmt.Errorf("calculating relative path: %w", err)
+		outcome.err = fmt.Errorf("staging file: %w", err)
+	}
+	return outcome
+}
+
+// commitOutcome queues a prepared file and records the outcome in result.
+// When opts.AutoFlush is set, a file too large to stage is streamed, and one
+// that did not fit is handled by flushAndStage.
+func (s *BTService) commitOutcome(outcome stageOutcome, opts StageOptions, result *StageResult) error {
+	if errors.Is(outcome.err, ErrFileTooLarge) && opts.AutoFlush {
+		return s.streamFile(outcome.directory, outcome.relativePath, outcome.path, result)
+	}
+	if errors.Is(outcome.err, ErrStagingFull) && opts.AutoFlush {
+		return s.flushAndStage(outcome.directory, outcome.relativePath, outcome.path, result)
+	}
+	if outcome.err != nil {
+		return outcome.err
+	}
+
+	if outcome.unchanged {
+		s.logger.Debug("file unchanged, skipping", "path", outcome.path.String())
+		result.Unchanged++
+		return nil
+	}
+
+	if err := s.stagingArea.Commit(outcome.prepared); err != nil {
+		return fmt.Errorf("staging file: %w", err)
+	}
+
+	s.logger.Debug("file staged", "path", outcome.path.String())
+	result.Staged++
+	return nil
+}
+
+// flushAndStage stages path, which did not fit when it was prepared. The
+// staging queue is only backed up if the file still does not fit, so a run of
+// files that did not fit triggers a single backup. Returns an error wrapping
+// ErrStagingFull if the file does not fit even then, because the room is
+// held by files prepared but not committed yet.
+func (s *BTService) flushAndStage(directory *sqlc.Directory, relativePath string, path *Path, result *StageResult) error {
+	err := s.stagingArea.Stage(directory, relativePath, path)
+	if errors.Is(err, ErrStagingFull) && !errors.Is(err, ErrFileTooLarge) {
+		queued, countErr := s.stagingArea.Count()
+		if countErr != nil {
+			return fmt.Errorf("checking staging queue: %w", countErr)
+		}
+		if queued > 0 {
+			s.logger.Info("staging area full, backing up queue", "queued", queued)
+			count, flushErr := s.BackupAll()
+			result.BackedUp += count
+			if flushErr != nil {
+				return fmt.Errorf("flushing staging area: %w", flushErr)
+			}
+			err = s.stagingArea.Stage(directory, relativePath, path)
+		}
 	}
 
-	if err := s.stagingArea.Stage(directory, relativePath, path); err != nil {
+	switch {
+	case err == nil:
+		s.logger.Debug("file staged", "path", path.String())
+		result.Staged++
+		return nil
+	case errors.Is(err, ErrFileTooLarge):
+		return s.streamFile(directory, relativePath, path, result)
+	default:
 		return fmt.Errorf("staging file: %w", err)
 	}
+}
 
-	s.logger.Debug("file staged", "path", path.String())
+// streamFile backs up a file too large to stage straight to the vault.
+func (s *BTService) streamFile(directory *sqlc.Directory, relativePath string, path *Path, result *StageResult) error {
+	s.logger.Info("file too large to stage, streaming to vault", "path", path.String())
+	if err := s.stagingArea.Stream(directory, relativePath, path, s.backupFile); err != nil {
+		return fmt.Errorf("streaming file: %w", err)
+	}
+	result.Streamed++
 	return nil
 }
 
+// isUnchanged reports whether the file at path matches its current snapshot
+// on every stat field a backup would record. Content is not read: this is
+// the same trust-the-metadata heuristic rsync uses without --checksum.
+func (s *BTService) isUnchanged(directory *sqlc.Directory, relativePath string, path *Path) (bool, error) {
+	file, err := s.database.FindFileByPath(directory, relativePath)
+	if err != nil {
+		return false, fmt.Errorf("finding file: %w", err)
+	}
+	if file == nil || !file.CurrentSnapshotID.Valid {
+		return false, nil
+	}
+
+	snapshot, err := s.database.FindFileSnapshotByID(file.CurrentSnapshotID.String)
+	if err != nil {
+		return false, fmt.Errorf("finding current snapshot: %w", err)
+	}
+	if snapshot == nil {
+		return false, nil
+	}
+
+	info := path.Info()
+	stat, err := s.fsmgr.ExtractStatData(info)
+	if err != nil {
+		return false, fmt.Errorf("extracting stat data: %w", err)
+	}
+
+	return snapshotMatchesStat(snapshot, info, stat), nil
+}
+
+// snapshotMatchesStat compares the stat fields captured in a snapshot against
+// fresh file info. AccessedAt is excluded — reading a file changes it.
+func snapshotMatchesStat(snapshot *sqlc.FileSnapshot, info fs.FileInfo, stat *StatData) bool {
+	return snapshot.Size == info.Size() &&
+		snapshot.Permissions == int64(info.Mode().Perm()) &&
+		snapshot.ModifiedAt.Equal(info.ModTime()) &&
+		snapshot.ChangedAt.Equal(stat.Ctime) &&
+		snapshot.Uid == stat.UID &&
+		snapshot.Gid == stat.GID
+}
+
 // BackupAll processes all staged files and backs them up to the vault(s).
 // Returns the number of files successfully backed up.
 func (s *BTService) BackupAll() (int, error) {
@@ -192,7 +482,10 @@ func (s *BTService) backupFile(content io.Reader, snapshot sqlc.FileSnapshot, di
 		s.logger.Debug("content deduplicated", "checksum", checksum)
 		snapshot.ID = s.idgen.New()
 		snapshot.CreatedAt = s.clock.Now()
-		return s.database.CreateFileSnapshotAndContent(directoryID, relativePath, &snapshot, "")
+		if err := s.database.CreateFileSnapshotAndContent(directoryID, relativePath, &snapshot, ""); err != nil {
+			return err
+		}
+		return s.addToManifest(directoryID, relativePath, &snapshot, existingContent.EncryptedContentID.String)
 	}
 
 	// New content — check if the directory is encrypted.
@@ -207,41 +500,18 @@ func (s *BTService) backupFile(content io.Reader, snapshot sqlc.FileSnapshot, di
 	snapshot.ID = s.idgen.New()
 	snapshot.CreatedAt = s.clock.Now()
 
+	var encChecksum string
 	if dir.Encrypted != 0 {
-		// Encrypted directory: encrypt to a temp file while hashing so we know the
-		// ciphertext checksum (vault key) without buffering the whole file in memory.
-		tmp, err := os.CreateTemp("", "bt-enc-*.tmp")
-		if err != nil {
-			return fmt.Errorf("creating encrypted temp file: %w", err)
-		}
-		tmpPath := tmp.Name()
-		defer os.Remove(tmpPath)
-
-		h := sha256.New()
-		if err := s.encryptor.Encrypt(content, io.MultiWriter(tmp, h)); err != nil {
-			tmp.Close()
-			return fmt.Errorf("encrypting content: %w", err)
-		}
-		encChecksum := hex.EncodeToString(h.Sum(nil))
-
-		info, err := tmp.Stat()
+		encChecksum, err = s.uploadEncrypted(checksum, content)
 		if err != nil {
-			tmp.Close()
-			return fmt.Errorf("stat encrypted temp file: %w", err)
+			return err
 		}
-		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
-			tmp.Close()
-			return fmt.Errorf("seeking encrypted temp file: %w", err)
-		}
-		if err := s.vault.PutContent(encChecksum, tmp, info.Size()); err != nil {
-			tmp.Close()
-			return fmt.Errorf("uploading encrypted content to vault: %w", err)
-		}
-		tmp.Close()
-
 		if err := s.database.CreateFileSnapshotAndContent(directoryID, relativePath, &snapshot, encChecksum); err != nil {
 			return fmt.Errorf("recording backup in database: %w", err)
 		}
+		if err := s.recordConvergent(encChecksum); err != nil {
+			return err
+		}
 	} else {
 		// Unencrypted: upload plaintext directly.
 		if err := s.vault.PutContent(checksum, content, snapshot.Size); err != nil {
@@ -253,5 +523,45 @@ func (s *BTService) backupFile(content io.Reader, snapshot sqlc.FileSnapshot, di
 	}
 
 	s.logger.Info("file backed up", "path", relativePath)
-	return nil
+	return s.addToManifest(directoryID, relativePath, &snapshot, encChecksum)
+}
+
+// uploadEncrypted encrypts content, whose plaintext checksum is checksum, and
+// stores the ciphertext in the vault, returning its checksum (the vault key). The ciphertext goes to a temp file
+// while it is hashed, so the checksum is known before uploading without
+// buffering the whole file in memory.
+func (s *BTService) uploadEncrypted(checksum string, content io.Reader) (string, error) {
+	tmp, err := os.CreateTemp("", "bt-enc-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("creating encrypted temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if err := s.encryptor.EncryptContent(checksum, content, io.MultiWriter(tmp, h)); err != nil {
+		return "", fmt.Errorf("encrypting content: %w", err)
+	}
+	encChecksum := hex.EncodeToString(h.Sum(nil))
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return "", fmt.Errorf("stat encrypted temp file: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("seeking encrypted temp file: %w", err)
+	}
+	if err := s.vault.PutContent(encChecksum, tmp, info.Size()); err != nil {
+		return "", fmt.Errorf("uploading encrypted content to vault: %w", err)
+	}
+	return encChecksum, nil
+}
+
+// recordConvergent marks the real record of encrypted content just uploaded
+// as convergent if the Encryptor encrypted it with the convergence secret.
+func (s *BTService) recordConvergent(encChecksum string) error {
+	if !s.encryptor.Convergent() {
+		return nil
+	}
+	return s.database.MarkContentConvergent(encChecksum)
 }
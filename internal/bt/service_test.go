@@ -1,9 +1,15 @@
 package bt_test
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
 	"testing"
+	"time"
 
 	"bt-go/internal/bt"
+	"bt-go/internal/database/sqlc"
 	"bt-go/internal/testutil"
 )
 
@@ -87,12 +93,12 @@ func TestBTService_StageFiles(t *testing.T) {
 		svc.AddDirectory(dirPath, false)
 
 		filePath, _ := fsmgr.Resolve("/home/user/docs/file.txt")
-		count, err := svc.StageFiles(filePath, false)
+		result, err := svc.StageFiles(filePath, bt.StageOptions{})
 		if err != nil {
 			t.Fatalf("StageFiles() error = %v", err)
 		}
-		if count != 1 {
-			t.Errorf("StageFiles() count = %d, want 1", count)
+		if result.Staged != 1 {
+			t.Errorf("StageFiles() staged = %d, want 1", result.Staged)
 		}
 	})
 
@@ -108,12 +114,12 @@ func TestBTService_StageFiles(t *testing.T) {
 		dirPath, _ := fsmgr.Resolve("/home/user/docs")
 		svc.AddDirectory(dirPath, false)
 
-		count, err := svc.StageFiles(dirPath, false)
+		result, err := svc.StageFiles(dirPath, bt.StageOptions{})
 		if err != nil {
 			t.Fatalf("StageFiles() error = %v", err)
 		}
-		if count != 2 {
-			t.Errorf("StageFiles() count = %d, want 2", count)
+		if result.Staged != 2 {
+			t.Errorf("StageFiles() staged = %d, want 2", result.Staged)
 		}
 	})
 
@@ -129,12 +135,12 @@ func TestBTService_StageFiles(t *testing.T) {
 		dirPath, _ := fsmgr.Resolve("/home/user/docs")
 		svc.AddDirectory(dirPath, false)
 
-		count, err := svc.StageFiles(dirPath, true)
+		result, err := svc.StageFiles(dirPath, bt.StageOptions{Recursive: true})
 		if err != nil {
 			t.Fatalf("StageFiles() error = %v", err)
 		}
-		if count != 3 {
-			t.Errorf("StageFiles() count = %d, want 3", count)
+		if result.Staged != 3 {
+			t.Errorf("StageFiles() staged = %d, want 3", result.Staged)
 		}
 	})
 
@@ -146,7 +152,7 @@ func TestBTService_StageFiles(t *testing.T) {
 		fsmgr.AddFile("/home/user/docs/file.txt", []byte("content"))
 
 		dirPath, _ := fsmgr.Resolve("/home/user/docs")
-		_, err := svc.StageFiles(dirPath, false)
+		_, err := svc.StageFiles(dirPath, bt.StageOptions{})
 		if err == nil {
 			t.Fatal("expected error for untracked directory")
 		}
@@ -161,12 +167,12 @@ func TestBTService_StageFiles(t *testing.T) {
 		dirPath, _ := fsmgr.Resolve("/home/user/docs")
 		svc.AddDirectory(dirPath, false)
 
-		count, err := svc.StageFiles(dirPath, false)
+		result, err := svc.StageFiles(dirPath, bt.StageOptions{})
 		if err != nil {
 			t.Fatalf("StageFiles() error = %v", err)
 		}
-		if count != 0 {
-			t.Errorf("StageFiles() count = %d, want 0", count)
+		if result.Staged != 0 {
+			t.Errorf("StageFiles() staged = %d, want 0", result.Staged)
 		}
 	})
 
@@ -177,9 +183,9 @@ func TestBTService_StageFiles(t *testing.T) {
 		fsmgr.AddFile("/home/user/untracked/file.txt", []byte("content"))
 
 		filePath, _ := fsmgr.Resolve("/home/user/untracked/file.txt")
-		_, err := svc.StageFiles(filePath, false)
-		if err == nil {
-			t.Fatal("expected error for file not in tracked directory")
+		_, err := svc.StageFiles(filePath, bt.StageOptions{})
+		if !errors.Is(err, bt.ErrDirectoryNotTracked) {
+			t.Fatalf("StageFiles() error = %v, want ErrDirectoryNotTracked", err)
 		}
 	})
 
@@ -195,7 +201,7 @@ func TestBTService_StageFiles(t *testing.T) {
 		svc.AddDirectory(dirPath, false)
 
 		filePath, _ := fsmgr.Resolve("/home/user/docs/app.log")
-		_, err := svc.StageFiles(filePath, false)
+		_, err := svc.StageFiles(filePath, bt.StageOptions{})
 		if err == nil {
 			t.Fatal("expected error when staging ignored file")
 		}
@@ -214,12 +220,12 @@ func TestBTService_StageFiles(t *testing.T) {
 		dirPath, _ := fsmgr.Resolve("/home/user/docs")
 		svc.AddDirectory(dirPath, false)
 
-		count, err := svc.StageFiles(dirPath, false)
+		result, err := svc.StageFiles(dirPath, bt.StageOptions{})
 		if err != nil {
 			t.Fatalf("StageFiles() error = %v", err)
 		}
-		if count != 1 {
-			t.Errorf("StageFiles() count = %d, want 1 (only readme.txt)", count)
+		if result.Staged != 1 {
+			t.Errorf("StageFiles() staged = %d, want 1 (only readme.txt)", result.Staged)
 		}
 	})
 
@@ -235,12 +241,259 @@ func TestBTService_StageFiles(t *testing.T) {
 		svc.AddDirectory(dirPath, false)
 
 		filePath, _ := fsmgr.Resolve("/home/user/docs/readme.txt")
-		count, err := svc.StageFiles(filePath, false)
+		result, err := svc.StageFiles(filePath, bt.StageOptions{})
+		if err != nil {
+			t.Fatalf("StageFiles() error = %v", err)
+		}
+		if result.Staged != 1 {
+			t.Errorf("StageFiles() staged = %d, want 1", result.Staged)
+		}
+	})
+}
+
+func TestBTService_StageFiles_Unchanged(t *testing.T) {
+	// setup tracks /home/user/docs, backs up file.txt once, and returns the
+	// service ready for a second staging pass.
+	setup := func(t *testing.T) (*bt.BTService, *testutil.MockFilesystemManager, bt.StagingArea) {
+		t.Helper()
+		db := testutil.NewTestDatabase(t)
+		fsmgr := testutil.NewMockFilesystemManager()
+		staging := testutil.NewTestStagingArea(fsmgr)
+		svc := bt.NewBTService(db, staging, testutil.NewTestVault(), fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+		fsmgr.AddDirectory("/home/user/docs")
+		fsmgr.AddFile("/home/user/docs/file.txt", []byte("content"))
+
+		dirPath, _ := fsmgr.Resolve("/home/user/docs")
+		if err := svc.AddDirectory(dirPath, false); err != nil {
+			t.Fatalf("AddDirectory() error = %v", err)
+		}
+		if _, err := svc.StageFiles(dirPath, bt.StageOptions{}); err != nil {
+			t.Fatalf("StageFiles() error = %v", err)
+		}
+		if _, err := svc.BackupAll(); err != nil {
+			t.Fatalf("BackupAll() error = %v", err)
+		}
+		return svc, fsmgr, staging
+	}
+
+	t.Run("skips file unchanged since last backup", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, staging := setup(t)
+
+		filePath, _ := fsmgr.Resolve("/home/user/docs/file.txt")
+		result, err := svc.StageFiles(filePath, bt.StageOptions{})
+		if err != nil {
+			t.Fatalf("StageFiles() error = %v", err)
+		}
+		if result.Staged != 0 || result.Unchanged != 1 {
+			t.Errorf("StageFiles() = %+v, want 0 staged, 1 unchanged", result)
+		}
+		if count, _ := staging.Count(); count != 0 {
+			t.Errorf("staged count = %d, want 0", count)
+		}
+	})
+
+	t.Run("stages file whose mtime changed", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, _ := setup(t)
+
+		fsmgr.UpdateFile("/home/user/docs/file.txt", []byte("content"), time.Now().Add(time.Hour))
+
+		dirPath, _ := fsmgr.Resolve("/home/user/docs")
+		result, err := svc.StageFiles(dirPath, bt.StageOptions{})
+		if err != nil {
+			t.Fatalf("StageFiles() error = %v", err)
+		}
+		if result.Staged != 1 || result.Unchanged != 0 {
+			t.Errorf("StageFiles() = %+v, want 1 staged, 0 unchanged", result)
+		}
+	})
+
+	t.Run("force stages unchanged file", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, _ := setup(t)
+
+		dirPath, _ := fsmgr.Resolve("/home/user/docs")
+		result, err := svc.StageFiles(dirPath, bt.StageOptions{Force: true})
 		if err != nil {
 			t.Fatalf("StageFiles() error = %v", err)
 		}
-		if count != 1 {
-			t.Errorf("StageFiles() count = %d, want 1", count)
+		if result.Staged != 1 || result.Unchanged != 0 {
+			t.Errorf("StageFiles() = %+v, want 1 staged, 0 unchanged", result)
 		}
 	})
 }
+
+func TestBTService_StageFiles_AutoFlush(t *testing.T) {
+	setup := func(t *testing.T, maxSize int64) (*bt.BTService, *testutil.MockFilesystemManager, bt.StagingArea, bt.Database) {
+		t.Helper()
+		db := testutil.NewTestDatabase(t)
+		fsmgr := testutil.NewMockFilesystemManager()
+		staging := testutil.NewTestStagingAreaWithSize(fsmgr, maxSize)
+		svc := bt.NewBTService(db, staging, testutil.NewTestVault(), fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+		fsmgr.AddDirectory("/home/user/docs")
+		dirPath, _ := fsmgr.Resolve("/home/user/docs")
+		if err := svc.AddDirectory(dirPath, false); err != nil {
+			t.Fatalf("AddDirectory() error = %v", err)
+		}
+		return svc, fsmgr, staging, db
+	}
+
+	t.Run("fails when full without auto-flush", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, _, _ := setup(t, 10)
+		fsmgr.AddFile("/home/user/docs/a.txt", []byte("123456"))
+		fsmgr.AddFile("/home/user/docs/b.txt", []byte("123456"))
+
+		dirPath, _ := fsmgr.Resolve("/home/user/docs")
+		_, err := svc.StageFiles(dirPath, bt.StageOptions{})
+		if !errors.Is(err, bt.ErrStagingFull) {
+			t.Errorf("StageFiles() error = %v, want ErrStagingFull", err)
+		}
+	})
+
+	t.Run("backs up queue and continues staging", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, staging, _ := setup(t, 10)
+		fsmgr.AddFile("/home/user/docs/a.txt", []byte("123456"))
+		fsmgr.AddFile("/home/user/docs/b.txt", []byte("123456"))
+		fsmgr.AddFile("/home/user/docs/c.txt", []byte("123456"))
+
+		dirPath, _ := fsmgr.Resolve("/home/user/docs")
+		result, err := svc.StageFiles(dirPath, bt.StageOptions{AutoFlush: true})
+		if err != nil {
+			t.Fatalf("StageFiles() error = %v", err)
+		}
+		if result.Staged != 3 || result.BackedUp != 2 || result.Streamed != 0 {
+			t.Errorf("StageFiles() = %+v, want 3 staged, 2 backed up, 0 streamed", result)
+		}
+		if count, _ := staging.Count(); count != 1 {
+			t.Errorf("staged count = %d, want 1", count)
+		}
+	})
+
+	t.Run("streams file larger than the staging area", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, staging, db := setup(t, 10)
+		content := []byte("this file is larger than the limit")
+		fsmgr.AddFile("/home/user/docs/big.txt", content)
+
+		filePath, _ := fsmgr.Resolve("/home/user/docs/big.txt")
+		result, err := svc.StageFiles(filePath, bt.StageOptions{AutoFlush: true})
+		if err != nil {
+			t.Fatalf("StageFiles() error = %v", err)
+		}
+		if result.Staged != 0 || result.Streamed != 1 {
+			t.Errorf("StageFiles() = %+v, want 0 staged, 1 streamed", result)
+		}
+		if count, _ := staging.Count(); count != 0 {
+			t.Errorf("staged count = %d, want 0", count)
+		}
+
+		c, err := db.FindContentByChecksum(testutil.SHA256Hex(content))
+		if err != nil {
+			t.Fatalf("FindContentByChecksum() error = %v", err)
+		}
+		if c == nil {
+			t.Error("streamed content was not recorded in database")
+		}
+	})
+
+	t.Run("streams file larger than the staging area without flushing", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, staging, _ := setup(t, 10)
+		fsmgr.AddFile("/home/user/docs/a.txt", []byte("123456"))
+		fsmgr.AddFile("/home/user/docs/big.txt", []byte("this file is larger than the limit"))
+
+		dirPath, _ := fsmgr.Resolve("/home/user/docs")
+		result, err := svc.StageFiles(dirPath, bt.StageOptions{AutoFlush: true})
+		if err != nil {
+			t.Fatalf("StageFiles() error = %v", err)
+		}
+		if result.Staged != 1 || result.BackedUp != 0 || result.Streamed != 1 {
+			t.Errorf("StageFiles() = %+v, want 1 staged, 0 backed up, 1 streamed", result)
+		}
+		if count, _ := staging.Count(); count != 1 {
+			t.Errorf("staged count = %d, want 1", count)
+		}
+	})
+
+	t.Run("does not stream file that fits the staging area", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, staging, db := setup(t, 10)
+		content := []byte("123456")
+		fsmgr.AddFile("/home/user/docs/a.txt", content)
+		fsmgr.AddFile("/home/user/docs/held.txt", []byte("abcdef"))
+
+		// Room held by a file prepared but not committed, as by another
+		// worker, is not freed by backing up the queue.
+		dir, _ := db.FindDirectoryByPath("/home/user/docs")
+		heldPath, _ := fsmgr.Resolve("/home/user/docs/held.txt")
+		held, err := staging.Prepare(dir, "held.txt", heldPath)
+		if err != nil {
+			t.Fatalf("Prepare() error = %v", err)
+		}
+		defer staging.Discard(held)
+
+		filePath, _ := fsmgr.Resolve("/home/user/docs/a.txt")
+		result, err := svc.StageFiles(filePath, bt.StageOptions{AutoFlush: true})
+		if !errors.Is(err, bt.ErrStagingFull) || errors.Is(err, bt.ErrFileTooLarge) {
+			t.Fatalf("StageFiles() = %+v, %v, want ErrStagingFull", result, err)
+		}
+		if c, _ := db.FindContentByChecksum(testutil.SHA256Hex(content)); c != nil {
+			t.Error("a file that fits the staging area was streamed")
+		}
+	})
+}
+
+func TestBTService_StageFiles_Concurrent(t *testing.T) {
+	db := testutil.NewTestDatabase(t)
+	fsmgr := testutil.NewMockFilesystemManager()
+	staging := testutil.NewTestStagingArea(fsmgr)
+	svc := bt.NewBTService(db, staging, nil, fsmgr, testutil.NewTestEncryptor(), bt.NewNopLogger(), bt.RealClock{}, bt.UUIDGenerator{})
+
+	fsmgr.AddDirectory("/home/user/docs")
+	var want []string
+	for i := range 50 {
+		rel := fmt.Sprintf("sub%d/file%02d.txt", i%3, i)
+		// Duplicate content exercises deduplication across workers.
+		fsmgr.AddFile("/home/user/docs/"+rel, []byte(fmt.Sprintf("content %d", i%5)))
+		want = append(want, rel)
+	}
+	slices.Sort(want)
+
+	dirPath, _ := fsmgr.Resolve("/home/user/docs")
+	if err := svc.AddDirectory(dirPath, false); err != nil {
+		t.Fatalf("AddDirectory() error = %v", err)
+	}
+
+	result, err := svc.StageFiles(dirPath, bt.StageOptions{Recursive: true, Workers: 8})
+	if err != nil {
+		t.Fatalf("StageFiles() error = %v", err)
+	}
+	if result.Staged != len(want) {
+		t.Errorf("StageFiles() staged = %d, want %d", result.Staged, len(want))
+	}
+
+	// The queue must come out in discovery order, whichever worker finished first.
+	var got []string
+	for {
+		var rel string
+		err := staging.ProcessNext(func(content io.Reader, snapshot sqlc.FileSnapshot, directoryID string, relativePath string) error {
+			rel = relativePath
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ProcessNext() error = %v", err)
+		}
+		if rel == "" {
+			break
+		}
+		got = append(got, rel)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("queue order = %v, want %v", got, want)
+	}
+}
@@ -1,6 +1,8 @@
 package bt
 
 import (
+	"errors"
+	"fmt"
 	"io"
 
 	"bt-go/internal/database/sqlc"
@@ -13,6 +15,25 @@ import (
 // If it returns an error, the operation stays in queue for retry.
 type BackupFunc func(content io.Reader, snapshot sqlc.FileSnapshot, directoryID string, relativePath string) error
 
+// ErrStagingFull is returned (wrapped) by Stage when adding the file would
+// exceed the staging area's maximum size. Backing up the queue frees space,
+// unless the error is ErrFileTooLarge.
+var ErrStagingFull = errors.New("staging area full")
+
+// ErrFileTooLarge is returned (wrapped) by Stage when the file alone exceeds
+// the staging area's maximum size, so it can never be staged and must be
+// streamed instead. It wraps ErrStagingFull.
+var ErrFileTooLarge = fmt.Errorf("%w: file larger than the size limit", ErrStagingFull)
+
+// PreparedFile is a file whose content has been copied into the staging area
+// by Prepare but not yet queued for backup. It must be passed to exactly one
+// of Commit or Discard.
+type PreparedFile struct {
+	DirectoryID  string
+	RelativePath string
+	Snapshot     sqlc.FileSnapshot
+}
+
 // StagingArea provides an interface for staging files before backup.
 // Files are staged in a queue and processed during backup operations.
 // The staging area enforces a maximum size to prevent filling up the filesystem.
@@ -25,8 +46,31 @@ type StagingArea interface {
 	// It stats the source file, copies content to staging (computing checksum),
 	// re-stats to validate the file hasn't changed, and adds to the queue.
 	// If the same checksum already exists in staging, content is deduplicated.
+	// Returns an error wrapping ErrStagingFull if the file does not fit, and
+	// ErrFileTooLarge if it never would.
 	Stage(directory *sqlc.Directory, relativePath string, path *Path) error
 
+	// Prepare does the copying and hashing half of Stage without queuing the
+	// file. It is safe to call concurrently, so callers can hash many files
+	// in parallel and then Commit them in a deterministic order.
+	// Returns an error wrapping ErrStagingFull if the file does not fit, and
+	// ErrFileTooLarge if it never would.
+	Prepare(directory *sqlc.Directory, relativePath string, path *Path) (*PreparedFile, error)
+
+	// Commit adds a prepared file to the end of the queue.
+	Commit(prepared *PreparedFile) error
+
+	// Discard releases a prepared file's content without queuing it.
+	Discard(prepared *PreparedFile)
+
+	// Stream backs up a file directly from its source without copying it into
+	// the staging area, for files too large to stage. The file is read once to
+	// compute its checksum and again while fn consumes it; the second read is
+	// verified against the checksum and fails before EOF is reported if the
+	// file changed, so fn's vault write is aborted rather than stored under
+	// the wrong checksum.
+	Stream(directory *sqlc.Directory, relativePath string, path *Path, fn BackupFunc) error
+
 	// ProcessNext gets the next staged operation and calls fn with its data.
 	// If fn returns nil, the staged operation is removed (committed).
 	// If fn returns an error, the operation stays in queue for retry.
@@ -41,4 +85,9 @@ type StagingArea interface {
 
 	// IsStaged reports whether a file is currently in the staging queue.
 	IsStaged(directoryID string, relativePath string) (bool, error)
+
+	// RemoveDirectory drops every queued operation for the given directory,
+	// along with any staged content no longer referenced, and returns the
+	// number of operations removed.
+	RemoveDirectory(directoryID string) (int, error)
 }
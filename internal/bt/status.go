@@ -3,6 +3,8 @@ package bt
 import (
 	"fmt"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"bt-go/internal/database/sqlc"
 )
@@ -13,6 +15,10 @@ type FileStatus struct {
 	IsBackedUp      bool
 	IsStaged        bool
 	IsModifiedSince bool
+
+	// ExclusionReason is set for files and directories left out of backups.
+	// Excluded directories have a RelativePath ending in "/".
+	ExclusionReason string
 }
 
 // GetStatus returns the backup status of files under the given path.
@@ -37,27 +43,44 @@ func (s *BTService) GetStatus(path *Path, recursive bool) ([]*FileStatus, error)
 		}
 	}
 	if directory == nil {
-		return nil, fmt.Errorf("directory is not tracked: %s", path.String())
-	}
-
-	// Discover files on disk.
-	diskFiles, err := s.fsmgr.FindFiles(path, recursive)
-	if err != nil {
-		return nil, fmt.Errorf("finding files: %w", err)
+		return nil, fmt.Errorf("%w: %s", ErrDirectoryNotTracked, path.String())
 	}
 
-	// Build a set of relative paths we've seen on disk.
-	seen := make(map[string]bool, len(diskFiles))
+	// Walk files on disk, building a set of relative paths we've seen, and
+	// list what discovery left out, and why. Backed-up files beneath an
+	// excluded directory are covered by the directory's entry.
+	seen := make(map[string]bool)
 	var statuses []*FileStatus
+	var excludedDirs []string
+
+	for e, err := range s.fsmgr.Walk(path, directory.Path, recursive) {
+		if err != nil {
+			return nil, fmt.Errorf("finding files: %w", err)
+		}
+		if e.Exclusion != nil {
+			relPath, err := filepath.Rel(directory.Path, e.Exclusion.Path)
+			if err != nil {
+				return nil, fmt.Errorf("computing relative path: %w", err)
+			}
+			seen[relPath] = true
+			if e.Exclusion.IsDir {
+				excludedDirs = append(excludedDirs, relPath+"/")
+				relPath += "/"
+			}
+			statuses = append(statuses, &FileStatus{
+				RelativePath:    relPath,
+				ExclusionReason: e.Exclusion.Reason,
+			})
+			continue
+		}
 
-	for _, f := range diskFiles {
-		relPath, err := filepath.Rel(directory.Path, f.String())
+		relPath, err := filepath.Rel(directory.Path, e.File.String())
 		if err != nil {
 			return nil, fmt.Errorf("computing relative path: %w", err)
 		}
 		seen[relPath] = true
 
-		status, err := s.getFileStatus(directory, relPath, f)
+		status, err := s.getFileStatus(directory, relPath, e.File)
 		if err != nil {
 			return nil, fmt.Errorf("getting status for %s: %w", relPath, err)
 		}
@@ -101,7 +124,9 @@ func (s *BTService) GetStatus(path *Path, recursive bool) ([]*FileStatus, error)
 			}
 		}
 
-		if seen[dbFile.Name] {
+		if seen[dbFile.Name] || slices.ContainsFunc(excludedDirs, func(dir string) bool {
+			return dir == "./" || strings.HasPrefix(dbFile.Name, dir)
+		}) {
 			continue
 		}
 
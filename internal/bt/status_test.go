@@ -87,7 +87,7 @@ func TestBTService_GetStatus(t *testing.T) {
 		svc.AddDirectory(dirPath, false)
 
 		filePath, _ := fsmgr.Resolve("/home/user/docs/file.txt")
-		if _, err := svc.StageFiles(filePath, false); err != nil {
+		if _, err := svc.StageFiles(filePath, bt.StageOptions{}); err != nil {
 			t.Fatalf("StageFiles() error = %v", err)
 		}
 
@@ -119,7 +119,7 @@ func TestBTService_GetStatus(t *testing.T) {
 		svc.AddDirectory(dirPath, false)
 
 		filePath, _ := fsmgr.Resolve("/home/user/docs/file.txt")
-		svc.StageFiles(filePath, false)
+		svc.StageFiles(filePath, bt.StageOptions{})
 
 		if _, err := svc.BackupAll(); err != nil {
 			t.Fatalf("BackupAll() error = %v", err)
@@ -153,7 +153,7 @@ func TestBTService_GetStatus(t *testing.T) {
 		svc.AddDirectory(dirPath, false)
 
 		filePath, _ := fsmgr.Resolve("/home/user/docs/file.txt")
-		svc.StageFiles(filePath, false)
+		svc.StageFiles(filePath, bt.StageOptions{})
 		svc.BackupAll()
 
 		// Modify the file (change mtime)
@@ -257,4 +257,36 @@ func TestBTService_GetStatus(t *testing.T) {
 			t.Errorf("got %q, want %q", statuses[0].RelativePath, "sub/nested.txt")
 		}
 	})
+
+	t.Run("shows excluded files with a reason", func(t *testing.T) {
+		t.Parallel()
+		svc, fsmgr, _, _ := setup(t)
+
+		fsmgr.AddDirectory("/home/user/docs")
+		fsmgr.AddFile("/home/user/docs/keep.txt", []byte("keep"))
+		fsmgr.AddFile("/home/user/docs/debug.log", []byte("log"))
+		fsmgr.SetIgnorePatterns([]string{"*.log"})
+
+		dirPath, _ := fsmgr.Resolve("/home/user/docs")
+		svc.AddDirectory(dirPath, false)
+
+		statuses, err := svc.GetStatus(dirPath, false)
+		if err != nil {
+			t.Fatalf("GetStatus() error = %v", err)
+		}
+
+		reasons := make(map[string]string)
+		for _, s := range statuses {
+			reasons[s.RelativePath] = s.ExclusionReason
+		}
+		if len(reasons) != 2 {
+			t.Fatalf("got statuses for %v, want keep.txt and debug.log", reasons)
+		}
+		if reasons["keep.txt"] != "" {
+			t.Errorf("keep.txt ExclusionReason = %q, want empty", reasons["keep.txt"])
+		}
+		if reasons["debug.log"] == "" {
+			t.Error("expected an ExclusionReason for debug.log")
+		}
+	})
 }
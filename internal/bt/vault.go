@@ -1,6 +1,22 @@
 package bt
 
-import "io"
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrMetadataConflict is returned by Vault.PutMetadata when the item was
+// written by someone else since the version the write replaces, as when two
+// machines are configured with the same host ID.
+var ErrMetadataConflict = errors.New("metadata changed by another writer; is another machine using the same host ID?")
+
+// MetadataVersion describes a version of a metadata item kept in a vault.
+type MetadataVersion struct {
+	Version  int64
+	Size     int64
+	Uploaded time.Time
+}
 
 // Vault provides an interface for backup storage backends.
 // All operations use io.Reader/io.Writer for streaming to support large files
@@ -16,8 +32,17 @@ type Vault interface {
 
 	// PutMetadata stores a named metadata item for a specific host.
 	// size is the number of bytes that will be read from r.
-	// version is stored alongside the metadata for consistency checks.
-	// Known names: "db" (SQLite database), "public_key", "private_key".
+	// version is stored alongside the metadata for consistency checks, and
+	// must be greater than the stored version; otherwise, or if another
+	// writer replaces the stored version first, PutMetadata fails with
+	// ErrMetadataConflict and the stored version is left as it was.
+	// Known names: "db" (SQLite database), "journal" and "journal.<op>"
+	// (its journal index and segments), "manifest.<op>" (the files a
+	// backup operation backed up), "host" (the host descriptor),
+	// "public_key", "private_key",
+	// "previous_public_key"/"previous_private_key" during a key rotation, and
+	// "convergence_secret" (encrypted to the key pair) in convergent mode,
+	// and "signing_key" (encrypted to the key pair).
 	PutMetadata(hostID string, name string, r io.Reader, size int64, version int64) error
 
 	// GetMetadata retrieves a named metadata item for a specific host and writes it to w.
@@ -27,6 +52,28 @@ type Vault interface {
 	// Returns 0 if no metadata has been stored for this host/name.
 	GetMetadataVersion(hostID string, name string) (int64, error)
 
+	// ListMetadataVersions returns the versions of a named metadata item the
+	// vault still keeps, oldest first. PutMetadata keeps the last few versions
+	// of each item, so a bad upload does not replace the only good copy.
+	ListMetadataVersions(hostID string, name string) ([]MetadataVersion, error)
+
+	// GetMetadataAt retrieves a kept version of a named metadata item and
+	// writes it to w.
+	GetMetadataAt(hostID string, name string, version int64, w io.Writer) error
+
+	// DeleteMetadata removes a named metadata item for a specific host with
+	// all its kept versions. Deleting an item that does not exist is not an
+	// error.
+	DeleteMetadata(hostID string, name string) error
+
+	// ListHosts returns the IDs of the hosts that have stored metadata in
+	// the vault, sorted.
+	ListHosts() ([]string, error)
+
+	// ListMetadata returns the names of the metadata items stored for a
+	// host, sorted.
+	ListMetadata(hostID string) ([]string, error)
+
 	// ValidateSetup verifies that the vault is accessible and properly configured.
 	ValidateSetup() error
 }
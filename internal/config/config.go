@@ -26,11 +26,84 @@ type EncryptionConfig struct {
 	Type           string `toml:"type"`             // "age" (default) or "test"
 	PublicKeyPath  string `toml:"public_key_path"`
 	PrivateKeyPath string `toml:"private_key_path"`
+
+	// Recipients are additional public keys that content and the metadata
+	// database are encrypted to alongside the key pair, e.g. an offline
+	// recovery key. Each entry is an age public key ("age1...") or an SSH
+	// public key line ("ssh-ed25519 AAAA... comment").
+	Recipients []string `toml:"recipients,omitempty"`
+
+	// PostQuantum generates hybrid ML-KEM-768+X25519 key pairs instead of
+	// X25519 ones, on setup and on key rotation. Additional recipients must
+	// then be post-quantum ("age1pq1...") too.
+	PostQuantum bool `toml:"post_quantum,omitempty"`
+
+	// PassphraseEnv, PassphraseFile and PassphraseCommand read the passphrase
+	// from an environment variable, a file only its owner can access, or the
+	// standard output of a shell command (e.g. "pass show bt") instead of
+	// prompting for it. At most one may be set; the --passphrase-* flags take
+	// precedence.
+	PassphraseEnv     string `toml:"passphrase_env,omitempty"`
+	PassphraseFile    string `toml:"passphrase_file,omitempty"`
+	PassphraseCommand string `toml:"passphrase_command,omitempty"`
+
+	// AgentSocket is where bt agent listens; defaults to agent/agent.sock
+	// under the base directory.
+	AgentSocket string `toml:"agent_socket,omitempty"`
+
+	// Convergent encrypts content deterministically, with a key derived from
+	// the convergence secret and the plaintext checksum, so hosts sharing the
+	// secret store identical files once. Anyone holding the secret can tell
+	// whether a file they can guess is in the vault, and convergent content is
+	// protected by the secret rather than the passphrase.
+	Convergent bool `toml:"convergent,omitempty"`
+
+	// ConvergenceSecretPath is where the convergence secret is kept; defaults
+	// to bt.secret beside the private key.
+	ConvergenceSecretPath string `toml:"convergence_secret_path,omitempty"`
+
+	// SigningKeyPath is where the key this host signs its metadata with is
+	// kept; defaults to bt.sign beside the private key.
+	SigningKeyPath string `toml:"signing_key_path,omitempty"`
 }
 
 // FilesystemConfig holds filesystem-related settings.
 type FilesystemConfig struct {
 	Ignore []string `toml:"ignore"`
+
+	// UseGitignore honors .gitignore files alongside .btignore files. Where
+	// both exist in a directory, .btignore patterns take precedence.
+	UseGitignore bool `toml:"use_gitignore,omitempty"`
+
+	// ExcludeCaches skips directories tagged with a CACHEDIR.TAG file
+	// (https://bford.info/cachedir/).
+	ExcludeCaches bool `toml:"exclude_caches,omitempty"`
+
+	// ExcludeIfPresent skips directories containing any of these file names,
+	// e.g. ".nobackup".
+	ExcludeIfPresent []string `toml:"exclude_if_present,omitempty"`
+
+	// MaxFileSize skips files larger than this many bytes; 0 means no limit.
+	MaxFileSize int64 `toml:"max_file_size,omitempty"`
+
+	// OneFileSystem skips directories on a different filesystem from the
+	// tracked directory they are found in.
+	OneFileSystem bool `toml:"one_file_system,omitempty"`
+
+	// Directories overrides the exclusion settings above for individual
+	// tracked directories.
+	Directories []DirectoryFilesystemConfig `toml:"directories,omitempty"`
+}
+
+// DirectoryFilesystemConfig overrides exclusion settings for the tracked
+// directory at Path. Unset fields inherit the global FilesystemConfig values;
+// ExcludeIfPresent adds to the global marker files.
+type DirectoryFilesystemConfig struct {
+	Path             string   `toml:"path"`
+	ExcludeCaches    *bool    `toml:"exclude_caches,omitempty"`
+	ExcludeIfPresent []string `toml:"exclude_if_present,omitempty"`
+	MaxFileSize      *int64   `toml:"max_file_size,omitempty"`
+	OneFileSystem    *bool    `toml:"one_file_system,omitempty"`
 }
 
 // VaultConfig represents configuration for a vault backend.
@@ -39,6 +112,11 @@ type VaultConfig struct {
 	Type string `toml:"type"` // "memory", "s3", or "filesystem"
 	Name string `toml:"name"`
 
+	// MetadataVersions is how many versions of each metadata item the vault
+	// keeps for 'bt metadata restore --version'; 0 means the default of 10.
+	// Only the latest version of private keys and secrets is kept.
+	MetadataVersions int `toml:"metadata_versions,omitempty"`
+
 	// S3-specific fields (only used when Type == "s3")
 	S3Bucket          string `toml:"s3_bucket,omitempty"`
 	S3Region          string `toml:"s3_region,omitempty"`
@@ -64,6 +142,11 @@ type StagingConfig struct {
 	Type       string `toml:"type"`                  // "memory" or "filesystem"
 	StagingDir string `toml:"staging_dir,omitempty"` // only used for type=filesystem
 	MaxSize    int64  `toml:"max_size"`              // max total size in bytes; must be positive, defaults to 1MB
+
+	// MaxFreePercent, when set, limits staging to this percentage of the free
+	// space on the staging filesystem instead of MaxSize. Only used for
+	// type=filesystem.
+	MaxFreePercent float64 `toml:"max_free_percent,omitempty"`
 }
 
 // vaultExamples is appended as a comment block to newly initialized config files
@@ -75,6 +158,7 @@ const vaultExamples = `
 # type = "filesystem"
 # name = "local"
 # fs_vault_root = "/path/to/vault"
+# metadata_versions = 10
 #
 # [[vaults]]
 # type = "s3"
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"bt-go/internal/bt"
+	"bt-go/internal/database/sqlc"
+)
+
+// The operation log is a hash chain. When an operation finishes, its hash is
+// the SHA-256 of the previous sealed operation's hash, its own columns and
+// the digests of the snapshots it created, recorded in operation_snapshots as
+// they are created. Operations are chained in ID order, skipping those
+// without a hash: recorded before the chain began, or never finished.
+
+// formatChainTime formats a timestamp for hashing, the same however the
+// driver returns it.
+func formatChainTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// snapshotDigest returns the digest of a snapshot as created. The file it
+// belongs to is left out, since moving or merging directories changes it.
+func snapshotDigest(s *sqlc.FileSnapshot) string {
+	born := ""
+	if s.BornAt.Valid {
+		born = formatChainTime(s.BornAt.Time)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "bt-snapshot/v1\n%q\n%q\n%d\n%d\n%d\n%d\n%s\n%s\n%s\n%s\n%s\n",
+		s.ID, s.ContentID, s.Size, s.Permissions, s.Uid, s.Gid,
+		formatChainTime(s.CreatedAt), formatChainTime(s.AccessedAt),
+		formatChainTime(s.ModifiedAt), formatChainTime(s.ChangedAt), born)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// operationHash returns the hash of a finished operation chained after prev,
+// the hash of the previous sealed operation or "" for the first, covering
+// the snapshots it created, sorted by ID.
+func operationHash(prev string, op *sqlc.BackupOperation, snapshots []sqlc.OperationSnapshot) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "bt-operation/v1\n%s\n%d\n%q\n%q\n%q\n%s\n%s\n",
+		prev, op.ID, op.Operation, op.Parameters, op.Status,
+		formatChainTime(op.StartedAt), formatChainTime(op.FinishedAt.Time))
+	for _, s := range snapshots {
+		fmt.Fprintf(h, "%q %s\n", s.SnapshotID, s.Digest)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordOperationSnapshot records that the running operation, if any,
+// created snapshot, as stored.
+func (s *SQLiteDatabase) recordOperationSnapshot(ctx context.Context, qtx *sqlc.Queries, snapshot *sqlc.FileSnapshot) error {
+	if s.operationID == 0 {
+		return nil
+	}
+	err := qtx.InsertOperationSnapshot(ctx, sqlc.InsertOperationSnapshotParams{
+		SnapshotID:  snapshot.ID,
+		OperationID: s.operationID,
+		Digest:      snapshotDigest(snapshot),
+	})
+	if err != nil {
+		return fmt.Errorf("recording snapshot of operation %d: %w", s.operationID, err)
+	}
+	return nil
+}
+
+// previousChainHash returns the hash of the last sealed operation before id,
+// or "" if there is none.
+func previousChainHash(ctx context.Context, qtx *sqlc.Queries, id int64) (string, error) {
+	prev, err := qtx.GetSealedBackupOperationBefore(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("finding previous operation: %w", err)
+	}
+	return prev.Hash.String, nil
+}
+
+func (s *SQLiteDatabase) FindBackupOperation(id int64) (*sqlc.BackupOperation, error) {
+	op, err := s.queries.GetBackupOperationByID(context.Background(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("finding backup operation: %w", err)
+	}
+	return &op, nil
+}
+
+func (s *SQLiteDatabase) FindOperationChainHead() (*sqlc.BackupOperation, error) {
+	op, err := s.queries.GetSealedBackupOperationBefore(context.Background(), math.MaxInt64)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("finding operation chain head: %w", err)
+	}
+	return &op, nil
+}
+
+// VerifyOperationChain walks the operations in ID order. A mismatch is
+// reported once: the chain carries on from the recorded hash, so one changed
+// or deleted operation does not fail every one after it. Operations without a
+// hash are only expected before the first sealed one, or while running.
+func (s *SQLiteDatabase) VerifyOperationChain() (*bt.OperationChain, error) {
+	ctx := context.Background()
+	ops, err := s.queries.GetBackupOperationsInOrder(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing backup operations: %w", err)
+	}
+
+	chain := &bt.OperationChain{}
+	prev := ""
+	for i := range ops {
+		op := &ops[i]
+		if !op.Hash.Valid {
+			chain.Unsealed++
+			if chain.Head != nil && op.Status != "running" {
+				chain.Problems = append(chain.Problems, fmt.Sprintf("operation %d (%s) finished without a hash", op.ID, op.Operation))
+			}
+			continue
+		}
+
+		snapshots, err := s.queries.GetOperationSnapshotsByOperationID(ctx, op.ID)
+		if err != nil {
+			return nil, fmt.Errorf("listing snapshots of operation %d: %w", op.ID, err)
+		}
+		if operationHash(prev, op, snapshots) == op.Hash.String {
+			chain.Sealed++
+		} else {
+			chain.Problems = append(chain.Problems, fmt.Sprintf(
+				"operation %d (%s) does not match its hash: it, the snapshots it recorded or an operation before it were changed or deleted", op.ID, op.Operation))
+		}
+		prev = op.Hash.String
+		chain.Head = op
+
+		for _, recorded := range snapshots {
+			snapshot, err := s.queries.GetFileSnapshotByID(ctx, recorded.SnapshotID)
+			if errors.Is(err, sql.ErrNoRows) {
+				chain.Missing++
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("loading snapshot %s: %w", recorded.SnapshotID, err)
+			}
+			if snapshotDigest(&snapshot) != recorded.Digest {
+				chain.Problems = append(chain.Problems, fmt.Sprintf("snapshot %s created by operation %d was changed", snapshot.ID, op.ID))
+				continue
+			}
+			chain.Snapshots++
+		}
+	}
+	return chain, nil
+}
@@ -0,0 +1,2 @@
+-- Removed directories become tracked again rather than losing their history.
+ALTER TABLE directories DROP COLUMN removed_at;
@@ -0,0 +1,4 @@
+-- Untracking a directory while keeping its history sets removed_at instead of
+-- deleting the row, so its files and snapshots stay restorable and come back
+-- if the same path is tracked again.
+ALTER TABLE directories ADD COLUMN removed_at DATETIME;
@@ -0,0 +1 @@
+DROP TABLE key_rotation_pending;
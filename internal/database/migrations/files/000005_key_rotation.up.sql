@@ -0,0 +1,6 @@
+-- Real (encrypted) content records still to be re-encrypted by a key rotation.
+-- Filled before the new key pair is made current and drained as each content
+-- is re-encrypted, so an interrupted rotation resumes where it stopped.
+CREATE TABLE key_rotation_pending (
+    content_id TEXT PRIMARY KEY REFERENCES contents(id)
+);
@@ -0,0 +1,20 @@
+DROP TRIGGER journal_backup_operations_insert;
+DROP TRIGGER journal_backup_operations_update;
+DROP TRIGGER journal_backup_operations_delete;
+DROP TRIGGER journal_contents_insert;
+DROP TRIGGER journal_contents_update;
+DROP TRIGGER journal_contents_delete;
+DROP TRIGGER journal_directories_insert;
+DROP TRIGGER journal_directories_update;
+DROP TRIGGER journal_directories_delete;
+DROP TRIGGER journal_file_snapshots_insert;
+DROP TRIGGER journal_file_snapshots_update;
+DROP TRIGGER journal_file_snapshots_delete;
+DROP TRIGGER journal_files_insert;
+DROP TRIGGER journal_files_update;
+DROP TRIGGER journal_files_delete;
+DROP TRIGGER journal_key_rotation_pending_insert;
+DROP TRIGGER journal_key_rotation_pending_update;
+DROP TRIGGER journal_key_rotation_pending_delete;
+DROP TABLE metadata_segments;
+DROP TABLE metadata_journal;
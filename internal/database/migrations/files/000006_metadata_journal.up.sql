@@ -0,0 +1,187 @@
+-- Incremental metadata sync. Every row change is recorded in metadata_journal
+-- by the triggers below; when a mutating command finishes, the pending entries
+-- are uploaded to the vault as one journal segment and dropped. Every so often
+-- the whole database is uploaded instead as a checkpoint, which starts a new
+-- run of segments.
+--
+-- A migration that adds a column to a journaled table must recreate its
+-- triggers, or the column is lost when the journal is replayed.
+CREATE TABLE metadata_journal (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    table_name TEXT NOT NULL,
+    op TEXT NOT NULL,  -- 'upsert' or 'delete'
+    row_data TEXT NOT NULL  -- JSON object: every column for upsert, the key for delete
+);
+
+-- Journal segments uploaded since the last checkpoint, one per operation.
+CREATE TABLE metadata_segments (
+    operation_id INTEGER PRIMARY KEY,
+    entries INTEGER NOT NULL,
+    size INTEGER NOT NULL
+);
+
+CREATE TRIGGER journal_backup_operations_insert AFTER INSERT ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'upsert', json_object(
+        'id', NEW.id,
+        'started_at', NEW.started_at,
+        'finished_at', NEW.finished_at,
+        'operation', NEW.operation,
+        'parameters', NEW.parameters,
+        'status', NEW.status
+    ));
+END;
+
+CREATE TRIGGER journal_backup_operations_update AFTER UPDATE ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'upsert', json_object(
+        'id', NEW.id,
+        'started_at', NEW.started_at,
+        'finished_at', NEW.finished_at,
+        'operation', NEW.operation,
+        'parameters', NEW.parameters,
+        'status', NEW.status
+    ));
+END;
+
+CREATE TRIGGER journal_backup_operations_delete AFTER DELETE ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_contents_insert AFTER INSERT ON contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('contents', 'upsert', json_object(
+        'id', NEW.id,
+        'created_at', NEW.created_at,
+        'encrypted_content_id', NEW.encrypted_content_id
+    ));
+END;
+
+CREATE TRIGGER journal_contents_update AFTER UPDATE ON contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('contents', 'upsert', json_object(
+        'id', NEW.id,
+        'created_at', NEW.created_at,
+        'encrypted_content_id', NEW.encrypted_content_id
+    ));
+END;
+
+CREATE TRIGGER journal_contents_delete AFTER DELETE ON contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('contents', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_directories_insert AFTER INSERT ON directories
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('directories', 'upsert', json_object(
+        'id', NEW.id,
+        'path', NEW.path,
+        'created_at', NEW.created_at,
+        'encrypted', NEW.encrypted,
+        'removed_at', NEW.removed_at
+    ));
+END;
+
+CREATE TRIGGER journal_directories_update AFTER UPDATE ON directories
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('directories', 'upsert', json_object(
+        'id', NEW.id,
+        'path', NEW.path,
+        'created_at', NEW.created_at,
+        'encrypted', NEW.encrypted,
+        'removed_at', NEW.removed_at
+    ));
+END;
+
+CREATE TRIGGER journal_directories_delete AFTER DELETE ON directories
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('directories', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_file_snapshots_insert AFTER INSERT ON file_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('file_snapshots', 'upsert', json_object(
+        'id', NEW.id,
+        'file_id', NEW.file_id,
+        'content_id', NEW.content_id,
+        'created_at', NEW.created_at,
+        'size', NEW.size,
+        'permissions', NEW.permissions,
+        'uid', NEW.uid,
+        'gid', NEW.gid,
+        'accessed_at', NEW.accessed_at,
+        'modified_at', NEW.modified_at,
+        'changed_at', NEW.changed_at,
+        'born_at', NEW.born_at
+    ));
+END;
+
+CREATE TRIGGER journal_file_snapshots_update AFTER UPDATE ON file_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('file_snapshots', 'upsert', json_object(
+        'id', NEW.id,
+        'file_id', NEW.file_id,
+        'content_id', NEW.content_id,
+        'created_at', NEW.created_at,
+        'size', NEW.size,
+        'permissions', NEW.permissions,
+        'uid', NEW.uid,
+        'gid', NEW.gid,
+        'accessed_at', NEW.accessed_at,
+        'modified_at', NEW.modified_at,
+        'changed_at', NEW.changed_at,
+        'born_at', NEW.born_at
+    ));
+END;
+
+CREATE TRIGGER journal_file_snapshots_delete AFTER DELETE ON file_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('file_snapshots', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_files_insert AFTER INSERT ON files
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('files', 'upsert', json_object(
+        'id', NEW.id,
+        'name', NEW.name,
+        'directory_id', NEW.directory_id,
+        'current_snapshot_id', NEW.current_snapshot_id,
+        'deleted', NEW.deleted
+    ));
+END;
+
+CREATE TRIGGER journal_files_update AFTER UPDATE ON files
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('files', 'upsert', json_object(
+        'id', NEW.id,
+        'name', NEW.name,
+        'directory_id', NEW.directory_id,
+        'current_snapshot_id', NEW.current_snapshot_id,
+        'deleted', NEW.deleted
+    ));
+END;
+
+CREATE TRIGGER journal_files_delete AFTER DELETE ON files
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('files', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_key_rotation_pending_insert AFTER INSERT ON key_rotation_pending
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('key_rotation_pending', 'upsert', json_object(
+        'content_id', NEW.content_id
+    ));
+END;
+
+CREATE TRIGGER journal_key_rotation_pending_update AFTER UPDATE ON key_rotation_pending
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('key_rotation_pending', 'upsert', json_object(
+        'content_id', NEW.content_id
+    ));
+END;
+
+CREATE TRIGGER journal_key_rotation_pending_delete AFTER DELETE ON key_rotation_pending
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('key_rotation_pending', 'delete', json_object('content_id', OLD.content_id));
+END;
@@ -0,0 +1,32 @@
+DROP TRIGGER journal_operation_snapshots_insert;
+DROP TRIGGER journal_operation_snapshots_update;
+DROP TRIGGER journal_operation_snapshots_delete;
+DROP TRIGGER journal_backup_operations_insert;
+DROP TRIGGER journal_backup_operations_update;
+
+CREATE TRIGGER journal_backup_operations_insert AFTER INSERT ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'upsert', json_object(
+        'id', NEW.id,
+        'started_at', NEW.started_at,
+        'finished_at', NEW.finished_at,
+        'operation', NEW.operation,
+        'parameters', NEW.parameters,
+        'status', NEW.status
+    ));
+END;
+
+CREATE TRIGGER journal_backup_operations_update AFTER UPDATE ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'upsert', json_object(
+        'id', NEW.id,
+        'started_at', NEW.started_at,
+        'finished_at', NEW.finished_at,
+        'operation', NEW.operation,
+        'parameters', NEW.parameters,
+        'status', NEW.status
+    ));
+END;
+
+DROP TABLE operation_snapshots;
+ALTER TABLE backup_operations DROP COLUMN hash;
@@ -0,0 +1,68 @@
+-- Tamper-evident operation log. When an operation finishes, its hash is
+-- recorded: the SHA-256 of the previous finished operation's hash, its own
+-- columns and the snapshots it created, so editing or deleting an operation,
+-- or a snapshot it recorded, breaks the chain from there on.
+ALTER TABLE backup_operations ADD COLUMN hash TEXT;
+
+-- The snapshots each operation created, with the digest of each as created.
+-- Rows outlive their snapshots, so purging a directory's history leaves the
+-- chain intact.
+CREATE TABLE operation_snapshots (
+    snapshot_id TEXT PRIMARY KEY,
+    operation_id INTEGER NOT NULL,
+    digest TEXT NOT NULL  -- SHA-256 of the snapshot's columns
+);
+
+CREATE INDEX idx_operation_snapshots_operation ON operation_snapshots(operation_id);
+
+DROP TRIGGER journal_backup_operations_insert;
+DROP TRIGGER journal_backup_operations_update;
+
+CREATE TRIGGER journal_backup_operations_insert AFTER INSERT ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'upsert', json_object(
+        'id', NEW.id,
+        'started_at', NEW.started_at,
+        'finished_at', NEW.finished_at,
+        'operation', NEW.operation,
+        'parameters', NEW.parameters,
+        'status', NEW.status,
+        'hash', NEW.hash
+    ));
+END;
+
+CREATE TRIGGER journal_backup_operations_update AFTER UPDATE ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'upsert', json_object(
+        'id', NEW.id,
+        'started_at', NEW.started_at,
+        'finished_at', NEW.finished_at,
+        'operation', NEW.operation,
+        'parameters', NEW.parameters,
+        'status', NEW.status,
+        'hash', NEW.hash
+    ));
+END;
+
+CREATE TRIGGER journal_operation_snapshots_insert AFTER INSERT ON operation_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('operation_snapshots', 'upsert', json_object(
+        'snapshot_id', NEW.snapshot_id,
+        'operation_id', NEW.operation_id,
+        'digest', NEW.digest
+    ));
+END;
+
+CREATE TRIGGER journal_operation_snapshots_update AFTER UPDATE ON operation_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('operation_snapshots', 'upsert', json_object(
+        'snapshot_id', NEW.snapshot_id,
+        'operation_id', NEW.operation_id,
+        'digest', NEW.digest
+    ));
+END;
+
+CREATE TRIGGER journal_operation_snapshots_delete AFTER DELETE ON operation_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('operation_snapshots', 'delete', json_object('snapshot_id', OLD.snapshot_id));
+END;
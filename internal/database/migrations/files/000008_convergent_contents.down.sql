@@ -0,0 +1,4 @@
+DROP TRIGGER journal_convergent_contents_insert;
+DROP TRIGGER journal_convergent_contents_update;
+DROP TRIGGER journal_convergent_contents_delete;
+DROP TABLE convergent_contents;
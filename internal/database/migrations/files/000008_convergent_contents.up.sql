@@ -0,0 +1,25 @@
+-- Real encrypted content records whose vault object was encrypted with the
+-- convergence secret rather than to the key pair. A key rotation leaves them
+-- out: encrypting the same plaintext again would produce the same object.
+CREATE TABLE convergent_contents (
+    content_id TEXT PRIMARY KEY REFERENCES contents(id)
+);
+
+CREATE TRIGGER journal_convergent_contents_insert AFTER INSERT ON convergent_contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('convergent_contents', 'upsert', json_object(
+        'content_id', NEW.content_id
+    ));
+END;
+
+CREATE TRIGGER journal_convergent_contents_update AFTER UPDATE ON convergent_contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('convergent_contents', 'upsert', json_object(
+        'content_id', NEW.content_id
+    ));
+END;
+
+CREATE TRIGGER journal_convergent_contents_delete AFTER DELETE ON convergent_contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('convergent_contents', 'delete', json_object('content_id', OLD.content_id));
+END;
@@ -85,6 +85,24 @@ func MigrateUp(db *sql.DB) error {
 	return nil
 }
 
+// MigrateTo runs the migrations up or down to bring database to version.
+func MigrateTo(db *sql.DB, version uint) error {
+	m, err := newMigrate(db)
+	if err != nil {
+		return fmt.Errorf("failed to create migrate instance: %w", err)
+	}
+	// As in MigrateUp, m is not closed so that the caller's db stays open
+
+	if err := m.Migrate(version); err != nil {
+		if errors.Is(err, migrate.ErrNoChange) {
+			return nil
+		}
+		return fmt.Errorf("migration to version %d failed: %w", version, err)
+	}
+
+	return nil
+}
+
 // newMigrate creates a new migrate instance for the given database.
 func newMigrate(db *sql.DB) (*migrate.Migrate, error) {
 	// Create source driver from embedded files
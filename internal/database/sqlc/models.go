@@ -10,12 +10,13 @@ import (
 )
 
 type BackupOperation struct {
-	ID         int64        `json:"id"`
-	StartedAt  time.Time    `json:"started_at"`
-	FinishedAt sql.NullTime `json:"finished_at"`
-	Operation  string       `json:"operation"`
-	Parameters string       `json:"parameters"`
-	Status     string       `json:"status"`
+	ID         int64          `json:"id"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt sql.NullTime   `json:"finished_at"`
+	Operation  string         `json:"operation"`
+	Parameters string         `json:"parameters"`
+	Status     string         `json:"status"`
+	Hash       sql.NullString `json:"hash"`
 }
 
 type Content struct {
@@ -24,11 +25,16 @@ type Content struct {
 	EncryptedContentID sql.NullString `json:"encrypted_content_id"`
 }
 
+type ConvergentContent struct {
+	ContentID string `json:"content_id"`
+}
+
 type Directory struct {
-	ID        string    `json:"id"`
-	Path      string    `json:"path"`
-	CreatedAt time.Time `json:"created_at"`
-	Encrypted int64     `json:"encrypted"`
+	ID        string       `json:"id"`
+	Path      string       `json:"path"`
+	CreatedAt time.Time    `json:"created_at"`
+	Encrypted int64        `json:"encrypted"`
+	RemovedAt sql.NullTime `json:"removed_at"`
 }
 
 type File struct {
@@ -53,3 +59,26 @@ type FileSnapshot struct {
 	ChangedAt   time.Time    `json:"changed_at"`
 	BornAt      sql.NullTime `json:"born_at"`
 }
+
+type KeyRotationPending struct {
+	ContentID string `json:"content_id"`
+}
+
+type MetadataJournal struct {
+	Seq       int64  `json:"seq"`
+	TableName string `json:"table_name"`
+	Op        string `json:"op"`
+	RowData   string `json:"row_data"`
+}
+
+type MetadataSegment struct {
+	OperationID int64 `json:"operation_id"`
+	Entries     int64 `json:"entries"`
+	Size        int64 `json:"size"`
+}
+
+type OperationSnapshot struct {
+	SnapshotID  string `json:"snapshot_id"`
+	OperationID int64  `json:"operation_id"`
+	Digest      string `json:"digest"`
+}
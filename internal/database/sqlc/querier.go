@@ -6,13 +6,25 @@ package sqlc
 
 import (
 	"context"
+	"database/sql"
+	"time"
 )
 
 type Querier interface {
+	CountEncryptedDirectoriesByContentID(ctx context.Context, contentID string) (int64, error)
 	DeleteDirectoryByID(ctx context.Context, id string) error
+	DeleteFileByID(ctx context.Context, id string) error
+	DeleteKeyRotationPending(ctx context.Context, contentID string) error
+	DeleteMetadataJournalThrough(ctx context.Context, seq int64) error
+	DeleteMetadataSegments(ctx context.Context) error
+	GetBackupOperationByID(ctx context.Context, id int64) (BackupOperation, error)
 	GetBackupOperations(ctx context.Context, limit int64) ([]BackupOperation, error)
+	GetBackupOperationsInOrder(ctx context.Context) ([]BackupOperation, error)
 	// Content queries
 	GetContentByID(ctx context.Context, id string) (Content, error)
+	GetContentIDByEncryptedContentID(ctx context.Context, encryptedContentID sql.NullString) (string, error)
+	GetContentsByDirectoryID(ctx context.Context, directoryID string) ([]Content, error)
+	GetDirectories(ctx context.Context) ([]Directory, error)
 	GetDirectoriesByPathPrefix(ctx context.Context, path string) ([]Directory, error)
 	GetDirectoryByID(ctx context.Context, id string) (Directory, error)
 	// SQL queries for bt database operations
@@ -20,6 +32,7 @@ type Querier interface {
 	// See: https://docs.sqlc.dev/en/latest/
 	// Directory queries
 	GetDirectoryByPath(ctx context.Context, path string) (Directory, error)
+	GetDirectoryStats(ctx context.Context, directoryID string) (GetDirectoryStatsRow, error)
 	GetFileByDirectoryAndName(ctx context.Context, arg GetFileByDirectoryAndNameParams) (File, error)
 	// File queries
 	GetFileByID(ctx context.Context, id string) (File, error)
@@ -28,16 +41,37 @@ type Querier interface {
 	GetFileSnapshotByID(ctx context.Context, id string) (FileSnapshot, error)
 	GetFileSnapshotsByFileID(ctx context.Context, fileID string) ([]FileSnapshot, error)
 	GetFilesByDirectoryID(ctx context.Context, directoryID string) ([]File, error)
+	GetKeyRotationPending(ctx context.Context) ([]string, error)
+	GetLatestSnapshotCreatedAtByDirectoryID(ctx context.Context, directoryID string) (time.Time, error)
 	GetMaxBackupOperationID(ctx context.Context) (int64, error)
+	GetMaxMetadataJournalSeq(ctx context.Context) (int64, error)
+	// Metadata journal queries
+	GetMetadataJournal(ctx context.Context) ([]MetadataJournal, error)
+	GetMetadataSegments(ctx context.Context) ([]MetadataSegment, error)
+	GetOperationSnapshotsByOperationID(ctx context.Context, operationID int64) ([]OperationSnapshot, error)
+	GetSealedBackupOperationBefore(ctx context.Context, id int64) (BackupOperation, error)
 	// Backup operation queries
 	InsertBackupOperation(ctx context.Context, arg InsertBackupOperationParams) (BackupOperation, error)
 	InsertContent(ctx context.Context, arg InsertContentParams) (Content, error)
+	InsertConvergentContent(ctx context.Context, contentID string) error
 	InsertDirectory(ctx context.Context, arg InsertDirectoryParams) (Directory, error)
 	InsertFile(ctx context.Context, arg InsertFileParams) (File, error)
 	InsertFileSnapshot(ctx context.Context, arg InsertFileSnapshotParams) (FileSnapshot, error)
+	// Key rotation queries
+	InsertKeyRotationPending(ctx context.Context, skipConvergent bool) error
+	InsertMetadataSegment(ctx context.Context, arg InsertMetadataSegmentParams) error
+	// Operation snapshot queries
+	InsertOperationSnapshot(ctx context.Context, arg InsertOperationSnapshotParams) error
+	ReactivateDirectory(ctx context.Context, arg ReactivateDirectoryParams) (Directory, error)
 	UpdateBackupOperationFinished(ctx context.Context, arg UpdateBackupOperationFinishedParams) error
+	UpdateContentEncryptedContentID(ctx context.Context, arg UpdateContentEncryptedContentIDParams) error
+	UpdateContentsEncryptedContentID(ctx context.Context, arg UpdateContentsEncryptedContentIDParams) error
+	UpdateDirectoryEncrypted(ctx context.Context, arg UpdateDirectoryEncryptedParams) error
+	UpdateDirectoryPath(ctx context.Context, arg UpdateDirectoryPathParams) error
+	UpdateDirectoryRemovedAt(ctx context.Context, arg UpdateDirectoryRemovedAtParams) error
 	UpdateFileCurrentSnapshot(ctx context.Context, arg UpdateFileCurrentSnapshotParams) error
 	UpdateFileDirectoryAndName(ctx context.Context, arg UpdateFileDirectoryAndNameParams) error
+	UpdateFileSnapshotsFileID(ctx context.Context, arg UpdateFileSnapshotsFileIDParams) error
 }
 
 var _ Querier = (*Queries)(nil)
@@ -21,6 +21,36 @@ RETURNING *;
 -- name: DeleteDirectoryByID :exec
 DELETE FROM directories WHERE id = ?;
 
+-- name: GetDirectories :many
+SELECT * FROM directories ORDER BY path;
+
+-- name: UpdateDirectoryRemovedAt :exec
+UPDATE directories SET removed_at = ? WHERE id = ?;
+
+-- name: ReactivateDirectory :one
+UPDATE directories SET removed_at = NULL, encrypted = ? WHERE id = ?
+RETURNING *;
+
+-- name: UpdateDirectoryPath :exec
+UPDATE directories SET path = ? WHERE id = ?;
+
+-- name: UpdateDirectoryEncrypted :exec
+UPDATE directories SET encrypted = ? WHERE id = ?;
+
+-- name: GetDirectoryStats :one
+SELECT
+    CAST(COUNT(*) AS INTEGER) AS file_count,
+    CAST(COALESCE(SUM(s.size), 0) AS INTEGER) AS total_size
+FROM files f
+JOIN file_snapshots s ON s.id = f.current_snapshot_id
+WHERE f.directory_id = ? AND f.deleted = 0;
+
+-- name: GetLatestSnapshotCreatedAtByDirectoryID :one
+SELECT s.created_at FROM file_snapshots s
+JOIN files f ON f.id = s.file_id
+WHERE f.directory_id = ?
+ORDER BY s.created_at DESC LIMIT 1;
+
 -- File queries
 
 -- name: GetFileByID :one
@@ -35,6 +65,9 @@ SELECT * FROM files WHERE directory_id = ? AND name = ? LIMIT 1;
 -- name: UpdateFileDirectoryAndName :exec
 UPDATE files SET directory_id = ?, name = ? WHERE id = ?;
 
+-- name: DeleteFileByID :exec
+DELETE FROM files WHERE id = ?;
+
 -- name: InsertFile :one
 INSERT INTO files (id, name, directory_id, current_snapshot_id, deleted)
 VALUES (?, ?, ?, ?, ?)
@@ -54,6 +87,9 @@ SELECT * FROM file_snapshots WHERE file_id = ? ORDER BY created_at;
 -- name: GetFileSnapshotByFileAndContent :one
 SELECT * FROM file_snapshots WHERE file_id = ? AND content_id = ? LIMIT 1;
 
+-- name: UpdateFileSnapshotsFileID :exec
+UPDATE file_snapshots SET file_id = sqlc.arg(new_file_id) WHERE file_id = sqlc.arg(old_file_id);
+
 -- name: InsertFileSnapshot :one
 INSERT INTO file_snapshots (id, file_id, content_id, created_at, size, permissions, uid, gid, accessed_at, modified_at, changed_at, born_at)
 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
@@ -64,11 +100,30 @@ RETURNING *;
 -- name: GetContentByID :one
 SELECT * FROM contents WHERE id = ? LIMIT 1;
 
+-- name: GetContentIDByEncryptedContentID :one
+SELECT id FROM contents WHERE encrypted_content_id = ? ORDER BY id LIMIT 1;
+
 -- name: InsertContent :one
 INSERT INTO contents (id, created_at, encrypted_content_id)
 VALUES (?, ?, ?)
 RETURNING *;
 
+-- name: UpdateContentEncryptedContentID :exec
+UPDATE contents SET encrypted_content_id = ? WHERE id = ?;
+
+-- name: GetContentsByDirectoryID :many
+SELECT DISTINCT c.* FROM contents c
+JOIN file_snapshots s ON s.content_id = c.id
+JOIN files f ON f.id = s.file_id
+WHERE f.directory_id = ?
+ORDER BY c.id;
+
+-- name: CountEncryptedDirectoriesByContentID :one
+SELECT COUNT(DISTINCT f.directory_id) FROM file_snapshots s
+JOIN files f ON f.id = s.file_id
+JOIN directories d ON d.id = f.directory_id
+WHERE s.content_id = ? AND d.encrypted = 1;
+
 -- Backup operation queries
 
 -- name: InsertBackupOperation :one
@@ -77,10 +132,68 @@ VALUES (?, ?, ?)
 RETURNING *;
 
 -- name: UpdateBackupOperationFinished :exec
-UPDATE backup_operations SET finished_at = ?, status = ? WHERE id = ?;
+UPDATE backup_operations SET finished_at = ?, status = ?, hash = ? WHERE id = ?;
 
 -- name: GetMaxBackupOperationID :one
 SELECT CAST(COALESCE(MAX(id), 0) AS INTEGER) AS max_id FROM backup_operations;
 
 -- name: GetBackupOperations :many
 SELECT * FROM backup_operations ORDER BY id DESC LIMIT ?;
+
+-- name: GetBackupOperationByID :one
+SELECT * FROM backup_operations WHERE id = ? LIMIT 1;
+
+-- name: GetBackupOperationsInOrder :many
+SELECT * FROM backup_operations ORDER BY id;
+
+-- name: GetSealedBackupOperationBefore :one
+SELECT * FROM backup_operations WHERE hash IS NOT NULL AND id < ? ORDER BY id DESC LIMIT 1;
+
+-- Operation snapshot queries
+
+-- name: InsertOperationSnapshot :exec
+INSERT INTO operation_snapshots (snapshot_id, operation_id, digest)
+VALUES (?, ?, ?);
+
+-- name: GetOperationSnapshotsByOperationID :many
+SELECT * FROM operation_snapshots WHERE operation_id = ? ORDER BY snapshot_id;
+
+-- Key rotation queries
+
+-- name: InsertKeyRotationPending :exec
+INSERT OR IGNORE INTO key_rotation_pending (content_id)
+SELECT DISTINCT encrypted_content_id FROM contents
+WHERE encrypted_content_id IS NOT NULL
+  AND NOT (sqlc.arg(skip_convergent) AND encrypted_content_id IN (SELECT content_id FROM convergent_contents));
+
+-- name: GetKeyRotationPending :many
+SELECT content_id FROM key_rotation_pending ORDER BY content_id;
+
+-- name: DeleteKeyRotationPending :exec
+DELETE FROM key_rotation_pending WHERE content_id = ?;
+
+-- name: UpdateContentsEncryptedContentID :exec
+UPDATE contents SET encrypted_content_id = sqlc.arg(new_id) WHERE encrypted_content_id = sqlc.arg(old_id);
+
+-- name: InsertConvergentContent :exec
+INSERT OR IGNORE INTO convergent_contents (content_id) VALUES (?);
+
+-- Metadata journal queries
+
+-- name: GetMetadataJournal :many
+SELECT * FROM metadata_journal ORDER BY seq;
+
+-- name: GetMaxMetadataJournalSeq :one
+SELECT CAST(COALESCE(MAX(seq), 0) AS INTEGER) AS max_seq FROM metadata_journal;
+
+-- name: DeleteMetadataJournalThrough :exec
+DELETE FROM metadata_journal WHERE seq <= ?;
+
+-- name: InsertMetadataSegment :exec
+INSERT INTO metadata_segments (operation_id, entries, size) VALUES (?, ?, ?);
+
+-- name: GetMetadataSegments :many
+SELECT * FROM metadata_segments ORDER BY operation_id;
+
+-- name: DeleteMetadataSegments :exec
+DELETE FROM metadata_segments;
@@ -11,6 +11,20 @@ import (
 	"time"
 )
 
+const countEncryptedDirectoriesByContentID = `-- name: CountEncryptedDirectoriesByContentID :one
+SELECT COUNT(DISTINCT f.directory_id) FROM file_snapshots s
+JOIN files f ON f.id = s.file_id
+JOIN directories d ON d.id = f.directory_id
+WHERE s.content_id = ? AND d.encrypted = 1
+`
+
+func (q *Queries) CountEncryptedDirectoriesByContentID(ctx context.Context, contentID string) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countEncryptedDirectoriesByContentID, contentID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const deleteDirectoryByID = `-- name: DeleteDirectoryByID :exec
 DELETE FROM directories WHERE id = ?
 `
@@ -20,8 +34,63 @@ func (q *Queries) DeleteDirectoryByID(ctx context.Context, id string) error {
 	return err
 }
 
+const deleteFileByID = `-- name: DeleteFileByID :exec
+DELETE FROM files WHERE id = ?
+`
+
+func (q *Queries) DeleteFileByID(ctx context.Context, id string) error {
+	_, err := q.db.ExecContext(ctx, deleteFileByID, id)
+	return err
+}
+
+const deleteKeyRotationPending = `-- name: DeleteKeyRotationPending :exec
+DELETE FROM key_rotation_pending WHERE content_id = ?
+`
+
+func (q *Queries) DeleteKeyRotationPending(ctx context.Context, contentID string) error {
+	_, err := q.db.ExecContext(ctx, deleteKeyRotationPending, contentID)
+	return err
+}
+
+const deleteMetadataJournalThrough = `-- name: DeleteMetadataJournalThrough :exec
+DELETE FROM metadata_journal WHERE seq <= ?
+`
+
+func (q *Queries) DeleteMetadataJournalThrough(ctx context.Context, seq int64) error {
+	_, err := q.db.ExecContext(ctx, deleteMetadataJournalThrough, seq)
+	return err
+}
+
+const deleteMetadataSegments = `-- name: DeleteMetadataSegments :exec
+DELETE FROM metadata_segments
+`
+
+func (q *Queries) DeleteMetadataSegments(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, deleteMetadataSegments)
+	return err
+}
+
+const getBackupOperationByID = `-- name: GetBackupOperationByID :one
+SELECT id, started_at, finished_at, operation, parameters, status, hash FROM backup_operations WHERE id = ? LIMIT 1
+`
+
+func (q *Queries) GetBackupOperationByID(ctx context.Context, id int64) (BackupOperation, error) {
+	row := q.db.QueryRowContext(ctx, getBackupOperationByID, id)
+	var i BackupOperation
+	err := row.Scan(
+		&i.ID,
+		&i.StartedAt,
+		&i.FinishedAt,
+		&i.Operation,
+		&i.Parameters,
+		&i.Status,
+		&i.Hash,
+	)
+	return i, err
+}
+
 const getBackupOperations = `-- name: GetBackupOperations :many
-SELECT id, started_at, finished_at, operation, parameters, status FROM backup_operations ORDER BY id DESC LIMIT ?
+SELECT id, started_at, finished_at, operation, parameters, status, hash FROM backup_operations ORDER BY id DESC LIMIT ?
 `
 
 func (q *Queries) GetBackupOperations(ctx context.Context, limit int64) ([]BackupOperation, error) {
@@ -40,6 +109,42 @@ func (q *Queries) GetBackupOperations(ctx context.Context, limit int64) ([]Backu
 			&i.Operation,
 			&i.Parameters,
 			&i.Status,
+			&i.Hash,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getBackupOperationsInOrder = `-- name: GetBackupOperationsInOrder :many
+SELECT id, started_at, finished_at, operation, parameters, status, hash FROM backup_operations ORDER BY id
+`
+
+func (q *Queries) GetBackupOperationsInOrder(ctx context.Context) ([]BackupOperation, error) {
+	rows, err := q.db.QueryContext(ctx, getBackupOperationsInOrder)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []BackupOperation
+	for rows.Next() {
+		var i BackupOperation
+		if err := rows.Scan(
+			&i.ID,
+			&i.StartedAt,
+			&i.FinishedAt,
+			&i.Operation,
+			&i.Parameters,
+			&i.Status,
+			&i.Hash,
 		); err != nil {
 			return nil, err
 		}
@@ -67,8 +172,87 @@ func (q *Queries) GetContentByID(ctx context.Context, id string) (Content, error
 	return i, err
 }
 
+const getContentIDByEncryptedContentID = `-- name: GetContentIDByEncryptedContentID :one
+SELECT id FROM contents WHERE encrypted_content_id = ? ORDER BY id LIMIT 1
+`
+
+func (q *Queries) GetContentIDByEncryptedContentID(ctx context.Context, encryptedContentID sql.NullString) (string, error) {
+	row := q.db.QueryRowContext(ctx, getContentIDByEncryptedContentID, encryptedContentID)
+	var id string
+	err := row.Scan(&id)
+	return id, err
+}
+
+const getContentsByDirectoryID = `-- name: GetContentsByDirectoryID :many
+SELECT DISTINCT c.id, c.created_at, c.encrypted_content_id FROM contents c
+JOIN file_snapshots s ON s.content_id = c.id
+JOIN files f ON f.id = s.file_id
+WHERE f.directory_id = ?
+ORDER BY c.id
+`
+
+func (q *Queries) GetContentsByDirectoryID(ctx context.Context, directoryID string) ([]Content, error) {
+	rows, err := q.db.QueryContext(ctx, getContentsByDirectoryID, directoryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Content
+	for rows.Next() {
+		var i Content
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.EncryptedContentID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDirectories = `-- name: GetDirectories :many
+SELECT id, path, created_at, encrypted, removed_at FROM directories ORDER BY path
+`
+
+func (q *Queries) GetDirectories(ctx context.Context) ([]Directory, error) {
+	rows, err := q.db.QueryContext(ctx, getDirectories)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Directory
+	for rows.Next() {
+		var i Directory
+		if err := rows.Scan(
+			&i.ID,
+			&i.Path,
+			&i.CreatedAt,
+			&i.Encrypted,
+			&i.RemovedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getDirectoriesByPathPrefix = `-- name: GetDirectoriesByPathPrefix :many
-SELECT id, path, created_at, encrypted FROM directories WHERE path LIKE ?1 ORDER BY path
+SELECT id, path, created_at, encrypted, removed_at FROM directories WHERE path LIKE ?1 ORDER BY path
 `
 
 func (q *Queries) GetDirectoriesByPathPrefix(ctx context.Context, path string) ([]Directory, error) {
@@ -85,6 +269,7 @@ func (q *Queries) GetDirectoriesByPathPrefix(ctx context.Context, path string) (
 			&i.Path,
 			&i.CreatedAt,
 			&i.Encrypted,
+			&i.RemovedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -100,7 +285,7 @@ func (q *Queries) GetDirectoriesByPathPrefix(ctx context.Context, path string) (
 }
 
 const getDirectoryByID = `-- name: GetDirectoryByID :one
-SELECT id, path, created_at, encrypted FROM directories WHERE id = ? LIMIT 1
+SELECT id, path, created_at, encrypted, removed_at FROM directories WHERE id = ? LIMIT 1
 `
 
 func (q *Queries) GetDirectoryByID(ctx context.Context, id string) (Directory, error) {
@@ -111,6 +296,7 @@ func (q *Queries) GetDirectoryByID(ctx context.Context, id string) (Directory, e
 		&i.Path,
 		&i.CreatedAt,
 		&i.Encrypted,
+		&i.RemovedAt,
 	)
 	return i, err
 }
@@ -118,7 +304,7 @@ func (q *Queries) GetDirectoryByID(ctx context.Context, id string) (Directory, e
 const getDirectoryByPath = `-- name: GetDirectoryByPath :one
 
 
-SELECT id, path, created_at, encrypted FROM directories WHERE path = ? LIMIT 1
+SELECT id, path, created_at, encrypted, removed_at FROM directories WHERE path = ? LIMIT 1
 `
 
 // SQL queries for bt database operations
@@ -133,10 +319,32 @@ func (q *Queries) GetDirectoryByPath(ctx context.Context, path string) (Director
 		&i.Path,
 		&i.CreatedAt,
 		&i.Encrypted,
+		&i.RemovedAt,
 	)
 	return i, err
 }
 
+const getDirectoryStats = `-- name: GetDirectoryStats :one
+SELECT
+    CAST(COUNT(*) AS INTEGER) AS file_count,
+    CAST(COALESCE(SUM(s.size), 0) AS INTEGER) AS total_size
+FROM files f
+JOIN file_snapshots s ON s.id = f.current_snapshot_id
+WHERE f.directory_id = ? AND f.deleted = 0
+`
+
+type GetDirectoryStatsRow struct {
+	FileCount int64 `json:"file_count"`
+	TotalSize int64 `json:"total_size"`
+}
+
+func (q *Queries) GetDirectoryStats(ctx context.Context, directoryID string) (GetDirectoryStatsRow, error) {
+	row := q.db.QueryRowContext(ctx, getDirectoryStats, directoryID)
+	var i GetDirectoryStatsRow
+	err := row.Scan(&i.FileCount, &i.TotalSize)
+	return i, err
+}
+
 const getFileByDirectoryAndName = `-- name: GetFileByDirectoryAndName :one
 SELECT id, name, directory_id, current_snapshot_id, deleted FROM files WHERE directory_id = ? AND name = ? LIMIT 1
 `
@@ -306,6 +514,47 @@ func (q *Queries) GetFilesByDirectoryID(ctx context.Context, directoryID string)
 	return items, nil
 }
 
+const getKeyRotationPending = `-- name: GetKeyRotationPending :many
+SELECT content_id FROM key_rotation_pending ORDER BY content_id
+`
+
+func (q *Queries) GetKeyRotationPending(ctx context.Context) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, getKeyRotationPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var content_id string
+		if err := rows.Scan(&content_id); err != nil {
+			return nil, err
+		}
+		items = append(items, content_id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getLatestSnapshotCreatedAtByDirectoryID = `-- name: GetLatestSnapshotCreatedAtByDirectoryID :one
+SELECT s.created_at FROM file_snapshots s
+JOIN files f ON f.id = s.file_id
+WHERE f.directory_id = ?
+ORDER BY s.created_at DESC LIMIT 1
+`
+
+func (q *Queries) GetLatestSnapshotCreatedAtByDirectoryID(ctx context.Context, directoryID string) (time.Time, error) {
+	row := q.db.QueryRowContext(ctx, getLatestSnapshotCreatedAtByDirectoryID, directoryID)
+	var created_at time.Time
+	err := row.Scan(&created_at)
+	return created_at, err
+}
+
 const getMaxBackupOperationID = `-- name: GetMaxBackupOperationID :one
 SELECT CAST(COALESCE(MAX(id), 0) AS INTEGER) AS max_id FROM backup_operations
 `
@@ -317,11 +566,128 @@ func (q *Queries) GetMaxBackupOperationID(ctx context.Context) (int64, error) {
 	return max_id, err
 }
 
+const getMaxMetadataJournalSeq = `-- name: GetMaxMetadataJournalSeq :one
+SELECT CAST(COALESCE(MAX(seq), 0) AS INTEGER) AS max_seq FROM metadata_journal
+`
+
+func (q *Queries) GetMaxMetadataJournalSeq(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getMaxMetadataJournalSeq)
+	var max_seq int64
+	err := row.Scan(&max_seq)
+	return max_seq, err
+}
+
+const getMetadataJournal = `-- name: GetMetadataJournal :many
+SELECT seq, table_name, op, row_data FROM metadata_journal ORDER BY seq
+`
+
+// Metadata journal queries
+func (q *Queries) GetMetadataJournal(ctx context.Context) ([]MetadataJournal, error) {
+	rows, err := q.db.QueryContext(ctx, getMetadataJournal)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []MetadataJournal
+	for rows.Next() {
+		var i MetadataJournal
+		if err := rows.Scan(
+			&i.Seq,
+			&i.TableName,
+			&i.Op,
+			&i.RowData,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getMetadataSegments = `-- name: GetMetadataSegments :many
+SELECT operation_id, entries, size FROM metadata_segments ORDER BY operation_id
+`
+
+func (q *Queries) GetMetadataSegments(ctx context.Context) ([]MetadataSegment, error) {
+	rows, err := q.db.QueryContext(ctx, getMetadataSegments)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []MetadataSegment
+	for rows.Next() {
+		var i MetadataSegment
+		if err := rows.Scan(&i.OperationID, &i.Entries, &i.Size); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getOperationSnapshotsByOperationID = `-- name: GetOperationSnapshotsByOperationID :many
+SELECT snapshot_id, operation_id, digest FROM operation_snapshots WHERE operation_id = ? ORDER BY snapshot_id
+`
+
+func (q *Queries) GetOperationSnapshotsByOperationID(ctx context.Context, operationID int64) ([]OperationSnapshot, error) {
+	rows, err := q.db.QueryContext(ctx, getOperationSnapshotsByOperationID, operationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []OperationSnapshot
+	for rows.Next() {
+		var i OperationSnapshot
+		if err := rows.Scan(&i.SnapshotID, &i.OperationID, &i.Digest); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSealedBackupOperationBefore = `-- name: GetSealedBackupOperationBefore :one
+SELECT id, started_at, finished_at, operation, parameters, status, hash FROM backup_operations WHERE hash IS NOT NULL AND id < ? ORDER BY id DESC LIMIT 1
+`
+
+func (q *Queries) GetSealedBackupOperationBefore(ctx context.Context, id int64) (BackupOperation, error) {
+	row := q.db.QueryRowContext(ctx, getSealedBackupOperationBefore, id)
+	var i BackupOperation
+	err := row.Scan(
+		&i.ID,
+		&i.StartedAt,
+		&i.FinishedAt,
+		&i.Operation,
+		&i.Parameters,
+		&i.Status,
+		&i.Hash,
+	)
+	return i, err
+}
+
 const insertBackupOperation = `-- name: InsertBackupOperation :one
 
 INSERT INTO backup_operations (started_at, operation, parameters)
 VALUES (?, ?, ?)
-RETURNING id, started_at, finished_at, operation, parameters, status
+RETURNING id, started_at, finished_at, operation, parameters, status, hash
 `
 
 type InsertBackupOperationParams struct {
@@ -341,6 +707,7 @@ func (q *Queries) InsertBackupOperation(ctx context.Context, arg InsertBackupOpe
 		&i.Operation,
 		&i.Parameters,
 		&i.Status,
+		&i.Hash,
 	)
 	return i, err
 }
@@ -364,10 +731,19 @@ func (q *Queries) InsertContent(ctx context.Context, arg InsertContentParams) (C
 	return i, err
 }
 
+const insertConvergentContent = `-- name: InsertConvergentContent :exec
+INSERT OR IGNORE INTO convergent_contents (content_id) VALUES (?)
+`
+
+func (q *Queries) InsertConvergentContent(ctx context.Context, contentID string) error {
+	_, err := q.db.ExecContext(ctx, insertConvergentContent, contentID)
+	return err
+}
+
 const insertDirectory = `-- name: InsertDirectory :one
 INSERT INTO directories (id, path, created_at, encrypted)
 VALUES (?, ?, ?, ?)
-RETURNING id, path, created_at, encrypted
+RETURNING id, path, created_at, encrypted, removed_at
 `
 
 type InsertDirectoryParams struct {
@@ -390,6 +766,7 @@ func (q *Queries) InsertDirectory(ctx context.Context, arg InsertDirectoryParams
 		&i.Path,
 		&i.CreatedAt,
 		&i.Encrypted,
+		&i.RemovedAt,
 	)
 	return i, err
 }
@@ -481,18 +858,164 @@ func (q *Queries) InsertFileSnapshot(ctx context.Context, arg InsertFileSnapshot
 	return i, err
 }
 
+const insertKeyRotationPending = `-- name: InsertKeyRotationPending :exec
+
+INSERT OR IGNORE INTO key_rotation_pending (content_id)
+SELECT DISTINCT encrypted_content_id FROM contents
+WHERE encrypted_content_id IS NOT NULL
+  AND NOT (?1 AND encrypted_content_id IN (SELECT content_id FROM convergent_contents))
+`
+
+// Key rotation queries
+func (q *Queries) InsertKeyRotationPending(ctx context.Context, skipConvergent bool) error {
+	_, err := q.db.ExecContext(ctx, insertKeyRotationPending, skipConvergent)
+	return err
+}
+
+const insertMetadataSegment = `-- name: InsertMetadataSegment :exec
+INSERT INTO metadata_segments (operation_id, entries, size) VALUES (?, ?, ?)
+`
+
+type InsertMetadataSegmentParams struct {
+	OperationID int64 `json:"operation_id"`
+	Entries     int64 `json:"entries"`
+	Size        int64 `json:"size"`
+}
+
+func (q *Queries) InsertMetadataSegment(ctx context.Context, arg InsertMetadataSegmentParams) error {
+	_, err := q.db.ExecContext(ctx, insertMetadataSegment, arg.OperationID, arg.Entries, arg.Size)
+	return err
+}
+
+const insertOperationSnapshot = `-- name: InsertOperationSnapshot :exec
+
+INSERT INTO operation_snapshots (snapshot_id, operation_id, digest)
+VALUES (?, ?, ?)
+`
+
+type InsertOperationSnapshotParams struct {
+	SnapshotID  string `json:"snapshot_id"`
+	OperationID int64  `json:"operation_id"`
+	Digest      string `json:"digest"`
+}
+
+// Operation snapshot queries
+func (q *Queries) InsertOperationSnapshot(ctx context.Context, arg InsertOperationSnapshotParams) error {
+	_, err := q.db.ExecContext(ctx, insertOperationSnapshot, arg.SnapshotID, arg.OperationID, arg.Digest)
+	return err
+}
+
+const reactivateDirectory = `-- name: ReactivateDirectory :one
+UPDATE directories SET removed_at = NULL, encrypted = ? WHERE id = ?
+RETURNING id, path, created_at, encrypted, removed_at
+`
+
+type ReactivateDirectoryParams struct {
+	Encrypted int64  `json:"encrypted"`
+	ID        string `json:"id"`
+}
+
+func (q *Queries) ReactivateDirectory(ctx context.Context, arg ReactivateDirectoryParams) (Directory, error) {
+	row := q.db.QueryRowContext(ctx, reactivateDirectory, arg.Encrypted, arg.ID)
+	var i Directory
+	err := row.Scan(
+		&i.ID,
+		&i.Path,
+		&i.CreatedAt,
+		&i.Encrypted,
+		&i.RemovedAt,
+	)
+	return i, err
+}
+
 const updateBackupOperationFinished = `-- name: UpdateBackupOperationFinished :exec
-UPDATE backup_operations SET finished_at = ?, status = ? WHERE id = ?
+UPDATE backup_operations SET finished_at = ?, status = ?, hash = ? WHERE id = ?
 `
 
 type UpdateBackupOperationFinishedParams struct {
-	FinishedAt sql.NullTime `json:"finished_at"`
-	Status     string       `json:"status"`
-	ID         int64        `json:"id"`
+	FinishedAt sql.NullTime   `json:"finished_at"`
+	Status     string         `json:"status"`
+	Hash       sql.NullString `json:"hash"`
+	ID         int64          `json:"id"`
 }
 
 func (q *Queries) UpdateBackupOperationFinished(ctx context.Context, arg UpdateBackupOperationFinishedParams) error {
-	_, err := q.db.ExecContext(ctx, updateBackupOperationFinished, arg.FinishedAt, arg.Status, arg.ID)
+	_, err := q.db.ExecContext(ctx, updateBackupOperationFinished,
+		arg.FinishedAt,
+		arg.Status,
+		arg.Hash,
+		arg.ID,
+	)
+	return err
+}
+
+const updateContentEncryptedContentID = `-- name: UpdateContentEncryptedContentID :exec
+UPDATE contents SET encrypted_content_id = ? WHERE id = ?
+`
+
+type UpdateContentEncryptedContentIDParams struct {
+	EncryptedContentID sql.NullString `json:"encrypted_content_id"`
+	ID                 string         `json:"id"`
+}
+
+func (q *Queries) UpdateContentEncryptedContentID(ctx context.Context, arg UpdateContentEncryptedContentIDParams) error {
+	_, err := q.db.ExecContext(ctx, updateContentEncryptedContentID, arg.EncryptedContentID, arg.ID)
+	return err
+}
+
+const updateContentsEncryptedContentID = `-- name: UpdateContentsEncryptedContentID :exec
+UPDATE contents SET encrypted_content_id = ?1 WHERE encrypted_content_id = ?2
+`
+
+type UpdateContentsEncryptedContentIDParams struct {
+	NewID sql.NullString `json:"new_id"`
+	OldID sql.NullString `json:"old_id"`
+}
+
+func (q *Queries) UpdateContentsEncryptedContentID(ctx context.Context, arg UpdateContentsEncryptedContentIDParams) error {
+	_, err := q.db.ExecContext(ctx, updateContentsEncryptedContentID, arg.NewID, arg.OldID)
+	return err
+}
+
+const updateDirectoryEncrypted = `-- name: UpdateDirectoryEncrypted :exec
+UPDATE directories SET encrypted = ? WHERE id = ?
+`
+
+type UpdateDirectoryEncryptedParams struct {
+	Encrypted int64  `json:"encrypted"`
+	ID        string `json:"id"`
+}
+
+func (q *Queries) UpdateDirectoryEncrypted(ctx context.Context, arg UpdateDirectoryEncryptedParams) error {
+	_, err := q.db.ExecContext(ctx, updateDirectoryEncrypted, arg.Encrypted, arg.ID)
+	return err
+}
+
+const updateDirectoryPath = `-- name: UpdateDirectoryPath :exec
+UPDATE directories SET path = ? WHERE id = ?
+`
+
+type UpdateDirectoryPathParams struct {
+	Path string `json:"path"`
+	ID   string `json:"id"`
+}
+
+func (q *Queries) UpdateDirectoryPath(ctx context.Context, arg UpdateDirectoryPathParams) error {
+	_, err := q.db.ExecContext(ctx, updateDirectoryPath, arg.Path, arg.ID)
+	return err
+}
+
+const updateDirectoryRemovedAt = `-- name: UpdateDirectoryRemovedAt :exec
+UPDATE directories SET removed_at = ? WHERE id = ?
+`
+
+type UpdateDirectoryRemovedAtParams struct {
+	RemovedAt sql.NullTime `json:"removed_at"`
+	ID        string       `json:"id"`
+}
+
+func (q *Queries) UpdateDirectoryRemovedAt(ctx context.Context, arg UpdateDirectoryRemovedAtParams) error {
+	_, err := q.db.ExecContext(ctx, updateDirectoryRemovedAt, arg.RemovedAt, arg.ID)
 	return err
 }
 
@@ -524,3 +1047,17 @@ func (q *Queries) UpdateFileDirectoryAndName(ctx context.Context, arg UpdateFile
 	_, err := q.db.ExecContext(ctx, updateFileDirectoryAndName, arg.DirectoryID, arg.Name, arg.ID)
 	return err
 }
+
+const updateFileSnapshotsFileID = `-- name: UpdateFileSnapshotsFileID :exec
+UPDATE file_snapshots SET file_id = ?1 WHERE file_id = ?2
+`
+
+type UpdateFileSnapshotsFileIDParams struct {
+	NewFileID string `json:"new_file_id"`
+	OldFileID string `json:"old_file_id"`
+}
+
+func (q *Queries) UpdateFileSnapshotsFileID(ctx context.Context, arg UpdateFileSnapshotsFileIDParams) error {
+	_, err := q.db.ExecContext(ctx, updateFileSnapshotsFileID, arg.NewFileID, arg.OldFileID)
+	return err
+}
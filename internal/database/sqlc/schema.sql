@@ -9,18 +9,22 @@ CREATE TABLE backup_operations (
     operation TEXT NOT NULL,
     parameters TEXT NOT NULL DEFAULT '',
     status TEXT NOT NULL DEFAULT 'running'
-);
+, hash TEXT);
 
 CREATE TABLE contents (
     id TEXT PRIMARY KEY,  -- SHA-256 checksum (not a UUID)
     created_at DATETIME NOT NULL
 , encrypted_content_id TEXT REFERENCES contents(id));
 
+CREATE TABLE convergent_contents (
+    content_id TEXT PRIMARY KEY REFERENCES contents(id)
+);
+
 CREATE TABLE directories (
     id TEXT PRIMARY KEY,  -- UUID
     path TEXT NOT NULL UNIQUE,  -- Absolute path on host
     created_at DATETIME NOT NULL
-, encrypted INTEGER NOT NULL DEFAULT 0);
+, encrypted INTEGER NOT NULL DEFAULT 0, removed_at DATETIME);
 
 CREATE TABLE file_snapshots (
     id TEXT PRIMARY KEY,  -- UUID
@@ -50,6 +54,29 @@ CREATE TABLE files (
     UNIQUE(directory_id, name)  -- File name must be unique within a directory
 );
 
+CREATE TABLE key_rotation_pending (
+    content_id TEXT PRIMARY KEY REFERENCES contents(id)
+);
+
+CREATE TABLE metadata_journal (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    table_name TEXT NOT NULL,
+    op TEXT NOT NULL,  -- 'upsert' or 'delete'
+    row_data TEXT NOT NULL  -- JSON object: every column for upsert, the key for delete
+);
+
+CREATE TABLE metadata_segments (
+    operation_id INTEGER PRIMARY KEY,
+    entries INTEGER NOT NULL,
+    size INTEGER NOT NULL
+);
+
+CREATE TABLE operation_snapshots (
+    snapshot_id TEXT PRIMARY KEY,
+    operation_id INTEGER NOT NULL,
+    digest TEXT NOT NULL  -- SHA-256 of the snapshot's columns
+);
+
 CREATE INDEX idx_directories_path ON directories(path);
 
 CREATE INDEX idx_file_snapshots_content ON file_snapshots(content_id);
@@ -62,3 +89,215 @@ CREATE INDEX idx_files_deleted ON files(deleted);
 
 CREATE INDEX idx_files_directory ON files(directory_id);
 
+CREATE INDEX idx_operation_snapshots_operation ON operation_snapshots(operation_id);
+
+CREATE TRIGGER journal_backup_operations_delete AFTER DELETE ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_backup_operations_insert AFTER INSERT ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'upsert', json_object(
+        'id', NEW.id,
+        'started_at', NEW.started_at,
+        'finished_at', NEW.finished_at,
+        'operation', NEW.operation,
+        'parameters', NEW.parameters,
+        'status', NEW.status,
+        'hash', NEW.hash
+    ));
+END;
+
+CREATE TRIGGER journal_backup_operations_update AFTER UPDATE ON backup_operations
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('backup_operations', 'upsert', json_object(
+        'id', NEW.id,
+        'started_at', NEW.started_at,
+        'finished_at', NEW.finished_at,
+        'operation', NEW.operation,
+        'parameters', NEW.parameters,
+        'status', NEW.status,
+        'hash', NEW.hash
+    ));
+END;
+
+CREATE TRIGGER journal_contents_delete AFTER DELETE ON contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('contents', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_contents_insert AFTER INSERT ON contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('contents', 'upsert', json_object(
+        'id', NEW.id,
+        'created_at', NEW.created_at,
+        'encrypted_content_id', NEW.encrypted_content_id
+    ));
+END;
+
+CREATE TRIGGER journal_contents_update AFTER UPDATE ON contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('contents', 'upsert', json_object(
+        'id', NEW.id,
+        'created_at', NEW.created_at,
+        'encrypted_content_id', NEW.encrypted_content_id
+    ));
+END;
+
+CREATE TRIGGER journal_convergent_contents_delete AFTER DELETE ON convergent_contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('convergent_contents', 'delete', json_object('content_id', OLD.content_id));
+END;
+
+CREATE TRIGGER journal_convergent_contents_insert AFTER INSERT ON convergent_contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('convergent_contents', 'upsert', json_object(
+        'content_id', NEW.content_id
+    ));
+END;
+
+CREATE TRIGGER journal_convergent_contents_update AFTER UPDATE ON convergent_contents
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('convergent_contents', 'upsert', json_object(
+        'content_id', NEW.content_id
+    ));
+END;
+
+CREATE TRIGGER journal_directories_delete AFTER DELETE ON directories
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('directories', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_directories_insert AFTER INSERT ON directories
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('directories', 'upsert', json_object(
+        'id', NEW.id,
+        'path', NEW.path,
+        'created_at', NEW.created_at,
+        'encrypted', NEW.encrypted,
+        'removed_at', NEW.removed_at
+    ));
+END;
+
+CREATE TRIGGER journal_directories_update AFTER UPDATE ON directories
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('directories', 'upsert', json_object(
+        'id', NEW.id,
+        'path', NEW.path,
+        'created_at', NEW.created_at,
+        'encrypted', NEW.encrypted,
+        'removed_at', NEW.removed_at
+    ));
+END;
+
+CREATE TRIGGER journal_file_snapshots_delete AFTER DELETE ON file_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('file_snapshots', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_file_snapshots_insert AFTER INSERT ON file_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('file_snapshots', 'upsert', json_object(
+        'id', NEW.id,
+        'file_id', NEW.file_id,
+        'content_id', NEW.content_id,
+        'created_at', NEW.created_at,
+        'size', NEW.size,
+        'permissions', NEW.permissions,
+        'uid', NEW.uid,
+        'gid', NEW.gid,
+        'accessed_at', NEW.accessed_at,
+        'modified_at', NEW.modified_at,
+        'changed_at', NEW.changed_at,
+        'born_at', NEW.born_at
+    ));
+END;
+
+CREATE TRIGGER journal_file_snapshots_update AFTER UPDATE ON file_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('file_snapshots', 'upsert', json_object(
+        'id', NEW.id,
+        'file_id', NEW.file_id,
+        'content_id', NEW.content_id,
+        'created_at', NEW.created_at,
+        'size', NEW.size,
+        'permissions', NEW.permissions,
+        'uid', NEW.uid,
+        'gid', NEW.gid,
+        'accessed_at', NEW.accessed_at,
+        'modified_at', NEW.modified_at,
+        'changed_at', NEW.changed_at,
+        'born_at', NEW.born_at
+    ));
+END;
+
+CREATE TRIGGER journal_files_delete AFTER DELETE ON files
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('files', 'delete', json_object('id', OLD.id));
+END;
+
+CREATE TRIGGER journal_files_insert AFTER INSERT ON files
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('files', 'upsert', json_object(
+        'id', NEW.id,
+        'name', NEW.name,
+        'directory_id', NEW.directory_id,
+        'current_snapshot_id', NEW.current_snapshot_id,
+        'deleted', NEW.deleted
+    ));
+END;
+
+CREATE TRIGGER journal_files_update AFTER UPDATE ON files
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('files', 'upsert', json_object(
+        'id', NEW.id,
+        'name', NEW.name,
+        'directory_id', NEW.directory_id,
+        'current_snapshot_id', NEW.current_snapshot_id,
+        'deleted', NEW.deleted
+    ));
+END;
+
+CREATE TRIGGER journal_key_rotation_pending_delete AFTER DELETE ON key_rotation_pending
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('key_rotation_pending', 'delete', json_object('content_id', OLD.content_id));
+END;
+
+CREATE TRIGGER journal_key_rotation_pending_insert AFTER INSERT ON key_rotation_pending
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('key_rotation_pending', 'upsert', json_object(
+        'content_id', NEW.content_id
+    ));
+END;
+
+CREATE TRIGGER journal_key_rotation_pending_update AFTER UPDATE ON key_rotation_pending
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('key_rotation_pending', 'upsert', json_object(
+        'content_id', NEW.content_id
+    ));
+END;
+
+CREATE TRIGGER journal_operation_snapshots_delete AFTER DELETE ON operation_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('operation_snapshots', 'delete', json_object('snapshot_id', OLD.snapshot_id));
+END;
+
+CREATE TRIGGER journal_operation_snapshots_insert AFTER INSERT ON operation_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('operation_snapshots', 'upsert', json_object(
+        'snapshot_id', NEW.snapshot_id,
+        'operation_id', NEW.operation_id,
+        'digest', NEW.digest
+    ));
+END;
+
+CREATE TRIGGER journal_operation_snapshots_update AFTER UPDATE ON operation_snapshots
+BEGIN
+    INSERT INTO metadata_journal (table_name, op, row_data) VALUES ('operation_snapshots', 'upsert', json_object(
+        'snapshot_id', NEW.snapshot_id,
+        'operation_id', NEW.operation_id,
+        'digest', NEW.digest
+    ));
+END;
+
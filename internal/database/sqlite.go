@@ -3,9 +3,12 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,6 +27,10 @@ type SQLiteDatabase struct {
 	path    string
 	nowFn   func() time.Time
 	newIDFn func() string
+
+	// operationID is the running operation, which the snapshots created are
+	// recorded against; 0 if none is running.
+	operationID int64
 }
 
 // NewSQLiteDatabase creates a new SQLite database connection.
@@ -79,6 +86,11 @@ func OpenConnection(path string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
+	// Use a single connection: PRAGMAs are per-connection, an in-memory
+	// database is private to the connection that created it, and SQLite
+	// serializes writers anyway. Concurrent callers queue for the connection.
+	db.SetMaxOpenConns(1)
+
 	// Enable foreign key constraints (SQLite default is OFF for backward compatibility)
 	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
 		db.Close()
@@ -114,6 +126,9 @@ func (s *SQLiteDatabase) FindDirectoryByPath(path string) (*sqlc.Directory, erro
 		}
 		return nil, fmt.Errorf("finding directory by path: %w", err)
 	}
+	if dir.RemovedAt.Valid {
+		return nil, nil // Removed, no longer tracked
+	}
 	return &dir, nil
 }
 
@@ -133,6 +148,9 @@ func (s *SQLiteDatabase) SearchDirectoryForPath(path string) (*sqlc.Directory, e
 
 	for i := range dirs {
 		dir := &dirs[i]
+		if dir.RemovedAt.Valid {
+			continue
+		}
 		// Check if this directory is a prefix of the path
 		if path == dir.Path {
 			// Exact match - if we're searching for a directory itself, return it
@@ -165,67 +183,210 @@ func (s *SQLiteDatabase) CreateDirectory(path string, encrypted bool) (*sqlc.Dir
 
 	qtx := s.queries.WithTx(tx)
 
-	// Find any child directories that need to be consolidated
+	// Find any child directories that need to be consolidated. Removed
+	// children are included so their history is kept under the new directory.
 	childDirs, err := qtx.GetDirectoriesByPathPrefix(ctx, path+"/%")
 	if err != nil {
 		return nil, fmt.Errorf("finding child directories: %w", err)
 	}
 
-	// Create the new directory
 	var encryptedInt int64
 	if encrypted {
 		encryptedInt = 1
 	}
-	newDir, err := qtx.InsertDirectory(ctx, sqlc.InsertDirectoryParams{
-		ID:        s.newIDFn(),
-		Path:      path,
-		CreatedAt: s.nowFn(),
-		Encrypted: encryptedInt,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("inserting directory: %w", err)
+
+	// A directory removed with its history kept is tracked again in place.
+	var newDir sqlc.Directory
+	existing, err := qtx.GetDirectoryByPath(ctx, path)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("finding existing directory: %w", err)
+	}
+	if err == nil && existing.RemovedAt.Valid {
+		newDir, err = qtx.ReactivateDirectory(ctx, sqlc.ReactivateDirectoryParams{
+			Encrypted: encryptedInt,
+			ID:        existing.ID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reactivating directory: %w", err)
+		}
+	} else {
+		newDir, err = qtx.InsertDirectory(ctx, sqlc.InsertDirectoryParams{
+			ID:        s.newIDFn(),
+			Path:      path,
+			CreatedAt: s.nowFn(),
+			Encrypted: encryptedInt,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("inserting directory: %w", err)
+		}
 	}
 
 	// Move files from child directories to the new directory
 	for _, childDir := range childDirs {
-		// Get all files in the child directory
-		files, err := qtx.GetFilesByDirectoryID(ctx, childDir.ID)
-		if err != nil {
-			return nil, fmt.Errorf("getting files from child directory %s: %w", childDir.Path, err)
+		if err := mergeDirectory(ctx, qtx, &childDir, childDir.Path, &newDir); err != nil {
+			return nil, err
 		}
+	}
 
-		// Calculate the relative path prefix for files being moved
-		// e.g., if parent is /home/user/docs and child is /home/user/docs/subdir,
-		// files need "subdir/" prepended to their names
-		relPath, err := filepath.Rel(path, childDir.Path)
-		if err != nil {
-			return nil, fmt.Errorf("calculating relative path: %w", err)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing transaction: %w", err)
+	}
+
+	return &newDir, nil
+}
+
+func (s *SQLiteDatabase) MoveDirectory(directory *sqlc.Directory, newPath string) (*sqlc.Directory, error) {
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qtx := s.queries.WithTx(tx)
+
+	if _, err := qtx.GetDirectoryByPath(ctx, newPath); err == nil {
+		return nil, fmt.Errorf("a directory is already recorded at %s", newPath)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("finding directory at new path: %w", err)
+	}
+
+	dirs, err := qtx.GetDirectoriesByPathPrefix(ctx, "/%")
+	if err != nil {
+		return nil, fmt.Errorf("finding directories: %w", err)
+	}
+
+	// If the new path is inside another tracked directory, the moved
+	// directory's files join it, as CreateDirectory would have done.
+	for i := range dirs {
+		parent := &dirs[i]
+		if parent.ID == directory.ID || parent.RemovedAt.Valid || !strings.HasPrefix(newPath, parent.Path+"/") {
+			continue
+		}
+		if err := mergeDirectory(ctx, qtx, directory, newPath, parent); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("committing transaction: %w", err)
+		}
+		return parent, nil
+	}
+
+	// Otherwise the directory takes the new path and absorbs any tracked
+	// directories beneath it.
+	moved := *directory
+	moved.Path = newPath
+	if err := qtx.UpdateDirectoryPath(ctx, sqlc.UpdateDirectoryPathParams{Path: newPath, ID: directory.ID}); err != nil {
+		return nil, fmt.Errorf("updating directory path: %w", err)
+	}
+	for i := range dirs {
+		child := &dirs[i]
+		if child.ID == directory.ID || !strings.HasPrefix(child.Path, newPath+"/") {
+			continue
 		}
+		if err := mergeDirectory(ctx, qtx, child, child.Path, &moved); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing transaction: %w", err)
+	}
+	return &moved, nil
+}
+
+// mergeDirectory moves every file of from into into and deletes from. fromPath
+// is where from's files are now, inside into's path; files are renamed to
+// their path relative to into. Where into already has a file of the same
+// name, the two files' snapshots are combined and the newer of their current
+// snapshots stays current.
+func mergeDirectory(ctx context.Context, qtx *sqlc.Queries, from *sqlc.Directory, fromPath string, into *sqlc.Directory) error {
+	files, err := qtx.GetFilesByDirectoryID(ctx, from.ID)
+	if err != nil {
+		return fmt.Errorf("getting files from directory %s: %w", from.Path, err)
+	}
+
+	// e.g., if into is /home/user/docs and from is /home/user/docs/subdir,
+	// files need "subdir/" prepended to their names
+	relPath, err := filepath.Rel(into.Path, fromPath)
+	if err != nil {
+		return fmt.Errorf("calculating relative path: %w", err)
+	}
 
-		// Move each file to the new directory with updated name
-		for _, file := range files {
-			newName := filepath.Join(relPath, file.Name)
+	for _, file := range files {
+		newName := filepath.Join(relPath, file.Name)
+		existing, err := qtx.GetFileByDirectoryAndName(ctx, sqlc.GetFileByDirectoryAndNameParams{
+			DirectoryID: into.ID,
+			Name:        newName,
+		})
+		if errors.Is(err, sql.ErrNoRows) {
 			err := qtx.UpdateFileDirectoryAndName(ctx, sqlc.UpdateFileDirectoryAndNameParams{
-				DirectoryID: newDir.ID,
+				DirectoryID: into.ID,
 				Name:        newName,
 				ID:          file.ID,
 			})
 			if err != nil {
-				return nil, fmt.Errorf("moving file %s: %w", file.Name, err)
+				return fmt.Errorf("moving file %s: %w", file.Name, err)
 			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("finding file %s: %w", newName, err)
 		}
 
-		// Delete the child directory
-		if err := qtx.DeleteDirectoryByID(ctx, childDir.ID); err != nil {
-			return nil, fmt.Errorf("deleting child directory %s: %w", childDir.Path, err)
+		if err := mergeFile(ctx, qtx, &file, &existing); err != nil {
+			return fmt.Errorf("merging file %s: %w", newName, err)
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("committing transaction: %w", err)
+	if err := qtx.DeleteDirectoryByID(ctx, from.ID); err != nil {
+		return fmt.Errorf("deleting directory %s: %w", from.Path, err)
+	}
+	return nil
+}
+
+// mergeFile moves the snapshots of from to into, makes the newer of their
+// current snapshots current for into, and deletes from.
+func mergeFile(ctx context.Context, qtx *sqlc.Queries, from, into *sqlc.File) error {
+	err := qtx.UpdateFileSnapshotsFileID(ctx, sqlc.UpdateFileSnapshotsFileIDParams{
+		NewFileID: into.ID,
+		OldFileID: from.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("moving snapshots: %w", err)
 	}
 
-	return &newDir, nil
+	current := into.CurrentSnapshotID
+	if from.CurrentSnapshotID.Valid {
+		if !current.Valid {
+			current = from.CurrentSnapshotID
+		} else {
+			ours, err := qtx.GetFileSnapshotByID(ctx, into.CurrentSnapshotID.String)
+			if err != nil {
+				return fmt.Errorf("getting current snapshot: %w", err)
+			}
+			theirs, err := qtx.GetFileSnapshotByID(ctx, from.CurrentSnapshotID.String)
+			if err != nil {
+				return fmt.Errorf("getting current snapshot: %w", err)
+			}
+			if theirs.CreatedAt.After(ours.CreatedAt) {
+				current = from.CurrentSnapshotID
+			}
+		}
+	}
+	err = qtx.UpdateFileCurrentSnapshot(ctx, sqlc.UpdateFileCurrentSnapshotParams{
+		CurrentSnapshotID: current,
+		ID:                into.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("updating current snapshot: %w", err)
+	}
+
+	if err := qtx.DeleteFileByID(ctx, from.ID); err != nil {
+		return fmt.Errorf("deleting merged file: %w", err)
+	}
+	return nil
 }
 
 func (s *SQLiteDatabase) FindDirectoriesByPathPrefix(pathPrefix string) ([]*sqlc.Directory, error) {
@@ -236,14 +397,78 @@ func (s *SQLiteDatabase) FindDirectoriesByPathPrefix(pathPrefix string) ([]*sqlc
 		return nil, fmt.Errorf("finding directories by path prefix: %w", err)
 	}
 
-	// Convert to pointer slice
-	result := make([]*sqlc.Directory, len(dirs))
+	// Convert to pointer slice, skipping removed directories
+	result := make([]*sqlc.Directory, 0, len(dirs))
+	for i := range dirs {
+		if !dirs[i].RemovedAt.Valid {
+			result = append(result, &dirs[i])
+		}
+	}
+	return result, nil
+}
+
+func (s *SQLiteDatabase) ListDirectories(includeRemoved bool) ([]*sqlc.Directory, error) {
+	dirs, err := s.queries.GetDirectories(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("listing directories: %w", err)
+	}
+
+	result := make([]*sqlc.Directory, 0, len(dirs))
 	for i := range dirs {
-		result[i] = &dirs[i]
+		if includeRemoved || !dirs[i].RemovedAt.Valid {
+			result = append(result, &dirs[i])
+		}
 	}
 	return result, nil
 }
 
+func (s *SQLiteDatabase) FindDirectoryStats(directory *sqlc.Directory) (*bt.DirectoryStats, error) {
+	ctx := context.Background()
+
+	row, err := s.queries.GetDirectoryStats(ctx, directory.ID)
+	if err != nil {
+		return nil, fmt.Errorf("summarizing directory files: %w", err)
+	}
+	stats := &bt.DirectoryStats{
+		FileCount: row.FileCount,
+		TotalSize: row.TotalSize,
+	}
+
+	lastBackupAt, err := s.queries.GetLatestSnapshotCreatedAtByDirectoryID(ctx, directory.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("finding latest snapshot: %w", err)
+	}
+	stats.LastBackupAt = lastBackupAt
+	return stats, nil
+}
+
+func (s *SQLiteDatabase) RemoveDirectory(directory *sqlc.Directory) error {
+	err := s.queries.UpdateDirectoryRemovedAt(context.Background(), sqlc.UpdateDirectoryRemovedAtParams{
+		RemovedAt: sql.NullTime{Time: s.nowFn(), Valid: true},
+		ID:        directory.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("removing directory: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteDatabase) SetDirectoryEncrypted(directory *sqlc.Directory, encrypted bool) error {
+	var flag int64
+	if encrypted {
+		flag = 1
+	}
+	err := s.queries.UpdateDirectoryEncrypted(context.Background(), sqlc.UpdateDirectoryEncryptedParams{
+		Encrypted: flag,
+		ID:        directory.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("updating directory encryption: %w", err)
+	}
+	directory.Encrypted = flag
+	return nil
+}
+
 func (s *SQLiteDatabase) DeleteDirectory(directory *sqlc.Directory) error {
 	if err := s.queries.DeleteDirectoryByID(context.Background(), directory.ID); err != nil {
 		return fmt.Errorf("deleting directory: %w", err)
@@ -319,6 +544,17 @@ func (s *SQLiteDatabase) FindFileSnapshotsForFile(file *sqlc.File) ([]*sqlc.File
 	return result, nil
 }
 
+func (s *SQLiteDatabase) FindFileSnapshotByID(id string) (*sqlc.FileSnapshot, error) {
+	snapshot, err := s.queries.GetFileSnapshotByID(context.Background(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil // Not found
+		}
+		return nil, fmt.Errorf("finding file snapshot by ID: %w", err)
+	}
+	return &snapshot, nil
+}
+
 func (s *SQLiteDatabase) FindFileSnapshotByChecksum(file *sqlc.File, checksum string) (*sqlc.FileSnapshot, error) {
 	snapshot, err := s.queries.GetFileSnapshotByFileAndContent(context.Background(), sqlc.GetFileSnapshotByFileAndContentParams{
 		FileID:    file.ID,
@@ -334,7 +570,16 @@ func (s *SQLiteDatabase) FindFileSnapshotByChecksum(file *sqlc.File, checksum st
 }
 
 func (s *SQLiteDatabase) CreateFileSnapshot(snapshot *sqlc.FileSnapshot) error {
-	_, err := s.queries.InsertFileSnapshot(context.Background(), sqlc.InsertFileSnapshotParams{
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qtx := s.queries.WithTx(tx)
+	created, err := qtx.InsertFileSnapshot(ctx, sqlc.InsertFileSnapshotParams{
 		ID:          snapshot.ID,
 		FileID:      snapshot.FileID,
 		ContentID:   snapshot.ContentID,
@@ -351,6 +596,13 @@ func (s *SQLiteDatabase) CreateFileSnapshot(snapshot *sqlc.FileSnapshot) error {
 	if err != nil {
 		return fmt.Errorf("creating file snapshot: %w", err)
 	}
+	if err := s.recordOperationSnapshot(ctx, qtx, &created); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
 	return nil
 }
 
@@ -487,6 +739,9 @@ func (s *SQLiteDatabase) CreateFileSnapshotAndContent(directoryID string, relati
 	if err != nil {
 		return fmt.Errorf("creating file snapshot: %w", err)
 	}
+	if err := s.recordOperationSnapshot(ctx, qtx, &created); err != nil {
+		return err
+	}
 
 	err = qtx.UpdateFileCurrentSnapshot(ctx, sqlc.UpdateFileCurrentSnapshotParams{
 		CurrentSnapshotID: sql.NullString{String: created.ID, Valid: true},
@@ -528,18 +783,51 @@ func (s *SQLiteDatabase) CreateBackupOperation(operation string, parameters stri
 	if err != nil {
 		return nil, fmt.Errorf("creating backup operation: %w", err)
 	}
+	s.operationID = op.ID
 	return &op, nil
 }
 
 func (s *SQLiteDatabase) FinishBackupOperation(id int64, status string) error {
-	err := s.queries.UpdateBackupOperationFinished(context.Background(), sqlc.UpdateBackupOperationFinishedParams{
-		FinishedAt: sql.NullTime{Time: s.nowFn(), Valid: true},
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qtx := s.queries.WithTx(tx)
+	op, err := qtx.GetBackupOperationByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("finding backup operation: %w", err)
+	}
+	prev, err := previousChainHash(ctx, qtx, id)
+	if err != nil {
+		return err
+	}
+	snapshots, err := qtx.GetOperationSnapshotsByOperationID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("listing snapshots of operation %d: %w", id, err)
+	}
+
+	op.FinishedAt = sql.NullTime{Time: s.nowFn(), Valid: true}
+	op.Status = status
+	err = qtx.UpdateBackupOperationFinished(ctx, sqlc.UpdateBackupOperationFinishedParams{
+		FinishedAt: op.FinishedAt,
 		Status:     status,
+		Hash:       sql.NullString{String: operationHash(prev, &op, snapshots), Valid: true},
 		ID:         id,
 	})
 	if err != nil {
 		return fmt.Errorf("finishing backup operation: %w", err)
 	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	if s.operationID == id {
+		s.operationID = 0
+	}
 	return nil
 }
 
@@ -564,6 +852,26 @@ func (s *SQLiteDatabase) MaxBackupOperationID() (int64, error) {
 	return id, nil
 }
 
+// SkipBackupOperationIDs makes the next backup operation ID greater than
+// after, so the operations recorded after a rollback never reuse the IDs of
+// the ones it discarded.
+func (s *SQLiteDatabase) SkipBackupOperationIDs(after int64) error {
+	res, err := s.db.Exec("UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = 'backup_operations'", after)
+	if err != nil {
+		return fmt.Errorf("skipping backup operation IDs: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("skipping backup operation IDs: %w", err)
+	} else if n > 0 {
+		return nil
+	}
+	// No operation was ever recorded, so there is no sequence row yet.
+	if _, err := s.db.Exec("INSERT INTO sqlite_sequence (name, seq) VALUES ('backup_operations', ?)", after); err != nil {
+		return fmt.Errorf("skipping backup operation IDs: %w", err)
+	}
+	return nil
+}
+
 // Content operations
 
 func (s *SQLiteDatabase) CreateContent(checksum string, encryptedContentID string) (*sqlc.Content, error) {
@@ -589,6 +897,369 @@ func (s *SQLiteDatabase) FindContentByChecksum(checksum string) (*sqlc.Content,
 	return &content, nil
 }
 
+func (s *SQLiteDatabase) FindPlaintextChecksum(encryptedContentID string) (string, error) {
+	id, err := s.queries.GetContentIDByEncryptedContentID(context.Background(), sql.NullString{String: encryptedContentID, Valid: true})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("finding plaintext content: %w", err)
+	}
+	return id, nil
+}
+
+func (s *SQLiteDatabase) FindContentsByDirectory(directory *sqlc.Directory) ([]*sqlc.Content, error) {
+	contents, err := s.queries.GetContentsByDirectoryID(context.Background(), directory.ID)
+	if err != nil {
+		return nil, fmt.Errorf("finding contents by directory: %w", err)
+	}
+
+	result := make([]*sqlc.Content, len(contents))
+	for i := range contents {
+		result[i] = &contents[i]
+	}
+	return result, nil
+}
+
+// UpdateContentEncryption points the plaintext content record at a new vault
+// object in a single transaction. With a non-empty encryptedContentID, the
+// real encrypted record is created if needed, as CreateFileSnapshotAndContent
+// does; with an empty one, the record stores its plaintext directly again.
+func (s *SQLiteDatabase) UpdateContentEncryption(checksum string, encryptedContentID string) error {
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qtx := s.queries.WithTx(tx)
+
+	if encryptedContentID != "" {
+		_, err = qtx.GetContentByID(ctx, encryptedContentID)
+		if errors.Is(err, sql.ErrNoRows) {
+			_, err = qtx.InsertContent(ctx, sqlc.InsertContentParams{
+				ID:                 encryptedContentID,
+				CreatedAt:          s.nowFn(),
+				EncryptedContentID: sql.NullString{},
+			})
+			if err != nil {
+				return fmt.Errorf("creating encrypted content record: %w", err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("checking for encrypted content: %w", err)
+		}
+	}
+
+	err = qtx.UpdateContentEncryptedContentID(ctx, sqlc.UpdateContentEncryptedContentIDParams{
+		EncryptedContentID: sql.NullString{String: encryptedContentID, Valid: encryptedContentID != ""},
+		ID:                 checksum,
+	})
+	if err != nil {
+		return fmt.Errorf("updating content: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteDatabase) IsContentInEncryptedDirectory(checksum string) (bool, error) {
+	count, err := s.queries.CountEncryptedDirectoriesByContentID(context.Background(), checksum)
+	if err != nil {
+		return false, fmt.Errorf("counting encrypted directories: %w", err)
+	}
+	return count > 0, nil
+}
+
+// Key rotation
+
+func (s *SQLiteDatabase) MarkContentConvergent(encryptedContentID string) error {
+	if err := s.queries.InsertConvergentContent(context.Background(), encryptedContentID); err != nil {
+		return fmt.Errorf("marking content convergent: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteDatabase) StartKeyRotation(skipConvergent bool) error {
+	if err := s.queries.InsertKeyRotationPending(context.Background(), skipConvergent); err != nil {
+		return fmt.Errorf("queueing encrypted content for rotation: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteDatabase) FindKeyRotationPending() ([]string, error) {
+	ids, err := s.queries.GetKeyRotationPending(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("finding content pending rotation: %w", err)
+	}
+	return ids, nil
+}
+
+// ReplaceEncryptedContent atomically swaps a re-encrypted vault object in for
+// the old one: creates the real record for newID, points every virtual record
+// at it, and removes oldID from the rotation queue. The old real record is
+// left unreferenced.
+func (s *SQLiteDatabase) ReplaceEncryptedContent(oldID string, newID string) error {
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qtx := s.queries.WithTx(tx)
+
+	_, err = qtx.GetContentByID(ctx, newID)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = qtx.InsertContent(ctx, sqlc.InsertContentParams{
+			ID:                 newID,
+			CreatedAt:          s.nowFn(),
+			EncryptedContentID: sql.NullString{},
+		})
+		if err != nil {
+			return fmt.Errorf("creating encrypted content record: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("checking for encrypted content: %w", err)
+	}
+
+	err = qtx.UpdateContentsEncryptedContentID(ctx, sqlc.UpdateContentsEncryptedContentIDParams{
+		NewID: sql.NullString{String: newID, Valid: true},
+		OldID: sql.NullString{String: oldID, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("updating content records: %w", err)
+	}
+
+	if err := qtx.DeleteKeyRotationPending(ctx, oldID); err != nil {
+		return fmt.Errorf("removing content from rotation queue: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+// Metadata journal
+
+func (s *SQLiteDatabase) FindJournalEntries() ([]*sqlc.MetadataJournal, error) {
+	entries, err := s.queries.GetMetadataJournal(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("finding journal entries: %w", err)
+	}
+	result := make([]*sqlc.MetadataJournal, len(entries))
+	for i := range entries {
+		result[i] = &entries[i]
+	}
+	return result, nil
+}
+
+func (s *SQLiteDatabase) FindJournalSegments() ([]*sqlc.MetadataSegment, error) {
+	segments, err := s.queries.GetMetadataSegments(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("finding journal segments: %w", err)
+	}
+	result := make([]*sqlc.MetadataSegment, len(segments))
+	for i := range segments {
+		result[i] = &segments[i]
+	}
+	return result, nil
+}
+
+func (s *SQLiteDatabase) RecordJournalSegment(segment *sqlc.MetadataSegment, throughSeq int64) error {
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qtx := s.queries.WithTx(tx)
+
+	err = qtx.InsertMetadataSegment(ctx, sqlc.InsertMetadataSegmentParams{
+		OperationID: segment.OperationID,
+		Entries:     segment.Entries,
+		Size:        segment.Size,
+	})
+	if err != nil {
+		return fmt.Errorf("recording journal segment: %w", err)
+	}
+	if err := qtx.DeleteMetadataJournalThrough(ctx, throughSeq); err != nil {
+		return fmt.Errorf("dropping uploaded journal entries: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteDatabase) RecordCheckpoint(throughSeq int64) error {
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qtx := s.queries.WithTx(tx)
+
+	if err := qtx.DeleteMetadataJournalThrough(ctx, throughSeq); err != nil {
+		return fmt.Errorf("dropping checkpointed journal entries: %w", err)
+	}
+	if err := qtx.DeleteMetadataSegments(ctx); err != nil {
+		return fmt.Errorf("dropping journal segments: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+// journalKeys maps each journaled table to its primary key column. Entries
+// naming any other table are refused.
+var journalKeys = map[string]string{
+	"backup_operations":    "id",
+	"contents":             "id",
+	"convergent_contents":  "content_id",
+	"directories":          "id",
+	"file_snapshots":       "id",
+	"files":                "id",
+	"key_rotation_pending": "content_id",
+	"operation_snapshots":  "snapshot_id",
+}
+
+// ApplyJournal replays the entries with the same statements whatever their
+// table: an upsert inserts the row or overwrites every column of the existing
+// one, and a delete removes the row by its key. Foreign keys hold at every
+// step because the entries are replayed in the order they were recorded.
+func (s *SQLiteDatabase) ApplyJournal(entries []*sqlc.MetadataJournal) error {
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := s.queries.WithTx(tx).GetMaxMetadataJournalSeq(ctx)
+	if err != nil {
+		return fmt.Errorf("finding journal position: %w", err)
+	}
+
+	for _, entry := range entries {
+		if err := applyJournalEntry(ctx, tx, entry); err != nil {
+			return fmt.Errorf("applying journal entry %d: %w", entry.Seq, err)
+		}
+	}
+
+	// The triggers journaled the replay; those changes are in the vault already.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM metadata_journal WHERE seq > ?", before); err != nil {
+		return fmt.Errorf("dropping replayed journal entries: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+// applyJournalEntry replays a single journal entry within tx.
+func applyJournalEntry(ctx context.Context, tx *sql.Tx, entry *sqlc.MetadataJournal) error {
+	key, ok := journalKeys[entry.TableName]
+	if !ok {
+		return fmt.Errorf("unknown table %q", entry.TableName)
+	}
+
+	dec := json.NewDecoder(strings.NewReader(entry.RowData))
+	dec.UseNumber()
+	var row map[string]any
+	if err := dec.Decode(&row); err != nil {
+		return fmt.Errorf("decoding row: %w", err)
+	}
+	if _, ok := row[key]; !ok {
+		return fmt.Errorf("row has no %s", key)
+	}
+
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		if !isColumnName(column) {
+			return fmt.Errorf("invalid column name %q", column)
+		}
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	args := make([]any, len(columns))
+	for i, column := range columns {
+		args[i] = journalValue(row[column])
+	}
+
+	var query string
+	switch entry.Op {
+	case "delete":
+		query = fmt.Sprintf("DELETE FROM %s WHERE %s = ?", entry.TableName, key)
+		args = []any{journalValue(row[key])}
+	case "upsert":
+		var updates []string
+		for _, column := range columns {
+			if column != key {
+				updates = append(updates, fmt.Sprintf("%s = excluded.%s", column, column))
+			}
+		}
+		conflict := "DO NOTHING"
+		if len(updates) > 0 {
+			conflict = "DO UPDATE SET " + strings.Join(updates, ", ")
+		}
+		query = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT(%s) %s",
+			entry.TableName, strings.Join(columns, ", "),
+			strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "), key, conflict)
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	return nil
+}
+
+// journalValue converts a value decoded from a journal row into a query
+// argument, keeping integers exact.
+func journalValue(v any) any {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return n.String()
+}
+
+// isColumnName reports whether name is safe to use as a column name in SQL.
+func isColumnName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
 // Path returns the database file path (or ":memory:" for in-memory databases).
 func (s *SQLiteDatabase) Path() string {
 	return s.path
@@ -599,6 +1270,15 @@ func (s *SQLiteDatabase) CheckMigrations() error {
 	return migrations.CheckDBMigrationStatus(s.db)
 }
 
+// Migrate brings the database schema up to date, as for a copy made by an
+// older version of bt. A database newer than this binary is refused.
+func (s *SQLiteDatabase) Migrate() error {
+	if err := migrations.MigrateUp(s.db); err != nil {
+		return err
+	}
+	return s.CheckMigrations()
+}
+
 // BackupTo creates a complete copy of the database at destPath using VACUUM INTO.
 func (s *SQLiteDatabase) BackupTo(destPath string) error {
 	_, err := s.db.Exec("VACUUM INTO ?", destPath)
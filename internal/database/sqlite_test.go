@@ -3,12 +3,16 @@ package database
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 
+	"bt-go/internal/bt"
 	"bt-go/internal/database/sqlc"
 )
 
@@ -286,6 +290,267 @@ func TestSQLiteDatabase_DeleteDirectory(t *testing.T) {
 			t.Error("directory should have been deleted")
 		}
 	})
+
+	t.Run("deletes files with the directory", func(t *testing.T) {
+		db := newTestDB(t)
+
+		dir, _ := db.CreateDirectory("/home/user/docs", false)
+		createTestFile(t, db, dir.ID, "a.txt")
+
+		if err := db.DeleteDirectory(dir); err != nil {
+			t.Fatalf("DeleteDirectory() error = %v", err)
+		}
+
+		file, err := db.FindFileByPath(dir, "a.txt")
+		if err != nil {
+			t.Fatalf("FindFileByPath() error = %v", err)
+		}
+		if file != nil {
+			t.Error("files should be deleted with the directory")
+		}
+	})
+}
+
+func TestSQLiteDatabase_RemoveDirectory(t *testing.T) {
+	t.Run("hides directory but keeps its files", func(t *testing.T) {
+		db := newTestDB(t)
+
+		dir, _ := db.CreateDirectory("/home/user/docs", false)
+		createTestFile(t, db, dir.ID, "a.txt")
+
+		if err := db.RemoveDirectory(dir); err != nil {
+			t.Fatalf("RemoveDirectory() error = %v", err)
+		}
+
+		found, err := db.FindDirectoryByPath("/home/user/docs")
+		if err != nil {
+			t.Fatalf("FindDirectoryByPath() error = %v", err)
+		}
+		if found != nil {
+			t.Error("removed directory should not be found by path")
+		}
+		found, err = db.SearchDirectoryForPath("/home/user/docs/a.txt")
+		if err != nil {
+			t.Fatalf("SearchDirectoryForPath() error = %v", err)
+		}
+		if found != nil {
+			t.Error("removed directory should not be found by search")
+		}
+
+		file, err := db.FindFileByPath(dir, "a.txt")
+		if err != nil {
+			t.Fatalf("FindFileByPath() error = %v", err)
+		}
+		if file == nil {
+			t.Error("files of a removed directory should be kept")
+		}
+	})
+
+	t.Run("tracking the path again restores history", func(t *testing.T) {
+		db := newTestDB(t)
+
+		dir, _ := db.CreateDirectory("/home/user/docs", false)
+		createTestFile(t, db, dir.ID, "a.txt")
+		db.RemoveDirectory(dir)
+
+		again, err := db.CreateDirectory("/home/user/docs", true)
+		if err != nil {
+			t.Fatalf("CreateDirectory() error = %v", err)
+		}
+		if again.ID != dir.ID {
+			t.Errorf("CreateDirectory() ID = %q, want reactivated %q", again.ID, dir.ID)
+		}
+		if again.RemovedAt.Valid {
+			t.Error("reactivated directory should not be marked removed")
+		}
+		if again.Encrypted != 1 {
+			t.Errorf("Encrypted = %d, want 1", again.Encrypted)
+		}
+
+		file, _ := db.FindFileByPath(again, "a.txt")
+		if file == nil {
+			t.Error("history should be restored")
+		}
+	})
+}
+
+func TestSQLiteDatabase_ListDirectories(t *testing.T) {
+	db := newTestDB(t)
+
+	db.CreateDirectory("/b", false)
+	removed, _ := db.CreateDirectory("/a", false)
+	db.RemoveDirectory(removed)
+
+	tracked, err := db.ListDirectories(false)
+	if err != nil {
+		t.Fatalf("ListDirectories() error = %v", err)
+	}
+	if len(tracked) != 1 || tracked[0].Path != "/b" {
+		t.Errorf("ListDirectories(false) returned %d directories, want only /b", len(tracked))
+	}
+
+	all, err := db.ListDirectories(true)
+	if err != nil {
+		t.Fatalf("ListDirectories() error = %v", err)
+	}
+	if len(all) != 2 || all[0].Path != "/a" || all[1].Path != "/b" {
+		t.Errorf("ListDirectories(true) returned %d directories, want /a and /b", len(all))
+	}
+}
+
+func TestSQLiteDatabase_FindDirectoryStats(t *testing.T) {
+	t.Run("empty directory", func(t *testing.T) {
+		db := newTestDB(t)
+		dir, _ := db.CreateDirectory("/home/user/docs", false)
+		createTestFile(t, db, dir.ID, "never-backed-up.txt")
+
+		stats, err := db.FindDirectoryStats(dir)
+		if err != nil {
+			t.Fatalf("FindDirectoryStats() error = %v", err)
+		}
+		if stats.FileCount != 0 || stats.TotalSize != 0 || !stats.LastBackupAt.IsZero() {
+			t.Errorf("FindDirectoryStats() = %+v, want zero", stats)
+		}
+	})
+
+	t.Run("counts current snapshots", func(t *testing.T) {
+		db := newTestDB(t)
+		dir, _ := db.CreateDirectory("/home/user/docs", false)
+
+		backedUpAt := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+		for i, name := range []string{"a.txt", "b.txt", "a.txt"} {
+			now := backedUpAt.Add(time.Duration(i) * time.Hour)
+			err := db.CreateFileSnapshotAndContent(dir.ID, name, &sqlc.FileSnapshot{
+				ID:         uuid.New().String(),
+				ContentID:  "checksum" + string(rune('0'+i)),
+				CreatedAt:  now,
+				Size:       int64(10 * (i + 1)),
+				AccessedAt: now,
+				ModifiedAt: now,
+				ChangedAt:  now,
+			}, "")
+			if err != nil {
+				t.Fatalf("CreateFileSnapshotAndContent() error = %v", err)
+			}
+		}
+
+		stats, err := db.FindDirectoryStats(dir)
+		if err != nil {
+			t.Fatalf("FindDirectoryStats() error = %v", err)
+		}
+		// a.txt's current snapshot is 30 bytes, b.txt's is 20.
+		if stats.FileCount != 2 || stats.TotalSize != 50 {
+			t.Errorf("FindDirectoryStats() = %d files, %d bytes; want 2 files, 50 bytes", stats.FileCount, stats.TotalSize)
+		}
+		if want := backedUpAt.Add(2 * time.Hour); !stats.LastBackupAt.Equal(want) {
+			t.Errorf("LastBackupAt = %v, want %v", stats.LastBackupAt, want)
+		}
+	})
+}
+
+func TestSQLiteDatabase_MoveDirectory(t *testing.T) {
+	snapshotAt := func(contentID string, createdAt time.Time) *sqlc.FileSnapshot {
+		return &sqlc.FileSnapshot{
+			ID:         uuid.New().String(),
+			ContentID:  contentID,
+			CreatedAt:  createdAt,
+			AccessedAt: createdAt,
+			ModifiedAt: createdAt,
+			ChangedAt:  createdAt,
+		}
+	}
+
+	t.Run("rewrites the path", func(t *testing.T) {
+		db := newTestDB(t)
+		dir, _ := db.CreateDirectory("/home/user/projects", false)
+		createTestFile(t, db, dir.ID, "a.txt")
+
+		moved, err := db.MoveDirectory(dir, "/data/projects")
+		if err != nil {
+			t.Fatalf("MoveDirectory() error = %v", err)
+		}
+		if moved.ID != dir.ID || moved.Path != "/data/projects" {
+			t.Errorf("MoveDirectory() = %s %s, want %s /data/projects", moved.ID, moved.Path, dir.ID)
+		}
+
+		if old, _ := db.FindDirectoryByPath("/home/user/projects"); old != nil {
+			t.Error("old path should no longer be tracked")
+		}
+		found, _ := db.FindDirectoryByPath("/data/projects")
+		if found == nil {
+			t.Fatal("new path should be tracked")
+		}
+		if file, _ := db.FindFileByPath(found, "a.txt"); file == nil {
+			t.Error("files should move with the directory")
+		}
+	})
+
+	t.Run("fails when new path is already recorded", func(t *testing.T) {
+		db := newTestDB(t)
+		dir, _ := db.CreateDirectory("/a", false)
+		db.CreateDirectory("/b", false)
+
+		if _, err := db.MoveDirectory(dir, "/b"); err == nil {
+			t.Error("expected error moving onto a tracked directory")
+		}
+	})
+
+	t.Run("absorbs tracked directories beneath new path", func(t *testing.T) {
+		db := newTestDB(t)
+		dir, _ := db.CreateDirectory("/home/user/projects", false)
+		child, _ := db.CreateDirectory("/data/projects/sub", false)
+		createTestFile(t, db, child.ID, "c.txt")
+
+		moved, err := db.MoveDirectory(dir, "/data/projects")
+		if err != nil {
+			t.Fatalf("MoveDirectory() error = %v", err)
+		}
+		if gone, _ := db.FindDirectoryByID(child.ID); gone != nil {
+			t.Error("child directory should be merged away")
+		}
+		if file, _ := db.FindFileByPath(moved, "sub/c.txt"); file == nil {
+			t.Error("child's files should move into the moved directory")
+		}
+	})
+
+	t.Run("joins tracked parent and combines history", func(t *testing.T) {
+		db := newTestDB(t)
+		dir, _ := db.CreateDirectory("/home/user/projects", false)
+		parent, _ := db.CreateDirectory("/data", false)
+
+		base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		db.CreateFileSnapshotAndContent(dir.ID, "a.txt", snapshotAt("old", base), "")
+		db.CreateFileSnapshotAndContent(dir.ID, "b.txt", snapshotAt("b", base), "")
+		// After the move on disk, a.txt was backed up again as part of /data.
+		db.CreateFileSnapshotAndContent(parent.ID, "projects/a.txt", snapshotAt("new", base.Add(time.Hour)), "")
+
+		into, err := db.MoveDirectory(dir, "/data/projects")
+		if err != nil {
+			t.Fatalf("MoveDirectory() error = %v", err)
+		}
+		if into.ID != parent.ID {
+			t.Errorf("MoveDirectory() returned %s, want parent /data", into.Path)
+		}
+		if gone, _ := db.FindDirectoryByID(dir.ID); gone != nil {
+			t.Error("moved directory should be merged into its parent")
+		}
+
+		if file, _ := db.FindFileByPath(parent, "projects/b.txt"); file == nil {
+			t.Error("projects/b.txt should be in the parent")
+		}
+		file, _ := db.FindFileByPath(parent, "projects/a.txt")
+		if file == nil {
+			t.Fatal("projects/a.txt should be in the parent")
+		}
+		snapshots, _ := db.FindFileSnapshotsForFile(file)
+		if len(snapshots) != 2 {
+			t.Errorf("got %d snapshots, want both histories combined", len(snapshots))
+		}
+		current, _ := db.FindFileSnapshotByID(file.CurrentSnapshotID.String)
+		if current == nil || current.ContentID != "new" {
+			t.Error("the newer current snapshot should stay current")
+		}
+	})
 }
 
 // createTestFile is a helper to create a file in a directory for testing.
@@ -540,6 +805,163 @@ func TestSQLiteDatabase_CreateFileSnapshotAndContent(t *testing.T) {
 	})
 }
 
+func TestSQLiteDatabase_UpdateContentEncryption(t *testing.T) {
+	db := newTestDB(t)
+	plain, _ := db.CreateDirectory("/home/user/docs", false)
+	secret, _ := db.CreateDirectory("/home/user/secret", true)
+
+	snap := &sqlc.FileSnapshot{
+		ID:         uuid.New().String(),
+		ContentID:  "plain-checksum",
+		CreatedAt:  time.Now(),
+		AccessedAt: time.Now(),
+		ModifiedAt: time.Now(),
+		ChangedAt:  time.Now(),
+	}
+	if err := db.CreateFileSnapshotAndContent(plain.ID, "a.txt", snap, ""); err != nil {
+		t.Fatalf("CreateFileSnapshotAndContent() error = %v", err)
+	}
+
+	contents, err := db.FindContentsByDirectory(plain)
+	if err != nil {
+		t.Fatalf("FindContentsByDirectory() error = %v", err)
+	}
+	if len(contents) != 1 || contents[0].ID != "plain-checksum" {
+		t.Fatalf("FindContentsByDirectory() = %v, want plain-checksum", contents)
+	}
+	if shared, _ := db.IsContentInEncryptedDirectory("plain-checksum"); shared {
+		t.Error("content should not be in an encrypted directory yet")
+	}
+
+	if err := db.UpdateContentEncryption("plain-checksum", "enc-checksum"); err != nil {
+		t.Fatalf("UpdateContentEncryption() error = %v", err)
+	}
+	content, _ := db.FindContentByChecksum("plain-checksum")
+	if content.EncryptedContentID.String != "enc-checksum" {
+		t.Errorf("EncryptedContentID = %v, want enc-checksum", content.EncryptedContentID)
+	}
+	if encRecord, _ := db.FindContentByChecksum("enc-checksum"); encRecord == nil || encRecord.EncryptedContentID.Valid {
+		t.Errorf("encrypted record = %+v, want one without a pointer", encRecord)
+	}
+	if checksum, err := db.FindPlaintextChecksum("enc-checksum"); err != nil || checksum != "plain-checksum" {
+		t.Errorf("FindPlaintextChecksum() = %q, %v, want plain-checksum", checksum, err)
+	}
+	if checksum, err := db.FindPlaintextChecksum("plain-checksum"); err != nil || checksum != "" {
+		t.Errorf("FindPlaintextChecksum() of unreferenced content = %q, %v, want empty", checksum, err)
+	}
+
+	if err := db.SetDirectoryEncrypted(plain, true); err != nil {
+		t.Fatalf("SetDirectoryEncrypted() error = %v", err)
+	}
+	if shared, _ := db.IsContentInEncryptedDirectory("plain-checksum"); !shared {
+		t.Error("content should be in an encrypted directory")
+	}
+	if found, _ := db.FindDirectoryByID(secret.ID); found.Encrypted != 1 {
+		t.Error("other directories should keep their flag")
+	}
+
+	if err := db.UpdateContentEncryption("plain-checksum", ""); err != nil {
+		t.Fatalf("UpdateContentEncryption() error = %v", err)
+	}
+	if content, _ := db.FindContentByChecksum("plain-checksum"); content.EncryptedContentID.Valid {
+		t.Error("EncryptedContentID should be cleared")
+	}
+}
+
+func TestSQLiteDatabase_KeyRotation(t *testing.T) {
+	db := newTestDB(t)
+	dir, _ := db.CreateDirectory("/home/user/secret", true)
+
+	for i, checksum := range []string{"plain-a", "plain-b"} {
+		snap := &sqlc.FileSnapshot{
+			ID:         uuid.New().String(),
+			ContentID:  checksum,
+			CreatedAt:  time.Now(),
+			AccessedAt: time.Now(),
+			ModifiedAt: time.Now(),
+			ChangedAt:  time.Now(),
+		}
+		if err := db.CreateFileSnapshotAndContent(dir.ID, fmt.Sprintf("%d.txt", i), snap, "enc-"+checksum); err != nil {
+			t.Fatalf("CreateFileSnapshotAndContent() error = %v", err)
+		}
+	}
+	db.CreateContent("plain-c", "")
+
+	if err := db.StartKeyRotation(false); err != nil {
+		t.Fatalf("StartKeyRotation() error = %v", err)
+	}
+	if err := db.StartKeyRotation(false); err != nil {
+		t.Fatalf("second StartKeyRotation() error = %v", err)
+	}
+	pending, err := db.FindKeyRotationPending()
+	if err != nil {
+		t.Fatalf("FindKeyRotationPending() error = %v", err)
+	}
+	if want := []string{"enc-plain-a", "enc-plain-b"}; !slices.Equal(pending, want) {
+		t.Fatalf("FindKeyRotationPending() = %v, want %v", pending, want)
+	}
+
+	if err := db.ReplaceEncryptedContent("enc-plain-a", "rotated-a"); err != nil {
+		t.Fatalf("ReplaceEncryptedContent() error = %v", err)
+	}
+	content, _ := db.FindContentByChecksum("plain-a")
+	if content.EncryptedContentID.String != "rotated-a" {
+		t.Errorf("plain-a points at %v, want rotated-a", content.EncryptedContentID)
+	}
+	if rotated, _ := db.FindContentByChecksum("rotated-a"); rotated == nil {
+		t.Error("real record for rotated-a should be created")
+	}
+	if pending, _ := db.FindKeyRotationPending(); !slices.Equal(pending, []string{"enc-plain-b"}) {
+		t.Errorf("FindKeyRotationPending() = %v, want [enc-plain-b]", pending)
+	}
+}
+
+func TestSQLiteDatabase_FindFileSnapshotByID(t *testing.T) {
+	t.Run("returns nil when snapshot not found", func(t *testing.T) {
+		db := newTestDB(t)
+
+		snap, err := db.FindFileSnapshotByID("nonexistent")
+		if err != nil {
+			t.Fatalf("FindFileSnapshotByID() error = %v", err)
+		}
+		if snap != nil {
+			t.Errorf("FindFileSnapshotByID() = %v, want nil", snap)
+		}
+	})
+
+	t.Run("finds the current snapshot of a file", func(t *testing.T) {
+		db := newTestDB(t)
+		dir, _ := db.CreateDirectory("/home/user/docs", false)
+
+		now := time.Now()
+		err := db.CreateFileSnapshotAndContent(dir.ID, "file.txt", &sqlc.FileSnapshot{
+			ID:          uuid.New().String(),
+			ContentID:   "checksum1",
+			CreatedAt:   now,
+			Size:        7,
+			Permissions: 0644,
+			AccessedAt:  now,
+			ModifiedAt:  now,
+			ChangedAt:   now,
+		}, "")
+		if err != nil {
+			t.Fatalf("CreateFileSnapshotAndContent() error = %v", err)
+		}
+
+		file, _ := db.FindFileByPath(dir, "file.txt")
+		snap, err := db.FindFileSnapshotByID(file.CurrentSnapshotID.String)
+		if err != nil {
+			t.Fatalf("FindFileSnapshotByID() error = %v", err)
+		}
+		if snap == nil {
+			t.Fatal("FindFileSnapshotByID() returned nil")
+		}
+		if snap.ContentID != "checksum1" || snap.Size != 7 {
+			t.Errorf("snapshot = %+v, want content checksum1 and size 7", snap)
+		}
+	})
+}
+
 func TestSQLiteDatabase_BackupOperations(t *testing.T) {
 	t.Run("create and list operations", func(t *testing.T) {
 		db := newTestDB(t)
@@ -615,6 +1037,185 @@ func TestSQLiteDatabase_BackupOperations(t *testing.T) {
 			t.Errorf("MaxBackupOperationID() = %d, want %d", maxID, op2.ID)
 		}
 	})
+
+	t.Run("skip operation IDs", func(t *testing.T) {
+		for _, existing := range []int{0, 2} {
+			db := newTestDB(t)
+			for range existing {
+				db.CreateBackupOperation("op", "")
+			}
+
+			if err := db.SkipBackupOperationIDs(5); err != nil {
+				t.Fatalf("SkipBackupOperationIDs() error = %v", err)
+			}
+			op, err := db.CreateBackupOperation("next", "")
+			if err != nil {
+				t.Fatalf("CreateBackupOperation() error = %v", err)
+			}
+			if op.ID != 6 {
+				t.Errorf("with %d operations, next ID = %d, want 6", existing, op.ID)
+			}
+
+			// Never moves the sequence backwards.
+			db.SkipBackupOperationIDs(1)
+			if op, _ := db.CreateBackupOperation("next", ""); op.ID != 7 {
+				t.Errorf("with %d operations, ID after skipping back = %d, want 7", existing, op.ID)
+			}
+		}
+	})
+}
+
+func TestSQLiteDatabase_OperationChain(t *testing.T) {
+	// setup runs two operations that each back up a file and returns them
+	// with the snapshot the first created.
+	setup := func(t *testing.T) (*SQLiteDatabase, []*sqlc.BackupOperation, string) {
+		t.Helper()
+		db := newTestDB(t)
+		dir, _ := db.CreateDirectory("/home/user/docs", false)
+
+		var ops []*sqlc.BackupOperation
+		var snapshotIDs []string
+		for i := range 2 {
+			op, err := db.CreateBackupOperation("BackupAll", "")
+			if err != nil {
+				t.Fatalf("CreateBackupOperation() error = %v", err)
+			}
+			snap := &sqlc.FileSnapshot{
+				ID:         uuid.New().String(),
+				ContentID:  fmt.Sprintf("checksum%d", i),
+				CreatedAt:  time.Now(),
+				Size:       42,
+				AccessedAt: time.Now(),
+				ModifiedAt: time.Now(),
+				ChangedAt:  time.Now(),
+			}
+			if err := db.CreateFileSnapshotAndContent(dir.ID, fmt.Sprintf("%d.txt", i), snap, ""); err != nil {
+				t.Fatalf("CreateFileSnapshotAndContent() error = %v", err)
+			}
+			if err := db.FinishBackupOperation(op.ID, "success"); err != nil {
+				t.Fatalf("FinishBackupOperation() error = %v", err)
+			}
+			ops = append(ops, op)
+			snapshotIDs = append(snapshotIDs, snap.ID)
+		}
+		return db, ops, snapshotIDs[0]
+	}
+
+	verify := func(t *testing.T, db *SQLiteDatabase) *bt.OperationChain {
+		t.Helper()
+		chain, err := db.VerifyOperationChain()
+		if err != nil {
+			t.Fatalf("VerifyOperationChain() error = %v", err)
+		}
+		return chain
+	}
+
+	t.Run("finished operations are sealed", func(t *testing.T) {
+		db, ops, _ := setup(t)
+		db.CreateBackupOperation("BackupAll", "")
+
+		chain := verify(t, db)
+		if len(chain.Problems) > 0 {
+			t.Errorf("Problems = %v, want none", chain.Problems)
+		}
+		if chain.Sealed != 2 || chain.Unsealed != 1 || chain.Snapshots != 2 || chain.Missing != 0 {
+			t.Errorf("chain = %+v, want 2 sealed, 1 running and 2 snapshots", chain)
+		}
+		if chain.Head == nil || chain.Head.ID != ops[1].ID {
+			t.Errorf("Head = %+v, want operation %d", chain.Head, ops[1].ID)
+		}
+		head, err := db.FindOperationChainHead()
+		if err != nil || head == nil || head.Hash != chain.Head.Hash {
+			t.Errorf("FindOperationChainHead() = %+v, %v; want operation %d", head, err, ops[1].ID)
+		}
+	})
+
+	t.Run("operations before the chain began are not problems", func(t *testing.T) {
+		db := newTestDB(t)
+		db.CreateBackupOperation("AddDirectory", "/docs")
+		db.db.Exec("UPDATE backup_operations SET status = 'success', finished_at = CURRENT_TIMESTAMP")
+		op, _ := db.CreateBackupOperation("BackupAll", "")
+		db.FinishBackupOperation(op.ID, "success")
+
+		chain := verify(t, db)
+		if len(chain.Problems) > 0 || chain.Sealed != 1 || chain.Unsealed != 1 {
+			t.Errorf("chain = %+v, want 1 sealed after 1 unsealed", chain)
+		}
+	})
+
+	tampered := []struct {
+		name   string
+		query  func(ops []*sqlc.BackupOperation, snapshotID string) string
+		failed []string
+	}{
+		{
+			name: "changed operation",
+			query: func(ops []*sqlc.BackupOperation, _ string) string {
+				return fmt.Sprintf("UPDATE backup_operations SET status = 'failed' WHERE id = %d", ops[0].ID)
+			},
+			failed: []string{"operation 1 "},
+		},
+		{
+			name: "deleted operation",
+			query: func(ops []*sqlc.BackupOperation, _ string) string {
+				return fmt.Sprintf("DELETE FROM backup_operations WHERE id = %d", ops[0].ID)
+			},
+			failed: []string{"operation 2 "},
+		},
+		{
+			name: "unsealed operation",
+			query: func(ops []*sqlc.BackupOperation, _ string) string {
+				return fmt.Sprintf("UPDATE backup_operations SET hash = NULL WHERE id = %d", ops[1].ID)
+			},
+			failed: []string{"without a hash"},
+		},
+		{
+			name: "changed snapshot",
+			query: func(_ []*sqlc.BackupOperation, snapshotID string) string {
+				return fmt.Sprintf("UPDATE file_snapshots SET size = 1 WHERE id = '%s'", snapshotID)
+			},
+			failed: []string{"was changed"},
+		},
+		{
+			// Both operations' snapshots changed.
+			name: "snapshot moved to another operation",
+			query: func(ops []*sqlc.BackupOperation, snapshotID string) string {
+				return fmt.Sprintf("UPDATE operation_snapshots SET operation_id = %d WHERE snapshot_id = '%s'", ops[1].ID, snapshotID)
+			},
+			failed: []string{"operation 1 ", "operation 2 "},
+		},
+	}
+	for _, tt := range tampered {
+		t.Run("detects a "+tt.name, func(t *testing.T) {
+			db, ops, snapshotID := setup(t)
+			if _, err := db.db.Exec(tt.query(ops, snapshotID)); err != nil {
+				t.Fatal(err)
+			}
+
+			chain := verify(t, db)
+			if len(chain.Problems) != len(tt.failed) {
+				t.Fatalf("Problems = %q, want %d", chain.Problems, len(tt.failed))
+			}
+			for i, want := range tt.failed {
+				if !strings.Contains(chain.Problems[i], want) {
+					t.Errorf("Problems[%d] = %q, want one about %q", i, chain.Problems[i], want)
+				}
+			}
+		})
+	}
+
+	t.Run("purged snapshots are missing, not problems", func(t *testing.T) {
+		db, _, snapshotID := setup(t)
+		db.db.Exec("UPDATE files SET current_snapshot_id = NULL WHERE current_snapshot_id = ?", snapshotID)
+		if _, err := db.db.Exec("DELETE FROM file_snapshots WHERE id = ?", snapshotID); err != nil {
+			t.Fatal(err)
+		}
+
+		chain := verify(t, db)
+		if len(chain.Problems) > 0 || chain.Missing != 1 || chain.Snapshots != 1 {
+			t.Errorf("chain = %+v, want 1 snapshot missing and no problems", chain)
+		}
+	})
 }
 
 func TestSQLiteDatabase_BackupTo(t *testing.T) {
@@ -642,6 +1243,116 @@ func TestSQLiteDatabase_BackupTo(t *testing.T) {
 	}
 }
 
+func TestSQLiteDatabase_Journal(t *testing.T) {
+	db := newTestDB(t)
+	op, _ := db.CreateBackupOperation("BackupAll", "")
+	docs, _ := db.CreateDirectory("/home/user/docs", false)
+	tmp, _ := db.CreateDirectory("/home/user/tmp", true)
+	db.FindOrCreateFile(tmp, "b.txt")
+	snap := &sqlc.FileSnapshot{
+		ID:          uuid.New().String(),
+		ContentID:   "checksum",
+		CreatedAt:   time.Now(),
+		Size:        1 << 40,
+		Permissions: 0644,
+		AccessedAt:  time.Now(),
+		ModifiedAt:  time.Now(),
+		ChangedAt:   time.Now(),
+	}
+	if err := db.CreateFileSnapshotAndContent(docs.ID, "a.txt", snap, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteDirectory(tmp); err != nil {
+		t.Fatal(err)
+	}
+	db.FinishBackupOperation(op.ID, "success")
+
+	entries, err := db.FindJournalEntries()
+	if err != nil {
+		t.Fatalf("FindJournalEntries() error = %v", err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("FindJournalEntries() returned nothing")
+	}
+
+	// Replaying the journal onto an empty database reproduces the changes.
+	replica := newTestDB(t)
+	if err := replica.ApplyJournal(entries); err != nil {
+		t.Fatalf("ApplyJournal() error = %v", err)
+	}
+	if pending, _ := replica.FindJournalEntries(); len(pending) != 0 {
+		t.Errorf("replay journaled %d entries, want none", len(pending))
+	}
+	if dir, _ := replica.FindDirectoryByPath("/home/user/tmp"); dir != nil {
+		t.Error("deleted directory should not be replayed")
+	}
+	dir, _ := replica.FindDirectoryByPath("/home/user/docs")
+	if dir == nil || dir.ID != docs.ID {
+		t.Fatalf("replayed directory = %+v, want %s", dir, docs.ID)
+	}
+	file, _ := replica.FindFileByPath(dir, "a.txt")
+	if file == nil || file.CurrentSnapshotID.String != snap.ID {
+		t.Fatalf("replayed file = %+v, want current snapshot %s", file, snap.ID)
+	}
+	got, _ := replica.FindFileSnapshotByID(snap.ID)
+	if got == nil || got.Size != snap.Size || !got.ModifiedAt.Equal(snap.ModifiedAt) {
+		t.Errorf("replayed snapshot = %+v, want %+v", got, snap)
+	}
+	ops, _ := replica.ListBackupOperations(10)
+	if len(ops) != 1 || ops[0].Status != "success" || !ops[0].FinishedAt.Valid {
+		t.Errorf("replayed operations = %+v", ops)
+	}
+
+	// Replaying again changes nothing.
+	if err := replica.ApplyJournal(entries); err != nil {
+		t.Fatalf("second ApplyJournal() error = %v", err)
+	}
+
+	throughSeq := entries[len(entries)-1].Seq
+	segment := &sqlc.MetadataSegment{OperationID: op.ID, Entries: int64(len(entries)), Size: 100}
+	if err := db.RecordJournalSegment(segment, throughSeq); err != nil {
+		t.Fatalf("RecordJournalSegment() error = %v", err)
+	}
+	if pending, _ := db.FindJournalEntries(); len(pending) != 0 {
+		t.Errorf("FindJournalEntries() after RecordJournalSegment() = %d entries, want none", len(pending))
+	}
+	if segments, _ := db.FindJournalSegments(); len(segments) != 1 || *segments[0] != *segment {
+		t.Errorf("FindJournalSegments() = %v, want [%v]", segments, segment)
+	}
+
+	db.CreateDirectory("/home/user/music", false)
+	pending, _ := db.FindJournalEntries()
+	if err := db.RecordCheckpoint(pending[len(pending)-1].Seq); err != nil {
+		t.Fatalf("RecordCheckpoint() error = %v", err)
+	}
+	if pending, _ := db.FindJournalEntries(); len(pending) != 0 {
+		t.Errorf("FindJournalEntries() after RecordCheckpoint() = %d entries, want none", len(pending))
+	}
+	if segments, _ := db.FindJournalSegments(); len(segments) != 0 {
+		t.Errorf("FindJournalSegments() after RecordCheckpoint() = %v, want none", segments)
+	}
+}
+
+func TestSQLiteDatabase_ApplyJournal_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry sqlc.MetadataJournal
+	}{
+		{"unknown table", sqlc.MetadataJournal{TableName: "schema_migrations", Op: "delete", RowData: `{"version": 1}`}},
+		{"bad column", sqlc.MetadataJournal{TableName: "contents", Op: "upsert", RowData: `{"id": "x", "id = 1; --": 1}`}},
+		{"missing key", sqlc.MetadataJournal{TableName: "contents", Op: "delete", RowData: `{}`}},
+		{"unknown op", sqlc.MetadataJournal{TableName: "contents", Op: "truncate", RowData: `{"id": "x"}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.ApplyJournal([]*sqlc.MetadataJournal{&tt.entry}); err == nil {
+				t.Error("ApplyJournal() should fail")
+			}
+		})
+	}
+}
+
 func TestSQLiteDatabase_CheckMigrations(t *testing.T) {
 	t.Run("fails on DB without migrations applied", func(t *testing.T) {
 		db, err := NewSQLiteDatabase(":memory:", nil, nil)
@@ -71,14 +71,15 @@ func main() {
 }
 
 // extractSchema extracts the SQL schema from the database.
-// It queries sqlite_master for all CREATE statements, excluding:
+// It queries sqlite_master for all CREATE statements, including the journal
+// triggers, excluding:
 // - SQLite internal tables (sqlite_*)
 // - Migration tracking table (schema_migrations)
 func extractSchema(db *sql.DB) (string, error) {
 	query := `
 		SELECT sql || ';'
 		FROM sqlite_master
-		WHERE type IN ('table', 'index')
+		WHERE type IN ('table', 'index', 'trigger')
 		  AND name NOT LIKE 'sqlite_%'
 		  AND name != 'schema_migrations'
 		  AND tbl_name != 'schema_migrations'
@@ -86,6 +87,7 @@ func extractSchema(db *sql.DB) (string, error) {
 		  CASE type
 		    WHEN 'table' THEN 1
 		    WHEN 'index' THEN 2
+		    WHEN 'trigger' THEN 3
 		  END,
 		  name
 	`
@@ -1,76 +1,220 @@
 package encryption
 
 import (
+	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
 
 	"bt-go/internal/bt"
 	"bt-go/internal/config"
 )
 
-// AgeEncryptor implements bt.Encryptor using filippo.io/age with X25519 keys.
+// AgeEncryptor implements bt.Encryptor using filippo.io/age with X25519 keys,
+// or hybrid ML-KEM-768+X25519 keys when post-quantum keys are configured.
 // The public key is stored in plaintext; the private key is encrypted with the
-// user's passphrase using age's scrypt-based passphrase encryption.
+// user's passphrase using age's scrypt-based passphrase encryption. Data is
+// also encrypted to any additional recipients from the configuration, so it
+// can be decrypted with any of their identities. In convergent mode, file
+// content is encrypted with keys derived from the convergence secret instead
+// (see convergent.go).
 type AgeEncryptor struct {
 	publicKeyPath  string
 	privateKeyPath string
+	recipients     []string
+	postQuantum    bool
+	convergent     bool
+	secretPath     string
 }
 
 var _ bt.Encryptor = (*AgeEncryptor)(nil)
 
+// ScryptWorkFactor is the base-2 logarithm of the scrypt work factor used to
+// encrypt private keys with a passphrase; age's default. Tests lower it so
+// that setting up keys does not dominate their run time.
+var ScryptWorkFactor = 18
+
 // NewAgeEncryptor creates a new AgeEncryptor from configuration.
 func NewAgeEncryptor(cfg config.EncryptionConfig) *AgeEncryptor {
 	return &AgeEncryptor{
 		publicKeyPath:  cfg.PublicKeyPath,
 		privateKeyPath: cfg.PrivateKeyPath,
+		recipients:     cfg.Recipients,
+		postQuantum:    cfg.PostQuantum,
+		convergent:     cfg.Convergent,
+		secretPath:     ConvergenceSecretPath(cfg),
 	}
 }
 
-// Setup generates a new X25519 key pair, stores the public key in plaintext,
-// and encrypts the private key with the passphrase using age's scrypt-based
-// passphrase encryption.
+// Setup generates a new key pair, stores the public key in plaintext, and
+// encrypts the private key with the passphrase using age's scrypt-based
+// passphrase encryption. In convergent mode it also generates the convergence
+// secret, unless one was already copied into place from another host.
 func (e *AgeEncryptor) Setup(passphrase string) error {
-	identity, err := age.GenerateX25519Identity()
+	publicKey, privateKey, err := generateKeyPair(e.postQuantum)
 	if err != nil {
 		return fmt.Errorf("generating key pair: %w", err)
 	}
+	if err := writeKeyPair(e.publicKeyPath, e.privateKeyPath, publicKey, privateKey, passphrase); err != nil {
+		return err
+	}
+	if e.convergent && !fileExists(e.secretPath) {
+		return NewConvergenceSecret(e.secretPath)
+	}
+	return nil
+}
+
+// ImportIdentity sets up the key pair from an existing identity instead of
+// generating one, so hosts can share a key. The file at path may hold an age
+// identity, be encrypted with an age passphrase, or be an ed25519 or RSA SSH
+// private key; identityPassphrase is only called if the file is protected by
+// one. The identity is validated, then stored like a generated one: its
+// public key in plaintext and the identity itself encrypted with passphrase.
+func (e *AgeEncryptor) ImportIdentity(path string, identityPassphrase func() (string, error), passphrase string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading identity file: %w", err)
+	}
+
+	if bytes.HasPrefix(data, []byte("age-encryption.org/")) {
+		p, err := identityPassphrase()
+		if err != nil {
+			return err
+		}
+		if data, err = decryptKeyFile(path, p); err != nil {
+			return err
+		}
+	}
+
+	var publicKey, privateKey string
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		key, err := parseSSHKey(data, identityPassphrase)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return fmt.Errorf("deriving SSH public key: %w", err)
+		}
+		// Store the key unprotected by its own passphrase; the wrapping with
+		// ours protects it instead.
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			return fmt.Errorf("encoding SSH private key: %w", err)
+		}
+		publicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+		privateKey = strings.TrimSpace(string(pem.EncodeToMemory(block)))
+	} else {
+		identities, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("parsing identity file: %w", err)
+		}
+		if len(identities) != 1 {
+			return fmt.Errorf("identity file holds %d identities, want 1", len(identities))
+		}
+		switch identity := identities[0].(type) {
+		case *age.X25519Identity:
+			publicKey, privateKey = identity.Recipient().String(), identity.String()
+		case *age.HybridIdentity:
+			publicKey, privateKey = identity.Recipient().String(), identity.String()
+		default:
+			return fmt.Errorf("unsupported identity type %T", identity)
+		}
+	}
+
+	primary, err := ParseRecipient(publicKey)
+	if err != nil {
+		return err
+	}
+	_, postQuantum := primary.(*age.HybridRecipient)
+	if _, err := ParseRecipients(e.recipients, postQuantum); err != nil {
+		return err
+	}
+	if err := writeKeyPair(e.publicKeyPath, e.privateKeyPath, publicKey, privateKey, passphrase); err != nil {
+		return err
+	}
+	if e.convergent && !fileExists(e.secretPath) {
+		return NewConvergenceSecret(e.secretPath)
+	}
+	return nil
+}
+
+// generateKeyPair returns the encoded public and private keys of a new hybrid
+// ML-KEM-768+X25519 identity if postQuantum is set, and of a new X25519
+// identity otherwise.
+func generateKeyPair(postQuantum bool) (publicKey, privateKey string, err error) {
+	if postQuantum {
+		identity, err := age.GenerateHybridIdentity()
+		if err != nil {
+			return "", "", err
+		}
+		return identity.Recipient().String(), identity.String(), nil
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", "", err
+	}
+	return identity.Recipient().String(), identity.String(), nil
+}
 
+// writeKeyPair writes publicKey in plaintext to publicKeyPath and privateKey,
+// encrypted with the passphrase, to privateKeyPath.
+func writeKeyPair(publicKeyPath, privateKeyPath, publicKey, privateKey, passphrase string) error {
 	// Ensure key directories exist.
-	if err := os.MkdirAll(filepath.Dir(e.publicKeyPath), 0700); err != nil {
+	if err := os.MkdirAll(filepath.Dir(publicKeyPath), 0700); err != nil {
 		return fmt.Errorf("creating public key directory: %w", err)
 	}
-	if err := os.MkdirAll(filepath.Dir(e.privateKeyPath), 0700); err != nil {
+	if err := os.MkdirAll(filepath.Dir(privateKeyPath), 0700); err != nil {
 		return fmt.Errorf("creating private key directory: %w", err)
 	}
 
 	// Write public key in plaintext.
-	if err := os.WriteFile(e.publicKeyPath, []byte(identity.Recipient().String()+"\n"), 0644); err != nil {
+	if err := os.WriteFile(publicKeyPath, []byte(publicKey+"\n"), 0644); err != nil {
 		return fmt.Errorf("writing public key: %w", err)
 	}
 
-	// Encrypt private key with passphrase and write it.
-	privFile, err := os.OpenFile(e.privateKeyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	return writePrivateKey(privateKeyPath, []byte(privateKey+"\n"), passphrase)
+}
+
+// writePrivateKey encrypts keyData with the passphrase and writes it to path.
+// The file is written beside path and renamed over it, so an existing key is
+// replaced atomically.
+func writePrivateKey(path string, keyData []byte, passphrase string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
 	if err != nil {
 		return fmt.Errorf("creating private key file: %w", err)
 	}
-	defer privFile.Close()
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	defer tmp.Close()
+
+	if err := tmp.Chmod(0600); err != nil {
+		return fmt.Errorf("setting private key permissions: %w", err)
+	}
 
 	recipient, err := age.NewScryptRecipient(passphrase)
 	if err != nil {
 		return fmt.Errorf("creating scrypt recipient: %w", err)
 	}
+	recipient.SetWorkFactor(ScryptWorkFactor)
 
-	w, err := age.Encrypt(privFile, recipient)
+	w, err := age.Encrypt(tmp, recipient)
 	if err != nil {
 		return fmt.Errorf("creating encrypted writer: %w", err)
 	}
 
-	if _, err := io.WriteString(w, identity.String()+"\n"); err != nil {
+	if _, err := w.Write(keyData); err != nil {
 		return fmt.Errorf("writing encrypted private key: %w", err)
 	}
 
@@ -78,18 +222,24 @@ func (e *AgeEncryptor) Setup(passphrase string) error {
 		return fmt.Errorf("finalizing encrypted private key: %w", err)
 	}
 
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("syncing private key file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing private key file: %w", err)
+	}
 	return nil
 }
 
 // Encrypt reads plaintext from r and writes age-encrypted ciphertext to w
-// using the stored public key.
+// using the stored public key and any additional recipients.
 func (e *AgeEncryptor) Encrypt(r io.Reader, w io.Writer) error {
-	recipient, err := e.loadRecipient()
+	recipients, err := e.loadRecipients()
 	if err != nil {
 		return fmt.Errorf("loading public key: %w", err)
 	}
 
-	encWriter, err := age.Encrypt(w, recipient)
+	encWriter, err := age.Encrypt(w, recipients...)
 	if err != nil {
 		return fmt.Errorf("creating encrypted writer: %w", err)
 	}
@@ -105,10 +255,169 @@ func (e *AgeEncryptor) Encrypt(r io.Reader, w io.Writer) error {
 	return nil
 }
 
+// EncryptContent encrypts file content convergently in convergent mode, and
+// like Encrypt otherwise.
+func (e *AgeEncryptor) EncryptContent(checksum string, r io.Reader, w io.Writer) error {
+	if !e.convergent {
+		return e.Encrypt(r, w)
+	}
+	secret, err := loadConvergenceSecret(e.secretPath)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("convergence secret %s not found; run 'bt keys secret' or copy it from another host", e.secretPath)
+	}
+	return convergentEncrypt(secret, checksum, r, w)
+}
+
+// Convergent returns true in convergent mode.
+func (e *AgeEncryptor) Convergent() bool {
+	return e.convergent
+}
+
 // Unlock decrypts the private key using the passphrase and returns an
 // AgeDecryptionContext holding the unlocked identity.
 func (e *AgeEncryptor) Unlock(passphrase string) (bt.DecryptionContext, error) {
-	privData, err := os.ReadFile(e.privateKeyPath)
+	ctx, err := unlockKeyFile(e.privateKeyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return e.withSecret(ctx)
+}
+
+// withSecret attaches the convergence secret, if there is one, to ctx so it
+// can decrypt convergent content too.
+func (e *AgeEncryptor) withSecret(ctx *AgeDecryptionContext) (*AgeDecryptionContext, error) {
+	secret, err := loadConvergenceSecret(e.secretPath)
+	if err != nil {
+		return nil, err
+	}
+	ctx.secret = secret
+	return ctx, nil
+}
+
+// unlockKeyFile decrypts the passphrase-protected private key at path. The
+// key is age identities, or an SSH private key imported at setup.
+func unlockKeyFile(path string, passphrase string) (*AgeDecryptionContext, error) {
+	keyData, err := decryptKeyFile(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Contains(keyData, []byte("-----BEGIN")) {
+		key, err := parseSSHKey(keyData, func() (string, error) {
+			return "", fmt.Errorf("imported SSH key is protected by a passphrase")
+		})
+		if err != nil {
+			return nil, fmt.Errorf("parsing private key: %w", err)
+		}
+		identity, err := sshIdentity(key)
+		if err != nil {
+			return nil, fmt.Errorf("parsing private key: %w", err)
+		}
+		return &AgeDecryptionContext{identities: []age.Identity{identity}}, nil
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(keyData))
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identities found in private key")
+	}
+
+	return &AgeDecryptionContext{identities: identities}, nil
+}
+
+// UnlockIdentityFile returns an AgeDecryptionContext for the identity file at
+// path instead of the configured private key. The file may hold age
+// identities ("AGE-SECRET-KEY-1..." lines, as for an offline recovery key),
+// be a passphrase-protected key file like the one Setup writes, or be an
+// ed25519 or RSA SSH private key. passphrase is only called if the file is
+// protected by one.
+func (e *AgeEncryptor) UnlockIdentityFile(path string, passphrase func() (string, error)) (bt.DecryptionContext, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading identity file: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("age-encryption.org/")):
+		p, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		ctx, err := unlockKeyFile(path, p)
+		if err != nil {
+			return nil, err
+		}
+		return e.withSecret(ctx)
+	case bytes.Contains(data, []byte("-----BEGIN")):
+		key, err := parseSSHKey(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := sshIdentity(key)
+		if err != nil {
+			return nil, err
+		}
+		return e.withSecret(&AgeDecryptionContext{identities: []age.Identity{identity}})
+	default:
+		identities, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("parsing identity file: %w", err)
+		}
+		return e.withSecret(&AgeDecryptionContext{identities: identities})
+	}
+}
+
+// parseSSHKey parses an SSH private key, decrypting it with passphrase if it
+// is protected. The key is decrypted up front so a wrong passphrase is
+// reported here rather than on first use. ed25519 keys are returned as
+// ed25519.PrivateKey and RSA keys as *rsa.PrivateKey; other types are refused.
+func parseSSHKey(pemBytes []byte, passphrase func() (string, error)) (crypto.PrivateKey, error) {
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		p, perr := passphrase()
+		if perr != nil {
+			return nil, perr
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(p))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing SSH private key: %w", err)
+	}
+
+	switch k := key.(type) {
+	case *ed25519.PrivateKey:
+		return *k, nil
+	case ed25519.PrivateKey, *rsa.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported SSH key type %T", key)
+	}
+}
+
+// sshIdentity returns the age identity for an SSH private key returned by
+// parseSSHKey.
+func sshIdentity(key crypto.PrivateKey) (age.Identity, error) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return agessh.NewEd25519Identity(k)
+	case *rsa.PrivateKey:
+		return agessh.NewRSAIdentity(k)
+	default:
+		return nil, fmt.Errorf("unsupported SSH key type %T", key)
+	}
+}
+
+// decryptKeyFile returns the plaintext of the passphrase-protected private
+// key at path.
+func decryptKeyFile(path string, passphrase string) ([]byte, error) {
+	privData, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("reading private key file: %w", err)
 	}
@@ -127,17 +436,35 @@ func (e *AgeEncryptor) Unlock(passphrase string) (bt.DecryptionContext, error) {
 	if err != nil {
 		return nil, fmt.Errorf("reading decrypted private key: %w", err)
 	}
+	return keyData, nil
+}
 
-	identities, err := age.ParseIdentities(bytes.NewReader(keyData))
-	if err != nil {
-		return nil, fmt.Errorf("parsing private key: %w", err)
+// ChangePassphrase re-encrypts the private key with a new passphrase. The
+// identity itself is unchanged, so existing content stays decryptable. While a
+// rotation is in progress, the previous private key is re-encrypted too.
+func (e *AgeEncryptor) ChangePassphrase(oldPassphrase string, newPassphrase string) error {
+	paths := []string{e.privateKeyPath}
+	if e.RotationInProgress() {
+		paths = append(paths, PreviousKeyPath(e.privateKeyPath))
 	}
 
-	if len(identities) == 0 {
-		return nil, fmt.Errorf("no identities found in private key")
+	// Decrypt every key before writing any, so a wrong passphrase changes
+	// nothing.
+	keys := make([][]byte, len(paths))
+	for i, path := range paths {
+		keyData, err := decryptKeyFile(path, oldPassphrase)
+		if err != nil {
+			return err
+		}
+		keys[i] = keyData
 	}
 
-	return &AgeDecryptionContext{identity: identities[0]}, nil
+	for i, path := range paths {
+		if err := writePrivateKey(path, keys[i], newPassphrase); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // IsConfigured returns true if both key files exist.
@@ -151,35 +478,222 @@ func (e *AgeEncryptor) IsConfigured() bool {
 	return true
 }
 
-// loadRecipient reads the public key from disk and parses it.
-func (e *AgeEncryptor) loadRecipient() (age.Recipient, error) {
-	pubData, err := os.ReadFile(e.publicKeyPath)
+// PreviousKeyPath returns where a key file is kept while a rotation replaces
+// it.
+func PreviousKeyPath(path string) string {
+	return path + ".old"
+}
+
+// newKeyPath returns where a rotation writes a new key file before moving it
+// into place.
+func newKeyPath(path string) string {
+	return path + ".new"
+}
+
+// BeginRotation generates a new key pair protected by the same passphrase and
+// swaps it in for the current one, which moves to PreviousKeyPath. The new
+// pair is post-quantum if configured or if the current one already is, so
+// rotating never downgrades a hybrid key pair. The new pair is written
+// beside the current one first, and moving the private key aside marks the
+// rotation as started; after an interruption, the remaining renames are
+// completed on the next call.
+func (e *AgeEncryptor) BeginRotation(passphrase string) (bt.DecryptionContext, error) {
+	if !e.RotationInProgress() {
+		// Unlock first so a wrong passphrase changes nothing.
+		if _, err := e.Unlock(passphrase); err != nil {
+			return nil, err
+		}
+
+		publicKey, privateKey, err := generateKeyPair(e.postQuantum || e.isPostQuantum())
+		if err != nil {
+			return nil, fmt.Errorf("generating key pair: %w", err)
+		}
+		if err := writeKeyPair(newKeyPath(e.publicKeyPath), newKeyPath(e.privateKeyPath), publicKey, privateKey, passphrase); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(e.privateKeyPath, PreviousKeyPath(e.privateKeyPath)); err != nil {
+			return nil, fmt.Errorf("moving private key aside: %w", err)
+		}
+	}
+
+	if err := e.completeSwap(); err != nil {
+		return nil, err
+	}
+	ctx, err := unlockKeyFile(PreviousKeyPath(e.privateKeyPath), passphrase)
 	if err != nil {
-		return nil, fmt.Errorf("reading public key: %w", err)
+		return nil, err
 	}
+	return e.withSecret(ctx)
+}
 
-	recipients, err := age.ParseRecipients(bytes.NewReader(pubData))
+// completeSwap moves the new key pair into place once the previous private
+// key has been moved aside. Steps already done are skipped.
+func (e *AgeEncryptor) completeSwap() error {
+	if fileExists(newKeyPath(e.publicKeyPath)) {
+		if !fileExists(PreviousKeyPath(e.publicKeyPath)) {
+			if err := os.Rename(e.publicKeyPath, PreviousKeyPath(e.publicKeyPath)); err != nil {
+				return fmt.Errorf("moving public key aside: %w", err)
+			}
+		}
+		if err := os.Rename(newKeyPath(e.publicKeyPath), e.publicKeyPath); err != nil {
+			return fmt.Errorf("installing new public key: %w", err)
+		}
+	}
+	if fileExists(newKeyPath(e.privateKeyPath)) {
+		if err := os.Rename(newKeyPath(e.privateKeyPath), e.privateKeyPath); err != nil {
+			return fmt.Errorf("installing new private key: %w", err)
+		}
+	}
+	return nil
+}
+
+// RotationInProgress returns true while the previous private key is kept.
+func (e *AgeEncryptor) RotationInProgress() bool {
+	return fileExists(PreviousKeyPath(e.privateKeyPath))
+}
+
+// FinishRotation deletes the previous key pair.
+func (e *AgeEncryptor) FinishRotation() error {
+	for _, path := range []string{PreviousKeyPath(e.publicKeyPath), PreviousKeyPath(e.privateKeyPath)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing previous key: %w", err)
+		}
+	}
+	return nil
+}
+
+// isPostQuantum returns true if the current public key is a hybrid
+// ML-KEM-768+X25519 key.
+func (e *AgeEncryptor) isPostQuantum() bool {
+	recipient, err := e.loadRecipient()
 	if err != nil {
-		return nil, fmt.Errorf("parsing public key: %w", err)
+		return false
 	}
+	_, ok := recipient.(*age.HybridRecipient)
+	return ok
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
 
-	if len(recipients) == 0 {
-		return nil, fmt.Errorf("no recipients found in public key file")
+// loadRecipients returns the stored public key followed by the additional
+// recipients.
+func (e *AgeEncryptor) loadRecipients() ([]age.Recipient, error) {
+	primary, err := e.loadRecipient()
+	if err != nil {
+		return nil, err
 	}
+	_, postQuantum := primary.(*age.HybridRecipient)
+	recipients, err := ParseRecipients(e.recipients, postQuantum)
+	if err != nil {
+		return nil, err
+	}
+	return append([]age.Recipient{primary}, recipients...), nil
+}
 
-	return recipients[0], nil
+// ParseRecipients parses additional recipients for a key pair that is
+// post-quantum or not, as ParseRecipient does.
+func ParseRecipients(recipients []string, postQuantum bool) ([]age.Recipient, error) {
+	var parsed []age.Recipient
+	for _, s := range recipients {
+		r, err := ParseRecipient(s)
+		if err != nil {
+			return nil, err
+		}
+		// age refuses to mix post-quantum and classic recipients, since the
+		// file would only be as strong as the weakest of them.
+		if _, ok := r.(*age.HybridRecipient); ok != postQuantum {
+			if postQuantum {
+				return nil, fmt.Errorf("recipient %q is not post-quantum but the key pair is", s)
+			}
+			return nil, fmt.Errorf("recipient %q is post-quantum but the key pair is not", s)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
 }
 
-// AgeDecryptionContext holds an unlocked age identity for decrypting data.
+// ParseRecipient parses an additional recipient: an age public key, either
+// X25519 ("age1...") or hybrid post-quantum ("age1pq1..."), or an SSH public
+// key line as found in authorized_keys or a .pub file.
+func ParseRecipient(s string) (age.Recipient, error) {
+	s = strings.TrimSpace(s)
+	var (
+		r   age.Recipient
+		err error
+	)
+	switch {
+	case strings.HasPrefix(s, "ssh-"):
+		r, err = agessh.ParseRecipient(s)
+	case strings.HasPrefix(s, "age1pq1"):
+		r, err = age.ParseHybridRecipient(s)
+	default:
+		r, err = age.ParseX25519Recipient(s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing recipient %q: %w", s, err)
+	}
+	return r, nil
+}
+
+// loadRecipient reads the public key from disk and parses it. It is an age
+// public key, or an SSH public key line for an imported SSH identity.
+func (e *AgeEncryptor) loadRecipient() (age.Recipient, error) {
+	pubData, err := os.ReadFile(e.publicKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading public key: %w", err)
+	}
+
+	for _, line := range strings.Split(string(pubData), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRecipient(line)
+		if err != nil {
+			return nil, fmt.Errorf("parsing public key: %w", err)
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("no recipients found in public key file")
+}
+
+// AgeDecryptionContext holds unlocked age identities for decrypting data, and
+// the convergence secret if there is one.
 type AgeDecryptionContext struct {
-	identity age.Identity
+	identities []age.Identity
+	secret     []byte
 }
 
 var _ bt.DecryptionContext = (*AgeDecryptionContext)(nil)
 
-// Decrypt reads age-encrypted ciphertext from r and writes plaintext to w.
+// DecryptionContext returns an AgeDecryptionContext for identities, such as
+// one that unwraps file keys through bt agent, along with the convergence
+// secret if there is one.
+func (e *AgeEncryptor) DecryptionContext(identities ...age.Identity) (*AgeDecryptionContext, error) {
+	return e.withSecret(&AgeDecryptionContext{identities: identities})
+}
+
+// Identities returns the unlocked identities, so bt agent can hold them.
+func (c *AgeDecryptionContext) Identities() []age.Identity {
+	return c.identities
+}
+
+// Decrypt reads age-encrypted or convergent ciphertext from r and writes
+// plaintext to w.
 func (c *AgeDecryptionContext) Decrypt(r io.Reader, w io.Writer) error {
-	decReader, err := age.Decrypt(r, c.identity)
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(len(convergentMagic)); isConvergent(header) {
+		if c.secret == nil {
+			return fmt.Errorf("content is convergently encrypted but no convergence secret was found")
+		}
+		br.Discard(len(convergentMagic))
+		return convergentDecrypt(c.secret, br, w)
+	}
+
+	decReader, err := age.Decrypt(br, c.identities...)
 	if err != nil {
 		return fmt.Errorf("creating decrypted reader: %w", err)
 	}
@@ -2,12 +2,28 @@ package encryption
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/pem"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+
+	"bt-go/internal/bt"
 	"bt-go/internal/config"
 )
 
+// TestMain lowers the scrypt work factor: the tests set up keys far too
+// often to pay for the default one each time.
+func TestMain(m *testing.M) {
+	ScryptWorkFactor = 10
+	os.Exit(m.Run())
+}
+
 func newTestAgeEncryptor(t *testing.T) *AgeEncryptor {
 	t.Helper()
 	dir := t.TempDir()
@@ -125,3 +141,500 @@ func TestAgeEncryptor_UnlockBeforeSetup(t *testing.T) {
 		t.Error("Unlock() before Setup should return error")
 	}
 }
+
+func TestAgeEncryptor_Rotation(t *testing.T) {
+	t.Parallel()
+
+	passphrase := "test-passphrase"
+	e := newTestAgeEncryptor(t)
+	if err := e.Setup(passphrase); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	var before bytes.Buffer
+	if err := e.Encrypt(bytes.NewReader([]byte("old data")), &before); err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	if _, err := e.BeginRotation("wrong-passphrase"); err == nil {
+		t.Fatal("BeginRotation() with wrong passphrase should return error")
+	}
+	if e.RotationInProgress() {
+		t.Fatal("a failed BeginRotation() should not start a rotation")
+	}
+
+	previous, err := e.BeginRotation(passphrase)
+	if err != nil {
+		t.Fatalf("BeginRotation() error = %v", err)
+	}
+	if !e.RotationInProgress() {
+		t.Error("RotationInProgress() = false after BeginRotation")
+	}
+	var decrypted bytes.Buffer
+	if err := previous.Decrypt(bytes.NewReader(before.Bytes()), &decrypted); err != nil || decrypted.String() != "old data" {
+		t.Errorf("previous key Decrypt() = %q, %v", decrypted.String(), err)
+	}
+
+	// Data encrypted now uses the new key only.
+	var after bytes.Buffer
+	if err := e.Encrypt(bytes.NewReader([]byte("new data")), &after); err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	if err := previous.Decrypt(bytes.NewReader(after.Bytes()), io.Discard); err == nil {
+		t.Error("previous key should not decrypt data encrypted after rotation")
+	}
+	current, err := e.Unlock(passphrase)
+	if err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+	decrypted.Reset()
+	if err := current.Decrypt(bytes.NewReader(after.Bytes()), &decrypted); err != nil || decrypted.String() != "new data" {
+		t.Errorf("new key Decrypt() = %q, %v", decrypted.String(), err)
+	}
+
+	// Calling BeginRotation again resumes with the same previous key.
+	resumed, err := e.BeginRotation(passphrase)
+	if err != nil {
+		t.Fatalf("resumed BeginRotation() error = %v", err)
+	}
+	if err := resumed.Decrypt(bytes.NewReader(before.Bytes()), io.Discard); err != nil {
+		t.Errorf("resumed previous key Decrypt() error = %v", err)
+	}
+
+	if err := e.FinishRotation(); err != nil {
+		t.Fatalf("FinishRotation() error = %v", err)
+	}
+	if e.RotationInProgress() {
+		t.Error("RotationInProgress() = true after FinishRotation")
+	}
+	if _, err := os.Stat(PreviousKeyPath(e.privateKeyPath)); !os.IsNotExist(err) {
+		t.Errorf("previous private key should be deleted, stat error = %v", err)
+	}
+}
+
+func TestAgeEncryptor_RotationCompletesInterruptedSwap(t *testing.T) {
+	t.Parallel()
+
+	passphrase := "test-passphrase"
+	e := newTestAgeEncryptor(t)
+	if err := e.Setup(passphrase); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	oldPublic, _ := os.ReadFile(e.publicKeyPath)
+
+	// Simulate a crash right after the private key was moved aside.
+	if _, err := e.BeginRotation(passphrase); err != nil {
+		t.Fatalf("BeginRotation() error = %v", err)
+	}
+	newPublic, _ := os.ReadFile(e.publicKeyPath)
+	newPrivate, _ := os.ReadFile(e.privateKeyPath)
+	os.WriteFile(newKeyPath(e.publicKeyPath), newPublic, 0644)
+	os.WriteFile(newKeyPath(e.privateKeyPath), newPrivate, 0600)
+	os.Rename(PreviousKeyPath(e.publicKeyPath), e.publicKeyPath)
+	os.Remove(e.privateKeyPath)
+	os.WriteFile(e.publicKeyPath, oldPublic, 0644)
+
+	if _, err := e.BeginRotation(passphrase); err != nil {
+		t.Fatalf("resumed BeginRotation() error = %v", err)
+	}
+	if got, _ := os.ReadFile(e.publicKeyPath); !bytes.Equal(got, newPublic) {
+		t.Error("public key should be the new one")
+	}
+	if got, _ := os.ReadFile(PreviousKeyPath(e.publicKeyPath)); !bytes.Equal(got, oldPublic) {
+		t.Error("previous public key should be the old one")
+	}
+	if !e.IsConfigured() {
+		t.Error("IsConfigured() = false after resuming")
+	}
+}
+
+func TestAgeEncryptor_ChangePassphrase(t *testing.T) {
+	t.Parallel()
+
+	e := newTestAgeEncryptor(t)
+	if err := e.Setup("old-passphrase"); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	var encrypted bytes.Buffer
+	if err := e.Encrypt(bytes.NewReader([]byte("data")), &encrypted); err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	if err := e.ChangePassphrase("wrong-passphrase", "new-passphrase"); err == nil {
+		t.Fatal("ChangePassphrase() with wrong passphrase should return error")
+	}
+	if err := e.ChangePassphrase("old-passphrase", "new-passphrase"); err != nil {
+		t.Fatalf("ChangePassphrase() error = %v", err)
+	}
+
+	if _, err := e.Unlock("old-passphrase"); err == nil {
+		t.Error("Unlock() with old passphrase should fail after ChangePassphrase")
+	}
+	ctx, err := e.Unlock("new-passphrase")
+	if err != nil {
+		t.Fatalf("Unlock() with new passphrase error = %v", err)
+	}
+	var decrypted bytes.Buffer
+	if err := ctx.Decrypt(&encrypted, &decrypted); err != nil || decrypted.String() != "data" {
+		t.Errorf("Decrypt() = %q, %v; the key itself should be unchanged", decrypted.String(), err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(e.privateKeyPath))
+	if len(entries) != 2 {
+		t.Errorf("key directory has %d entries, want only the key pair", len(entries))
+	}
+}
+
+func TestAgeEncryptor_AdditionalRecipients(t *testing.T) {
+	t.Parallel()
+
+	recovery, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity() error = %v", err)
+	}
+	sshPub, sshPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	sshPubKey, err := ssh.NewPublicKey(sshPub)
+	if err != nil {
+		t.Fatalf("NewPublicKey() error = %v", err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(sshPriv, "", []byte("ssh-passphrase"))
+	if err != nil {
+		t.Fatalf("MarshalPrivateKeyWithPassphrase() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	recoveryPath := filepath.Join(dir, "recovery.txt")
+	sshPath := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(recoveryPath, []byte(recovery.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sshPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewAgeEncryptor(config.EncryptionConfig{
+		PublicKeyPath:  filepath.Join(dir, "keys", "bt.pub"),
+		PrivateKeyPath: filepath.Join(dir, "keys", "bt.key"),
+		Recipients: []string{
+			recovery.Recipient().String(),
+			string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(sshPubKey))) + " user@host",
+		},
+	})
+	if err := e.Setup("passphrase"); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	var encrypted bytes.Buffer
+	if err := e.Encrypt(strings.NewReader("secret"), &encrypted); err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	decrypt := func(t *testing.T, ctx bt.DecryptionContext) {
+		t.Helper()
+		var plaintext bytes.Buffer
+		if err := ctx.Decrypt(bytes.NewReader(encrypted.Bytes()), &plaintext); err != nil {
+			t.Fatalf("Decrypt() error = %v", err)
+		}
+		if plaintext.String() != "secret" {
+			t.Errorf("Decrypt() = %q, want %q", plaintext.String(), "secret")
+		}
+	}
+	passphrase := func(p string) func() (string, error) {
+		return func() (string, error) { return p, nil }
+	}
+	noPassphrase := func() (string, error) {
+		t.Error("passphrase requested for an unprotected identity")
+		return "", nil
+	}
+
+	t.Run("private key", func(t *testing.T) {
+		ctx, err := e.Unlock("passphrase")
+		if err != nil {
+			t.Fatalf("Unlock() error = %v", err)
+		}
+		decrypt(t, ctx)
+	})
+
+	t.Run("recovery key", func(t *testing.T) {
+		ctx, err := e.UnlockIdentityFile(recoveryPath, noPassphrase)
+		if err != nil {
+			t.Fatalf("UnlockIdentityFile() error = %v", err)
+		}
+		decrypt(t, ctx)
+	})
+
+	t.Run("SSH key", func(t *testing.T) {
+		if _, err := e.UnlockIdentityFile(sshPath, passphrase("wrong")); err == nil {
+			t.Error("expected error with the wrong SSH passphrase")
+		}
+		ctx, err := e.UnlockIdentityFile(sshPath, passphrase("ssh-passphrase"))
+		if err != nil {
+			t.Fatalf("UnlockIdentityFile() error = %v", err)
+		}
+		decrypt(t, ctx)
+	})
+
+	t.Run("passphrase-protected key file", func(t *testing.T) {
+		ctx, err := e.UnlockIdentityFile(e.privateKeyPath, passphrase("passphrase"))
+		if err != nil {
+			t.Fatalf("UnlockIdentityFile() error = %v", err)
+		}
+		decrypt(t, ctx)
+	})
+
+	t.Run("unknown identity", func(t *testing.T) {
+		other, _ := age.GenerateX25519Identity()
+		path := filepath.Join(t.TempDir(), "other.txt")
+		if err := os.WriteFile(path, []byte(other.String()+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		ctx, err := e.UnlockIdentityFile(path, noPassphrase)
+		if err != nil {
+			t.Fatalf("UnlockIdentityFile() error = %v", err)
+		}
+		if err := ctx.Decrypt(bytes.NewReader(encrypted.Bytes()), io.Discard); err == nil {
+			t.Error("expected error decrypting with an identity that is not a recipient")
+		}
+	})
+}
+
+func TestAgeEncryptor_InvalidRecipient(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	e := NewAgeEncryptor(config.EncryptionConfig{
+		PublicKeyPath:  filepath.Join(dir, "bt.pub"),
+		PrivateKeyPath: filepath.Join(dir, "bt.key"),
+		Recipients:     []string{"not-a-key"},
+	})
+	if err := e.Setup("passphrase"); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	if err := e.Encrypt(strings.NewReader("data"), io.Discard); err == nil {
+		t.Error("expected error encrypting to an invalid recipient")
+	}
+}
+
+func TestAgeEncryptor_PostQuantum(t *testing.T) {
+	t.Parallel()
+
+	// roundTrip encrypts data with e and decrypts it with ctx.
+	roundTrip := func(t *testing.T, e *AgeEncryptor, ctx bt.DecryptionContext) {
+		t.Helper()
+		var encrypted, plaintext bytes.Buffer
+		if err := e.Encrypt(strings.NewReader("data"), &encrypted); err != nil {
+			t.Fatalf("Encrypt() error = %v", err)
+		}
+		if err := ctx.Decrypt(&encrypted, &plaintext); err != nil {
+			t.Fatalf("Decrypt() error = %v", err)
+		}
+		if plaintext.String() != "data" {
+			t.Errorf("Decrypt() = %q, want %q", plaintext.String(), "data")
+		}
+	}
+	publicKey := func(t *testing.T, e *AgeEncryptor) string {
+		t.Helper()
+		data, err := os.ReadFile(e.publicKeyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	t.Run("setup generates a hybrid key pair", func(t *testing.T) {
+		t.Parallel()
+		e := newTestAgeEncryptor(t)
+		e.postQuantum = true
+		if err := e.Setup("passphrase"); err != nil {
+			t.Fatalf("Setup() error = %v", err)
+		}
+		if got := publicKey(t, e); !strings.HasPrefix(got, "age1pq1") {
+			t.Errorf("public key = %q, want a hybrid key", got)
+		}
+		ctx, err := e.Unlock("passphrase")
+		if err != nil {
+			t.Fatalf("Unlock() error = %v", err)
+		}
+		roundTrip(t, e, ctx)
+	})
+
+	t.Run("rotation migrates to a hybrid key pair and keeps it", func(t *testing.T) {
+		t.Parallel()
+		e := newTestAgeEncryptor(t)
+		if err := e.Setup("passphrase"); err != nil {
+			t.Fatalf("Setup() error = %v", err)
+		}
+		var old bytes.Buffer
+		if err := e.Encrypt(strings.NewReader("old"), &old); err != nil {
+			t.Fatalf("Encrypt() error = %v", err)
+		}
+
+		e.postQuantum = true
+		previous, err := e.BeginRotation("passphrase")
+		if err != nil {
+			t.Fatalf("BeginRotation() error = %v", err)
+		}
+		if err := previous.Decrypt(&old, io.Discard); err != nil {
+			t.Errorf("previous key should decrypt old content: %v", err)
+		}
+		if err := e.FinishRotation(); err != nil {
+			t.Fatalf("FinishRotation() error = %v", err)
+		}
+		if !e.isPostQuantum() {
+			t.Fatal("key pair should be post-quantum after rotating with postQuantum")
+		}
+
+		// A later rotation without the setting does not downgrade.
+		e.postQuantum = false
+		if _, err := e.BeginRotation("passphrase"); err != nil {
+			t.Fatalf("second BeginRotation() error = %v", err)
+		}
+		if err := e.FinishRotation(); err != nil {
+			t.Fatalf("FinishRotation() error = %v", err)
+		}
+		if !e.isPostQuantum() {
+			t.Error("rotation should keep a post-quantum key pair")
+		}
+		ctx, err := e.Unlock("passphrase")
+		if err != nil {
+			t.Fatalf("Unlock() error = %v", err)
+		}
+		roundTrip(t, e, ctx)
+	})
+
+	t.Run("additional recipients must match", func(t *testing.T) {
+		t.Parallel()
+		recovery, _ := age.GenerateHybridIdentity()
+		classic, _ := age.GenerateX25519Identity()
+
+		e := newTestAgeEncryptor(t)
+		e.postQuantum = true
+		if err := e.Setup("passphrase"); err != nil {
+			t.Fatalf("Setup() error = %v", err)
+		}
+		e.recipients = []string{classic.Recipient().String()}
+		if err := e.Encrypt(strings.NewReader("data"), io.Discard); err == nil {
+			t.Error("expected error mixing a classic recipient with a hybrid key pair")
+		}
+
+		e.recipients = []string{recovery.Recipient().String()}
+		path := filepath.Join(t.TempDir(), "recovery.txt")
+		if err := os.WriteFile(path, []byte(recovery.String()+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		ctx, err := e.UnlockIdentityFile(path, nil)
+		if err != nil {
+			t.Fatalf("UnlockIdentityFile() error = %v", err)
+		}
+		roundTrip(t, e, ctx)
+	})
+}
+
+func TestAgeEncryptor_ImportIdentity(t *testing.T) {
+	t.Parallel()
+
+	x25519, _ := age.GenerateX25519Identity()
+	hybrid, _ := age.GenerateHybridIdentity()
+	_, sshPriv, _ := ed25519.GenerateKey(nil)
+	plainSSH, _ := ssh.MarshalPrivateKey(sshPriv, "")
+	protectedSSH, _ := ssh.MarshalPrivateKeyWithPassphrase(sshPriv, "", []byte("file-passphrase"))
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	protectedAge := filepath.Join(dir, "protected.age")
+	if err := writePrivateKey(protectedAge, []byte(x25519.String()+"\n"), "file-passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		publicKey string
+	}{
+		{"x25519", write("x25519.txt", []byte("# comment\n"+x25519.String()+"\n")), x25519.Recipient().String()},
+		{"hybrid", write("hybrid.txt", []byte(hybrid.String()+"\n")), hybrid.Recipient().String()},
+		{"passphrase-protected age", protectedAge, x25519.Recipient().String()},
+		{"ssh", write("id_ed25519", pem.EncodeToMemory(plainSSH)), "ssh-ed25519 "},
+		{"passphrase-protected ssh", write("id_ed25519_protected", pem.EncodeToMemory(protectedSSH)), "ssh-ed25519 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			e := newTestAgeEncryptor(t)
+			filePassphrase := func() (string, error) { return "file-passphrase", nil }
+			if err := e.ImportIdentity(tt.path, filePassphrase, "passphrase"); err != nil {
+				t.Fatalf("ImportIdentity() error = %v", err)
+			}
+			if !e.IsConfigured() {
+				t.Fatal("IsConfigured() = false after ImportIdentity")
+			}
+			pub, _ := os.ReadFile(e.publicKeyPath)
+			if !strings.HasPrefix(string(pub), tt.publicKey) {
+				t.Errorf("public key = %q, want prefix %q", pub, tt.publicKey)
+			}
+
+			var encrypted bytes.Buffer
+			if err := e.Encrypt(strings.NewReader("secret"), &encrypted); err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+			if _, err := e.Unlock("file-passphrase"); err == nil {
+				t.Error("Unlock() with the identity file's passphrase should fail")
+			}
+			ctx, err := e.Unlock("passphrase")
+			if err != nil {
+				t.Fatalf("Unlock() error = %v", err)
+			}
+			var plaintext bytes.Buffer
+			if err := ctx.Decrypt(&encrypted, &plaintext); err != nil || plaintext.String() != "secret" {
+				t.Errorf("Decrypt() = %q, %v; want %q", plaintext.String(), err, "secret")
+			}
+		})
+	}
+
+	t.Run("shared between hosts", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(dir, "x25519.txt")
+		a, b := newTestAgeEncryptor(t), newTestAgeEncryptor(t)
+		for _, e := range []*AgeEncryptor{a, b} {
+			if err := e.ImportIdentity(path, nil, "passphrase"); err != nil {
+				t.Fatalf("ImportIdentity() error = %v", err)
+			}
+		}
+		var encrypted bytes.Buffer
+		if err := a.Encrypt(strings.NewReader("secret"), &encrypted); err != nil {
+			t.Fatal(err)
+		}
+		ctx, err := b.Unlock("passphrase")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.Decrypt(&encrypted, io.Discard); err != nil {
+			t.Errorf("Decrypt() on another host error = %v", err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		e := newTestAgeEncryptor(t)
+		if err := e.ImportIdentity(write("garbage.txt", []byte("not a key\n")), nil, "passphrase"); err == nil {
+			t.Error("expected error importing an invalid identity")
+		}
+		if e.IsConfigured() {
+			t.Error("a failed import should write no keys")
+		}
+
+		e.recipients = []string{hybrid.Recipient().String()}
+		if err := e.ImportIdentity(filepath.Join(dir, "x25519.txt"), nil, "passphrase"); err == nil {
+			t.Error("expected error mixing a post-quantum recipient with a classic identity")
+		}
+		if e.IsConfigured() {
+			t.Error("a failed import should write no keys")
+		}
+	})
+}
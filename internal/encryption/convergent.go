@@ -0,0 +1,243 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"bt-go/internal/config"
+)
+
+// Convergent encryption stores identical plaintexts as identical ciphertext,
+// so content backed up by several hosts sharing a vault, and a convergence
+// secret, is stored once.
+//
+// Each content is encrypted with its own key, derived from the secret and the
+// plaintext checksum. The file starts with convergentMagic, then that key
+// wrapped with a key also derived from the secret; the wrapping nonce is
+// derived from the content key, so the header is deterministic too. The
+// payload follows age's STREAM construction: 64 KiB chunks sealed with
+// ChaCha20-Poly1305 under the content key, with a nonce made of a chunk
+// counter and a flag marking the last chunk. A content key is only ever used
+// for one plaintext, so counter nonces never repeat.
+//
+// Decrypting needs only the secret: the ciphertext carries the wrapped key,
+// and the checksum is not needed.
+const (
+	convergentMagic     = "bt-convergent/v1\n"
+	convergentChunkSize = 64 * 1024
+	convergentKeySize   = chacha20poly1305.KeySize
+	convergentNonceSize = chacha20poly1305.NonceSize
+	convergentHeaderLen = len(convergentMagic) + convergentNonceSize + convergentKeySize + chacha20poly1305.Overhead
+)
+
+// ConvergenceSecretPath returns where the convergence secret is kept:
+// cfg.ConvergenceSecretPath, or bt.secret beside the private key.
+func ConvergenceSecretPath(cfg config.EncryptionConfig) string {
+	if cfg.ConvergenceSecretPath != "" {
+		return cfg.ConvergenceSecretPath
+	}
+	return filepath.Join(filepath.Dir(cfg.PrivateKeyPath), "bt.secret")
+}
+
+// NewConvergenceSecret generates a random convergence secret and writes it to
+// path, readable only by its owner. It refuses to replace an existing secret,
+// since content encrypted with it could no longer be decrypted.
+func NewConvergenceSecret(path string) error {
+	secret := make([]byte, convergentKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("generating convergence secret: %w", err)
+	}
+	return writeConvergenceSecret(path, secret)
+}
+
+// InstallConvergenceSecret writes the convergence secret encoded in data, as
+// read from a secret file, to path. Like NewConvergenceSecret, it refuses to
+// replace a secret.
+func InstallConvergenceSecret(path string, data []byte) error {
+	secret, err := parseConvergenceSecret(data)
+	if err != nil {
+		return err
+	}
+	return writeConvergenceSecret(path, secret)
+}
+
+func writeConvergenceSecret(path string, secret []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating convergence secret directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("creating convergence secret: %w", err)
+	}
+	if _, err := f.WriteString(hex.EncodeToString(secret) + "\n"); err != nil {
+		f.Close()
+		return fmt.Errorf("writing convergence secret: %w", err)
+	}
+	return f.Close()
+}
+
+// loadConvergenceSecret reads the secret at path, returning nil if there is
+// none.
+func loadConvergenceSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading convergence secret: %w", err)
+	}
+	secret, err := parseConvergenceSecret(data)
+	if err != nil {
+		return nil, fmt.Errorf("convergence secret %s: %w", path, err)
+	}
+	return secret, nil
+}
+
+// parseConvergenceSecret decodes a secret file: the hex-encoded secret.
+func parseConvergenceSecret(data []byte) ([]byte, error) {
+	secret, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(secret) != convergentKeySize {
+		return nil, fmt.Errorf("convergence secret is malformed")
+	}
+	return secret, nil
+}
+
+// deriveKey returns HMAC-SHA256(key, label || data).
+func deriveKey(key []byte, label string, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// wrapKey returns the key that wraps content keys under secret.
+func wrapKey(secret []byte) []byte {
+	return deriveKey(secret, "bt-convergent/v1 wrap key", nil)
+}
+
+// convergentEncrypt encrypts plaintext from r, whose checksum is checksum, to
+// w under secret. The output depends only on the three.
+func convergentEncrypt(secret []byte, checksum string, r io.Reader, w io.Writer) error {
+	contentKey := deriveKey(secret, "bt-convergent/v1 content key", []byte(checksum))
+
+	wrapper, err := chacha20poly1305.New(wrapKey(secret))
+	if err != nil {
+		return err
+	}
+	nonce := deriveKey(wrapKey(secret), "bt-convergent/v1 wrap nonce", contentKey)[:convergentNonceSize]
+	header := append([]byte(convergentMagic), nonce...)
+	header = wrapper.Seal(header, nonce, contentKey, []byte(convergentMagic))
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+
+	aead, err := chacha20poly1305.New(contentKey)
+	if err != nil {
+		return err
+	}
+	// Read one byte past each chunk to know whether it is the last one.
+	br := bufio.NewReaderSize(r, convergentChunkSize+1)
+	chunk := make([]byte, convergentChunkSize)
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(br, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("reading plaintext: %w", err)
+		}
+		_, peekErr := br.Peek(1)
+		last := peekErr != nil
+		if peekErr != nil && peekErr != io.EOF {
+			return fmt.Errorf("reading plaintext: %w", peekErr)
+		}
+		if _, err := w.Write(aead.Seal(nil, streamNonce(counter, last), chunk[:n], nil)); err != nil {
+			return fmt.Errorf("writing ciphertext: %w", err)
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// convergentDecrypt decrypts a convergent file from r, whose magic has
+// already been consumed, to w under secret.
+func convergentDecrypt(secret []byte, r io.Reader, w io.Writer) error {
+	rest := make([]byte, convergentHeaderLen-len(convergentMagic))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	wrapper, err := chacha20poly1305.New(wrapKey(secret))
+	if err != nil {
+		return err
+	}
+	nonce, wrapped := rest[:convergentNonceSize], rest[convergentNonceSize:]
+	contentKey, err := wrapper.Open(nil, nonce, wrapped, []byte(convergentMagic))
+	if err != nil {
+		return errors.New("content was encrypted with a different convergence secret")
+	}
+
+	aead, err := chacha20poly1305.New(contentKey)
+	if err != nil {
+		return err
+	}
+	return openStream(aead, bufio.NewReaderSize(r, convergentChunkSize+chacha20poly1305.Overhead+1), w)
+}
+
+// openStream decrypts STREAM chunks from br to w.
+func openStream(aead cipher.AEAD, br *bufio.Reader, w io.Writer) error {
+	chunk := make([]byte, convergentChunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(br, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return errors.New("ciphertext is truncated")
+			}
+			return fmt.Errorf("reading ciphertext: %w", err)
+		}
+		_, peekErr := br.Peek(1)
+		last := peekErr != nil
+		if peekErr != nil && peekErr != io.EOF {
+			return fmt.Errorf("reading ciphertext: %w", peekErr)
+		}
+		plaintext, err := aead.Open(chunk[:0], streamNonce(counter, last), chunk[:n], nil)
+		if err != nil {
+			return errors.New("ciphertext is corrupt or truncated")
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return fmt.Errorf("writing plaintext: %w", err)
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// streamNonce returns the nonce for chunk counter: the counter as 11
+// big-endian bytes, then 1 for the last chunk and 0 otherwise.
+func streamNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, convergentNonceSize)
+	for i := 10; i >= 3 && counter > 0; i-- {
+		nonce[i] = byte(counter)
+		counter >>= 8
+	}
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// isConvergent reports whether header starts a convergent file.
+func isConvergent(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(convergentMagic))
+}
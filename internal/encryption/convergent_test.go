@@ -0,0 +1,141 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bt-go/internal/config"
+)
+
+// newConvergentEncryptor returns a set-up convergent AgeEncryptor with its own
+// key pair, using the convergence secret at secretPath.
+func newConvergentEncryptor(t *testing.T, secretPath string) *AgeEncryptor {
+	t.Helper()
+	dir := t.TempDir()
+	e := NewAgeEncryptor(config.EncryptionConfig{
+		PublicKeyPath:         filepath.Join(dir, "keys", "bt.pub"),
+		PrivateKeyPath:        filepath.Join(dir, "keys", "bt.key"),
+		Convergent:            true,
+		ConvergenceSecretPath: secretPath,
+	})
+	if err := e.Setup("passphrase"); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	return e
+}
+
+func encryptContent(t *testing.T, e *AgeEncryptor, plaintext []byte) []byte {
+	t.Helper()
+	sum := sha256.Sum256(plaintext)
+	var buf bytes.Buffer
+	if err := e.EncryptContent(hex.EncodeToString(sum[:]), bytes.NewReader(plaintext), &buf); err != nil {
+		t.Fatalf("EncryptContent() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestAgeEncryptor_Convergent(t *testing.T) {
+	t.Parallel()
+	secretPath := filepath.Join(t.TempDir(), "bt.secret")
+	a := newConvergentEncryptor(t, secretPath)
+	b := newConvergentEncryptor(t, secretPath) // another host with the secret copied over
+
+	ctx, err := b.Unlock("passphrase")
+	if err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+
+	for _, size := range []int{0, 1, convergentChunkSize, convergentChunkSize + 1, 3 * convergentChunkSize} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext := encryptContent(t, a, plaintext)
+		if !bytes.Equal(ciphertext, encryptContent(t, b, plaintext)) {
+			t.Errorf("size %d: ciphertext differs between encryptors sharing a secret", size)
+		}
+		if size > 1 && bytes.Contains(ciphertext, plaintext) {
+			t.Errorf("size %d: ciphertext contains the plaintext", size)
+		}
+
+		var out bytes.Buffer
+		if err := ctx.Decrypt(bytes.NewReader(ciphertext), &out); err != nil {
+			t.Fatalf("size %d: Decrypt() error = %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plaintext) {
+			t.Errorf("size %d: Decrypt() returned different plaintext", size)
+		}
+	}
+
+	// Age-encrypted content still decrypts with the same context.
+	var aged bytes.Buffer
+	if err := b.Encrypt(strings.NewReader("metadata"), &aged); err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	var out bytes.Buffer
+	if err := ctx.Decrypt(&aged, &out); err != nil || out.String() != "metadata" {
+		t.Errorf("Decrypt() of age content = %q, %v", out.String(), err)
+	}
+}
+
+func TestAgeEncryptor_ConvergentWrongSecret(t *testing.T) {
+	t.Parallel()
+	a := newConvergentEncryptor(t, filepath.Join(t.TempDir(), "bt.secret"))
+	b := newConvergentEncryptor(t, filepath.Join(t.TempDir(), "bt.secret"))
+
+	plaintext := []byte("hello")
+	if bytes.Equal(encryptContent(t, a, plaintext), encryptContent(t, b, plaintext)) {
+		t.Error("ciphertext should differ between secrets")
+	}
+
+	ctx, err := b.Unlock("passphrase")
+	if err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+	var out bytes.Buffer
+	err = ctx.Decrypt(bytes.NewReader(encryptContent(t, a, plaintext)), &out)
+	if err == nil || !strings.Contains(err.Error(), "different convergence secret") {
+		t.Errorf("Decrypt() error = %v, want different convergence secret", err)
+	}
+}
+
+func TestAgeEncryptor_ConvergentTruncated(t *testing.T) {
+	t.Parallel()
+	e := newConvergentEncryptor(t, filepath.Join(t.TempDir(), "bt.secret"))
+	ctx, err := e.Unlock("passphrase")
+	if err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+
+	plaintext := make([]byte, 2*convergentChunkSize)
+	ciphertext := encryptContent(t, e, plaintext)
+
+	// Dropping the last chunk leaves a full chunk that is not marked last.
+	chunkLen := convergentChunkSize + 16
+	for _, n := range []int{len(ciphertext) - 1, convergentHeaderLen + chunkLen, convergentHeaderLen} {
+		var out bytes.Buffer
+		if err := ctx.Decrypt(bytes.NewReader(ciphertext[:n]), &out); err == nil {
+			t.Errorf("Decrypt() of %d of %d bytes succeeded, want error", n, len(ciphertext))
+		}
+	}
+}
+
+func TestAgeEncryptor_ConvergentMissingSecret(t *testing.T) {
+	t.Parallel()
+	secretPath := filepath.Join(t.TempDir(), "bt.secret")
+	e := newConvergentEncryptor(t, secretPath)
+	if err := NewConvergenceSecret(secretPath); err == nil {
+		t.Error("NewConvergenceSecret() should refuse to replace an existing secret")
+	}
+
+	e.secretPath = filepath.Join(t.TempDir(), "missing")
+	var buf bytes.Buffer
+	err := e.EncryptContent("checksum", strings.NewReader("data"), &buf)
+	if err == nil || !strings.Contains(err.Error(), "bt keys secret") {
+		t.Errorf("EncryptContent() error = %v, want hint to run bt keys secret", err)
+	}
+}
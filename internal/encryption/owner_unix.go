@@ -0,0 +1,23 @@
+//go:build unix
+
+package encryption
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// checkOwner returns an error unless the file described by info is owned by
+// the current user, as ssh requires of private keys.
+func checkOwner(path string, info fs.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("cannot determine the owner of %s", path)
+	}
+	if uid := int(stat.Uid); uid != os.Getuid() {
+		return fmt.Errorf("%s is owned by user %d, not the current user", path, uid)
+	}
+	return nil
+}
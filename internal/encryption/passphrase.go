@@ -0,0 +1,155 @@
+package encryption
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"bt-go/internal/config"
+)
+
+// Passphrase source kinds.
+const (
+	PassphraseEnv     = "env"
+	PassphraseFD      = "fd"
+	PassphraseFile    = "file"
+	PassphraseCommand = "command"
+)
+
+// PassphraseSource reads the key passphrase without prompting, so commands
+// can be scripted.
+type PassphraseSource struct {
+	// Kind is PassphraseEnv, PassphraseFD, PassphraseFile or
+	// PassphraseCommand.
+	Kind string
+
+	// Value is the environment variable name, file descriptor number, file
+	// path or shell command, depending on Kind.
+	Value string
+}
+
+// PassphraseSourceFromConfig returns the passphrase source set in cfg, or nil
+// if the passphrase should be prompted for. At most one source may be set.
+func PassphraseSourceFromConfig(cfg config.EncryptionConfig) (*PassphraseSource, error) {
+	var sources []*PassphraseSource
+	for _, s := range []PassphraseSource{
+		{Kind: PassphraseEnv, Value: cfg.PassphraseEnv},
+		{Kind: PassphraseFile, Value: cfg.PassphraseFile},
+		{Kind: PassphraseCommand, Value: cfg.PassphraseCommand},
+	} {
+		if s.Value != "" {
+			sources = append(sources, &s)
+		}
+	}
+	if len(sources) > 1 {
+		return nil, fmt.Errorf("only one of passphrase_env, passphrase_file and passphrase_command may be set")
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	return sources[0], nil
+}
+
+// Read returns the passphrase. A single trailing newline is removed, as
+// written by echo or most password managers; other whitespace is kept.
+func (s *PassphraseSource) Read() (string, error) {
+	var (
+		data []byte
+		err  error
+	)
+	switch s.Kind {
+	case PassphraseEnv:
+		v, ok := os.LookupEnv(s.Value)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", s.Value)
+		}
+		data = []byte(v)
+	case PassphraseFD:
+		data, err = readPassphraseFD(s.Value)
+	case PassphraseFile:
+		data, err = readPassphraseFile(s.Value)
+	case PassphraseCommand:
+		data, err = runPassphraseCommand(s.Value)
+	default:
+		return "", fmt.Errorf("unknown passphrase source %q", s.Kind)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	passphrase := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase from %s %s is empty", s.Kind, s.Value)
+	}
+	return passphrase, nil
+}
+
+// readPassphraseFD reads the passphrase from an inherited file descriptor
+// until EOF.
+func readPassphraseFD(value string) ([]byte, error) {
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("invalid passphrase file descriptor %q", value)
+	}
+	f := os.NewFile(uintptr(fd), "passphrase-fd-"+value)
+	if f == nil {
+		return nil, fmt.Errorf("invalid passphrase file descriptor %d", fd)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading passphrase from file descriptor %d: %w", fd, err)
+	}
+	return data, nil
+}
+
+// readPassphraseFile reads the passphrase from a regular file owned by the
+// current user that neither its group nor others can access, like ssh does
+// for private keys.
+func readPassphraseFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening passphrase file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat passphrase file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("passphrase file %s is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return nil, fmt.Errorf("passphrase file %s is accessible by others (mode %04o); run chmod 600 on it", path, perm)
+	}
+	if err := checkOwner(path, info); err != nil {
+		return nil, fmt.Errorf("passphrase file: %w", err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading passphrase file: %w", err)
+	}
+	return data, nil
+}
+
+// runPassphraseCommand runs command with sh and returns its standard output.
+// Standard input and error are passed through, so the command can prompt,
+// e.g. for a GPG PIN.
+func runPassphraseCommand(command string) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running passphrase command %q: %w", command, err)
+	}
+	return stdout.Bytes(), nil
+}
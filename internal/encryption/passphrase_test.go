@@ -0,0 +1,105 @@
+package encryption
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"bt-go/internal/config"
+)
+
+func TestPassphraseSource_Read(t *testing.T) {
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("BT_TEST_PASSPHRASE", "from env")
+		got, err := (&PassphraseSource{Kind: PassphraseEnv, Value: "BT_TEST_PASSPHRASE"}).Read()
+		if err != nil || got != "from env" {
+			t.Errorf("Read() = %q, %v; want %q", got, err, "from env")
+		}
+		if _, err := (&PassphraseSource{Kind: PassphraseEnv, Value: "BT_TEST_UNSET"}).Read(); err == nil {
+			t.Error("expected error for unset variable")
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "passphrase")
+		if err := os.WriteFile(path, []byte("from file \n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		source := &PassphraseSource{Kind: PassphraseFile, Value: path}
+		if got, err := source.Read(); err != nil || got != "from file " {
+			t.Errorf("Read() = %q, %v; want %q", got, err, "from file ")
+		}
+
+		if err := os.Chmod(path, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.Read(); err == nil {
+			t.Error("expected error for a file readable by its group")
+		}
+
+		if os.Getuid() != 0 {
+			return // only root can give the file away
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chown(path, 12345, -1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.Read(); err == nil {
+			t.Error("expected error for a file owned by another user")
+		}
+	})
+
+	t.Run("fd", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		w.WriteString("from fd\r\n")
+		w.Close()
+		// Read closes the descriptor it is given, so hand it a duplicate.
+		fd, err := syscall.Dup(int(r.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := (&PassphraseSource{Kind: PassphraseFD, Value: strconv.Itoa(fd)}).Read()
+		if err != nil || got != "from fd" {
+			t.Errorf("Read() = %q, %v; want %q", got, err, "from fd")
+		}
+	})
+
+	t.Run("command", func(t *testing.T) {
+		got, err := (&PassphraseSource{Kind: PassphraseCommand, Value: "echo from command"}).Read()
+		if err != nil || got != "from command" {
+			t.Errorf("Read() = %q, %v; want %q", got, err, "from command")
+		}
+		if _, err := (&PassphraseSource{Kind: PassphraseCommand, Value: "exit 1"}).Read(); err == nil {
+			t.Error("expected error for a failing command")
+		}
+		if _, err := (&PassphraseSource{Kind: PassphraseCommand, Value: "true"}).Read(); err == nil {
+			t.Error("expected error for an empty passphrase")
+		}
+	})
+}
+
+func TestPassphraseSourceFromConfig(t *testing.T) {
+	t.Parallel()
+
+	source, err := PassphraseSourceFromConfig(config.EncryptionConfig{})
+	if err != nil || source != nil {
+		t.Errorf("PassphraseSourceFromConfig(empty) = %+v, %v; want nil", source, err)
+	}
+
+	source, err = PassphraseSourceFromConfig(config.EncryptionConfig{PassphraseCommand: "pass show bt"})
+	if err != nil || source == nil || source.Kind != PassphraseCommand || source.Value != "pass show bt" {
+		t.Errorf("PassphraseSourceFromConfig(command) = %+v, %v", source, err)
+	}
+
+	if _, err := PassphraseSourceFromConfig(config.EncryptionConfig{PassphraseEnv: "X", PassphraseFile: "/f"}); err == nil {
+		t.Error("expected error with two sources set")
+	}
+}
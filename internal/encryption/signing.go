@@ -0,0 +1,90 @@
+package encryption
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bt-go/internal/config"
+)
+
+// SigningKeyPath returns where the host's signing key is kept:
+// cfg.SigningKeyPath, or bt.sign beside the private key.
+func SigningKeyPath(cfg config.EncryptionConfig) string {
+	if cfg.SigningKeyPath != "" {
+		return cfg.SigningKeyPath
+	}
+	return filepath.Join(filepath.Dir(cfg.PrivateKeyPath), "bt.sign")
+}
+
+// NewSigningKey generates an Ed25519 signing key and writes it to path,
+// readable only by its owner. It refuses to replace an existing key, since
+// hosts that pinned it would reject metadata signed with another.
+func NewSigningKey(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating signing key: %w", err)
+	}
+	if err := writeSigningKey(path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// InstallSigningKey writes the signing key encoded in data, as read from a
+// key file, to path. Like NewSigningKey, it refuses to replace a key.
+func InstallSigningKey(path string, data []byte) (ed25519.PrivateKey, error) {
+	key, err := parseSigningKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSigningKey(path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadSigningKey reads the signing key at path, returning nil if there is
+// none.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+	key, err := parseSigningKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("signing key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// parseSigningKey decodes a key file: the hex-encoded Ed25519 seed.
+func parseSigningKey(data []byte) (ed25519.PrivateKey, error) {
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key is malformed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func writeSigningKey(path string, key ed25519.PrivateKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating signing key directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("creating signing key: %w", err)
+	}
+	if _, err := f.WriteString(hex.EncodeToString(key.Seed()) + "\n"); err != nil {
+		f.Close()
+		return fmt.Errorf("writing signing key: %w", err)
+	}
+	return f.Close()
+}
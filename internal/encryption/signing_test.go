@@ -0,0 +1,50 @@
+package encryption
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bt-go/internal/config"
+)
+
+func TestSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	path := SigningKeyPath(config.EncryptionConfig{PrivateKeyPath: filepath.Join(dir, "bt.key")})
+	if path != filepath.Join(dir, "bt.sign") {
+		t.Fatalf("SigningKeyPath() = %q, want bt.sign beside the private key", path)
+	}
+
+	if key, err := LoadSigningKey(path); err != nil || key != nil {
+		t.Fatalf("LoadSigningKey() with no key = %v, %v; want nil, nil", key, err)
+	}
+	key, err := NewSigningKey(path)
+	if err != nil {
+		t.Fatalf("NewSigningKey() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("signing key mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+	if _, err := NewSigningKey(path); err == nil {
+		t.Error("NewSigningKey() should refuse to replace a key")
+	}
+
+	loaded, err := LoadSigningKey(path)
+	if err != nil || !bytes.Equal(loaded, key) {
+		t.Fatalf("LoadSigningKey() = %v, %v; want the key written", loaded, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other.sign")
+	installed, err := InstallSigningKey(other, data)
+	if err != nil || !bytes.Equal(installed, key) {
+		t.Fatalf("InstallSigningKey() = %v, %v; want the key", installed, err)
+	}
+	if _, err := InstallSigningKey(filepath.Join(dir, "bad.sign"), []byte("not a key")); err == nil {
+		t.Error("InstallSigningKey() should reject a malformed key")
+	}
+}
@@ -4,20 +4,36 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
 
 	"bt-go/internal/bt"
 )
 
 // testHeader is prepended to data by TestEncryptor to make encrypted output
 // clearly different from plaintext while remaining deterministic and reversible.
+// Its last byte is the key generation, which rotation increments.
 var testHeader = []byte("BTENC\x00\x00\x00")
 
+// headerFor returns testHeader for the given key generation.
+func headerFor(generation byte) []byte {
+	header := bytes.Clone(testHeader)
+	header[len(header)-1] = generation
+	return header
+}
+
+// convergentGeneration is the header generation of content TestEncryptor
+// encrypts in convergent mode, which every TestDecryptionContext decrypts.
+const convergentGeneration = 0xff
+
 // TestEncryptor is a simple, deterministic encryptor for testing.
 // It prepends a fixed 8-byte header during encryption and strips it during
 // decryption. This ensures encrypted output differs from plaintext (so content
 // checksums differ) while being trivially reversible and requiring no crypto.
 type TestEncryptor struct {
 	setupCalled bool
+	generation  byte
+	rotating    bool
+	convergent  bool
 }
 
 var _ bt.Encryptor = (*TestEncryptor)(nil)
@@ -33,7 +49,23 @@ func (e *TestEncryptor) Setup(passphrase string) error {
 }
 
 func (e *TestEncryptor) Encrypt(r io.Reader, w io.Writer) error {
-	if _, err := w.Write(testHeader); err != nil {
+	if _, err := w.Write(headerFor(e.generation)); err != nil {
+		return fmt.Errorf("writing test header: %w", err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("copying data: %w", err)
+	}
+	return nil
+}
+
+// EncryptContent is the same as Encrypt, which is already deterministic,
+// except in convergent mode, where the header is the same for every key
+// generation.
+func (e *TestEncryptor) EncryptContent(checksum string, r io.Reader, w io.Writer) error {
+	if !e.convergent {
+		return e.Encrypt(r, w)
+	}
+	if _, err := w.Write(headerFor(convergentGeneration)); err != nil {
 		return fmt.Errorf("writing test header: %w", err)
 	}
 	if _, err := io.Copy(w, r); err != nil {
@@ -42,16 +74,61 @@ func (e *TestEncryptor) Encrypt(r io.Reader, w io.Writer) error {
 	return nil
 }
 
+// SetConvergent switches convergent mode on or off.
+func (e *TestEncryptor) SetConvergent(convergent bool) {
+	e.convergent = convergent
+}
+
+func (e *TestEncryptor) Convergent() bool {
+	return e.convergent
+}
+
 func (e *TestEncryptor) Unlock(passphrase string) (bt.DecryptionContext, error) {
-	return &TestDecryptionContext{}, nil
+	return &TestDecryptionContext{Generation: e.generation}, nil
+}
+
+// UnlockIdentityFile accepts any readable file as an identity for the current
+// key generation.
+func (e *TestEncryptor) UnlockIdentityFile(path string, passphrase func() (string, error)) (bt.DecryptionContext, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("reading identity file: %w", err)
+	}
+	return &TestDecryptionContext{Generation: e.generation}, nil
 }
 
 func (e *TestEncryptor) IsConfigured() bool {
 	return true
 }
 
-// TestDecryptionContext strips the test header added by TestEncryptor.
-type TestDecryptionContext struct{}
+func (e *TestEncryptor) ChangePassphrase(oldPassphrase string, newPassphrase string) error {
+	return nil
+}
+
+// BeginRotation moves to the next key generation, so content encrypted
+// afterwards has a different header and checksum.
+func (e *TestEncryptor) BeginRotation(passphrase string) (bt.DecryptionContext, error) {
+	if !e.rotating {
+		e.generation++
+		e.rotating = true
+	}
+	return &TestDecryptionContext{Generation: e.generation - 1}, nil
+}
+
+func (e *TestEncryptor) RotationInProgress() bool {
+	return e.rotating
+}
+
+func (e *TestEncryptor) FinishRotation() error {
+	e.rotating = false
+	return nil
+}
+
+// TestDecryptionContext strips the test header added by TestEncryptor,
+// rejecting data encrypted under a different key generation unless it was
+// encrypted in convergent mode.
+type TestDecryptionContext struct {
+	Generation byte
+}
 
 var _ bt.DecryptionContext = (*TestDecryptionContext)(nil)
 
@@ -60,7 +137,7 @@ func (c *TestDecryptionContext) Decrypt(r io.Reader, w io.Writer) error {
 	if _, err := io.ReadFull(r, header); err != nil {
 		return fmt.Errorf("reading test header: %w", err)
 	}
-	if !bytes.Equal(header, testHeader) {
+	if !bytes.Equal(header, headerFor(c.Generation)) && !bytes.Equal(header, headerFor(convergentGeneration)) {
 		return fmt.Errorf("invalid test encryption header")
 	}
 	if _, err := io.Copy(w, r); err != nil {
@@ -0,0 +1,189 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"bt-go/internal/config"
+)
+
+// cacheDirTagSignature is the required start of a CACHEDIR.TAG file, per the
+// Cache Directory Tagging Specification.
+const cacheDirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// exclusionRules are the content-aware exclusions in effect for one tracked
+// directory.
+type exclusionRules struct {
+	excludeCaches    bool
+	excludeIfPresent []string
+	maxFileSize      int64
+	oneFileSystem    bool
+}
+
+// newExclusionRules returns the global exclusion rules from cfg.
+func newExclusionRules(cfg config.FilesystemConfig) exclusionRules {
+	return exclusionRules{
+		excludeCaches:    cfg.ExcludeCaches,
+		excludeIfPresent: cfg.ExcludeIfPresent,
+		maxFileSize:      cfg.MaxFileSize,
+		oneFileSystem:    cfg.OneFileSystem,
+	}
+}
+
+// rulesFor returns the exclusion rules for the tracked directory dirRoot:
+// the global rules with that directory's overrides applied.
+func (m *OSFilesystemManager) rulesFor(dirRoot string) exclusionRules {
+	rules := m.rules
+	for _, d := range m.directories {
+		if filepath.Clean(d.Path) != filepath.Clean(dirRoot) {
+			continue
+		}
+		if d.ExcludeCaches != nil {
+			rules.excludeCaches = *d.ExcludeCaches
+		}
+		if len(d.ExcludeIfPresent) > 0 {
+			rules.excludeIfPresent = append(slices.Clip(rules.excludeIfPresent), d.ExcludeIfPresent...)
+		}
+		if d.MaxFileSize != nil {
+			rules.maxFileSize = *d.MaxFileSize
+		}
+		if d.OneFileSystem != nil {
+			rules.oneFileSystem = *d.OneFileSystem
+		}
+	}
+	return rules
+}
+
+// exclusionState decides what to exclude while descending from a tracked
+// directory root. Ignore files are added to matcher as each directory is
+// entered, so directories must be entered parent before child.
+type exclusionState struct {
+	m       *OSFilesystemManager
+	matcher *IgnoreMatcher
+	rules   exclusionRules
+	rootDev uint64
+}
+
+// newExclusionState prepares to walk the tracked directory dirRoot. The root
+// itself must still be entered with enterDir.
+func (m *OSFilesystemManager) newExclusionState(dirRoot string) (*exclusionState, error) {
+	st := &exclusionState{
+		m:       m,
+		matcher: m.baseMatcher.clone(),
+		rules:   m.rulesFor(dirRoot),
+	}
+	if st.rules.oneFileSystem {
+		dev, err := statDeviceID(dirRoot)
+		if err != nil {
+			return nil, err
+		}
+		st.rootDev = dev
+	}
+	return st, nil
+}
+
+// enterDir reports why the directory at absDir (slashRel relative to the
+// tracked root, "" for the root itself) is excluded, or "" if it is not, in
+// which case its ignore files are loaded for the entries beneath it.
+func (st *exclusionState) enterDir(absDir, slashRel string) (string, error) {
+	if slashRel != "" {
+		if p := st.matcher.ignoredBy(slashRel, true); p != nil {
+			return fmt.Sprintf("matches ignore pattern %q", p.pattern), nil
+		}
+	}
+
+	if st.rules.oneFileSystem {
+		dev, err := statDeviceID(absDir)
+		if err != nil {
+			return "", err
+		}
+		if dev != st.rootDev {
+			return "on a different filesystem", nil
+		}
+	}
+
+	if st.rules.excludeCaches {
+		tagged, err := hasCacheDirTag(absDir)
+		if err != nil {
+			return "", err
+		}
+		if tagged {
+			return "tagged with CACHEDIR.TAG", nil
+		}
+	}
+
+	for _, marker := range st.rules.excludeIfPresent {
+		if _, err := os.Lstat(filepath.Join(absDir, marker)); err == nil {
+			return fmt.Sprintf("contains %s", marker), nil
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("checking for %s: %w", marker, err)
+		}
+	}
+
+	if err := st.m.loadIgnoreFiles(st.matcher, absDir, slashRel); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// enterParents enters the tracked root dirRoot and each directory below it
+// down to and including relDir, so that their ignore files apply. It returns
+// the first of them that is excluded, with the reason, or "" if none is.
+func (st *exclusionState) enterParents(dirRoot, relDir string) (dir string, reason string, err error) {
+	dirs := []string{""}
+	if relDir != "" && relDir != "." {
+		dirs = append(dirs, slices.Collect(parentDirs(filepath.ToSlash(relDir)+"/"))...)
+	}
+	for _, dir := range dirs {
+		reason, err := st.enterDir(filepath.Join(dirRoot, filepath.FromSlash(dir)), dir)
+		if err != nil || reason != "" {
+			return dir, reason, err
+		}
+	}
+	return "", "", nil
+}
+
+// patternReason reports why the file at slashRel is excluded by an ignore
+// pattern, or "" if it is not. Parent directories are not considered.
+func (st *exclusionState) patternReason(slashRel string) string {
+	p := st.m.defaultMatcher.ignoredBy(slashRel, false)
+	if p == nil {
+		p = st.matcher.ignoredBy(slashRel, false)
+	}
+	if p == nil {
+		return ""
+	}
+	return fmt.Sprintf("matches ignore pattern %q", p.pattern)
+}
+
+// sizeReason reports why a file is excluded by its size, or "" if it is not.
+func (st *exclusionState) sizeReason(info fs.FileInfo) string {
+	if st.rules.maxFileSize > 0 && info.Size() > st.rules.maxFileSize {
+		return fmt.Sprintf("larger than max file size of %d bytes", st.rules.maxFileSize)
+	}
+	return ""
+}
+
+// hasCacheDirTag reports whether dir contains a CACHEDIR.TAG file starting
+// with the signature the specification requires.
+func hasCacheDirTag(dir string) (bool, error) {
+	f, err := os.Open(filepath.Join(dir, "CACHEDIR.TAG"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("opening CACHEDIR.TAG: %w", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(cacheDirTagSignature))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		// Too short to hold the signature, so not a valid tag.
+		return false, nil
+	}
+	return string(buf) == cacheDirTagSignature, nil
+}
@@ -0,0 +1,213 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"bt-go/internal/config"
+)
+
+func TestOSFilesystemManager_Exclusions(t *testing.T) {
+	writeFile := func(t *testing.T, path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("writing %s: %v", path, err)
+		}
+	}
+	// walk returns the relative paths WalkFiles yields and a map of the
+	// exclusions Walk reports to their reasons, checking that Walk yields
+	// the same files.
+	walk := func(t *testing.T, m *OSFilesystemManager, root string) ([]string, map[string]string) {
+		t.Helper()
+		dirPath, err := m.Resolve(root)
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		var files []string
+		for p, err := range m.WalkFiles(dirPath, root, true) {
+			if err != nil {
+				t.Fatalf("WalkFiles() error = %v", err)
+			}
+			rel, _ := filepath.Rel(root, p.String())
+			files = append(files, filepath.ToSlash(rel))
+		}
+		var walked []string
+		excluded := make(map[string]string)
+		for e, err := range m.Walk(dirPath, root, true) {
+			if err != nil {
+				t.Fatalf("Walk() error = %v", err)
+			}
+			if e.File != nil {
+				rel, _ := filepath.Rel(root, e.File.String())
+				walked = append(walked, filepath.ToSlash(rel))
+				continue
+			}
+			rel, _ := filepath.Rel(root, e.Exclusion.Path)
+			excluded[filepath.ToSlash(rel)] = e.Exclusion.Reason
+		}
+		if !slices.Equal(walked, files) {
+			t.Errorf("Walk() files = %v, WalkFiles() = %v", walked, files)
+		}
+		return files, excluded
+	}
+
+	t.Run("skips directories with a valid CACHEDIR.TAG", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "keep.txt"), "x")
+		writeFile(t, filepath.Join(root, "cache", "CACHEDIR.TAG"), cacheDirTagSignature+"\n# comment\n")
+		writeFile(t, filepath.Join(root, "cache", "blob"), "x")
+		writeFile(t, filepath.Join(root, "fake", "CACHEDIR.TAG"), "not a signature")
+		writeFile(t, filepath.Join(root, "fake", "data"), "x")
+
+		m := NewOSFilesystemManager(config.FilesystemConfig{ExcludeCaches: true})
+		files, excluded := walk(t, m, root)
+		if want := []string{"fake/CACHEDIR.TAG", "fake/data", "keep.txt"}; !slices.Equal(files, want) {
+			t.Errorf("WalkFiles() = %v, want %v", files, want)
+		}
+		if excluded["cache"] != "tagged with CACHEDIR.TAG" || len(excluded) != 1 {
+			t.Errorf("Walk() exclusions = %v, want only cache tagged", excluded)
+		}
+	})
+
+	t.Run("cache tags ignored unless enabled", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "cache", "CACHEDIR.TAG"), cacheDirTagSignature)
+
+		files, _ := walk(t, NewOSFilesystemManager(config.FilesystemConfig{}), root)
+		if want := []string{"cache/CACHEDIR.TAG"}; !slices.Equal(files, want) {
+			t.Errorf("WalkFiles() = %v, want %v", files, want)
+		}
+	})
+
+	t.Run("skips directories containing a marker file", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "a.txt"), "x")
+		writeFile(t, filepath.Join(root, "scratch", ".nobackup"), "")
+		writeFile(t, filepath.Join(root, "scratch", "b.txt"), "x")
+
+		m := NewOSFilesystemManager(config.FilesystemConfig{ExcludeIfPresent: []string{".nobackup"}})
+		files, excluded := walk(t, m, root)
+		if want := []string{"a.txt"}; !slices.Equal(files, want) {
+			t.Errorf("WalkFiles() = %v, want %v", files, want)
+		}
+		if excluded["scratch"] != "contains .nobackup" {
+			t.Errorf("Walk() exclusions = %v, want scratch containing .nobackup", excluded)
+		}
+	})
+
+	t.Run("skips files above max size", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "small"), "12345")
+		writeFile(t, filepath.Join(root, "big"), "123456")
+
+		m := NewOSFilesystemManager(config.FilesystemConfig{MaxFileSize: 5})
+		files, excluded := walk(t, m, root)
+		if want := []string{"small"}; !slices.Equal(files, want) {
+			t.Errorf("WalkFiles() = %v, want %v", files, want)
+		}
+		if !strings.Contains(excluded["big"], "max file size") {
+			t.Errorf("Walk() exclusions = %v, want big over max file size", excluded)
+		}
+	})
+
+	t.Run("per-directory settings override global ones", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		other := t.TempDir()
+		for _, dir := range []string{root, other} {
+			writeFile(t, filepath.Join(dir, "big"), "123456")
+			writeFile(t, filepath.Join(dir, "tmp", ".nobackup"), "")
+			writeFile(t, filepath.Join(dir, "tmp", "x"), "x")
+			writeFile(t, filepath.Join(dir, "junk", ".skipme"), "")
+		}
+
+		noLimit := int64(0)
+		m := NewOSFilesystemManager(config.FilesystemConfig{
+			MaxFileSize:      5,
+			ExcludeIfPresent: []string{".nobackup"},
+			Directories: []config.DirectoryFilesystemConfig{
+				{Path: root, MaxFileSize: &noLimit, ExcludeIfPresent: []string{".skipme"}},
+			},
+		})
+
+		files, excluded := walk(t, m, root)
+		if want := []string{"big"}; !slices.Equal(files, want) {
+			t.Errorf("overridden: WalkFiles() = %v, want %v", files, want)
+		}
+		if excluded["tmp"] == "" || excluded["junk"] == "" {
+			t.Errorf("overridden: Walk() exclusions = %v, want tmp and junk excluded", excluded)
+		}
+
+		files, _ = walk(t, m, other)
+		if want := []string{"junk/.skipme"}; !slices.Equal(files, want) {
+			t.Errorf("global: WalkFiles() = %v, want %v", files, want)
+		}
+	})
+
+	t.Run("one file system keeps the tracked filesystem", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "sub", "a.txt"), "x")
+
+		// A temp dir never spans filesystems, so nothing is excluded; this
+		// checks the device comparison doesn't misfire.
+		files, excluded := walk(t, NewOSFilesystemManager(config.FilesystemConfig{OneFileSystem: true}), root)
+		if want := []string{"sub/a.txt"}; !slices.Equal(files, want) || len(excluded) != 0 {
+			t.Errorf("WalkFiles() = %v, exclusions %v; want %v and none", files, excluded, want)
+		}
+	})
+
+	t.Run("ExclusionReason explains files in excluded directories", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "build", "CACHEDIR.TAG"), cacheDirTagSignature)
+		writeFile(t, filepath.Join(root, "build", "out", "a.o"), "x")
+
+		m := NewOSFilesystemManager(config.FilesystemConfig{ExcludeCaches: true})
+		p, err := m.Resolve(filepath.Join(root, "build", "out", "a.o"))
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		reason, err := m.ExclusionReason(p, root)
+		if err != nil {
+			t.Fatalf("ExclusionReason() error = %v", err)
+		}
+		if want := "inside excluded directory build (tagged with CACHEDIR.TAG)"; reason != want {
+			t.Errorf("ExclusionReason() = %q, want %q", reason, want)
+		}
+	})
+
+	t.Run("walking a subdirectory applies the tracked root's rules", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, ".btignore"), "/sub/secret.txt\n")
+		writeFile(t, filepath.Join(root, "sub", "secret.txt"), "x")
+		writeFile(t, filepath.Join(root, "sub", "plain.txt"), "x")
+
+		m := NewOSFilesystemManager(config.FilesystemConfig{})
+		subPath, err := m.Resolve(filepath.Join(root, "sub"))
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		var files []string
+		for p, err := range m.WalkFiles(subPath, root, true) {
+			if err != nil {
+				t.Fatalf("WalkFiles() error = %v", err)
+			}
+			files = append(files, filepath.Base(p.String()))
+		}
+		if want := []string{"plain.txt"}; !slices.Equal(files, want) {
+			t.Errorf("WalkFiles() = %v, want %v", files, want)
+		}
+	})
+}
@@ -4,41 +4,55 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"iter"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"bt-go/internal/bt"
+	"bt-go/internal/config"
 )
 
 // OSFilesystemManager is the real filesystem implementation of FilesystemManager.
 // It performs actual filesystem operations using the os package.
 type OSFilesystemManager struct {
-	baseMatcher *IgnoreMatcher // hard-coded + config patterns
+	defaultMatcher *IgnoreMatcher // hard-coded patterns; ignore files cannot negate these
+	baseMatcher    *IgnoreMatcher // config patterns
+	ignoreFiles    []string       // per-directory ignore file names, lowest precedence first
+	rules          exclusionRules // global content-aware exclusions
+	directories    []config.DirectoryFilesystemConfig
 }
 
 // NewOSFilesystemManager creates a new filesystem manager that operates on the real filesystem.
-// configPatterns are ignore patterns from the user's config file.
-func NewOSFilesystemManager(configPatterns []string) *OSFilesystemManager {
-	allBase := append(defaultIgnorePatterns, configPatterns...)
+// cfg.Ignore holds ignore patterns from the user's config file. With
+// cfg.UseGitignore, .gitignore files are honored alongside .btignore files.
+// The remaining settings configure content-aware exclusions, globally and
+// per tracked directory.
+func NewOSFilesystemManager(cfg config.FilesystemConfig) *OSFilesystemManager {
+	ignoreFiles := []string{".btignore"}
+	if cfg.UseGitignore {
+		ignoreFiles = []string{".gitignore", ".btignore"}
+	}
 	return &OSFilesystemManager{
-		baseMatcher: NewIgnoreMatcher(allBase),
+		defaultMatcher: NewIgnoreMatcher(defaultIgnorePatterns),
+		baseMatcher:    NewIgnoreMatcher(cfg.Ignore),
+		ignoreFiles:    ignoreFiles,
+		rules:          newExclusionRules(cfg),
+		directories:    cfg.Directories,
 	}
 }
 
-// combinedMatcher builds an IgnoreMatcher that includes the base patterns
-// plus any .btignore patterns found in the given directory.
-func (m *OSFilesystemManager) combinedMatcher(dirPath string) *IgnoreMatcher {
-	btignorePath := filepath.Join(dirPath, ".btignore")
-	btignorePatterns, err := ParseIgnoreFile(btignorePath)
-	if err != nil || len(btignorePatterns) == 0 {
-		return m.baseMatcher
-	}
-	allPatterns := make([]string, 0, len(defaultIgnorePatterns)+len(btignorePatterns))
-	for _, p := range m.baseMatcher.patterns {
-		allPatterns = append(allPatterns, p.pattern)
+// loadIgnoreFiles adds the patterns from the ignore files in dir to matcher.
+// base is dir relative to the tracked directory root, slash-separated.
+func (m *OSFilesystemManager) loadIgnoreFiles(matcher *IgnoreMatcher, dir, base string) error {
+	for _, name := range m.ignoreFiles {
+		patterns, err := ParseIgnoreFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		matcher.add(base, patterns)
 	}
-	allPatterns = append(allPatterns, btignorePatterns...)
-	return NewIgnoreMatcher(allPatterns)
+	return nil
 }
 
 // Resolve validates a raw path and returns a Path object.
@@ -86,78 +100,141 @@ func (m *OSFilesystemManager) Stat(path *bt.Path) (fs.FileInfo, error) {
 	return os.Stat(path.String())
 }
 
-// FindFiles discovers regular files under the given directory path.
-// Ignored files are excluded based on hard-coded, config, and .btignore patterns.
-func (m *OSFilesystemManager) FindFiles(path *bt.Path, recursive bool) ([]*bt.Path, error) {
+// WalkFiles discovers regular files under the given directory path.
+// Excluded files are left out and excluded directories are not walked.
+func (m *OSFilesystemManager) WalkFiles(path *bt.Path, dirRoot string, recursive bool) iter.Seq2[*bt.Path, error] {
+	return func(yield func(*bt.Path, error) bool) {
+		err := m.walk(path, dirRoot, recursive,
+			func(p *bt.Path) bool { return yield(p, nil) },
+			func(*bt.Exclusion) bool { return true })
+		if err != nil {
+			yield(nil, fmt.Errorf("walking directory: %w", err))
+		}
+	}
+}
+
+// Walk yields the files WalkFiles yields and the files and directories it
+// leaves out.
+func (m *OSFilesystemManager) Walk(path *bt.Path, dirRoot string, recursive bool) iter.Seq2[*bt.WalkEntry, error] {
+	return func(yield func(*bt.WalkEntry, error) bool) {
+		err := m.walk(path, dirRoot, recursive,
+			func(p *bt.Path) bool { return yield(&bt.WalkEntry{File: p}, nil) },
+			func(e *bt.Exclusion) bool { return yield(&bt.WalkEntry{Exclusion: e}, nil) })
+		if err != nil {
+			yield(nil, fmt.Errorf("walking directory: %w", err))
+		}
+	}
+}
+
+// walk descends from path, which lies within the tracked directory dirRoot,
+// calling include for each regular file to back up and exclude for each file
+// or directory left out. Either callback returning false stops the walk.
+func (m *OSFilesystemManager) walk(path *bt.Path, dirRoot string, recursive bool, include func(*bt.Path) bool, exclude func(*bt.Exclusion) bool) error {
 	if !path.IsDir() {
-		return nil, fmt.Errorf("path is not a directory: %s", path.String())
+		return fmt.Errorf("path is not a directory: %s", path.String())
 	}
 
-	matcher := m.combinedMatcher(path.String())
-	dirRoot := path.String()
-	var paths []*bt.Path
+	walkRoot := path.String()
+	relRoot, err := filepath.Rel(dirRoot, walkRoot)
+	if err != nil || relRoot == ".." || strings.HasPrefix(relRoot, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("path %s is not within %s", walkRoot, dirRoot)
+	}
 
-	if recursive {
-		err := filepath.WalkDir(dirRoot, func(p string, d fs.DirEntry, err error) error {
+	st, err := m.newExclusionState(dirRoot)
+	if err != nil {
+		return err
+	}
+	dir, reason, err := st.enterParents(dirRoot, relRoot)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		exclude(&bt.Exclusion{Path: filepath.Join(dirRoot, filepath.FromSlash(dir)), IsDir: true, Reason: reason})
+		return nil
+	}
+
+	return filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == walkRoot {
+			return nil
+		}
+		rel, err := filepath.Rel(dirRoot, p)
+		if err != nil {
+			return fmt.Errorf("computing relative path: %w", err)
+		}
+		slashRel := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if !recursive {
+				return filepath.SkipDir
+			}
+			reason, err := st.enterDir(p, slashRel)
 			if err != nil {
 				return err
 			}
-			if d.IsDir() {
+			if reason == "" {
 				return nil
 			}
-			if !d.Type().IsRegular() {
-				return nil
-			}
-			rel, err := filepath.Rel(dirRoot, p)
-			if err != nil {
-				return fmt.Errorf("computing relative path: %w", err)
-			}
-			if matcher.Match(rel) {
-				return nil
+			if !exclude(&bt.Exclusion{Path: p, IsDir: true, Reason: reason}) {
+				return filepath.SkipAll
 			}
-			info, err := d.Info()
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		reason := st.patternReason(slashRel)
+		var info fs.FileInfo
+		if reason == "" {
+			info, err = d.Info()
 			if err != nil {
 				return fmt.Errorf("stat %s: %w", p, err)
 			}
-			paths = append(paths, bt.NewPath(p, false, info))
-			return nil
-		})
-		if err != nil {
-			return nil, fmt.Errorf("walking directory: %w", err)
+			reason = st.sizeReason(info)
 		}
-	} else {
-		entries, err := os.ReadDir(dirRoot)
-		if err != nil {
-			return nil, fmt.Errorf("reading directory: %w", err)
-		}
-		for _, entry := range entries {
-			if !entry.Type().IsRegular() {
-				continue
-			}
-			if matcher.Match(entry.Name()) {
-				continue
+		if reason != "" {
+			if !exclude(&bt.Exclusion{Path: p, Reason: reason}) {
+				return filepath.SkipAll
 			}
-			info, err := entry.Info()
-			if err != nil {
-				return nil, fmt.Errorf("stat %s: %w", entry.Name(), err)
-			}
-			fullPath := filepath.Join(dirRoot, entry.Name())
-			paths = append(paths, bt.NewPath(fullPath, false, info))
+			return nil
 		}
-	}
-
-	return paths, nil
+		if !include(bt.NewPath(p, false, info)) {
+			return filepath.SkipAll
+		}
+		return nil
+	})
 }
 
-// IsIgnored checks whether a file path should be ignored based on
-// ignore rules (hard-coded patterns, config patterns, and .btignore in dirRoot).
-func (m *OSFilesystemManager) IsIgnored(path *bt.Path, dirRoot string) (bool, error) {
+// ExclusionReason reports why a file within the tracked directory dirRoot is
+// excluded from backups, or "" if it is not.
+func (m *OSFilesystemManager) ExclusionReason(path *bt.Path, dirRoot string) (string, error) {
 	rel, err := filepath.Rel(dirRoot, path.String())
 	if err != nil {
-		return false, fmt.Errorf("computing relative path: %w", err)
+		return "", fmt.Errorf("computing relative path: %w", err)
+	}
+
+	st, err := m.newExclusionState(dirRoot)
+	if err != nil {
+		return "", err
+	}
+	dir, reason, err := st.enterParents(dirRoot, filepath.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+	if reason != "" {
+		if dir == "" {
+			dir = "."
+		}
+		return fmt.Sprintf("inside excluded directory %s (%s)", dir, reason), nil
+	}
+
+	if reason := st.patternReason(filepath.ToSlash(rel)); reason != "" {
+		return reason, nil
 	}
-	matcher := m.combinedMatcher(dirRoot)
-	return matcher.Match(rel), nil
+	return st.sizeReason(path.Info()), nil
 }
 
 // Compile-time check that OSFilesystemManager implements bt.FilesystemManager interface
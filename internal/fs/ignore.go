@@ -3,8 +3,10 @@ package fs
 import (
 	"bufio"
 	"fmt"
+	"iter"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -13,62 +15,245 @@ var defaultIgnorePatterns = []string{".btignore", "*.btrestored"}
 
 // ignorePattern is a parsed ignore pattern with its matching strategy.
 type ignorePattern struct {
-	pattern   string
-	matchPath bool // true = match against relative path; false = match against basename only
+	pattern   string // pattern as written, for diagnostics
+	matchPath bool   // true = anchored to base; false = matches a name at any depth below base
+	negate    bool   // "!" prefix: re-include paths an earlier pattern ignored
+	dirOnly   bool   // trailing "/": only matches directories
+	base      string // slash-separated directory of the ignore file, relative to the root; "" for the root
+	re        *regexp.Regexp
 }
 
-// IgnoreMatcher checks file paths against a set of ignore patterns.
-// Patterns without '/' match against the file's basename only.
-// Patterns with '/' match against the full relative path from the directory root.
+// IgnoreMatcher checks file paths against a set of ignore patterns using
+// gitignore semantics:
+//   - Patterns without a '/' (other than a trailing one) match a file or
+//     directory name at any depth.
+//   - Patterns with a leading or middle '/' are anchored to the directory
+//     holding the ignore file.
+//   - '*' and '?' do not cross '/'; "**/" matches any number of directories
+//     and a trailing "/**" matches everything inside a directory.
+//   - A trailing '/' matches directories only.
+//   - A leading '!' re-includes a path an earlier pattern ignored. The last
+//     matching pattern wins, and nothing inside an ignored directory can be
+//     re-included.
 type IgnoreMatcher struct {
 	patterns []ignorePattern
 }
 
-// NewIgnoreMatcher creates an IgnoreMatcher from raw pattern strings.
+// NewIgnoreMatcher creates an IgnoreMatcher from raw pattern strings
+// anchored at the directory root.
 // Blank lines and lines starting with '#' are skipped.
 func NewIgnoreMatcher(rawPatterns []string) *IgnoreMatcher {
-	var patterns []ignorePattern
+	m := &IgnoreMatcher{}
+	m.add("", rawPatterns)
+	return m
+}
+
+// add appends patterns read from an ignore file in the base directory
+// (slash-separated, relative to the root). Later patterns take precedence,
+// so ignore files must be added parent before child.
+func (m *IgnoreMatcher) add(base string, rawPatterns []string) {
 	for _, raw := range rawPatterns {
-		raw = strings.TrimSpace(raw)
-		if raw == "" || strings.HasPrefix(raw, "#") {
+		if p, ok := parseIgnorePattern(base, raw); ok {
+			m.patterns = append(m.patterns, p)
+		}
+	}
+}
+
+// clone returns a copy of m that can be extended without affecting m.
+func (m *IgnoreMatcher) clone() *IgnoreMatcher {
+	return &IgnoreMatcher{patterns: append([]ignorePattern(nil), m.patterns...)}
+}
+
+// parseIgnorePattern parses one line of an ignore file. It reports false for
+// blank lines, comments and patterns that cannot be compiled.
+func parseIgnorePattern(base, raw string) (ignorePattern, bool) {
+	line := trimTrailingSpace(strings.TrimLeft(raw, " \t"))
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	p := ignorePattern{pattern: line, base: base}
+	glob := line
+	if strings.HasPrefix(glob, "!") {
+		p.negate = true
+		glob = glob[1:]
+	} else if strings.HasPrefix(glob, `\!`) || strings.HasPrefix(glob, `\#`) {
+		glob = glob[1:]
+	}
+	if strings.HasSuffix(glob, "/") {
+		p.dirOnly = true
+		glob = strings.TrimRight(glob, "/")
+	}
+	if glob == "" {
+		return ignorePattern{}, false
+	}
+
+	p.matchPath = strings.Contains(glob, "/")
+	glob = strings.TrimPrefix(glob, "/")
+
+	expr := globToRegexp(glob)
+	if p.matchPath {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		// Bad pattern — skip rather than crash.
+		return ignorePattern{}, false
+	}
+	p.re = re
+	return p, true
+}
+
+// trimTrailingSpace removes trailing spaces unless escaped with a backslash.
+func trimTrailingSpace(s string) string {
+	for strings.HasSuffix(s, " ") || strings.HasSuffix(s, "\t") {
+		if strings.HasSuffix(s[:len(s)-1], `\`) {
+			return s[:len(s)-2] + s[len(s)-1:]
+		}
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// globToRegexp translates a gitignore glob into an unanchored regular
+// expression over slash-separated paths.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	segmentStart := true
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case segmentStart && strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
 			continue
+		case segmentStart && glob[i:] == "**":
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			class, n := globClass(glob[i:])
+			if n == 0 {
+				b.WriteString(`\[`)
+			} else {
+				b.WriteString(class)
+				i += n - 1
+			}
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
 		}
-		patterns = append(patterns, ignorePattern{
-			pattern:   raw,
-			matchPath: strings.Contains(raw, "/"),
-		})
+		segmentStart = c == '/'
 	}
-	return &IgnoreMatcher{patterns: patterns}
+	return b.String()
 }
 
-// Match reports whether the given relative path should be ignored.
-// relativePath should use filepath separators and be relative to the directory root.
+// globClass translates a bracket expression at the start of s into a regexp
+// character class. It returns the class and the number of bytes of s it
+// consumed, or 0 if s has no closing ']'.
+func globClass(s string) (string, int) {
+	i := 1
+	var b strings.Builder
+	b.WriteString("[")
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		b.WriteString("^")
+		i++
+	}
+	first := true
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == ']' && !first {
+			b.WriteString("]")
+			return b.String(), i + 1
+		}
+		first = false
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		case c == '-':
+			b.WriteByte('-')
+		case c == '/':
+			return "", 0
+		default:
+			b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		}
+	}
+	return "", 0
+}
+
+// matches reports whether p matches the slash-separated relPath, or ok=false
+// if relPath is outside the pattern's base directory.
+func (p *ignorePattern) matches(relPath string, isDir bool) (matched, ok bool) {
+	if p.base != "" {
+		rest, found := strings.CutPrefix(relPath, p.base+"/")
+		if !found {
+			return false, false
+		}
+		relPath = rest
+	}
+	if p.dirOnly && !isDir {
+		return false, true
+	}
+	return p.re.MatchString(relPath), true
+}
+
+// ignored evaluates the patterns against a single path without looking at its
+// parent directories. The last matching pattern decides.
+func (m *IgnoreMatcher) ignored(relPath string, isDir bool) bool {
+	return m.ignoredBy(relPath, isDir) != nil
+}
+
+// ignoredBy is like ignored but returns the pattern that ignores relPath,
+// or nil if it is not ignored.
+func (m *IgnoreMatcher) ignoredBy(relPath string, isDir bool) *ignorePattern {
+	for i := len(m.patterns) - 1; i >= 0; i-- {
+		if matched, _ := m.patterns[i].matches(relPath, isDir); matched {
+			if m.patterns[i].negate {
+				return nil
+			}
+			return &m.patterns[i]
+		}
+	}
+	return nil
+}
+
+// Match reports whether the file at the given relative path should be ignored,
+// either by a pattern matching it or because one of its parent directories is
+// ignored. relativePath should use filepath separators and be relative to the
+// directory root.
 func (m *IgnoreMatcher) Match(relativePath string) bool {
-	if len(m.patterns) == 0 {
+	if len(m.patterns) == 0 || relativePath == "" {
 		return false
 	}
 
 	// Normalize to forward slashes for consistent matching.
 	normalized := filepath.ToSlash(relativePath)
-	basename := filepath.Base(relativePath)
-
-	for _, p := range m.patterns {
-		var matched bool
-		var err error
-		if p.matchPath {
-			matched, err = filepath.Match(p.pattern, normalized)
-		} else {
-			matched, err = filepath.Match(p.pattern, basename)
-		}
-		if err != nil {
-			// Bad pattern — skip rather than crash.
-			continue
-		}
-		if matched {
+	for dir := range parentDirs(normalized) {
+		if m.ignored(dir, true) {
 			return true
 		}
 	}
-	return false
+	return m.ignored(normalized, false)
+}
+
+// parentDirs yields the parent directories of a slash-separated relative
+// path, outermost first: "a/b/c" yields "a" then "a/b".
+func parentDirs(relPath string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for i := 0; i < len(relPath); i++ {
+			if relPath[i] == '/' && !yield(relPath[:i]) {
+				return
+			}
+		}
+	}
 }
 
 // ParseIgnoreFile reads a .btignore file and returns the raw pattern strings.
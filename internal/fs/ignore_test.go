@@ -3,7 +3,10 @@ package fs
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+
+	"bt-go/internal/config"
 )
 
 func TestNewIgnoreMatcher(t *testing.T) {
@@ -127,6 +130,96 @@ func TestIgnoreMatcher_Match(t *testing.T) {
 			relativePath: "data.tmp",
 			want:         true,
 		},
+		{
+			name:         "double star matches any depth",
+			patterns:     []string{"**/cache/*.bin"},
+			relativePath: filepath.Join("a", "b", "cache", "x.bin"),
+			want:         true,
+		},
+		{
+			name:         "double star matches zero directories",
+			patterns:     []string{"**/cache/*.bin"},
+			relativePath: filepath.Join("cache", "x.bin"),
+			want:         true,
+		},
+		{
+			name:         "middle double star",
+			patterns:     []string{"docs/**/draft.md"},
+			relativePath: filepath.Join("docs", "2024", "q1", "draft.md"),
+			want:         true,
+		},
+		{
+			name:         "trailing double star ignores contents",
+			patterns:     []string{"vendor/**"},
+			relativePath: filepath.Join("vendor", "lib", "x.go"),
+			want:         true,
+		},
+		{
+			name:         "single star does not cross directories",
+			patterns:     []string{"build/*.o"},
+			relativePath: filepath.Join("build", "sub", "main.o"),
+			want:         false,
+		},
+		{
+			name:         "negation re-includes file",
+			patterns:     []string{"*.log", "!keep.log"},
+			relativePath: "keep.log",
+			want:         false,
+		},
+		{
+			name:         "later pattern overrides negation",
+			patterns:     []string{"*.log", "!keep.log", "keep.*"},
+			relativePath: "keep.log",
+			want:         true,
+		},
+		{
+			name:         "directory-only pattern ignores files inside",
+			patterns:     []string{"build/"},
+			relativePath: filepath.Join("sub", "build", "out.o"),
+			want:         true,
+		},
+		{
+			name:         "directory-only pattern does not match file",
+			patterns:     []string{"build/"},
+			relativePath: "build",
+			want:         false,
+		},
+		{
+			name:         "negation cannot re-include file in ignored directory",
+			patterns:     []string{"build/", "!build/keep.txt"},
+			relativePath: filepath.Join("build", "keep.txt"),
+			want:         true,
+		},
+		{
+			name:         "negation works when only directory contents are ignored",
+			patterns:     []string{"build/*", "!build/keep.txt"},
+			relativePath: filepath.Join("build", "keep.txt"),
+			want:         false,
+		},
+		{
+			name:         "leading slash anchors to root",
+			patterns:     []string{"/todo.txt"},
+			relativePath: filepath.Join("sub", "todo.txt"),
+			want:         false,
+		},
+		{
+			name:         "leading slash matches at root",
+			patterns:     []string{"/todo.txt"},
+			relativePath: "todo.txt",
+			want:         true,
+		},
+		{
+			name:         "escaped hash is literal",
+			patterns:     []string{`\#notes`},
+			relativePath: "#notes",
+			want:         true,
+		},
+		{
+			name:         "negated character class",
+			patterns:     []string{"*.[!c]"},
+			relativePath: "main.c",
+			want:         false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -177,3 +270,120 @@ func TestParseIgnoreFile(t *testing.T) {
 		}
 	})
 }
+
+func TestOSFilesystemManager_IgnoreFiles(t *testing.T) {
+	// writeTree creates files under root; content doubles as file body.
+	writeTree := func(t *testing.T, root string, files map[string]string) {
+		t.Helper()
+		for rel, content := range files {
+			full := filepath.Join(root, filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+				t.Fatalf("writing %s: %v", rel, err)
+			}
+		}
+	}
+	walk := func(t *testing.T, m *OSFilesystemManager, root string) []string {
+		t.Helper()
+		dirPath, err := m.Resolve(root)
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		var got []string
+		for p, err := range m.WalkFiles(dirPath, root, true) {
+			if err != nil {
+				t.Fatalf("WalkFiles() error = %v", err)
+			}
+			rel, _ := filepath.Rel(root, p.String())
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return got
+	}
+
+	t.Run("nested btignore applies below its directory", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeTree(t, root, map[string]string{
+			".btignore":         "*.log\n",
+			"app.log":           "x",
+			"keep.txt":          "x",
+			"sub/.btignore":     "!debug.log\n*.txt\n",
+			"sub/debug.log":     "x",
+			"sub/other.log":     "x",
+			"sub/notes.txt":     "x",
+			"sibling/notes.txt": "x",
+		})
+
+		got := walk(t, NewOSFilesystemManager(config.FilesystemConfig{}), root)
+		want := []string{"keep.txt", "sibling/notes.txt", "sub/debug.log"}
+		if !slices.Equal(got, want) {
+			t.Errorf("WalkFiles() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("prunes ignored directories", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeTree(t, root, map[string]string{
+			"main.go":                "x",
+			"node_modules/a/b.js":    "x",
+			"node_modules/.btignore": "!*\n",
+		})
+
+		got := walk(t, NewOSFilesystemManager(config.FilesystemConfig{Ignore: []string{"node_modules/"}}), root)
+		want := []string{"main.go"}
+		if !slices.Equal(got, want) {
+			t.Errorf("WalkFiles() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("gitignore honored only when enabled", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeTree(t, root, map[string]string{
+			".gitignore": "*.o\nkeep.txt\n",
+			".btignore":  "!keep.txt\n",
+			"main.o":     "x",
+			"keep.txt":   "x",
+		})
+
+		got := walk(t, NewOSFilesystemManager(config.FilesystemConfig{}), root)
+		want := []string{".gitignore", "keep.txt", "main.o"}
+		if !slices.Equal(got, want) {
+			t.Errorf("without gitignore: WalkFiles() = %v, want %v", got, want)
+		}
+
+		got = walk(t, NewOSFilesystemManager(config.FilesystemConfig{UseGitignore: true}), root)
+		want = []string{".gitignore", "keep.txt"}
+		if !slices.Equal(got, want) {
+			t.Errorf("with gitignore: WalkFiles() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("ExclusionReason reads nested ignore files", func(t *testing.T) {
+		t.Parallel()
+		root := t.TempDir()
+		writeTree(t, root, map[string]string{
+			"a/b/.btignore":  "secret.txt\n",
+			"a/b/secret.txt": "x",
+			"a/secret.txt":   "x",
+		})
+		m := NewOSFilesystemManager(config.FilesystemConfig{})
+
+		for rel, want := range map[string]bool{"a/b/secret.txt": true, "a/secret.txt": false} {
+			p, err := m.Resolve(filepath.Join(root, rel))
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			reason, err := m.ExclusionReason(p, root)
+			if err != nil {
+				t.Fatalf("ExclusionReason() error = %v", err)
+			}
+			if got := reason != ""; got != want {
+				t.Errorf("ExclusionReason(%s) = %q, want excluded = %v", rel, reason, want)
+			}
+		}
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"fmt"
 	"io/fs"
+	"os"
 	"syscall"
 	"time"
 
@@ -28,3 +29,16 @@ func (m *OSFilesystemManager) ExtractStatData(info fs.FileInfo) (*bt.StatData, e
 		BirthTime: sql.NullTime{Valid: false},
 	}, nil
 }
+
+// statDeviceID returns the ID of the device holding the file at path.
+func statDeviceID(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("stat %s: %w", path, err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("cannot extract device ID: expected *syscall.Stat_t, got %T", info.Sys())
+	}
+	return uint64(stat.Dev), nil
+}
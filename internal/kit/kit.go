@@ -0,0 +1,265 @@
+// Package kit reads and writes disaster-recovery kits: a single printable
+// text file holding everything needed to reconstitute a host's configuration
+// and keys on a new machine.
+//
+// Binary data is stored in blocks of base32 lines, each prefixed with its line
+// number and followed by a checksum, so a kit typed back in from paper points
+// at the exact line of a typo. A block ends with a checksum of its whole
+// content, which catches missing lines.
+package kit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Block names.
+const (
+	BlockConfig            = "CONFIG"
+	BlockPublicKey         = "PUBLIC KEY"
+	BlockPrivateKey        = "PRIVATE KEY"
+	BlockConvergenceSecret = "CONVERGENCE SECRET"
+	BlockSigningKey        = "SIGNING KEY"
+)
+
+const (
+	// lineBytes is how many bytes each line encodes: 30 bytes are 48 base32
+	// characters, printed as eight groups of six.
+	lineBytes = 30
+	groupLen  = 6
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Kit is the content of a disaster-recovery kit.
+type Kit struct {
+	Created time.Time
+	HostID  string
+
+	// Vaults describes the configured vaults for the printed summary, e.g.
+	// "backup (s3)".
+	Vaults []string
+
+	// SecretsIncluded reports whether Config holds the vault credentials.
+	SecretsIncluded bool
+
+	// Config is the TOML configuration file.
+	Config []byte
+
+	// PublicKey and PrivateKey are the key files; the private key is still
+	// protected by the passphrase. Both are nil for a host that does not
+	// encrypt its backups.
+	PublicKey  []byte
+	PrivateKey []byte
+
+	// ConvergenceSecret is the convergence secret encrypted to the key pair,
+	// or nil if there is none.
+	ConvergenceSecret []byte
+
+	// SigningKey is the metadata signing key, encrypted to the key pair if
+	// there is one, or nil for a kit written before it was included.
+	SigningKey []byte
+}
+
+var instructions = template.Must(template.New("kit").Parse(`BT DISASTER RECOVERY KIT
+========================
+
+Host ID:  {{.HostID}}
+Created:  {{.Created.UTC.Format "2006-01-02 15:04:05 UTC"}}
+Vaults:   {{range $i, $v := .Vaults}}{{if $i}}, {{end}}{{$v}}{{else}}none{{end}}
+Secrets:  {{if .SecretsIncluded}}vault credentials INCLUDED - protect this kit like a password{{else}}vault credentials not included{{end}}
+
+{{if .PrivateKey}}This kit holds the configuration and the encryption keys of the host above.
+The private key is protected by the passphrase, which is NOT part of the kit:
+without both, the backups cannot be decrypted. Keep the kit somewhere safe and
+offline, away from the passphrase.
+{{else}}This kit holds the configuration of the host above, which does not encrypt its
+backups, and the key its metadata is signed with: anyone holding the kit can
+sign metadata as the host. Keep the kit somewhere safe and offline.
+{{end}}
+To recover on a new machine:
+
+  1. Install bt.
+  2. Save this kit as a text file, typing or scanning the blocks below if it
+     was printed. Spacing and letter case do not matter; each line ends
+     with a checksum, so a typo is reported with its line number.
+  3. Run: bt keys import-kit FILE
+     and enter the passphrase, if any, when asked. Paths under the original base
+     directory are moved under the new machine's.
+  4. If vault credentials were not included, add them to the configuration
+     file before using the vaults.
+
+`))
+
+// Write writes k as a printable kit.
+func Write(w io.Writer, k *Kit) error {
+	if err := instructions.Execute(w, k); err != nil {
+		return fmt.Errorf("writing kit: %w", err)
+	}
+	blocks := []struct {
+		name string
+		data []byte
+	}{
+		{BlockConfig, k.Config},
+		{BlockPublicKey, k.PublicKey},
+		{BlockPrivateKey, k.PrivateKey},
+		{BlockConvergenceSecret, k.ConvergenceSecret},
+		{BlockSigningKey, k.SigningKey},
+	}
+	for _, b := range blocks {
+		if b.data == nil {
+			continue
+		}
+		if _, err := io.WriteString(w, encodeBlock(b.name, b.data)+"\n"); err != nil {
+			return fmt.Errorf("writing kit: %w", err)
+		}
+	}
+	return nil
+}
+
+// Parse reads the blocks of a kit written by Write. Only Config, PublicKey,
+// PrivateKey, ConvergenceSecret and SigningKey are set; the printed summary
+// is ignored.
+func Parse(r io.Reader) (*Kit, error) {
+	blocks := make(map[string][]byte)
+	var (
+		name  string
+		lines []string
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "-----BEGIN BT ") && strings.HasSuffix(line, "-----"):
+			if name != "" {
+				return nil, fmt.Errorf("block %s is not terminated", name)
+			}
+			name = strings.TrimSuffix(strings.TrimPrefix(line, "-----BEGIN BT "), "-----")
+			lines = nil
+		case strings.HasPrefix(line, "-----END BT ") && strings.HasSuffix(line, "-----"):
+			end := strings.TrimSuffix(strings.TrimPrefix(line, "-----END BT "), "-----")
+			if end != name {
+				return nil, fmt.Errorf("unexpected end of block %s", end)
+			}
+			data, err := decodeBlock(name, lines)
+			if err != nil {
+				return nil, err
+			}
+			blocks[name] = data
+			name = ""
+		case name != "" && line != "":
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading kit: %w", err)
+	}
+	if name != "" {
+		return nil, fmt.Errorf("block %s is not terminated", name)
+	}
+
+	k := &Kit{
+		Config:            blocks[BlockConfig],
+		PublicKey:         blocks[BlockPublicKey],
+		PrivateKey:        blocks[BlockPrivateKey],
+		ConvergenceSecret: blocks[BlockConvergenceSecret],
+		SigningKey:        blocks[BlockSigningKey],
+	}
+	if k.Config == nil {
+		return nil, fmt.Errorf("kit has no %s block", BlockConfig)
+	}
+	if k.PublicKey == nil && k.PrivateKey != nil {
+		return nil, fmt.Errorf("kit has no %s block", BlockPublicKey)
+	}
+	if k.PrivateKey == nil && k.PublicKey != nil {
+		return nil, fmt.Errorf("kit has no %s block", BlockPrivateKey)
+	}
+	if k.PrivateKey == nil && k.SigningKey == nil {
+		return nil, fmt.Errorf("kit has no %s block", BlockPrivateKey)
+	}
+	return k, nil
+}
+
+// encodeBlock encodes data as a named block of numbered, checksummed lines.
+func encodeBlock(name string, data []byte) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-----BEGIN BT %s-----\n", name)
+	for i := 0; i*lineBytes < len(data); i++ {
+		chunk := data[i*lineBytes : min((i+1)*lineBytes, len(data))]
+		chars := encoding.EncodeToString(chunk)
+		var groups []string
+		for j := 0; j < len(chars); j += groupLen {
+			groups = append(groups, chars[j:min(j+groupLen, len(chars))])
+		}
+		fmt.Fprintf(&b, "%03d %-55s | %s\n", i+1, strings.Join(groups, " "), lineChecksum(name, i+1, chars))
+	}
+	fmt.Fprintf(&b, "SUM %s\n", blockChecksum(data))
+	fmt.Fprintf(&b, "-----END BT %s-----\n", name)
+	return b.String()
+}
+
+// decodeBlock decodes the lines of the named block, reporting the first line
+// whose checksum does not match.
+func decodeBlock(name string, lines []string) ([]byte, error) {
+	var data bytes.Buffer
+	sum := ""
+	next := 1
+	for _, line := range lines {
+		fields := strings.Fields(strings.ToUpper(line))
+		if len(fields) == 2 && fields[0] == "SUM" {
+			sum = fields[1]
+			continue
+		}
+		num, rest, ok := strings.Cut(line, " ")
+		n, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%s block: malformed line %q", name, line)
+		}
+		if n != next {
+			return nil, fmt.Errorf("%s block: expected line %d, found line %d", name, next, n)
+		}
+		next++
+		payload, check, ok := strings.Cut(rest, "|")
+		if !ok {
+			return nil, fmt.Errorf("%s block, line %d: missing checksum", name, n)
+		}
+		chars := strings.ToUpper(strings.Join(strings.Fields(payload), ""))
+		if lineChecksum(name, n, chars) != strings.ToUpper(strings.TrimSpace(check)) {
+			return nil, fmt.Errorf("%s block, line %d: checksum mismatch; check the line for typos", name, n)
+		}
+		chunk, err := encoding.DecodeString(chars)
+		if err != nil {
+			return nil, fmt.Errorf("%s block, line %d: %w", name, n, err)
+		}
+		data.Write(chunk)
+	}
+	if sum == "" {
+		return nil, fmt.Errorf("%s block: missing SUM line", name)
+	}
+	if blockChecksum(data.Bytes()) != sum {
+		return nil, fmt.Errorf("%s block: checksum mismatch; a line may be missing", name)
+	}
+	return data.Bytes(), nil
+}
+
+// lineChecksum returns the checksum printed after line n of the named block,
+// whose base32 characters are chars. It covers the block name and line number
+// too, so a line copied into the wrong place does not verify.
+func lineChecksum(name string, n int, chars string) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s %d %s", name, n, chars)))
+	return encoding.EncodeToString(h[:3])
+}
+
+// blockChecksum returns the checksum of a whole block's data.
+func blockChecksum(data []byte) string {
+	h := sha256.Sum256(data)
+	return encoding.EncodeToString(h[:10])
+}
@@ -24,6 +24,9 @@ func NewStagingAreaFromConfig(cfg config.StagingConfig, fsmgr bt.FilesystemManag
 		if cfg.StagingDir == "" {
 			return nil, fmt.Errorf("filesystem staging area requires staging_dir to be set")
 		}
+		if cfg.MaxFreePercent > 0 {
+			return NewFileSystemStagingAreaFreePercent(fsmgr, cfg.StagingDir, cfg.MaxFreePercent)
+		}
 		return NewFileSystemStagingArea(fsmgr, cfg.StagingDir, maxSize)
 	default:
 		return nil, fmt.Errorf("unknown staging area type: %s", cfg.Type)
@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"bt-go/internal/bt"
 )
@@ -33,6 +34,20 @@ var _ stagingStore = (*filesystemStore)(nil)
 // NewFileSystemStagingArea creates a new filesystem-based staging area.
 // maxSize is the maximum total size in bytes; must be positive.
 func NewFileSystemStagingArea(fsmgr bt.FilesystemManager, stagingDir string, maxSize int64) (bt.StagingArea, error) {
+	return newFileSystemStagingArea(fsmgr, stagingDir, fixedLimit(maxSize))
+}
+
+// NewFileSystemStagingAreaFreePercent creates a filesystem-based staging area
+// whose maximum size is percent% of the free space on the filesystem holding
+// stagingDir, re-evaluated each time a file is staged.
+func NewFileSystemStagingAreaFreePercent(fsmgr bt.FilesystemManager, stagingDir string, percent float64) (bt.StagingArea, error) {
+	if percent <= 0 || percent > 100 {
+		return nil, fmt.Errorf("free space percentage must be in (0, 100], got %v", percent)
+	}
+	return newFileSystemStagingArea(fsmgr, stagingDir, freeSpaceLimit(stagingDir, percent))
+}
+
+func newFileSystemStagingArea(fsmgr bt.FilesystemManager, stagingDir string, limit sizeLimit) (bt.StagingArea, error) {
 	contentDir := filepath.Join(stagingDir, "content")
 	queueFile := filepath.Join(stagingDir, "queue.json")
 
@@ -46,7 +61,7 @@ func NewFileSystemStagingArea(fsmgr bt.FilesystemManager, stagingDir string, max
 			contentDir: contentDir,
 			queueFile:  queueFile,
 		},
-		maxSize: maxSize,
+		limit: limit,
 	}, nil
 }
 
@@ -109,6 +124,8 @@ func (f *filesystemStore) OpenContent(checksum string) (io.ReadCloser, error) {
 	return file, nil
 }
 
+// ContentSize skips the temp files of content being stored: the staging area
+// still counts those bytes as reserved.
 func (f *filesystemStore) ContentSize() (int64, error) {
 	var totalSize int64
 
@@ -121,6 +138,9 @@ func (f *filesystemStore) ContentSize() (int64, error) {
 	}
 
 	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			continue
+		}
 		info, err := entry.Info()
 		if err != nil {
 			continue
@@ -180,6 +200,20 @@ func (f *filesystemStore) Pop(directoryID, relativePath, checksum string) (int,
 	return checksumCount, nil
 }
 
+func (f *filesystemStore) References(checksum string) (int, error) {
+	queue, err := f.readQueue()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, op := range queue {
+		if op.Snapshot.ContentID == checksum {
+			count++
+		}
+	}
+	return count, nil
+}
+
 func (f *filesystemStore) Len() (int, error) {
 	queue, err := f.readQueue()
 	if err != nil {
@@ -201,6 +235,31 @@ func (f *filesystemStore) Contains(directoryID, relativePath string) (bool, erro
 	return false, nil
 }
 
+func (f *filesystemStore) RemoveDirectory(directoryID string) ([]*stagedOperation, error) {
+	queue, err := f.readQueue()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []*stagedOperation
+	newQueue := make([]*stagedOperation, 0, len(queue))
+	for _, op := range queue {
+		if op.DirectoryID == directoryID {
+			removed = append(removed, op)
+			continue
+		}
+		newQueue = append(newQueue, op)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	if err := f.writeQueue(newQueue); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
 func (f *filesystemStore) readQueue() ([]*stagedOperation, error) {
 	data, err := os.ReadFile(f.queueFile)
 	if err != nil {
@@ -0,0 +1,28 @@
+package staging
+
+import "fmt"
+
+// sizeLimit returns the maximum total size of staged content in bytes.
+// staged is the number of bytes the staging area currently holds, for limits
+// that depend on how much space staging is already using.
+type sizeLimit func(staged int64) (int64, error)
+
+// fixedLimit is a sizeLimit that always returns maxSize.
+func fixedLimit(maxSize int64) sizeLimit {
+	return func(int64) (int64, error) {
+		return maxSize, nil
+	}
+}
+
+// freeSpaceLimit is a sizeLimit of percent% of the space available to staging
+// in dir: the filesystem's free bytes plus whatever staging already holds.
+// Counting staged bytes keeps the limit stable as staging fills the disk.
+func freeSpaceLimit(dir string, percent float64) sizeLimit {
+	return func(staged int64) (int64, error) {
+		free, err := freeSpace(dir)
+		if err != nil {
+			return 0, fmt.Errorf("checking free space: %w", err)
+		}
+		return int64(float64(free+staged) * percent / 100), nil
+	}
+}
@@ -6,14 +6,17 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"sync"
 
 	"bt-go/internal/bt"
 )
 
 // memoryStore is an in-memory implementation of stagingStore.
 // It stores staged content in memory, making it useful for testing.
-// Concurrency is managed by the caller (stagingArea.mu).
+// Concurrency is managed by the caller (stagingArea.mu), apart from content
+// and currentSize, which contentMu guards because StoreContent runs unlocked.
 type memoryStore struct {
+	contentMu   sync.Mutex
 	content     map[string][]byte  // checksum -> content
 	queue       []*stagedOperation // ordered queue of operations
 	refCount    map[string]int     // checksum -> number of operations referencing it
@@ -34,9 +37,9 @@ func newMemoryStore() *memoryStore {
 // maxSize is the maximum total size in bytes; must be positive.
 func NewMemoryStagingArea(fsmgr bt.FilesystemManager, maxSize int64) bt.StagingArea {
 	return &stagingArea{
-		fsmgr:   fsmgr,
-		store:   newMemoryStore(),
-		maxSize: maxSize,
+		fsmgr: fsmgr,
+		store: newMemoryStore(),
+		limit: fixedLimit(maxSize),
 	}
 }
 
@@ -53,6 +56,9 @@ func (m *memoryStore) StoreContent(r io.Reader) (string, int64, error) {
 	data := buf.Bytes()
 	size := int64(len(data))
 
+	m.contentMu.Lock()
+	defer m.contentMu.Unlock()
+
 	// Dedup: only store if not already present
 	if _, exists := m.content[checksum]; !exists {
 		m.content[checksum] = data
@@ -63,6 +69,8 @@ func (m *memoryStore) StoreContent(r io.Reader) (string, int64, error) {
 }
 
 func (m *memoryStore) RemoveContent(checksum string) {
+	m.contentMu.Lock()
+	defer m.contentMu.Unlock()
 	if c, ok := m.content[checksum]; ok {
 		m.currentSize -= int64(len(c))
 		delete(m.content, checksum)
@@ -71,6 +79,8 @@ func (m *memoryStore) RemoveContent(checksum string) {
 }
 
 func (m *memoryStore) OpenContent(checksum string) (io.ReadCloser, error) {
+	m.contentMu.Lock()
+	defer m.contentMu.Unlock()
 	content, ok := m.content[checksum]
 	if !ok {
 		return nil, fmt.Errorf("content not found: %s", checksum)
@@ -82,6 +92,8 @@ func (m *memoryStore) OpenContent(checksum string) (io.ReadCloser, error) {
 }
 
 func (m *memoryStore) ContentSize() (int64, error) {
+	m.contentMu.Lock()
+	defer m.contentMu.Unlock()
 	return m.currentSize, nil
 }
 
@@ -114,6 +126,10 @@ func (m *memoryStore) Pop(directoryID, relativePath, checksum string) (int, erro
 	return 0, nil
 }
 
+func (m *memoryStore) References(checksum string) (int, error) {
+	return m.refCount[checksum], nil
+}
+
 func (m *memoryStore) Len() (int, error) {
 	return len(m.queue), nil
 }
@@ -126,3 +142,21 @@ func (m *memoryStore) Contains(directoryID, relativePath string) (bool, error) {
 	}
 	return false, nil
 }
+
+func (m *memoryStore) RemoveDirectory(directoryID string) ([]*stagedOperation, error) {
+	var removed []*stagedOperation
+	kept := m.queue[:0]
+	for _, op := range m.queue {
+		if op.DirectoryID != directoryID {
+			kept = append(kept, op)
+			continue
+		}
+		removed = append(removed, op)
+		checksum := op.Snapshot.ContentID
+		if m.refCount[checksum]--; m.refCount[checksum] <= 0 {
+			delete(m.refCount, checksum)
+		}
+	}
+	m.queue = kept
+	return removed, nil
+}
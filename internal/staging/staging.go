@@ -1,7 +1,12 @@
 package staging
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
 	"sync"
 
 	"bt-go/internal/bt"
@@ -11,100 +16,272 @@ import (
 // stagingArea implements bt.StagingArea using a pluggable stagingStore
 // for the storage mechanics. All shared algorithm logic lives here.
 type stagingArea struct {
-	fsmgr   bt.FilesystemManager
-	store   stagingStore
-	maxSize int64
-	mu      sync.Mutex
+	fsmgr bt.FilesystemManager
+	store stagingStore
+	limit sizeLimit
+
+	// mu guards the store's queue, reserved and pending.
+	mu sync.Mutex
+
+	// content is held shared while Prepare writes content into the store and
+	// exclusively while content is removed, so content a prepared file
+	// depends on is never removed before it is counted in pending.
+	// Lock order is content before mu.
+	content sync.RWMutex
+
+	reserved int64          // bytes Prepare has checked against the limit but not yet stored
+	pending  map[string]int // checksum -> prepared files not yet committed or discarded
 }
 
 var _ bt.StagingArea = (*stagingArea)(nil)
 
 // Stage stages a file for backup.
 func (s *stagingArea) Stage(directory *sqlc.Directory, relativePath string, path *bt.Path) error {
+	prepared, err := s.Prepare(directory, relativePath, path)
+	if err != nil {
+		return err
+	}
+	return s.Commit(prepared)
+}
+
+// Prepare copies a file into the staging area without queuing it.
+func (s *stagingArea) Prepare(directory *sqlc.Directory, relativePath string, path *bt.Path) (*bt.PreparedFile, error) {
 	// 1. Get initial stat from the path
 	info1 := path.Info()
 	stat1, err := s.fsmgr.ExtractStatData(info1)
 	if err != nil {
-		return fmt.Errorf("extracting stat data: %w", err)
+		return nil, fmt.Errorf("extracting stat data: %w", err)
 	}
 
-	// 2. Open the source file
-	reader, err := s.fsmgr.Open(path)
+	// 2. Reserve room up front, so a file far larger than the limit is never
+	// copied only to be removed again, and concurrent Prepares cannot jointly
+	// overshoot the limit.
+	size := info1.Size()
+	s.mu.Lock()
+	err = s.checkLimit(size)
+	if err == nil {
+		s.reserved += size
+	}
+	s.mu.Unlock()
 	if err != nil {
-		return fmt.Errorf("opening file: %w", err)
+		return nil, err
 	}
 
-	// 3. Store content (hash + store), then close reader
-	s.mu.Lock()
-	checksum, size, err := s.store.StoreContent(reader)
-	s.mu.Unlock()
-	reader.Close()
+	// 3. Store content (hash + store)
+	checksum, storedSize, err := s.storeContent(path, size)
 	if err != nil {
-		return fmt.Errorf("storing content: %w", err)
+		return nil, err
+	}
+
+	prepared := &bt.PreparedFile{
+		DirectoryID:  directory.ID,
+		RelativePath: relativePath,
+		Snapshot:     newSnapshot(checksum, storedSize, info1, stat1),
 	}
 
 	// 4. Re-stat to validate file hasn't changed
-	info2, err := s.fsmgr.Stat(path)
-	if err != nil {
+	if err := s.checkUnchanged(path, info1, stat1); err != nil {
+		s.Discard(prepared)
+		return nil, err
+	}
+
+	return prepared, nil
+}
+
+// storeContent copies the file at path into the store and marks the content
+// pending. It releases the reservation of reserved bytes made by Prepare.
+func (s *stagingArea) storeContent(path *bt.Path, reserved int64) (string, int64, error) {
+	defer func() {
 		s.mu.Lock()
-		s.store.RemoveContent(checksum)
+		s.reserved -= reserved
 		s.mu.Unlock()
-		return fmt.Errorf("re-stat file: %w", err)
+	}()
+
+	reader, err := s.fsmgr.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("opening file: %w", err)
 	}
-	stat2, err := s.fsmgr.ExtractStatData(info2)
+	defer reader.Close()
+
+	s.content.RLock()
+	defer s.content.RUnlock()
+
+	checksum, size, err := s.store.StoreContent(reader)
 	if err != nil {
-		s.mu.Lock()
-		s.store.RemoveContent(checksum)
-		s.mu.Unlock()
-		return fmt.Errorf("extracting re-stat data: %w", err)
+		return "", 0, fmt.Errorf("storing content: %w", err)
 	}
 
-	if err := validateStatUnchanged(info1, info2, stat1, stat2); err != nil {
-		s.mu.Lock()
-		s.store.RemoveContent(checksum)
-		s.mu.Unlock()
-		return fmt.Errorf("file changed during staging: %w", err)
+	s.mu.Lock()
+	if s.pending == nil {
+		s.pending = make(map[string]int)
+	}
+	s.pending[checksum]++
+	s.mu.Unlock()
+
+	return checksum, size, nil
+}
+
+// Commit adds a prepared file to the end of the queue.
+func (s *stagingArea) Commit(prepared *bt.PreparedFile) error {
+	op := &stagedOperation{
+		DirectoryID:  prepared.DirectoryID,
+		RelativePath: prepared.RelativePath,
+		Snapshot:     prepared.Snapshot,
 	}
 
-	// 5. Check size limit and enqueue
+	s.mu.Lock()
+	err := s.store.Append(op)
+	if err == nil {
+		s.unpend(op.Snapshot.ContentID)
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.Discard(prepared)
+		return fmt.Errorf("adding to queue: %w", err)
+	}
+	return nil
+}
+
+// Discard releases a prepared file's content without queuing it. The content
+// is removed unless queued or other prepared files still reference it.
+func (s *stagingArea) Discard(prepared *bt.PreparedFile) {
+	checksum := prepared.Snapshot.ContentID
+
+	s.content.Lock()
+	defer s.content.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.unpend(checksum)
+	if s.pending[checksum] > 0 {
+		return
+	}
+	if refs, err := s.store.References(checksum); err == nil && refs == 0 {
+		s.store.RemoveContent(checksum)
+	}
+}
+
+// unpend drops one pending reference to checksum.
+// The caller must hold s.mu.
+func (s *stagingArea) unpend(checksum string) {
+	s.pending[checksum]--
+	if s.pending[checksum] <= 0 {
+		delete(s.pending, checksum)
+	}
+}
+
+// Stream backs up a file directly from its source, bypassing staged storage.
+func (s *stagingArea) Stream(directory *sqlc.Directory, relativePath string, path *bt.Path, fn bt.BackupFunc) error {
+	info1 := path.Info()
+	stat1, err := s.fsmgr.ExtractStatData(info1)
+	if err != nil {
+		return fmt.Errorf("extracting stat data: %w", err)
+	}
+
+	// 1. First pass: compute the checksum the vault object will be stored under.
+	reader, err := s.fsmgr.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, reader)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("hashing file: %w", err)
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+
+	if err := s.checkUnchanged(path, info1, stat1); err != nil {
+		return err
+	}
+
+	// 2. Second pass: hand the source to fn, verifying it still hashes the same.
+	reader, err = s.fsmgr.Open(path)
+	if err != nil {
+		return fmt.Errorf("reopening file: %w", err)
+	}
+	defer reader.Close()
+
+	verified := &verifyingReader{r: reader, h: sha256.New(), checksum: checksum}
+	return fn(verified, newSnapshot(checksum, size, info1, stat1), directory.ID, relativePath)
+}
+
+// checkLimit returns an error wrapping bt.ErrStagingFull if adding incoming
+// bytes would take the staged and reserved content over the size limit, and
+// bt.ErrFileTooLarge if incoming alone is over it.
+// The caller must hold s.mu.
+func (s *stagingArea) checkLimit(incoming int64) error {
 	contentSize, err := s.store.ContentSize()
 	if err != nil {
-		s.store.RemoveContent(checksum)
 		return fmt.Errorf("getting current size: %w", err)
 	}
-	if contentSize > s.maxSize {
-		s.store.RemoveContent(checksum)
-		return fmt.Errorf("staging area full: would exceed max size of %d bytes", s.maxSize)
+	maxSize, err := s.limit(contentSize)
+	if err != nil {
+		return fmt.Errorf("getting size limit: %w", err)
 	}
-
-	// 6. Add operation to queue
-	op := &stagedOperation{
-		DirectoryID:  directory.ID,
-		RelativePath: relativePath,
-		Snapshot: sqlc.FileSnapshot{
-			ContentID:   checksum,
-			Size:        size,
-			Permissions: int64(info1.Mode().Perm()),
-			Uid:         stat1.UID,
-			Gid:         stat1.GID,
-			AccessedAt:  stat1.Atime,
-			ModifiedAt:  info1.ModTime(),
-			ChangedAt:   stat1.Ctime,
-			BornAt:      stat1.BirthTime,
-		},
-	}
-
-	if err := s.store.Append(op); err != nil {
-		s.store.RemoveContent(checksum)
-		return fmt.Errorf("adding to queue: %w", err)
+	if incoming > maxSize {
+		return fmt.Errorf("%w: %d bytes, max size is %d bytes", bt.ErrFileTooLarge, incoming, maxSize)
 	}
+	if contentSize+s.reserved+incoming > maxSize {
+		return fmt.Errorf("%w: would exceed max size of %d bytes", bt.ErrStagingFull, maxSize)
+	}
+	return nil
+}
 
+// checkUnchanged re-stats path and compares it against the stat taken before
+// the file was read.
+func (s *stagingArea) checkUnchanged(path *bt.Path, info1 fs.FileInfo, stat1 *bt.StatData) error {
+	info2, err := s.fsmgr.Stat(path)
+	if err != nil {
+		return fmt.Errorf("re-stat file: %w", err)
+	}
+	stat2, err := s.fsmgr.ExtractStatData(info2)
+	if err != nil {
+		return fmt.Errorf("extracting re-stat data: %w", err)
+	}
+	if err := validateStatUnchanged(info1, info2, stat1, stat2); err != nil {
+		return fmt.Errorf("file changed during staging: %w", err)
+	}
 	return nil
 }
 
+// newSnapshot builds the snapshot recorded for a staged or streamed file.
+func newSnapshot(checksum string, size int64, info fs.FileInfo, stat *bt.StatData) sqlc.FileSnapshot {
+	return sqlc.FileSnapshot{
+		ContentID:   checksum,
+		Size:        size,
+		Permissions: int64(info.Mode().Perm()),
+		Uid:         stat.UID,
+		Gid:         stat.GID,
+		AccessedAt:  stat.Atime,
+		ModifiedAt:  info.ModTime(),
+		ChangedAt:   stat.Ctime,
+		BornAt:      stat.BirthTime,
+	}
+}
+
+// verifyingReader hashes everything read through it and, at EOF, returns an
+// error instead of io.EOF if the data does not match checksum. Consumers that
+// only commit on a clean EOF (vault writes, encryption) therefore never store
+// content under a checksum it does not have.
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	checksum string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(v.h.Sum(nil)); got != v.checksum {
+			return n, fmt.Errorf("file changed during backup: checksum %s, expected %s", got, v.checksum)
+		}
+	}
+	return n, err
+}
+
 // ProcessNext gets the next staged operation and calls fn with its data.
 // If fn returns nil, the staged operation is removed (committed).
 // If fn returns an error, the operation stays in queue for retry.
@@ -135,6 +312,8 @@ func (s *stagingArea) ProcessNext(fn bt.BackupFunc) error {
 	}
 
 	// Success - remove the operation
+	s.content.Lock()
+	defer s.content.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -143,7 +322,7 @@ func (s *stagingArea) ProcessNext(fn bt.BackupFunc) error {
 		return err
 	}
 
-	if remaining == 0 {
+	if remaining == 0 && s.pending[checksum] == 0 {
 		s.store.RemoveContent(checksum)
 	}
 
@@ -170,3 +349,28 @@ func (s *stagingArea) IsStaged(directoryID string, relativePath string) (bool, e
 	defer s.mu.Unlock()
 	return s.store.Contains(directoryID, relativePath)
 }
+
+// RemoveDirectory drops every queued operation for the given directory.
+func (s *stagingArea) RemoveDirectory(directoryID string) (int, error) {
+	s.content.Lock()
+	defer s.content.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed, err := s.store.RemoveDirectory(directoryID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, op := range removed {
+		checksum := op.Snapshot.ContentID
+		refs, err := s.store.References(checksum)
+		if err != nil {
+			return len(removed), err
+		}
+		if refs == 0 && s.pending[checksum] == 0 {
+			s.store.RemoveContent(checksum)
+		}
+	}
+	return len(removed), nil
+}
@@ -2,10 +2,15 @@ package staging
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"iter"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -76,12 +81,16 @@ func (m *mockFSMgr) ExtractStatData(info fs.FileInfo) (*bt.StatData, error) {
 	}, nil
 }
 
-func (m *mockFSMgr) FindFiles(path *bt.Path, recursive bool) ([]*bt.Path, error) {
-	return nil, nil
+func (m *mockFSMgr) WalkFiles(path *bt.Path, dirRoot string, recursive bool) iter.Seq2[*bt.Path, error] {
+	return func(func(*bt.Path, error) bool) {}
 }
 
-func (m *mockFSMgr) IsIgnored(path *bt.Path, dirRoot string) (bool, error) {
-	return false, nil
+func (m *mockFSMgr) Walk(path *bt.Path, dirRoot string, recursive bool) iter.Seq2[*bt.WalkEntry, error] {
+	return func(func(*bt.WalkEntry, error) bool) {}
+}
+
+func (m *mockFSMgr) ExclusionReason(path *bt.Path, dirRoot string) (string, error) {
+	return "", nil
 }
 
 type mockFileInfo struct {
@@ -120,6 +129,11 @@ func stageFile(t *testing.T, sa *stagingArea, fsmgr *mockFSMgr, dir *sqlc.Direct
 	}
 }
 
+func sha256hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 // Tests
 
 func TestStagingArea_Stage(t *testing.T) {
@@ -198,6 +212,37 @@ func TestStagingArea_IsStaged(t *testing.T) {
 	})
 }
 
+func TestStagingArea_RemoveDirectory(t *testing.T) {
+	dir1 := &sqlc.Directory{ID: "dir-1", Path: "/home/user/docs", CreatedAt: time.Now()}
+	dir2 := &sqlc.Directory{ID: "dir-2", Path: "/home/user/pics", CreatedAt: time.Now()}
+
+	sa, fsmgr := newTestSA(t)
+	stageFile(t, sa, fsmgr, dir1, "a.txt", []byte("shared"))
+	stageFile(t, sa, fsmgr, dir1, "b.txt", []byte("only in docs"))
+	stageFile(t, sa, fsmgr, dir2, "c.txt", []byte("shared"))
+
+	removed, err := sa.RemoveDirectory("dir-1")
+	if err != nil {
+		t.Fatalf("RemoveDirectory() error = %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("RemoveDirectory() = %d, want 2", removed)
+	}
+
+	count, _ := sa.Count()
+	if count != 1 {
+		t.Errorf("Count() = %d, want 1", count)
+	}
+	// Content shared with dir-2's file stays; the rest is released.
+	size, _ := sa.Size()
+	if size != int64(len("shared")) {
+		t.Errorf("Size() = %d, want %d", size, len("shared"))
+	}
+	if staged, _ := sa.IsStaged("dir-2", "c.txt"); !staged {
+		t.Error("file in other directory should stay staged")
+	}
+}
+
 func TestStagingArea_ProcessNext(t *testing.T) {
 	dir := &sqlc.Directory{ID: "dir-1", Path: "/home/user/docs", CreatedAt: time.Now()}
 
@@ -296,6 +341,202 @@ func TestStagingArea_SizeLimit(t *testing.T) {
 	if !strings.Contains(err.Error(), "staging area full") {
 		t.Errorf("error = %v, want 'staging area full'", err)
 	}
+	if !errors.Is(err, bt.ErrStagingFull) {
+		t.Errorf("error = %v, want wrapped bt.ErrStagingFull", err)
+	}
+	if !errors.Is(err, bt.ErrFileTooLarge) {
+		t.Errorf("error = %v, want wrapped bt.ErrFileTooLarge", err)
+	}
+
+	// A file that fits the limit but not the room left is not too large.
+	fsmgr.addFile("/home/user/docs/medium.txt", []byte("123456789"))
+	path, _ = fsmgr.Resolve("/home/user/docs/medium.txt")
+	err = sa.Stage(dir, "medium.txt", path)
+	if !errors.Is(err, bt.ErrStagingFull) || errors.Is(err, bt.ErrFileTooLarge) {
+		t.Errorf("error = %v, want wrapped bt.ErrStagingFull only", err)
+	}
+}
+
+func TestStagingArea_PrepareCommit(t *testing.T) {
+	dir := &sqlc.Directory{ID: "dir-1", Path: "/home/user/docs", CreatedAt: time.Now()}
+
+	prepare := func(t *testing.T, sa *stagingArea, fsmgr *mockFSMgr, relPath string, content []byte) *bt.PreparedFile {
+		t.Helper()
+		fsmgr.addFile(dir.Path+"/"+relPath, content)
+		path, _ := fsmgr.Resolve(dir.Path + "/" + relPath)
+		prepared, err := sa.Prepare(dir, relPath, path)
+		if err != nil {
+			t.Fatalf("Prepare(%s) error = %v", relPath, err)
+		}
+		return prepared
+	}
+
+	t.Run("commit order determines queue order", func(t *testing.T) {
+		sa, fsmgr := newTestSA(t)
+		a := prepare(t, sa, fsmgr, "a.txt", []byte("aaa"))
+		b := prepare(t, sa, fsmgr, "b.txt", []byte("bbb"))
+
+		if count, _ := sa.Count(); count != 0 {
+			t.Errorf("Count() after Prepare = %d, want 0", count)
+		}
+		if err := sa.Commit(b); err != nil {
+			t.Fatalf("Commit(b) error = %v", err)
+		}
+		if err := sa.Commit(a); err != nil {
+			t.Fatalf("Commit(a) error = %v", err)
+		}
+
+		var got string
+		sa.ProcessNext(func(_ io.Reader, _ sqlc.FileSnapshot, _ string, relativePath string) error {
+			got = relativePath
+			return nil
+		})
+		if got != "b.txt" {
+			t.Errorf("first queued = %q, want b.txt", got)
+		}
+	})
+
+	t.Run("discard removes unreferenced content", func(t *testing.T) {
+		sa, fsmgr := newTestSA(t)
+		prepared := prepare(t, sa, fsmgr, "a.txt", []byte("aaa"))
+
+		sa.Discard(prepared)
+		if size, _ := sa.Size(); size != 0 {
+			t.Errorf("Size() after Discard = %d, want 0", size)
+		}
+	})
+
+	t.Run("discard keeps content shared with a queued file", func(t *testing.T) {
+		sa, fsmgr := newTestSA(t)
+		stageFile(t, sa, fsmgr, dir, "a.txt", []byte("same"))
+		prepared := prepare(t, sa, fsmgr, "b.txt", []byte("same"))
+
+		sa.Discard(prepared)
+		err := sa.ProcessNext(func(r io.Reader, _ sqlc.FileSnapshot, _ string, _ string) error {
+			_, err := io.ReadAll(r)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("ProcessNext() error = %v", err)
+		}
+	})
+
+	t.Run("backing up keeps content shared with a prepared file", func(t *testing.T) {
+		sa, fsmgr := newTestSA(t)
+		stageFile(t, sa, fsmgr, dir, "a.txt", []byte("same"))
+		prepared := prepare(t, sa, fsmgr, "b.txt", []byte("same"))
+
+		noop := func(io.Reader, sqlc.FileSnapshot, string, string) error { return nil }
+		if err := sa.ProcessNext(noop); err != nil {
+			t.Fatalf("ProcessNext(a) error = %v", err)
+		}
+		if err := sa.Commit(prepared); err != nil {
+			t.Fatalf("Commit(b) error = %v", err)
+		}
+		if err := sa.ProcessNext(noop); err != nil {
+			t.Fatalf("ProcessNext(b) error = %v", err)
+		}
+	})
+}
+
+func TestStagingArea_Stream(t *testing.T) {
+	dir := &sqlc.Directory{ID: "dir-1", Path: "/home/user/docs", CreatedAt: time.Now()}
+
+	t.Run("passes content to fn without queuing", func(t *testing.T) {
+		fsmgr := newMockFSMgr()
+		sa := NewMemoryStagingArea(fsmgr, 10).(*stagingArea) // smaller than the file
+
+		content := []byte("larger than the staging area")
+		fsmgr.addFile("/home/user/docs/big.txt", content)
+		path, _ := fsmgr.Resolve("/home/user/docs/big.txt")
+
+		var got []byte
+		var gotSnapshot sqlc.FileSnapshot
+		var gotDirID, gotRelPath string
+		err := sa.Stream(dir, "big.txt", path, func(r io.Reader, snapshot sqlc.FileSnapshot, directoryID string, relativePath string) error {
+			var err error
+			got, err = io.ReadAll(r)
+			gotSnapshot, gotDirID, gotRelPath = snapshot, directoryID, relativePath
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Stream() error = %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("content = %q, want %q", got, content)
+		}
+		if gotSnapshot.ContentID != sha256hex(content) {
+			t.Errorf("ContentID = %q, want %q", gotSnapshot.ContentID, sha256hex(content))
+		}
+		if gotSnapshot.Size != int64(len(content)) {
+			t.Errorf("Size = %d, want %d", gotSnapshot.Size, len(content))
+		}
+		if gotDirID != "dir-1" || gotRelPath != "big.txt" {
+			t.Errorf("fn got (%q, %q), want (dir-1, big.txt)", gotDirID, gotRelPath)
+		}
+		if count, _ := sa.Count(); count != 0 {
+			t.Errorf("Count() = %d, want 0", count)
+		}
+	})
+
+	t.Run("returns fn error", func(t *testing.T) {
+		fsmgr := newMockFSMgr()
+		sa := NewMemoryStagingArea(fsmgr, 10).(*stagingArea)
+
+		fsmgr.addFile("/home/user/docs/big.txt", []byte("larger than the staging area"))
+		path, _ := fsmgr.Resolve("/home/user/docs/big.txt")
+
+		err := sa.Stream(dir, "big.txt", path, func(io.Reader, sqlc.FileSnapshot, string, string) error {
+			return fmt.Errorf("vault unavailable")
+		})
+		if err == nil {
+			t.Fatal("Stream() expected error from fn")
+		}
+	})
+}
+
+func TestVerifyingReader(t *testing.T) {
+	t.Run("matching content reads cleanly", func(t *testing.T) {
+		content := []byte("hello")
+		v := &verifyingReader{r: bytes.NewReader(content), h: sha256.New(), checksum: sha256hex(content)}
+		if _, err := io.ReadAll(v); err != nil {
+			t.Errorf("ReadAll() error = %v", err)
+		}
+	})
+
+	t.Run("changed content fails at EOF", func(t *testing.T) {
+		v := &verifyingReader{r: bytes.NewReader([]byte("changed")), h: sha256.New(), checksum: sha256hex([]byte("hello"))}
+		if _, err := io.ReadAll(v); err == nil {
+			t.Error("ReadAll() expected checksum mismatch error")
+		}
+	})
+}
+
+func TestFileSystemStagingAreaFreePercent(t *testing.T) {
+	t.Run("rejects out of range percentage", func(t *testing.T) {
+		for _, percent := range []float64{0, -5, 101} {
+			if _, err := NewFileSystemStagingAreaFreePercent(newMockFSMgr(), t.TempDir(), percent); err == nil {
+				t.Errorf("percent %v: expected error", percent)
+			}
+		}
+	})
+
+	t.Run("limit scales with free space", func(t *testing.T) {
+		dir := t.TempDir()
+		free, err := freeSpace(dir)
+		if err != nil {
+			t.Fatalf("freeSpace() error = %v", err)
+		}
+
+		limit, err := freeSpaceLimit(dir, 50)(0)
+		if err != nil {
+			t.Fatalf("limit error = %v", err)
+		}
+		// Free space can shift between the two calls; allow a little slack.
+		if want := free / 2; limit < want-want/100 || limit > want+want/100 {
+			t.Errorf("limit = %d, want about %d", limit, want)
+		}
+	})
 }
 
 func TestValidateStatUnchanged(t *testing.T) {
@@ -371,3 +612,19 @@ func TestValidateStatUnchanged(t *testing.T) {
 		}
 	})
 }
+
+func TestFilesystemStore_ContentSize(t *testing.T) {
+	dir := t.TempDir()
+	store := &filesystemStore{contentDir: dir, queueFile: filepath.Join(dir, "queue.json")}
+	if _, _, err := store.StoreContent(bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("StoreContent() error = %v", err)
+	}
+	// Content being stored is still reserved, so its temp file must not be
+	// counted as well.
+	if err := os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("in flight"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.ContentSize(); err != nil || size != 5 {
+		t.Errorf("ContentSize() = %d, %v, want 5", size, err)
+	}
+}
@@ -4,11 +4,13 @@ import "io"
 
 // stagingStore abstracts the storage mechanics for a staging area.
 // Implementations handle content storage and operation queue management.
-// Concurrency is managed by the caller (stagingArea.mu), so stores
-// do not need to be safe for concurrent use.
+// Concurrency is managed by the caller (stagingArea.mu), except that
+// StoreContent may run concurrently with itself and with the other methods
+// apart from RemoveContent.
 type stagingStore interface {
 	// StoreContent reads from r, computes SHA-256, and stores content.
 	// Deduplicates if checksum already exists. Returns checksum and size.
+	// It is called without stagingArea.mu held.
 	StoreContent(r io.Reader) (checksum string, size int64, err error)
 
 	// RemoveContent removes stored content by checksum (best-effort).
@@ -32,10 +34,18 @@ type stagingStore interface {
 	// (so the caller can decide whether to call RemoveContent).
 	Pop(directoryID, relativePath, checksum string) (checksumRefsRemaining int, err error)
 
+	// References returns the number of queued operations whose content has
+	// the given checksum.
+	References(checksum string) (int, error)
+
 	// Len returns the number of operations in the queue.
 	Len() (int, error)
 
 	// Contains reports whether an operation with the given directoryID and
 	// relativePath exists in the queue.
 	Contains(directoryID, relativePath string) (bool, error)
+
+	// RemoveDirectory removes every operation with the given directoryID and
+	// returns them, so the caller can release content nothing else references.
+	RemoveDirectory(directoryID string) ([]*stagedOperation, error)
 }
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"iter"
+	"maps"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -70,6 +73,16 @@ func (m *MockFilesystemManager) AddDirectory(path string) {
 	}
 }
 
+// RemoveAll removes a file or directory and everything beneath it from the
+// mock filesystem.
+func (m *MockFilesystemManager) RemoveAll(path string) {
+	for p := range m.files {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(m.files, p)
+		}
+	}
+}
+
 // UpdateFile updates a file's content and modtime in the mock filesystem.
 func (m *MockFilesystemManager) UpdateFile(path string, content []byte, modTime time.Time) {
 	f, ok := m.files[path]
@@ -90,7 +103,7 @@ func (m *MockFilesystemManager) Resolve(rawPath string) (*bt.Path, error) {
 
 	file, ok := m.files[absPath]
 	if !ok {
-		return nil, fmt.Errorf("file not found: %s", absPath)
+		return nil, fmt.Errorf("file not found: %s: %w", absPath, fs.ErrNotExist)
 	}
 
 	info := &mockFileInfo{
@@ -165,17 +178,45 @@ func (m *mockFileInfo) ModTime() time.Time { return m.modTime }
 func (m *mockFileInfo) IsDir() bool        { return m.isDir }
 func (m *mockFileInfo) Sys() any           { return m.mockFile }
 
-// FindFiles discovers regular files under the given directory path.
-func (m *MockFilesystemManager) FindFiles(path *bt.Path, recursive bool) ([]*bt.Path, error) {
+// WalkFiles discovers regular files under the given directory path,
+// yielding them in lexical order like the real filesystem walk.
+func (m *MockFilesystemManager) WalkFiles(path *bt.Path, dirRoot string, recursive bool) iter.Seq2[*bt.Path, error] {
+	return func(yield func(*bt.Path, error) bool) {
+		m.walk(path, dirRoot, recursive, func(p *bt.Path, ignored bool) bool {
+			if ignored {
+				return true
+			}
+			return yield(p, nil)
+		}, func(err error) { yield(nil, err) })
+	}
+}
+
+// Walk yields the files WalkFiles yields and those it leaves out because
+// they match an ignore pattern.
+func (m *MockFilesystemManager) Walk(path *bt.Path, dirRoot string, recursive bool) iter.Seq2[*bt.WalkEntry, error] {
+	return func(yield func(*bt.WalkEntry, error) bool) {
+		m.walk(path, dirRoot, recursive, func(p *bt.Path, ignored bool) bool {
+			if !ignored {
+				return yield(&bt.WalkEntry{File: p}, nil)
+			}
+			return yield(&bt.WalkEntry{Exclusion: &bt.Exclusion{Path: p.String(), Reason: "matches ignore pattern"}}, nil)
+		}, func(err error) { yield(nil, err) })
+	}
+}
+
+// walk calls visit for each mock file under path in lexical order, reporting
+// whether it matches an ignore pattern relative to dirRoot.
+func (m *MockFilesystemManager) walk(path *bt.Path, dirRoot string, recursive bool, visit func(p *bt.Path, ignored bool) bool, fail func(error)) {
 	if !path.IsDir() {
-		return nil, fmt.Errorf("path is not a directory: %s", path.String())
+		fail(fmt.Errorf("path is not a directory: %s", path.String()))
+		return
 	}
 
 	dir := path.String()
 	matcher := btfs.NewIgnoreMatcher(m.ignorePatterns)
-	var paths []*bt.Path
 
-	for p, f := range m.files {
+	for _, p := range slices.Sorted(maps.Keys(m.files)) {
+		f := m.files[p]
 		if f.IsDirectory {
 			continue
 		}
@@ -190,8 +231,10 @@ func (m *MockFilesystemManager) FindFiles(path *bt.Path, recursive bool) ([]*bt.
 				continue
 			}
 		}
-		if matcher.Match(rel) {
-			continue
+		rootRel, err := filepath.Rel(dirRoot, p)
+		if err != nil {
+			fail(fmt.Errorf("computing relative path: %w", err))
+			return
 		}
 		info := &mockFileInfo{
 			name:     filepath.Base(p),
@@ -201,20 +244,22 @@ func (m *MockFilesystemManager) FindFiles(path *bt.Path, recursive bool) ([]*bt.
 			isDir:    false,
 			mockFile: f,
 		}
-		paths = append(paths, bt.NewPath(p, false, info))
+		if !visit(bt.NewPath(p, false, info), matcher.Match(rootRel)) {
+			return
+		}
 	}
-
-	return paths, nil
 }
 
-// IsIgnored checks whether a file path should be ignored based on ignore patterns.
-func (m *MockFilesystemManager) IsIgnored(path *bt.Path, dirRoot string) (bool, error) {
+// ExclusionReason reports whether a file matches an ignore pattern.
+func (m *MockFilesystemManager) ExclusionReason(path *bt.Path, dirRoot string) (string, error) {
 	rel, err := filepath.Rel(dirRoot, path.String())
 	if err != nil {
-		return false, fmt.Errorf("computing relative path: %w", err)
+		return "", fmt.Errorf("computing relative path: %w", err)
 	}
-	matcher := btfs.NewIgnoreMatcher(m.ignorePatterns)
-	return matcher.Match(rel), nil
+	if btfs.NewIgnoreMatcher(m.ignorePatterns).Match(rel) {
+		return "matches ignore pattern", nil
+	}
+	return "", nil
 }
 
 // Compile-time check
@@ -9,9 +9,16 @@ import (
 
 // NewVaultFromConfig creates a Vault implementation based on the vault config type.
 func NewVaultFromConfig(cfg config.VaultConfig) (bt.Vault, error) {
+	keep := cfg.MetadataVersions
+	if keep <= 0 {
+		keep = DefaultMetadataVersions
+	}
+
 	switch cfg.Type {
 	case "memory":
-		return NewMemoryVault(cfg.Name), nil
+		v := NewMemoryVault(cfg.Name)
+		v.keepVersions = keep
+		return v, nil
 	case "s3":
 		if cfg.S3Bucket == "" {
 			return nil, fmt.Errorf("s3 vault requires s3_bucket")
@@ -22,13 +29,23 @@ func NewVaultFromConfig(cfg config.VaultConfig) (bt.Vault, error) {
 		if cfg.S3AccessKeyID == "" || cfg.S3SecretAccessKey == "" {
 			return nil, fmt.Errorf("s3 vault requires s3_access_key_id and s3_secret_access_key")
 		}
-		return NewS3Vault(cfg.Name, cfg.S3Bucket, cfg.S3ContentPrefix, cfg.S3MetadataPrefix,
+		v, err := NewS3Vault(cfg.Name, cfg.S3Bucket, cfg.S3ContentPrefix, cfg.S3MetadataPrefix,
 			cfg.S3Region, cfg.S3AccessKeyID, cfg.S3SecretAccessKey)
+		if err != nil {
+			return nil, err
+		}
+		v.keepVersions = keep
+		return v, nil
 	case "filesystem":
 		if cfg.FSVaultRoot == "" {
 			return nil, fmt.Errorf("filesystem vault requires fs_vault_root to be set")
 		}
-		return NewFileSystemVault(cfg.Name, cfg.FSVaultRoot)
+		v, err := NewFileSystemVault(cfg.Name, cfg.FSVaultRoot)
+		if err != nil {
+			return nil, err
+		}
+		v.keepVersions = keep
+		return v, nil
 	default:
 		return nil, fmt.Errorf("unknown vault type: %s", cfg.Type)
 	}
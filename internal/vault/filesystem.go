@@ -7,23 +7,37 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"bt-go/internal/bt"
 )
 
+// Lock file timing for swapping a metadata item's version file. The lock is
+// held only to check and rename the version file, so a lock older than
+// staleLockAge was left by a writer that crashed.
+const (
+	lockAttempts   = 50
+	lockRetryDelay = 20 * time.Millisecond
+	staleLockAge   = time.Minute
+)
+
 // FileSystemVault is a filesystem-based implementation of the Vault interface.
 // It stores content and metadata as files in a directory structure:
 //
 //	<root>/
 //	  content/
-//	    <checksum>     (content files, named by SHA-256)
+//	    <checksum>                  (content files, named by SHA-256)
 //	  metadata/
-//	    <hostID>.db    (per-host metadata files)
+//	    <hostID>/
+//	      <name>.version            (latest version number of a metadata item)
+//	      <name>.versions/<version> (kept versions, including the latest)
+//	      <name>                    (latest version, if stored before versions were kept)
 type FileSystemVault struct {
-	name        string
-	root        string
-	contentDir  string
-	metadataDir string
+	name         string
+	root         string
+	contentDir   string
+	metadataDir  string
+	keepVersions int
 }
 
 // NewFileSystemVault creates a new filesystem vault rooted at the given path.
@@ -40,10 +54,11 @@ func NewFileSystemVault(name, root string) (*FileSystemVault, error) {
 	}
 
 	return &FileSystemVault{
-		name:        name,
-		root:        root,
-		contentDir:  contentDir,
-		metadataDir: metadataDir,
+		name:         name,
+		root:         root,
+		contentDir:   contentDir,
+		metadataDir:  metadataDir,
+		keepVersions: DefaultMetadataVersions,
 	}, nil
 }
 
@@ -74,23 +89,96 @@ func (v *FileSystemVault) GetContent(checksum string, w io.Writer) error {
 	return v.readFile(srcPath, w, fmt.Sprintf("content not found: %s", checksum))
 }
 
-// PutMetadata stores a named metadata item for a specific host along with a version marker.
-// Layout: <root>/metadata/<hostID>/<name> and <root>/metadata/<hostID>/<name>.version
+// PutMetadata stores a named metadata item for a specific host as a new kept
+// version, <root>/metadata/<hostID>/<name>.versions/<version>, and then
+// points <name>.version at it. The pointer is only swapped if it still holds
+// the version read before the write, under a lock file, so a crash leaves the
+// previous version in place and a concurrent writer fails with
+// bt.ErrMetadataConflict. Kept versions no longer needed are then removed.
 func (v *FileSystemVault) PutMetadata(hostID string, name string, r io.Reader, size int64, version int64) error {
 	hostDir := filepath.Join(v.metadataDir, hostID)
-	if err := os.MkdirAll(hostDir, 0755); err != nil {
+	versionsDir := filepath.Join(hostDir, name+versionsSuffix)
+	if err := os.MkdirAll(versionsDir, 0755); err != nil {
 		return fmt.Errorf("creating host metadata directory: %w", err)
 	}
 
-	destPath := filepath.Join(hostDir, name)
-	if err := v.writeFile(destPath, r, size); err != nil {
+	previous, err := v.GetMetadataVersion(hostID, name)
+	if err != nil {
+		return err
+	}
+	if version <= previous {
+		return conflictError(hostID, name, previous, version)
+	}
+
+	// An item stored before versions were kept has its latest version only
+	// at <name>; move it with the others so it stays kept.
+	previousPath := filepath.Join(versionsDir, strconv.FormatInt(previous, 10))
+	if _, err := os.Stat(previousPath); previous > 0 && os.IsNotExist(err) {
+		if err := os.Rename(filepath.Join(hostDir, name), previousPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("keeping metadata version: %w", err)
+		}
+	}
+
+	keptPath := filepath.Join(versionsDir, strconv.FormatInt(version, 10))
+	if err := v.writeNewFile(keptPath, r, size); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("metadata %s/%s version %d was already written: %w", hostID, name, version, bt.ErrMetadataConflict)
+		}
+		return err
+	}
+
+	if err := v.swapVersion(hostID, name, previous, version); err != nil {
+		return err
+	}
+
+	kept, err := v.keptVersions(versionsDir)
+	if err != nil {
 		return err
 	}
+	for _, old := range staleVersions(kept, previous, version, keepFor(name, v.keepVersions)) {
+		if err := os.Remove(filepath.Join(versionsDir, strconv.FormatInt(old.Version, 10))); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing old metadata version: %w", err)
+		}
+	}
+	return nil
+}
 
-	// Write version file
-	versionPath := filepath.Join(hostDir, name+".version")
+// swapVersion points the version file of a metadata item at version if it
+// still points at previous. The check and the swap happen under a lock file;
+// a lock left by a writer that crashed is broken once it is older than
+// staleLockAge.
+func (v *FileSystemVault) swapVersion(hostID string, name string, previous int64, version int64) error {
+	versionPath := filepath.Join(v.metadataDir, hostID, name+".version")
+	lockPath := versionPath + ".lock"
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("locking metadata version: %w", err)
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(lockPath)
+			continue
+		}
+		if attempt == lockAttempts {
+			return fmt.Errorf("metadata %s/%s is locked by another writer: %w", hostID, name, bt.ErrMetadataConflict)
+		}
+		time.Sleep(lockRetryDelay)
+	}
+	defer os.Remove(lockPath)
+
+	current, err := v.GetMetadataVersion(hostID, name)
+	if err != nil {
+		return err
+	}
+	if current != previous {
+		return conflictError(hostID, name, current, version)
+	}
 	versionData := strconv.FormatInt(version, 10)
-	return os.WriteFile(versionPath, []byte(versionData), 0644)
+	return v.writeFile(versionPath, strings.NewReader(versionData), int64(len(versionData)))
 }
 
 // GetMetadataVersion returns the metadata version for a named item on a host.
@@ -112,10 +200,125 @@ func (v *FileSystemVault) GetMetadataVersion(hostID string, name string) (int64,
 	return version, nil
 }
 
-// GetMetadata retrieves a named metadata item for a specific host and writes it to w.
+// GetMetadata retrieves the version of a named metadata item for a specific
+// host that its version file points at, and writes it to w.
 func (v *FileSystemVault) GetMetadata(hostID string, name string, w io.Writer) error {
-	srcPath := filepath.Join(v.metadataDir, hostID, name)
-	return v.readFile(srcPath, w, fmt.Sprintf("metadata %q not found for host: %s", name, hostID))
+	version, err := v.GetMetadataVersion(hostID, name)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return fmt.Errorf("metadata %q not found for host: %s", name, hostID)
+	}
+	return v.GetMetadataAt(hostID, name, version, w)
+}
+
+// ListMetadataVersions returns the kept versions of a named metadata item,
+// oldest first. The latest version of an item stored before versions were
+// kept is listed too.
+func (v *FileSystemVault) ListMetadataVersions(hostID string, name string) ([]bt.MetadataVersion, error) {
+	versions, err := v.keptVersions(filepath.Join(v.metadataDir, hostID, name+versionsSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := v.GetMetadataVersion(hostID, name)
+	if err != nil {
+		return nil, err
+	}
+	versions = committedVersions(versions, current)
+	if current > 0 && !hasVersion(versions, current) {
+		info, err := os.Stat(filepath.Join(v.metadataDir, hostID, name))
+		if err == nil {
+			versions = append(versions, bt.MetadataVersion{Version: current, Size: info.Size(), Uploaded: info.ModTime()})
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("stat metadata: %w", err)
+		}
+	}
+	return versions, nil
+}
+
+// keptVersions returns the versions in a metadata item's versions directory,
+// oldest first, whether or not its version file points at them yet.
+func (v *FileSystemVault) keptVersions(versionsDir string) ([]bt.MetadataVersion, error) {
+	entries, err := os.ReadDir(versionsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("listing metadata versions: %w", err)
+	}
+
+	var versions []bt.MetadataVersion
+	for _, entry := range entries {
+		version, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			continue // temp file or stray entry
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("stat metadata version: %w", err)
+		}
+		versions = append(versions, bt.MetadataVersion{Version: version, Size: info.Size(), Uploaded: info.ModTime()})
+	}
+	sortVersions(versions)
+	return versions, nil
+}
+
+// GetMetadataAt retrieves a kept version of a named metadata item and writes it to w.
+func (v *FileSystemVault) GetMetadataAt(hostID string, name string, version int64, w io.Writer) error {
+	srcPath := filepath.Join(v.metadataDir, hostID, name+versionsSuffix, strconv.FormatInt(version, 10))
+	if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+		if current, err := v.GetMetadataVersion(hostID, name); err == nil && current == version {
+			srcPath = filepath.Join(v.metadataDir, hostID, name)
+		}
+	}
+	return v.readFile(srcPath, w, fmt.Sprintf("metadata %q version %d not found for host: %s", name, version, hostID))
+}
+
+// DeleteMetadata removes the version file of a named metadata item, then its
+// kept versions, so a delete that fails halfway leaves no listed item
+// without data.
+func (v *FileSystemVault) DeleteMetadata(hostID string, name string) error {
+	hostDir := filepath.Join(v.metadataDir, hostID)
+	if err := os.Remove(filepath.Join(hostDir, name+".version")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing metadata version file: %w", err)
+	}
+	if err := os.RemoveAll(filepath.Join(hostDir, name+versionsSuffix)); err != nil {
+		return fmt.Errorf("removing metadata versions: %w", err)
+	}
+	if err := os.Remove(filepath.Join(hostDir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing metadata: %w", err)
+	}
+	return nil
+}
+
+// ListHosts returns the IDs of the hosts with a metadata directory, sorted.
+func (v *FileSystemVault) ListHosts() ([]string, error) {
+	entries, err := os.ReadDir(v.metadataDir)
+	if err != nil {
+		return nil, fmt.Errorf("listing hosts: %w", err)
+	}
+	var hosts []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			hosts = append(hosts, entry.Name())
+		}
+	}
+	return hosts, nil
+}
+
+// ListMetadata returns the names of the metadata items with a version file
+// for a host, sorted.
+func (v *FileSystemVault) ListMetadata(hostID string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(v.metadataDir, hostID))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("listing metadata: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".version"); ok && !entry.IsDir() {
+			names = append(names, name)
+		}
+	}
+	return names, nil
 }
 
 // ValidateSetup verifies that the vault directories are accessible.
@@ -145,45 +348,85 @@ func (v *FileSystemVault) ValidateSetup() error {
 
 // writeFile writes data from r to the specified path using atomic write (temp file + rename).
 func (v *FileSystemVault) writeFile(destPath string, r io.Reader, expectedSize int64) error {
-	// Create temp file in the same directory to ensure atomic rename works
-	dir := filepath.Dir(destPath)
+	tmpPath, err := v.writeTemp(filepath.Dir(destPath), r, expectedSize)
+	if err != nil {
+		return err
+	}
+
+	// Atomic rename
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+// writeNewFile is like writeFile, but fails with an error satisfying
+// os.IsExist if destPath exists, even if another writer creates it
+// concurrently.
+func (v *FileSystemVault) writeNewFile(destPath string, r io.Reader, expectedSize int64) error {
+	tmpPath, err := v.writeTemp(filepath.Dir(destPath), r, expectedSize)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	// Linking, unlike renaming, never replaces an existing file.
+	err = os.Link(tmpPath, destPath)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+
+	// Not every filesystem supports hard links; create the file exclusively
+	// and copy instead.
+	src, err := os.Open(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to open temp file: %w", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(destPath)
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+	return nil
+}
+
+// writeTemp writes data from r to a new temp file in dir and returns its path.
+func (v *FileSystemVault) writeTemp(dir string, r io.Reader, expectedSize int64) (string, error) {
+	// Create temp file in the destination directory to ensure atomic rename works
 	tmpFile, err := os.CreateTemp(dir, ".tmp-*")
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return "", fmt.Errorf("failed to create temp file: %w", err)
 	}
 	tmpPath := tmpFile.Name()
 
-	// Clean up temp file on failure
-	success := false
-	defer func() {
-		if !success {
-			os.Remove(tmpPath)
-		}
-	}()
-
 	// Copy data to temp file
 	written, err := io.Copy(tmpFile, r)
 	if err != nil {
 		tmpFile.Close()
-		return fmt.Errorf("failed to write data: %w", err)
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to write data: %w", err)
 	}
 
 	if err := tmpFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temp file: %w", err)
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to close temp file: %w", err)
 	}
 
 	// Verify size
 	if written != expectedSize {
-		return fmt.Errorf("size mismatch: expected %d bytes, got %d", expectedSize, written)
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("size mismatch: expected %d bytes, got %d", expectedSize, written)
 	}
-
-	// Atomic rename
-	if err := os.Rename(tmpPath, destPath); err != nil {
-		return fmt.Errorf("failed to rename temp file: %w", err)
-	}
-
-	success = true
-	return nil
+	return tmpPath, nil
 }
 
 // readFile reads from the specified path and writes to w.
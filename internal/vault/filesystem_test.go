@@ -177,8 +177,9 @@ func TestFileSystemVault_PutMetadata(t *testing.T) {
 		t.Fatalf("PutMetadata() error = %v", err)
 	}
 
-	// Verify file exists at <metadataDir>/<hostID>/db
-	metadataPath := filepath.Join(v.metadataDir, hostID, "db")
+	// Verify file exists at <metadataDir>/<hostID>/db.versions/1, and the
+	// version file points at it
+	metadataPath := filepath.Join(v.metadataDir, hostID, "db.versions", "1")
 	content, err := os.ReadFile(metadataPath)
 	if err != nil {
 		t.Fatalf("failed to read metadata file: %v", err)
@@ -186,6 +187,13 @@ func TestFileSystemVault_PutMetadata(t *testing.T) {
 	if string(content) != data {
 		t.Errorf("metadata = %q, want %q", string(content), data)
 	}
+	version, err := os.ReadFile(filepath.Join(v.metadataDir, hostID, "db.version"))
+	if err != nil || string(version) != "1" {
+		t.Errorf("version file = %q, %v, want %q", version, err, "1")
+	}
+	if _, err := os.Stat(filepath.Join(v.metadataDir, hostID, "db")); !os.IsNotExist(err) {
+		t.Errorf("PutMetadata() should not write the unversioned file: %v", err)
+	}
 }
 
 func TestFileSystemVault_PutMetadata_Overwrites(t *testing.T) {
@@ -306,6 +314,93 @@ func TestFileSystemVault_GetMetadataVersion(t *testing.T) {
 	})
 }
 
+func TestFileSystemVault_ListHosts(t *testing.T) {
+	v, err := NewFileSystemVault("test", t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileSystemVault() error = %v", err)
+	}
+
+	hosts, err := v.ListHosts()
+	if err != nil || len(hosts) != 0 {
+		t.Errorf("ListHosts() of an empty vault = %v, %v", hosts, err)
+	}
+
+	for _, hostID := range []string{"host-b", "host-a"} {
+		if err := v.PutMetadata(hostID, "db", strings.NewReader("x"), 1, 1); err != nil {
+			t.Fatalf("PutMetadata() error = %v", err)
+		}
+	}
+	hosts, err = v.ListHosts()
+	if err != nil {
+		t.Fatalf("ListHosts() error = %v", err)
+	}
+	if len(hosts) != 2 || hosts[0] != "host-a" || hosts[1] != "host-b" {
+		t.Errorf("ListHosts() = %v, want [host-a host-b]", hosts)
+	}
+}
+
+func TestFileSystemVault_ListMetadata(t *testing.T) {
+	v, err := NewFileSystemVault("test", t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileSystemVault() error = %v", err)
+	}
+
+	names, err := v.ListMetadata("host-1")
+	if err != nil || len(names) != 0 {
+		t.Errorf("ListMetadata() of a new host = %v, %v", names, err)
+	}
+
+	for version, name := range []string{"manifest.2", "db", "manifest.10"} {
+		if err := v.PutMetadata("host-1", name, strings.NewReader("x"), 1, int64(version+1)); err != nil {
+			t.Fatalf("PutMetadata() error = %v", err)
+		}
+	}
+	v.PutMetadata("host-2", "host", strings.NewReader("x"), 1, 1)
+
+	names, err = v.ListMetadata("host-1")
+	if err != nil {
+		t.Fatalf("ListMetadata() error = %v", err)
+	}
+	if strings.Join(names, " ") != "db manifest.10 manifest.2" {
+		t.Errorf("ListMetadata() = %v, want [db manifest.10 manifest.2]", names)
+	}
+}
+
+func TestFileSystemVault_DeleteMetadata(t *testing.T) {
+	v, err := NewFileSystemVault("test", t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileSystemVault() error = %v", err)
+	}
+
+	for version := int64(1); version <= 3; version++ {
+		for _, name := range []string{"journal.1", "journal.10"} {
+			if err := v.PutMetadata("host-1", name, strings.NewReader("x"), 1, version); err != nil {
+				t.Fatalf("PutMetadata() error = %v", err)
+			}
+		}
+	}
+	if err := v.DeleteMetadata("host-1", "journal.1"); err != nil {
+		t.Fatalf("DeleteMetadata() error = %v", err)
+	}
+
+	names, err := v.ListMetadata("host-1")
+	if err != nil || strings.Join(names, " ") != "journal.10" {
+		t.Errorf("ListMetadata() = %v, %v, want [journal.10]", names, err)
+	}
+	if versions, err := v.ListMetadataVersions("host-1", "journal.1"); err != nil || len(versions) != 0 {
+		t.Errorf("ListMetadataVersions() of a deleted item = %v, %v", versions, err)
+	}
+	if _, err := os.Stat(filepath.Join(v.metadataDir, "host-1", "journal.1"+versionsSuffix)); !os.IsNotExist(err) {
+		t.Errorf("kept versions of a deleted item should be removed: %v", err)
+	}
+	if versions, _ := v.ListMetadataVersions("host-1", "journal.10"); len(versions) != 3 {
+		t.Errorf("journal.10 keeps %d versions, want 3", len(versions))
+	}
+	if err := v.DeleteMetadata("host-1", "journal.1"); err != nil {
+		t.Errorf("DeleteMetadata() of a missing item error = %v", err)
+	}
+}
+
 func TestFileSystemVault_ValidateSetup(t *testing.T) {
 	t.Run("valid setup", func(t *testing.T) {
 		v, err := NewFileSystemVault("test", t.TempDir())
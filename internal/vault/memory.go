@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"bt-go/internal/bt"
 )
@@ -14,12 +17,20 @@ import (
 // This implementation is safe for concurrent use.
 type MemoryVault struct {
 	name            string
-	content         map[string][]byte // checksum -> content
-	metadata        map[string][]byte // "hostID/name" -> metadata
-	metadataVersion map[string]int64  // "hostID/name" -> version
+	content         map[string][]byte              // checksum -> content
+	metadata        map[string][]byte              // "hostID/name" -> metadata
+	metadataVersion map[string]int64               // "hostID/name" -> version
+	kept            map[string][]memoryKeptVersion // "hostID/name" -> kept versions, oldest first
+	keepVersions    int
 	mu              sync.RWMutex
 }
 
+// memoryKeptVersion is a version of a metadata item kept by MemoryVault.
+type memoryKeptVersion struct {
+	bt.MetadataVersion
+	data []byte
+}
+
 // NewMemoryVault creates a new in-memory vault with the given name.
 func NewMemoryVault(name string) *MemoryVault {
 	return &MemoryVault{
@@ -27,6 +38,8 @@ func NewMemoryVault(name string) *MemoryVault {
 		content:         make(map[string][]byte),
 		metadata:        make(map[string][]byte),
 		metadataVersion: make(map[string]int64),
+		kept:            make(map[string][]memoryKeptVersion),
+		keepVersions:    DefaultMetadataVersions,
 	}
 }
 
@@ -71,7 +84,8 @@ func (m *MemoryVault) GetContent(checksum string, w io.Writer) error {
 	return nil
 }
 
-// PutMetadata stores a named metadata item for a specific host.
+// PutMetadata stores a named metadata item for a specific host. It fails with
+// bt.ErrMetadataConflict unless version is greater than the stored version.
 func (m *MemoryVault) PutMetadata(hostID string, name string, r io.Reader, size int64, version int64) error {
 	data, err := io.ReadAll(r)
 	if err != nil {
@@ -86,8 +100,20 @@ func (m *MemoryVault) PutMetadata(hostID string, name string, r io.Reader, size
 	defer m.mu.Unlock()
 
 	key := metadataKey(hostID, name)
+	if current := m.metadataVersion[key]; version <= current {
+		return conflictError(hostID, name, current, version)
+	}
 	m.metadata[key] = data
 	m.metadataVersion[key] = version
+
+	kept := append(m.kept[key], memoryKeptVersion{
+		MetadataVersion: bt.MetadataVersion{Version: version, Size: size, Uploaded: time.Now()},
+		data:            data,
+	})
+	if keep := keepFor(name, m.keepVersions); keep > 0 && len(kept) > keep {
+		kept = kept[len(kept)-keep:]
+	}
+	m.kept[key] = kept
 	return nil
 }
 
@@ -118,6 +144,80 @@ func (m *MemoryVault) GetMetadata(hostID string, name string, w io.Writer) error
 	return nil
 }
 
+// ListMetadataVersions returns the kept versions of a named metadata item, oldest first.
+func (m *MemoryVault) ListMetadataVersions(hostID string, name string) ([]bt.MetadataVersion, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var versions []bt.MetadataVersion
+	for _, k := range m.kept[metadataKey(hostID, name)] {
+		versions = append(versions, k.MetadataVersion)
+	}
+	return versions, nil
+}
+
+// GetMetadataAt retrieves a kept version of a named metadata item.
+func (m *MemoryVault) GetMetadataAt(hostID string, name string, version int64, w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, k := range m.kept[metadataKey(hostID, name)] {
+		if k.Version == version {
+			if _, err := io.Copy(w, bytes.NewReader(k.data)); err != nil {
+				return fmt.Errorf("failed to write metadata: %w", err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("metadata %q version %d not found for host: %s", name, version, hostID)
+}
+
+// DeleteMetadata removes a named metadata item with its kept versions.
+func (m *MemoryVault) DeleteMetadata(hostID string, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := metadataKey(hostID, name)
+	delete(m.metadata, key)
+	delete(m.metadataVersion, key)
+	delete(m.kept, key)
+	return nil
+}
+
+// ListHosts returns the IDs of the hosts that have stored metadata, sorted.
+func (m *MemoryVault) ListHosts() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var hosts []string
+	for key := range m.metadataVersion {
+		hostID, _, _ := strings.Cut(key, "/")
+		if !seen[hostID] {
+			seen[hostID] = true
+			hosts = append(hosts, hostID)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// ListMetadata returns the names of the metadata items stored for a host,
+// sorted.
+func (m *MemoryVault) ListMetadata(hostID string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var names []string
+	for key := range m.metadataVersion {
+		if name, ok := strings.CutPrefix(key, hostID+"/"); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 // ValidateSetup always succeeds for in-memory vault.
 func (m *MemoryVault) ValidateSetup() error {
 	return nil
@@ -177,6 +177,63 @@ func TestMemoryVault_GetMetadataVersion(t *testing.T) {
 	})
 }
 
+func TestMemoryVault_ListHosts(t *testing.T) {
+	v := NewMemoryVault("test-vault")
+	for _, hostID := range []string{"host-b", "host-a"} {
+		for _, name := range []string{"db", "host"} {
+			if err := v.PutMetadata(hostID, name, strings.NewReader("x"), 1, 1); err != nil {
+				t.Fatalf("PutMetadata() error = %v", err)
+			}
+		}
+	}
+
+	hosts, err := v.ListHosts()
+	if err != nil {
+		t.Fatalf("ListHosts() error = %v", err)
+	}
+	if len(hosts) != 2 || hosts[0] != "host-a" || hosts[1] != "host-b" {
+		t.Errorf("ListHosts() = %v, want [host-a host-b]", hosts)
+	}
+}
+
+func TestMemoryVault_ListMetadata(t *testing.T) {
+	v := NewMemoryVault("test-vault")
+	for _, name := range []string{"manifest.2", "db"} {
+		if err := v.PutMetadata("host-1", name, strings.NewReader("x"), 1, 1); err != nil {
+			t.Fatalf("PutMetadata() error = %v", err)
+		}
+	}
+	v.PutMetadata("host-2", "host", strings.NewReader("x"), 1, 1)
+
+	names, err := v.ListMetadata("host-1")
+	if err != nil {
+		t.Fatalf("ListMetadata() error = %v", err)
+	}
+	if len(names) != 2 || names[0] != "db" || names[1] != "manifest.2" {
+		t.Errorf("ListMetadata() = %v, want [db manifest.2]", names)
+	}
+}
+
+func TestMemoryVault_DeleteMetadata(t *testing.T) {
+	v := NewMemoryVault("test-vault")
+	for _, name := range []string{"journal.1", "journal.2"} {
+		if err := v.PutMetadata("host-1", name, strings.NewReader("x"), 1, 1); err != nil {
+			t.Fatalf("PutMetadata() error = %v", err)
+		}
+	}
+	if err := v.DeleteMetadata("host-1", "journal.1"); err != nil {
+		t.Fatalf("DeleteMetadata() error = %v", err)
+	}
+
+	names, err := v.ListMetadata("host-1")
+	if err != nil || len(names) != 1 || names[0] != "journal.2" {
+		t.Errorf("ListMetadata() = %v, %v, want [journal.2]", names, err)
+	}
+	if versions, _ := v.ListMetadataVersions("host-1", "journal.1"); len(versions) != 0 {
+		t.Errorf("ListMetadataVersions() of a deleted item = %v", versions)
+	}
+}
+
 func TestMemoryVault_ValidateSetup(t *testing.T) {
 	vault := NewMemoryVault("test-vault")
 
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 
 	"bt-go/internal/bt"
 )
@@ -25,6 +28,9 @@ type s3API interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 }
 
 // s3UploadAPI is the subset of manager.Uploader methods used by S3Vault.
@@ -37,9 +43,10 @@ type s3UploadAPI interface {
 // Content objects are stored under contentPrefix; metadata objects under metadataPrefix.
 // Object key layout:
 //
-//	{contentPrefix}/{checksum}                   → content object
-//	{metadataPrefix}/{hostID}/{name}             → metadata object
-//	{metadataPrefix}/{hostID}/{name}.version     → version marker (body = int64 string)
+//	{contentPrefix}/{checksum}                          → content object
+//	{metadataPrefix}/{hostID}/{name}.version            → version marker (body = int64 string)
+//	{metadataPrefix}/{hostID}/{name}.versions/{version} → kept version, including the latest
+//	{metadataPrefix}/{hostID}/{name}                    → latest version, if stored before versions were kept
 type S3Vault struct {
 	name           string
 	bucket         string
@@ -47,6 +54,7 @@ type S3Vault struct {
 	metadataPrefix string
 	client         s3API
 	uploader       s3UploadAPI
+	keepVersions   int
 }
 
 // NewS3Vault creates a new S3Vault with explicit AWS credentials.
@@ -69,6 +77,7 @@ func NewS3Vault(name, bucket, contentPrefix, metadataPrefix, region, accessKeyID
 		metadataPrefix: metadataPrefix,
 		client:         client,
 		uploader:       uploader,
+		keepVersions:   DefaultMetadataVersions,
 	}, nil
 }
 
@@ -126,37 +135,113 @@ func (v *S3Vault) GetContent(checksum string, w io.Writer) error {
 	return nil
 }
 
-// PutMetadata stores a named metadata item for a specific host with a version marker.
+// PutMetadata stores a named metadata item for a specific host as a new kept
+// version, {name}.versions/{version}, and then points the {name}.version
+// marker at it. Both writes are conditional: the kept version must not exist
+// yet, and the marker must not have changed since it was read before the
+// write, so a crash leaves the previous version in place and a concurrent
+// writer fails with bt.ErrMetadataConflict. Kept versions no longer needed
+// are then deleted.
 func (v *S3Vault) PutMetadata(hostID string, name string, r io.Reader, size int64, version int64) error {
 	ctx := context.Background()
 	dataKey := s3Key(v.metadataPrefix, hostID, name)
 	versionKey := dataKey + ".version"
 
-	_, err := v.client.PutObject(ctx, &s3.PutObjectInput{
+	previous, etag, err := v.readVersion(ctx, hostID, name)
+	if err != nil {
+		return err
+	}
+	if version <= previous {
+		return conflictError(hostID, name, previous, version)
+	}
+	kept, err := v.keptVersions(ctx, hostID, name)
+	if err != nil {
+		return err
+	}
+
+	// An item stored before versions were kept has its latest version only
+	// at {name}; move it with the others so it stays kept.
+	if previous > 0 && !hasVersion(kept, previous) {
+		_, err := v.client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(v.bucket),
+			Key:        aws.String(keptKey(dataKey, previous)),
+			CopySource: aws.String(copySource(v.bucket, dataKey)),
+		})
+		if err == nil {
+			_, err = v.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(v.bucket),
+				Key:    aws.String(dataKey),
+			})
+		}
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("keeping version %d of metadata %s/%s: %w", previous, hostID, name, err)
+		}
+	}
+
+	_, err = v.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        aws.String(v.bucket),
-		Key:           aws.String(dataKey),
+		Key:           aws.String(keptKey(dataKey, version)),
 		Body:          r,
 		ContentLength: aws.Int64(size),
+		IfNoneMatch:   aws.String("*"),
 	})
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("metadata %s/%s version %d was already written: %w", hostID, name, version, bt.ErrMetadataConflict)
+	}
 	if err != nil {
 		return fmt.Errorf("putting metadata %s/%s: %w", hostID, name, err)
 	}
 
 	versionStr := strconv.FormatInt(version, 10)
-	_, err = v.client.PutObject(ctx, &s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket:        aws.String(v.bucket),
 		Key:           aws.String(versionKey),
 		Body:          strings.NewReader(versionStr),
 		ContentLength: aws.Int64(int64(len(versionStr))),
-	})
+	}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+	_, err = v.client.PutObject(ctx, input)
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("metadata %s/%s changed while version %d was written: %w", hostID, name, version, bt.ErrMetadataConflict)
+	}
 	if err != nil {
 		return fmt.Errorf("putting version for metadata %s/%s: %w", hostID, name, err)
 	}
+
+	kept = append(kept, bt.MetadataVersion{Version: version, Size: size})
+	sortVersions(kept)
+	for _, old := range staleVersions(kept, previous, version, keepFor(name, v.keepVersions)) {
+		_, err := v.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(v.bucket),
+			Key:    aws.String(keptKey(dataKey, old.Version)),
+		})
+		if err != nil {
+			return fmt.Errorf("deleting version %d of metadata %s/%s: %w", old.Version, hostID, name, err)
+		}
+	}
 	return nil
 }
 
-// GetMetadata retrieves a named metadata item for a specific host and writes it to w.
+// GetMetadata retrieves the version of a named metadata item for a specific
+// host that its version marker points at, and writes it to w.
 func (v *S3Vault) GetMetadata(hostID string, name string, w io.Writer) error {
+	version, err := v.GetMetadataVersion(hostID, name)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return fmt.Errorf("metadata %q not found for host: %s", name, hostID)
+	}
+	return v.GetMetadataAt(hostID, name, version, w)
+}
+
+// getLegacyMetadata retrieves the latest version of a named metadata item
+// stored before versions were kept, and writes it to w.
+func (v *S3Vault) getLegacyMetadata(hostID string, name string, w io.Writer) error {
 	ctx := context.Background()
 	key := s3Key(v.metadataPrefix, hostID, name)
 
@@ -181,7 +266,13 @@ func (v *S3Vault) GetMetadata(hostID string, name string, w io.Writer) error {
 // GetMetadataVersion returns the stored version for a named metadata item.
 // Returns 0 if no version has been stored yet.
 func (v *S3Vault) GetMetadataVersion(hostID string, name string) (int64, error) {
-	ctx := context.Background()
+	version, _, err := v.readVersion(context.Background(), hostID, name)
+	return version, err
+}
+
+// readVersion returns the stored version for a named metadata item and the
+// ETag of its version marker, or 0 and "" if no version has been stored yet.
+func (v *S3Vault) readVersion(ctx context.Context, hostID string, name string) (int64, string, error) {
 	key := s3Key(v.metadataPrefix, hostID, name) + ".version"
 
 	out, err := v.client.GetObject(ctx, &s3.GetObjectInput{
@@ -190,21 +281,205 @@ func (v *S3Vault) GetMetadataVersion(hostID string, name string) (int64, error)
 	})
 	if err != nil {
 		if isNotFound(err) {
-			return 0, nil
+			return 0, "", nil
 		}
-		return 0, fmt.Errorf("getting metadata version %s/%s: %w", hostID, name, err)
+		return 0, "", fmt.Errorf("getting metadata version %s/%s: %w", hostID, name, err)
 	}
 	defer out.Body.Close()
 
 	data, err := io.ReadAll(out.Body)
 	if err != nil {
-		return 0, fmt.Errorf("reading metadata version %s/%s: %w", hostID, name, err)
+		return 0, "", fmt.Errorf("reading metadata version %s/%s: %w", hostID, name, err)
 	}
 	version, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
 	if err != nil {
-		return 0, fmt.Errorf("parsing metadata version %s/%s: %w", hostID, name, err)
+		return 0, "", fmt.Errorf("parsing metadata version %s/%s: %w", hostID, name, err)
+	}
+	return version, aws.ToString(out.ETag), nil
+}
+
+// ListMetadataVersions returns the kept versions of a named metadata item,
+// oldest first. The latest version of an item stored before versions were
+// kept is listed too.
+func (v *S3Vault) ListMetadataVersions(hostID string, name string) ([]bt.MetadataVersion, error) {
+	ctx := context.Background()
+	versions, err := v.keptVersions(ctx, hostID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := v.GetMetadataVersion(hostID, name)
+	if err != nil {
+		return nil, err
+	}
+	versions = committedVersions(versions, current)
+	if current > 0 && !hasVersion(versions, current) {
+		out, err := v.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(v.bucket),
+			Key:    aws.String(s3Key(v.metadataPrefix, hostID, name)),
+		})
+		if err == nil {
+			versions = append(versions, bt.MetadataVersion{
+				Version:  current,
+				Size:     aws.ToInt64(out.ContentLength),
+				Uploaded: aws.ToTime(out.LastModified),
+			})
+		} else if !isNotFound(err) {
+			return nil, fmt.Errorf("checking metadata %s/%s: %w", hostID, name, err)
+		}
+	}
+	return versions, nil
+}
+
+// keptVersions returns the versions stored under a metadata item's versions
+// prefix, oldest first, whether or not its version marker points at them yet.
+func (v *S3Vault) keptVersions(ctx context.Context, hostID string, name string) ([]bt.MetadataVersion, error) {
+	prefix := s3Key(v.metadataPrefix, hostID, name) + versionsSuffix + "/"
+
+	var versions []bt.MetadataVersion
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(v.bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		out, err := v.client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("listing versions of metadata %s/%s: %w", hostID, name, err)
+		}
+		for _, obj := range out.Contents {
+			version, err := strconv.ParseInt(strings.TrimPrefix(aws.ToString(obj.Key), prefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			versions = append(versions, bt.MetadataVersion{
+				Version:  version,
+				Size:     aws.ToInt64(obj.Size),
+				Uploaded: aws.ToTime(obj.LastModified),
+			})
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+	sortVersions(versions)
+	return versions, nil
+}
+
+// GetMetadataAt retrieves a kept version of a named metadata item and writes it to w.
+func (v *S3Vault) GetMetadataAt(hostID string, name string, version int64, w io.Writer) error {
+	ctx := context.Background()
+	key := keptKey(s3Key(v.metadataPrefix, hostID, name), version)
+
+	out, err := v.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(v.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			if current, err := v.GetMetadataVersion(hostID, name); err == nil && current == version {
+				return v.getLegacyMetadata(hostID, name, w)
+			}
+			return fmt.Errorf("metadata %q version %d not found for host: %s", name, version, hostID)
+		}
+		return fmt.Errorf("getting metadata %s/%s version %d: %w", hostID, name, version, err)
+	}
+	defer out.Body.Close()
+
+	if _, err := io.Copy(w, out.Body); err != nil {
+		return fmt.Errorf("reading metadata %s/%s version %d: %w", hostID, name, version, err)
+	}
+	return nil
+}
+
+// DeleteMetadata deletes the version marker of a named metadata item, then
+// its kept versions, so a delete that fails halfway leaves no listed item
+// without data.
+func (v *S3Vault) DeleteMetadata(hostID string, name string) error {
+	ctx := context.Background()
+	dataKey := s3Key(v.metadataPrefix, hostID, name)
+
+	kept, err := v.keptVersions(ctx, hostID, name)
+	if err != nil {
+		return err
+	}
+	keys := []string{dataKey + ".version", dataKey}
+	for _, k := range kept {
+		keys = append(keys, keptKey(dataKey, k.Version))
+	}
+	for _, key := range keys {
+		_, err := v.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(v.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("deleting metadata %s/%s: %w", hostID, name, err)
+		}
+	}
+	return nil
+}
+
+// ListHosts returns the IDs of the hosts with objects under the metadata
+// prefix, sorted.
+func (v *S3Vault) ListHosts() ([]string, error) {
+	ctx := context.Background()
+	prefix := v.metadataPrefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var hosts []string
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(v.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	for {
+		out, err := v.client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("listing hosts: %w", err)
+		}
+		for _, p := range out.CommonPrefixes {
+			hosts = append(hosts, strings.TrimSuffix(strings.TrimPrefix(aws.ToString(p.Prefix), prefix), "/"))
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// ListMetadata returns the names of the metadata items with a version marker
+// for a host, sorted.
+func (v *S3Vault) ListMetadata(hostID string) ([]string, error) {
+	ctx := context.Background()
+	prefix := s3Key(v.metadataPrefix, hostID) + "/"
+
+	var names []string
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(v.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	for {
+		out, err := v.client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("listing metadata of host %s: %w", hostID, err)
+		}
+		for _, obj := range out.Contents {
+			if name, ok := strings.CutSuffix(strings.TrimPrefix(aws.ToString(obj.Key), prefix), ".version"); ok {
+				names = append(names, name)
+			}
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = out.NextContinuationToken
 	}
-	return version, nil
+	sort.Strings(names)
+	return names, nil
 }
 
 // ValidateSetup verifies that the bucket exists and credentials are valid.
@@ -229,6 +504,21 @@ func s3Key(parts ...string) string {
 	return strings.Join(nonEmpty, "/")
 }
 
+// keptKey returns the key of a kept version of the metadata object at dataKey.
+func keptKey(dataKey string, version int64) string {
+	return dataKey + versionsSuffix + "/" + strconv.FormatInt(version, 10)
+}
+
+// copySource returns the CopySource of the object at key, URL-encoded as
+// CopyObject requires.
+func copySource(bucket, key string) string {
+	parts := strings.Split(bucket+"/"+key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
 // isNotFound returns true if the error indicates the requested S3 object does not exist.
 func isNotFound(err error) bool {
 	var noKey *types.NoSuchKey
@@ -242,5 +532,20 @@ func isNotFound(err error) bool {
 	return false
 }
 
+// isPreconditionFailed returns true if the error indicates a conditional
+// write failed because the object exists or changed. S3 answers 409
+// ConditionalRequestConflict instead of 412 when a concurrent conditional
+// write to the same key is in progress.
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
+
 // Compile-time check that S3Vault implements bt.Vault interface.
 var _ bt.Vault = (*S3Vault)(nil)
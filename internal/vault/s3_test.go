@@ -3,14 +3,19 @@ package vault
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"bt-go/internal/bt"
 )
 
 // mockS3Client implements s3API for testing.
@@ -19,6 +24,9 @@ type mockS3Client struct {
 	getObjectFn  func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	putObjectFn  func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 	headBucketFn func(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	copyObjectFn func(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	deleteObjectFn func(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	listObjectsFn  func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 }
 
 func (m *mockS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
@@ -49,6 +57,27 @@ func (m *mockS3Client) HeadBucket(ctx context.Context, params *s3.HeadBucketInpu
 	return m.headBucketFn(ctx, params, optFns...)
 }
 
+func (m *mockS3Client) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	if m.copyObjectFn == nil {
+		panic("unexpected call to CopyObject")
+	}
+	return m.copyObjectFn(ctx, params, optFns...)
+}
+
+func (m *mockS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if m.deleteObjectFn == nil {
+		panic("unexpected call to DeleteObject")
+	}
+	return m.deleteObjectFn(ctx, params, optFns...)
+}
+
+func (m *mockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if m.listObjectsFn == nil {
+		panic("unexpected call to ListObjectsV2")
+	}
+	return m.listObjectsFn(ctx, params, optFns...)
+}
+
 // mockUploader implements s3UploadAPI for testing.
 type mockUploader struct {
 	uploadFn func(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error)
@@ -196,6 +225,15 @@ func TestS3Vault_GetContent(t *testing.T) {
 	}
 }
 
+// versionObject returns a GetObject output for a version marker holding
+// version, with an ETag derived from it.
+func versionObject(version int64) *s3.GetObjectOutput {
+	return &s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(fmt.Sprint(version))),
+		ETag: aws.String(fmt.Sprintf(`"etag-%d"`, version)),
+	}
+}
+
 func TestS3Vault_PutMetadata(t *testing.T) {
 	t.Parallel()
 
@@ -209,7 +247,7 @@ func TestS3Vault_PutMetadata(t *testing.T) {
 		wantErr   bool
 	}{
 		{
-			name:    "stores data and version objects",
+			name:    "stores kept version, then swaps version marker",
 			hostID:  "host-123",
 			mdName:  "db",
 			data:    "metadata content",
@@ -220,7 +258,7 @@ func TestS3Vault_PutMetadata(t *testing.T) {
 			hostID:    "host-123",
 			mdName:    "db",
 			data:      "metadata content",
-			version:   1,
+			version:   42,
 			putObjErr: fmt.Errorf("access denied"),
 			wantErr:   true,
 		},
@@ -229,15 +267,21 @@ func TestS3Vault_PutMetadata(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			var putKeys []string
+			var puts []*s3.PutObjectInput
 			cl := &mockS3Client{
 				putObjectFn: func(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
 					if tt.putObjErr != nil {
 						return nil, tt.putObjErr
 					}
-					putKeys = append(putKeys, *params.Key)
+					puts = append(puts, params)
 					return &s3.PutObjectOutput{}, nil
 				},
+				listObjectsFn: func(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String(*params.Prefix + "41")}}}, nil
+				},
+				getObjectFn: func(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					return versionObject(41), nil
+				},
 			}
 			v := newTestVault(cl, &mockUploader{})
 
@@ -247,21 +291,217 @@ func TestS3Vault_PutMetadata(t *testing.T) {
 			}
 			if !tt.wantErr {
 				wantDataKey := "metadata/" + tt.hostID + "/" + tt.mdName
-				wantVersionKey := wantDataKey + ".version"
-				if len(putKeys) != 2 {
-					t.Fatalf("PutObject called %d times, want 2", len(putKeys))
+				if len(puts) != 2 {
+					t.Fatalf("PutObject called %d times, want 2", len(puts))
+				}
+				if got, want := *puts[0].Key, wantDataKey+".versions/42"; got != want {
+					t.Errorf("first PutObject key = %q, want %q", got, want)
 				}
-				if putKeys[0] != wantDataKey {
-					t.Errorf("first PutObject key = %q, want %q", putKeys[0], wantDataKey)
+				if aws.ToString(puts[0].IfNoneMatch) != "*" {
+					t.Errorf("kept version should only be written if absent, IfNoneMatch = %q", aws.ToString(puts[0].IfNoneMatch))
 				}
-				if putKeys[1] != wantVersionKey {
-					t.Errorf("second PutObject key = %q, want %q", putKeys[1], wantVersionKey)
+				if got, want := *puts[1].Key, wantDataKey+".version"; got != want {
+					t.Errorf("second PutObject key = %q, want %q", got, want)
 				}
+				if aws.ToString(puts[1].IfMatch) != `"etag-41"` {
+					t.Errorf("version marker should only be swapped if unchanged, IfMatch = %q", aws.ToString(puts[1].IfMatch))
+				}
+			}
+		})
+	}
+}
+
+func TestS3Vault_PutMetadata_Conflict(t *testing.T) {
+	t.Parallel()
+
+	preconditionFailed := &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	tests := []struct {
+		name    string
+		current int64
+		version int64
+		putErr  map[string]error // by key suffix
+	}{
+		{name: "version not newer than the stored one", current: 7, version: 7},
+		{name: "kept version already written", current: 6, version: 7, putErr: map[string]error{".versions/7": preconditionFailed}},
+		{name: "version marker changed", current: 6, version: 7, putErr: map[string]error{".version": preconditionFailed}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cl := &mockS3Client{
+				putObjectFn: func(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					for suffix, err := range tt.putErr {
+						if strings.HasSuffix(*params.Key, suffix) {
+							return nil, err
+						}
+					}
+					return &s3.PutObjectOutput{}, nil
+				},
+				listObjectsFn: func(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String(fmt.Sprint(*params.Prefix, tt.current))}}}, nil
+				},
+				getObjectFn: func(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					return versionObject(tt.current), nil
+				},
+			}
+			v := newTestVault(cl, &mockUploader{})
+
+			err := v.PutMetadata("host-1", "db", strings.NewReader("x"), 1, tt.version)
+			if !errors.Is(err, bt.ErrMetadataConflict) {
+				t.Errorf("PutMetadata() error = %v, want ErrMetadataConflict", err)
 			}
 		})
 	}
 }
 
+func TestS3Vault_PutMetadata_KeepsUnversioned(t *testing.T) {
+	t.Parallel()
+
+	// The latest version of an item stored before versions were kept is
+	// moved under the versions prefix before it is replaced.
+	var copied, deleted []string
+	cl := &mockS3Client{
+		putObjectFn: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			return &s3.PutObjectOutput{}, nil
+		},
+		listObjectsFn: func(_ context.Context, _ *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{}, nil
+		},
+		getObjectFn: func(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return versionObject(5), nil
+		},
+		copyObjectFn: func(_ context.Context, params *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+			copied = append(copied, *params.CopySource+" -> "+*params.Key)
+			return &s3.CopyObjectOutput{}, nil
+		},
+		deleteObjectFn: func(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			deleted = append(deleted, *params.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		},
+	}
+	v := newTestVault(cl, &mockUploader{})
+
+	if err := v.PutMetadata("host one", "db", strings.NewReader("x"), 1, 6); err != nil {
+		t.Fatalf("PutMetadata() error = %v", err)
+	}
+	if want := []string{"test-bucket/metadata/host%20one/db -> metadata/host one/db.versions/5"}; fmt.Sprint(copied) != fmt.Sprint(want) {
+		t.Errorf("copied %q, want %q", copied, want)
+	}
+	if want := []string{"metadata/host one/db"}; fmt.Sprint(deleted) != fmt.Sprint(want) {
+		t.Errorf("deleted %q, want %q", deleted, want)
+	}
+}
+
+func TestS3Vault_PutMetadata_PrunesVersions(t *testing.T) {
+	t.Parallel()
+
+	var deleted []string
+	cl := &mockS3Client{
+		putObjectFn: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			return &s3.PutObjectOutput{}, nil
+		},
+		listObjectsFn: func(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			// Two pages, out of order: 3..11 and 14, left by a write that
+			// lost a race, then 1 and 2.
+			if params.ContinuationToken == nil {
+				objs := []types.Object{{Key: aws.String(*params.Prefix + "14")}}
+				for i := 11; i >= 3; i-- {
+					objs = append(objs, types.Object{Key: aws.String(fmt.Sprintf("%s%d", *params.Prefix, i)), Size: aws.Int64(10)})
+				}
+				return &s3.ListObjectsV2Output{Contents: objs, IsTruncated: aws.Bool(true), NextContinuationToken: aws.String("next")}, nil
+			}
+			return &s3.ListObjectsV2Output{Contents: []types.Object{
+				{Key: aws.String(*params.Prefix + "2")},
+				{Key: aws.String(*params.Prefix + "1")},
+			}}, nil
+		},
+		getObjectFn: func(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return versionObject(11), nil
+		},
+		deleteObjectFn: func(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			deleted = append(deleted, *params.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		},
+	}
+	v := newTestVault(cl, &mockUploader{})
+	v.keepVersions = 10
+
+	if err := v.PutMetadata("host one", "db", strings.NewReader("x"), 1, 12); err != nil {
+		t.Fatalf("PutMetadata() error = %v", err)
+	}
+	want := []string{"metadata/host one/db.versions/1", "metadata/host one/db.versions/2"}
+	if fmt.Sprint(deleted) != fmt.Sprint(want) {
+		t.Errorf("deleted %q, want %q", deleted, want)
+	}
+}
+
+func TestS3Vault_PutMetadata_KeepsOneSecretVersion(t *testing.T) {
+	t.Parallel()
+
+	var deleted []string
+	cl := &mockS3Client{
+		putObjectFn: func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			return &s3.PutObjectOutput{}, nil
+		},
+		listObjectsFn: func(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{
+				{Key: aws.String(*params.Prefix + "1")},
+				{Key: aws.String(*params.Prefix + "2")},
+			}}, nil
+		},
+		getObjectFn: func(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return versionObject(2), nil
+		},
+		deleteObjectFn: func(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			deleted = append(deleted, *params.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		},
+	}
+	v := newTestVault(cl, &mockUploader{})
+	v.keepVersions = 10
+
+	if err := v.PutMetadata("host-1", "private_key", strings.NewReader("x"), 1, 3); err != nil {
+		t.Fatalf("PutMetadata() error = %v", err)
+	}
+	want := []string{"metadata/host-1/private_key.versions/1", "metadata/host-1/private_key.versions/2"}
+	if fmt.Sprint(deleted) != fmt.Sprint(want) {
+		t.Errorf("deleted %q, want %q", deleted, want)
+	}
+}
+
+func TestS3Vault_DeleteMetadata(t *testing.T) {
+	t.Parallel()
+
+	var deleted []string
+	cl := &mockS3Client{
+		listObjectsFn: func(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{
+				{Key: aws.String(*params.Prefix + "2")},
+				{Key: aws.String(*params.Prefix + "1")},
+			}}, nil
+		},
+		deleteObjectFn: func(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			deleted = append(deleted, *params.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		},
+	}
+	v := newTestVault(cl, &mockUploader{})
+
+	if err := v.DeleteMetadata("host one", "journal.7"); err != nil {
+		t.Fatalf("DeleteMetadata() error = %v", err)
+	}
+	want := []string{
+		"metadata/host one/journal.7.version",
+		"metadata/host one/journal.7",
+		"metadata/host one/journal.7.versions/1",
+		"metadata/host one/journal.7.versions/2",
+	}
+	if fmt.Sprint(deleted) != fmt.Sprint(want) {
+		t.Errorf("deleted %q, want %q", deleted, want)
+	}
+}
+
 func TestS3Vault_GetMetadata(t *testing.T) {
 	t.Parallel()
 
@@ -275,16 +515,35 @@ func TestS3Vault_GetMetadata(t *testing.T) {
 		wantMsg  string
 	}{
 		{
-			name:   "returns metadata",
+			name:   "returns the version the marker points at",
 			hostID: "host-123",
 			mdName: "db",
-			getObj: func(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
-				return &s3.GetObjectOutput{
-					Body: io.NopCloser(strings.NewReader("db content")),
-				}, nil
+			getObj: func(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				switch *params.Key {
+				case "metadata/host-123/db.version":
+					return versionObject(3), nil
+				case "metadata/host-123/db.versions/3":
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("db content"))}, nil
+				}
+				return nil, &types.NoSuchKey{}
 			},
 			wantData: "db content",
 		},
+		{
+			name:   "returns metadata stored before versions were kept",
+			hostID: "host-123",
+			mdName: "db",
+			getObj: func(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				switch *params.Key {
+				case "metadata/host-123/db.version":
+					return versionObject(3), nil
+				case "metadata/host-123/db":
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("old db"))}, nil
+				}
+				return nil, &types.NoSuchKey{}
+			},
+			wantData: "old db",
+		},
 		{
 			name:   "returns error for missing metadata",
 			hostID: "host-123",
@@ -362,6 +621,67 @@ func TestS3Vault_GetMetadataVersion(t *testing.T) {
 	}
 }
 
+func TestS3Vault_ListHosts(t *testing.T) {
+	t.Parallel()
+
+	cl := &mockS3Client{
+		listObjectsFn: func(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			if *params.Prefix != "metadata/" || aws.ToString(params.Delimiter) != "/" {
+				t.Errorf("ListObjectsV2() prefix = %q, delimiter = %q", *params.Prefix, aws.ToString(params.Delimiter))
+			}
+			if params.ContinuationToken == nil {
+				return &s3.ListObjectsV2Output{
+					CommonPrefixes:        []types.CommonPrefix{{Prefix: aws.String("metadata/host-b/")}},
+					IsTruncated:           aws.Bool(true),
+					NextContinuationToken: aws.String("next"),
+				}, nil
+			}
+			return &s3.ListObjectsV2Output{CommonPrefixes: []types.CommonPrefix{{Prefix: aws.String("metadata/host-a/")}}}, nil
+		},
+	}
+	v := newTestVault(cl, &mockUploader{})
+
+	hosts, err := v.ListHosts()
+	if err != nil {
+		t.Fatalf("ListHosts() error = %v", err)
+	}
+	if fmt.Sprint(hosts) != "[host-a host-b]" {
+		t.Errorf("ListHosts() = %v, want [host-a host-b]", hosts)
+	}
+}
+
+func TestS3Vault_ListMetadata(t *testing.T) {
+	t.Parallel()
+
+	cl := &mockS3Client{
+		listObjectsFn: func(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			if *params.Prefix != "metadata/host-1/" || aws.ToString(params.Delimiter) != "/" {
+				t.Errorf("ListObjectsV2() prefix = %q, delimiter = %q", *params.Prefix, aws.ToString(params.Delimiter))
+			}
+			if params.ContinuationToken == nil {
+				return &s3.ListObjectsV2Output{
+					Contents: []types.Object{
+						{Key: aws.String("metadata/host-1/manifest.2")},
+						{Key: aws.String("metadata/host-1/manifest.2.version")},
+					},
+					IsTruncated:           aws.Bool(true),
+					NextContinuationToken: aws.String("next"),
+				}, nil
+			}
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("metadata/host-1/db.version")}}}, nil
+		},
+	}
+	v := newTestVault(cl, &mockUploader{})
+
+	names, err := v.ListMetadata("host-1")
+	if err != nil {
+		t.Fatalf("ListMetadata() error = %v", err)
+	}
+	if fmt.Sprint(names) != "[db manifest.2]" {
+		t.Errorf("ListMetadata() = %v, want [db manifest.2]", names)
+	}
+}
+
 func TestS3Vault_ValidateSetup(t *testing.T) {
 	t.Parallel()
 
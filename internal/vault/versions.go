@@ -0,0 +1,98 @@
+package vault
+
+import (
+	"fmt"
+	"sort"
+
+	"bt-go/internal/bt"
+)
+
+// DefaultMetadataVersions is how many versions of each metadata item a vault
+// keeps unless configured otherwise.
+const DefaultMetadataVersions = 10
+
+// secretItems are the metadata items of which only the latest version is
+// kept, however many versions are kept of the others: an older version would
+// still be protected by a passphrase since changed, or encrypted to a key
+// pair since rotated away.
+var secretItems = map[string]bool{
+	"private_key":          true,
+	"previous_private_key": true,
+	"convergence_secret":   true,
+	"signing_key":          true,
+}
+
+// keepFor returns how many versions of the metadata item name to keep, given
+// that keep are kept of most items.
+func keepFor(name string, keep int) int {
+	if secretItems[name] {
+		return 1
+	}
+	return keep
+}
+
+// versionsSuffix is appended to a metadata item's name to form the name of
+// the directory or key prefix holding its kept versions.
+const versionsSuffix = ".versions"
+
+// Metadata writes are atomic and conflict-safe. PutMetadata first writes the
+// item as a new kept version, which must not exist yet, then swaps the
+// ".version" pointer from the version it read before the write to the new
+// one, failing if the pointer moved in between. A reader follows the pointer,
+// so it never sees a version whose data is incomplete, and two writers using
+// the same host ID cannot silently overwrite each other.
+
+// conflictError reports that a metadata write found the item at version
+// current, which the new version does not supersede.
+func conflictError(hostID, name string, current, version int64) error {
+	return fmt.Errorf("metadata %s/%s is at version %d, so version %d cannot replace it: %w", hostID, name, current, version, bt.ErrMetadataConflict)
+}
+
+// hasVersion reports whether versions includes version.
+func hasVersion(versions []bt.MetadataVersion, version int64) bool {
+	for _, v := range versions {
+		if v.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// sortVersions sorts versions oldest first.
+func sortVersions(versions []bt.MetadataVersion) {
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+}
+
+// committedVersions returns the versions up to current, the version the
+// pointer refers to. Versions above it were written by a PutMetadata that
+// has not swapped the pointer yet, or never will.
+func committedVersions(versions []bt.MetadataVersion, current int64) []bt.MetadataVersion {
+	var committed []bt.MetadataVersion
+	for _, v := range versions {
+		if v.Version <= current {
+			committed = append(committed, v)
+		}
+	}
+	return committed
+}
+
+// staleVersions returns the versions of sorted versions that are no longer
+// needed once version has replaced previous as the latest: those written in
+// between by writes that lost a race or crashed, and the oldest beyond the
+// newest keep.
+func staleVersions(versions []bt.MetadataVersion, previous, version int64, keep int) []bt.MetadataVersion {
+	var stale, committed []bt.MetadataVersion
+	for _, v := range versions {
+		switch {
+		case v.Version > previous && v.Version < version:
+			stale = append(stale, v)
+		case v.Version <= version:
+			committed = append(committed, v)
+		}
+	}
+	if keep > 0 && len(committed) > keep {
+		stale = append(stale, committed[:len(committed)-keep]...)
+	}
+	sortVersions(stale)
+	return stale
+}
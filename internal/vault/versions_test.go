@@ -0,0 +1,193 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bt-go/internal/bt"
+)
+
+// checkMetadataVersions stores five versions of an item in v, which keeps
+// three, and checks the kept versions.
+func checkMetadataVersions(t *testing.T, v bt.Vault) {
+	t.Helper()
+	for version := int64(1); version <= 5; version++ {
+		data := fmt.Sprintf("db v%d", version)
+		if err := v.PutMetadata("host-1", "db", strings.NewReader(data), int64(len(data)), version); err != nil {
+			t.Fatalf("PutMetadata(%d) error = %v", version, err)
+		}
+	}
+
+	versions, err := v.ListMetadataVersions("host-1", "db")
+	if err != nil {
+		t.Fatalf("ListMetadataVersions() error = %v", err)
+	}
+	var got []int64
+	for _, mv := range versions {
+		got = append(got, mv.Version)
+		if mv.Size != int64(len("db v1")) || mv.Uploaded.IsZero() {
+			t.Errorf("version %d: Size = %d, Uploaded = %v", mv.Version, mv.Size, mv.Uploaded)
+		}
+	}
+	if fmt.Sprint(got) != "[3 4 5]" {
+		t.Errorf("kept versions = %v, want [3 4 5]", got)
+	}
+
+	var buf bytes.Buffer
+	if err := v.GetMetadataAt("host-1", "db", 4, &buf); err != nil {
+		t.Fatalf("GetMetadataAt(4) error = %v", err)
+	}
+	if buf.String() != "db v4" {
+		t.Errorf("GetMetadataAt(4) = %q, want %q", buf.String(), "db v4")
+	}
+	buf.Reset()
+	if err := v.GetMetadata("host-1", "db", &buf); err != nil || buf.String() != "db v5" {
+		t.Errorf("GetMetadata() = %q, %v, want the latest version", buf.String(), err)
+	}
+	if err := v.GetMetadataAt("host-1", "db", 2, &buf); err == nil {
+		t.Error("GetMetadataAt() of a removed version should fail")
+	}
+
+	if versions, err := v.ListMetadataVersions("host-1", "missing"); err != nil || len(versions) != 0 {
+		t.Errorf("ListMetadataVersions() of a missing item = %v, %v", versions, err)
+	}
+
+	// Only the latest version of a secret is kept.
+	for version := int64(1); version <= 2; version++ {
+		if err := v.PutMetadata("host-1", "private_key", strings.NewReader("key"), 3, version); err != nil {
+			t.Fatalf("PutMetadata(private_key, %d) error = %v", version, err)
+		}
+	}
+	if versions, err := v.ListMetadataVersions("host-1", "private_key"); err != nil || len(versions) != 1 || versions[0].Version != 2 {
+		t.Errorf("kept private_key versions = %+v, %v, want only version 2", versions, err)
+	}
+}
+
+// checkMetadataConflicts checks that v refuses to store a version of an item
+// that does not supersede the stored one, and keeps the stored one.
+func checkMetadataConflicts(t *testing.T, v bt.Vault) {
+	t.Helper()
+	if err := v.PutMetadata("host-1", "db", strings.NewReader("v5"), 2, 5); err != nil {
+		t.Fatalf("PutMetadata(5) error = %v", err)
+	}
+	for _, version := range []int64{5, 4} {
+		err := v.PutMetadata("host-1", "db", strings.NewReader("vX"), 2, version)
+		if !errors.Is(err, bt.ErrMetadataConflict) {
+			t.Errorf("PutMetadata(%d) error = %v, want ErrMetadataConflict", version, err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := v.GetMetadata("host-1", "db", &buf); err != nil || buf.String() != "v5" {
+		t.Errorf("GetMetadata() = %q, %v, want the stored version", buf.String(), err)
+	}
+}
+
+func TestFileSystemVault_MetadataVersions(t *testing.T) {
+	v, err := NewFileSystemVault("test", t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileSystemVault() error = %v", err)
+	}
+	v.keepVersions = 3
+	checkMetadataVersions(t, v)
+}
+
+func TestFileSystemVault_MetadataVersions_Unversioned(t *testing.T) {
+	// An item stored before versions were kept has only its latest version.
+	root := t.TempDir()
+	v, err := NewFileSystemVault("test", root)
+	if err != nil {
+		t.Fatalf("NewFileSystemVault() error = %v", err)
+	}
+	hostDir := filepath.Join(root, "metadata", "host-1")
+	os.MkdirAll(hostDir, 0755)
+	os.WriteFile(filepath.Join(hostDir, "db"), []byte("old db"), 0644)
+	os.WriteFile(filepath.Join(hostDir, "db.version"), []byte("7"), 0644)
+
+	versions, err := v.ListMetadataVersions("host-1", "db")
+	if err != nil {
+		t.Fatalf("ListMetadataVersions() error = %v", err)
+	}
+	if len(versions) != 1 || versions[0].Version != 7 || versions[0].Size != 6 {
+		t.Errorf("ListMetadataVersions() = %+v, want version 7", versions)
+	}
+	var buf bytes.Buffer
+	if err := v.GetMetadataAt("host-1", "db", 7, &buf); err != nil || buf.String() != "old db" {
+		t.Errorf("GetMetadataAt(7) = %q, %v", buf.String(), err)
+	}
+
+	// Replacing it keeps it as a version.
+	if err := v.PutMetadata("host-1", "db", strings.NewReader("new db"), 6, 8); err != nil {
+		t.Fatalf("PutMetadata() error = %v", err)
+	}
+	versions, err = v.ListMetadataVersions("host-1", "db")
+	if err != nil || len(versions) != 2 || versions[0].Version != 7 || versions[1].Version != 8 {
+		t.Errorf("ListMetadataVersions() = %+v, %v, want versions 7 and 8", versions, err)
+	}
+	buf.Reset()
+	if err := v.GetMetadataAt("host-1", "db", 7, &buf); err != nil || buf.String() != "old db" {
+		t.Errorf("GetMetadataAt(7) = %q, %v", buf.String(), err)
+	}
+}
+
+func TestFileSystemVault_MetadataConflicts(t *testing.T) {
+	root := t.TempDir()
+	v, err := NewFileSystemVault("test", root)
+	if err != nil {
+		t.Fatalf("NewFileSystemVault() error = %v", err)
+	}
+	checkMetadataConflicts(t, v)
+	hostDir := filepath.Join(root, "metadata", "host-1")
+
+	// Another writer already wrote the version.
+	os.WriteFile(filepath.Join(hostDir, "db.versions", "6"), []byte("theirs"), 0644)
+	if err := v.PutMetadata("host-1", "db", strings.NewReader("v6"), 2, 6); !errors.Is(err, bt.ErrMetadataConflict) {
+		t.Errorf("PutMetadata() over an existing version error = %v, want ErrMetadataConflict", err)
+	}
+
+	// Another writer swapped the version file after it was read.
+	if err := v.swapVersion("host-1", "db", 4, 7); !errors.Is(err, bt.ErrMetadataConflict) {
+		t.Errorf("swapVersion() from a stale version error = %v, want ErrMetadataConflict", err)
+	}
+
+	// A lock left by a writer that crashed is broken once it is stale.
+	lockPath := filepath.Join(hostDir, "db.version.lock")
+	os.WriteFile(lockPath, nil, 0644)
+	old := time.Now().Add(-2 * staleLockAge)
+	os.Chtimes(lockPath, old, old)
+	if err := v.PutMetadata("host-1", "db", strings.NewReader("v7"), 2, 7); err != nil {
+		t.Fatalf("PutMetadata() with a stale lock error = %v", err)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("lock should be removed after the swap: %v", err)
+	}
+
+	// The version another writer wrote but never committed is not listed,
+	// and is removed once a later version is committed.
+	versions, _ := v.ListMetadataVersions("host-1", "db")
+	var got []int64
+	for _, mv := range versions {
+		got = append(got, mv.Version)
+	}
+	if fmt.Sprint(got) != "[5 7]" {
+		t.Errorf("ListMetadataVersions() = %v, want [5 7]", got)
+	}
+	if _, err := os.Stat(filepath.Join(hostDir, "db.versions", "6")); !os.IsNotExist(err) {
+		t.Errorf("uncommitted version should be removed: %v", err)
+	}
+}
+
+func TestMemoryVault_MetadataConflicts(t *testing.T) {
+	checkMetadataConflicts(t, NewMemoryVault("test"))
+}
+
+func TestMemoryVault_MetadataVersions(t *testing.T) {
+	v := NewMemoryVault("test")
+	v.keepVersions = 3
+	checkMetadataVersions(t, v)
+}